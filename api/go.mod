@@ -3,7 +3,10 @@ module github.com/fluxcd/image-reflector-controller/api
 go 1.14
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.0
 	github.com/fluxcd/pkg/apis/meta v0.1.0
+	github.com/google/go-containerregistry v0.1.1
+	github.com/onsi/gomega v1.10.1
 	k8s.io/api v0.18.9
 	k8s.io/apimachinery v0.18.9
 	sigs.k8s.io/controller-runtime v0.6.2
@@ -50,6 +50,27 @@ type Condition struct {
 const (
 	// ReadyCondition records the last reconciliation result.
 	ReadyCondition string = "Ready"
+
+	// RevisionAvailableCondition records whether a tag for the
+	// expected revision was found by the last scan.
+	RevisionAvailableCondition string = "RevisionAvailable"
+
+	// ScanFailingCondition records that recent scans of an image
+	// repository have failed, while it is still within the grace
+	// given before it's no longer considered ready.
+	ScanFailingCondition string = "ScanFailing"
+
+	// ReconcilingCondition records the progress of a long scan of
+	// an image repository, while it's underway.
+	ReconcilingCondition string = "Reconciling"
+
+	// BaselineValidCondition records whether the baseline given to
+	// an image policy could be compared with the tags.
+	BaselineValidCondition string = "BaselineValid"
+
+	// MutatedSelectionCondition records that the tag selected by an
+	// image policy has been pushed again with a different image.
+	MutatedSelectionCondition string = "MutatedSelection"
 )
 
 const (
@@ -62,9 +83,54 @@ const (
 	// ImageURLInvalidReason represents the fact that a given repository has an invalid image URL.
 	ImageURLInvalidReason string = "ImageURLInvalid"
 
+	// SubstitutionFailedReason represents the fact that the variables in a given image URL could not be resolved.
+	SubstitutionFailedReason string = "SubstitutionFailed"
+
+	// TagFilterInvalidReason represents the fact that a repository's tag filters are not valid regular expressions.
+	TagFilterInvalidReason string = "TagFilterInvalid"
+
+	// SecretNotFoundReason represents the fact that the secret given for scanning a repository does not exist.
+	SecretNotFoundReason string = "SecretNotFound"
+
+	// UnexpectedRedirectReason represents the fact that a registry redirected a request to a host that isn't allowed.
+	UnexpectedRedirectReason string = "UnexpectedRedirect"
+
+	// ResponseTooLargeReason represents the fact that a registry's response was larger than the controller accepts.
+	ResponseTooLargeReason string = "ResponseTooLarge"
+
+	// AuthenticationFailedReason represents the fact that a registry refused the credentials used to scan a repository.
+	AuthenticationFailedReason string = "AuthenticationFailed"
+
+	// RepositoryNotFoundReason represents the fact that a registry said the repository to be scanned does not exist.
+	RepositoryNotFoundReason string = "RepositoryNotFound"
+
+	// RateLimitedReason represents the fact that a registry refused to be scanned, for going over its rate limit.
+	RateLimitedReason string = "RateLimited"
+
+	// PartiallyScannedReason represents the fact that the scan of a repository's image failed, but some of the further images it lists were scanned.
+	PartiallyScannedReason string = "PartiallyScanned"
+
+	// ScanTimeoutReason represents the fact that a scan of a repository took longer than it was given.
+	ScanTimeoutReason string = "ScanTimeout"
+
+	// InlineAuthDisabledReason represents the fact that a repository gives inline credentials, which the controller doesn't allow.
+	InlineAuthDisabledReason string = "InlineAuthDisabled"
+
 	// ProgressingReason represents the fact that a reconciliation is underway.
 	ProgressingReason string = "Progressing"
 
+	// RevisionAvailableReason represents the fact that a tag for the expected revision was found.
+	RevisionAvailableReason string = "RevisionAvailable"
+
+	// RevisionMissingReason represents the fact that no tag for the expected revision was found.
+	RevisionMissingReason string = "RevisionMissing"
+
+	// BaselineInvalidReason represents the fact that an image policy's baseline can't be ordered with the tags.
+	BaselineInvalidReason string = "BaselineInvalid"
+
+	// DigestChangedReason represents the fact that a tag now refers to a different image than it did when it was selected.
+	DigestChangedReason string = "DigestChanged"
+
 	// SuspendedReason represents the fact that the reconciliation is suspended.
 	SuspendedReason string = "Suspended"
 )
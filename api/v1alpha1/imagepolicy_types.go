@@ -30,12 +30,60 @@ type ImagePolicySpec struct {
 	// being scanned
 	// +required
 	ImageRepositoryRef corev1.LocalObjectReference `json:"imageRepositoryRef"`
+	// AdditionalImageRepositoryRefs points at further image
+	// repositories publishing the same image; e.g., mirrors. The
+	// policy selects from the union of the tags of all the image
+	// repositories. A tag found in more than one is taken from the
+	// first listed, with `.spec.imageRepositoryRef` first of all. The
+	// tags of all the image repositories are interpreted according
+	// to the artifact type of `.spec.imageRepositoryRef`.
+	// +optional
+	AdditionalImageRepositoryRefs []corev1.LocalObjectReference `json:"additionalImageRepositoryRefs,omitempty"`
 	// Policy gives the particulars of the policy to be followed in
 	// selecting the most recent image
 	// +required
 	Policy ImagePolicyChoice `json:"policy"`
+	// Platform, if given, restricts the selection to tags that are
+	// available for the platform, given as `os/arch` or
+	// `os/arch/variant`; e.g., `linux/arm64`. The referenced
+	// ImageRepository must have `.spec.inspectPlatforms` set, for the
+	// platforms of each tag to be known.
+	// +optional
+	Platform string `json:"platform,omitempty"`
+	// VerifyDigest tells the controller to record the digest of the
+	// image selected, and check on each reconciliation that the tag
+	// still refers to that digest. If the tag has been pushed again
+	// with a different image, the latest image is left as it was, and
+	// the `MutatedSelection` condition is set, rather than silently
+	// following the tag. Defaults to false.
+	// +optional
+	VerifyDigest bool `json:"verifyDigest,omitempty"`
+	// Baseline, if given, is a tag to compare the others to; the tags
+	// that come after it in the policy's ordering are listed in
+	// `.status.newerTags`. For a semver policy, this must be a
+	// version, and only versions within the range are listed; for a
+	// date policy, it must have a date in it that matches the policy.
+	// A baseline can't be used with an extension.
+	// +optional
+	Baseline string `json:"baseline,omitempty"`
+	// FloatingTags lists tags that are moved from image to image,
+	// rather than naming a particular image, and so are excluded from
+	// selection; e.g., `v1`, if it's moved to each 1.x release (which
+	// would otherwise be taken as the version 1.0.0). If not given,
+	// the well-known floating tags `latest`, `stable` and `edge` are
+	// excluded. Tags are compared without regard to case.
+	// +optional
+	FloatingTags []string `json:"floatingTags,omitempty"`
+	// IncludeFloatingTags lets the floating tags be selected, as any
+	// other tag is. Defaults to false.
+	// +optional
+	IncludeFloatingTags bool `json:"includeFloatingTags,omitempty"`
 }
 
+// DefaultFloatingTags are the tags excluded from selection when an
+// image policy doesn't give `.spec.floatingTags`.
+var DefaultFloatingTags = []string{"latest", "stable", "edge"}
+
 // ImagePolicyChoice is a union of all the types of policy that can be
 // supplied.
 type ImagePolicyChoice struct {
@@ -43,6 +91,29 @@ type ImagePolicyChoice struct {
 	// available.
 	// +optional
 	SemVer *SemVerPolicy `json:"semver,omitempty"`
+	// Date gives a pattern and layout for extracting a date from each
+	// tag, so that the tags can be ordered chronologically.
+	// +optional
+	Date *DatePolicy `json:"date,omitempty"`
+	// Extension names a tag selection extension built into the
+	// controller, to select the tag by rules of its own; e.g.,
+	// `alphabetical` or `numerical`.
+	// +optional
+	Extension *ExtensionPolicy `json:"extension,omitempty"`
+}
+
+// ExtensionPolicy specifies a policy that hands the selection of a
+// tag to an extension.
+type ExtensionPolicy struct {
+	// Name is the name of the extension, as registered with the
+	// controller.
+	// +kubebuilder:validation:MinLength=1
+	// +required
+	Name string `json:"name"`
+	// Parameters are passed to the extension; which are understood
+	// depends on the extension.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
 }
 
 // SemVerPolicy specifices a semantic version policy.
@@ -53,17 +124,97 @@ type SemVerPolicy struct {
 	Range string `json:"range"`
 }
 
+// DatePolicy specifies a policy that orders tags by a date embedded
+// in them; e.g., `app-2024.01.15-build42`. Tags that don't match the
+// pattern, or whose date doesn't parse, are skipped.
+type DatePolicy struct {
+	// Pattern is a regular expression which must match the tag, and
+	// capture the date within it. If the pattern has a group named
+	// `date`, that group is used; otherwise, the first group is used.
+	// +required
+	Pattern string `json:"pattern"`
+	// Layout gives the format of the captured date, as understood by
+	// Go's time package; e.g., `2006.01.02` or `20060102T150405`.
+	// +required
+	Layout string `json:"layout"`
+}
+
 // ImagePolicyStatus defines the observed state of ImagePolicy
 type ImagePolicyStatus struct {
 	// LatestImage gives the first in the list of images scanned by
 	// the image repository, when filtered and ordered according to
 	// the policy.
 	LatestImage string `json:"latestImage,omitempty"`
+	// LatestImageRepository is the name of the image repository the
+	// latest image was taken from. This is of interest when the
+	// policy refers to more than one image repository.
+	// +optional
+	LatestImageRepository string `json:"latestImageRepository,omitempty"`
+	// LatestDigest is the digest of the latest image, when it was
+	// selected; it's recorded only if `.spec.verifyDigest` is set.
+	// +optional
+	LatestDigest string `json:"latestDigest,omitempty"`
+	// MatchingTags is the number of tags the policy chooses from; for
+	// a semver policy, those within the range; for a date policy,
+	// those with a date matching the pattern and layout; for an
+	// extension, all the tags. None means the policy's filters leave
+	// nothing to select.
+	// +optional
+	MatchingTags int `json:"matchingTags"`
+	// NewerTags lists the tags that come after `.spec.baseline`, in
+	// the policy's order, nearest the baseline first; at most 100 are
+	// listed.
+	// +optional
+	NewerTags []string `json:"newerTags,omitempty"`
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// SetImagePolicyCondition sets the condition of the type given,
+// replacing any existing condition of that type. The transition time
+// is kept if the status is unchanged.
+func SetImagePolicyCondition(pol ImagePolicy, conditionType string, status corev1.ConditionStatus, reason, message string) ImagePolicy {
+	condition := Condition{
+		Type:               conditionType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	conditions := make([]Condition, 0, len(pol.Status.Conditions)+1)
+	found := false
+	for _, c := range pol.Status.Conditions {
+		if c.Type == conditionType {
+			if c.Status == status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			c, found = condition, true
+		}
+		conditions = append(conditions, c)
+	}
+	if !found {
+		conditions = append(conditions, condition)
+	}
+	pol.Status.Conditions = conditions
+	return pol
+}
+
+// RemoveImagePolicyCondition removes any condition of the type given.
+func RemoveImagePolicyCondition(pol ImagePolicy, conditionType string) ImagePolicy {
+	var conditions []Condition
+	for _, c := range pol.Status.Conditions {
+		if c.Type != conditionType {
+			conditions = append(conditions, c)
+		}
+	}
+	pol.Status.Conditions = conditions
+	return pol
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="LatestImage",type=string,JSONPath=`.status.latestImage`
+// +kubebuilder:printcolumn:name="Matching",type=integer,JSONPath=`.status.matchingTags`
 
 // ImagePolicy is the Schema for the imagepolicies API
 type ImagePolicy struct {
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	semver "github.com/Masterminds/semver/v3"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// SetupWebhookWithManager registers the validating webhook for
+// ImagePolicy objects with the manager's webhook server.
+func (r *ImagePolicy) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-image-toolkit-fluxcd-io-v1alpha1-imagepolicy,mutating=false,failurePolicy=fail,groups=image.toolkit.fluxcd.io,resources=imagepolicies,versions=v1alpha1,name=vimagepolicy.image.toolkit.fluxcd.io
+
+var _ webhook.Validator = &ImagePolicy{}
+
+// ValidateCreate implements webhook.Validator.
+func (r *ImagePolicy) ValidateCreate() error {
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator.
+func (r *ImagePolicy) ValidateUpdate(old runtime.Object) error {
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator; deletions are always
+// allowed.
+func (r *ImagePolicy) ValidateDelete() error {
+	return nil
+}
+
+func (r *ImagePolicy) validate() error {
+	if sv := r.Spec.Policy.SemVer; sv != nil {
+		if err := sv.Validate(); err != nil {
+			return fmt.Errorf("invalid .spec.policy.semver: %w", err)
+		}
+	}
+	if date := r.Spec.Policy.Date; date != nil {
+		if err := date.Validate(); err != nil {
+			return fmt.Errorf("invalid .spec.policy.date: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the range can be parsed as a semver range.
+func (p *SemVerPolicy) Validate() error {
+	if _, err := semver.NewConstraint(p.Range); err != nil {
+		return fmt.Errorf("range %q is not a semver range: %w", p.Range, err)
+	}
+	return nil
+}
+
+// Validate checks that the pattern compiles and has a capture group,
+// and that the layout can be used to parse dates.
+func (p *DatePolicy) Validate() error {
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern %q does not compile: %w", p.Pattern, err)
+	}
+	if re.NumSubexp() == 0 {
+		return fmt.Errorf("pattern %q has no capture group for the date", p.Pattern)
+	}
+	// Formatting a time other than the reference time gives a string
+	// different from the layout, if the layout has any elements;
+	// parsing that back checks the layout is usable for parsing.
+	sample := time.Date(2019, time.November, 23, 21, 13, 37, 0, time.UTC)
+	formatted := sample.Format(p.Layout)
+	if formatted == p.Layout {
+		return fmt.Errorf("layout %q has no date or time elements", p.Layout)
+	}
+	if _, err := time.Parse(p.Layout, formatted); err != nil {
+		return fmt.Errorf("layout %q cannot be used to parse dates: %w", p.Layout, err)
+	}
+	return nil
+}
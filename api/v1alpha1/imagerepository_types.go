@@ -17,6 +17,8 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"unicode/utf8"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -25,16 +27,332 @@ import (
 
 const ImageRepositoryKind = "ImageRepository"
 
+// ImageRepositoryFinalizer is the finalizer the controller puts on
+// each image repository, so that it can drop the tags recorded for
+// it before it's deleted.
+const ImageRepositoryFinalizer = "finalizers.fluxcd.io"
+
+// PerObjectMetricsAnnotation, when set to "false" on an
+// ImageRepository or ImagePolicy, leaves the object (and, for an
+// ImageRepository, the policies selecting from it) out of the metrics
+// that have a series per object, to keep down the number of series.
+// Such objects are still counted in the aggregate metrics.
+const PerObjectMetricsAnnotation = "image.toolkit.fluxcd.io/per-object-metrics"
+
+const (
+	// ImageArtifactType is the artifact type of a repository of
+	// container images.
+	ImageArtifactType = "image"
+	// ChartArtifactType is the artifact type of a repository of Helm
+	// charts stored in an OCI registry.
+	ChartArtifactType = "chart"
+)
+
+const (
+	// NoTagNormalization stores tags exactly as listed, less any that
+	// aren't valid tag names.
+	NoTagNormalization = "None"
+	// TrimTagNormalization removes surrounding whitespace from tags,
+	// then drops empty and duplicate tags.
+	TrimTagNormalization = "Trim"
+	// FullTagNormalization does as TrimTagNormalization, and also
+	// puts tags into Unicode normal form C, and drops tags that
+	// differ from an earlier tag only in case.
+	FullTagNormalization = "Full"
+)
+
+const (
+	// GenericProvider takes credentials from a secret or inline, and
+	// otherwise from the cloud provider, if the image is hosted by
+	// one that's known.
+	GenericProvider = "generic"
+	// AWSProvider takes credentials for Amazon ECR from the
+	// controller's AWS credentials.
+	AWSProvider = "aws"
+	// GCPProvider takes credentials for Google Container Registry and
+	// Artifact Registry from the controller's Google credentials.
+	GCPProvider = "gcp"
+	// AzureProvider takes credentials for Azure Container Registry
+	// from the controller's managed identity.
+	AzureProvider = "azure"
+)
+
 // ImageRepositorySpec defines the parameters for scanning an image
 // repository, e.g., `fluxcd/flux`.
 type ImageRepositorySpec struct {
-	// Image is the name of the image repository
+	// Image is the name of the image repository. It may contain
+	// references of the form `${VAR}`, which are replaced with values
+	// taken from the objects listed in `.spec.substituteFrom`.
 	// +required
 	Image string `json:"image,omitempty"`
+	// Repositories lists further repositories on the same registry as
+	// `.spec.image`, by path (e.g., `org/app-worker`), to be scanned
+	// along with it, with the same credentials and settings. The
+	// tags of each are recorded under its own name, and the outcome
+	// of scanning each is reported in `.status.repositories`; a
+	// repository that fails to scan doesn't fail the others, or the
+	// scan of `.spec.image`.
+	// +optional
+	Repositories []string `json:"repositories,omitempty"`
+	// Images lists further images, by name (e.g.,
+	// `ghcr.io/org/service-b`), to be scanned along with
+	// `.spec.image`, with the same settings; they needn't be on the
+	// same registry. The tags of each are recorded under its
+	// canonical name, and the outcome of scanning each is reported in
+	// `.status.images`. The image repository fails only if the scans
+	// of `.spec.image` and all of these fail.
+	// +optional
+	Images []string `json:"images,omitempty"`
+	// SubstituteFrom lists ConfigMaps and Secrets, in the same
+	// namespace, whose data supplies the values for variables
+	// referenced in `.spec.image`. Where a variable is given by more
+	// than one object, the last in the list wins.
+	// +optional
+	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty"`
+	// ArtifactType says what is stored in the repository; either
+	// `image` (the default) for container images, or `chart` for Helm
+	// charts stored in an OCI registry, in which case the tags are
+	// treated as chart versions.
+	// +kubebuilder:validation:Enum=image;chart
+	// +optional
+	ArtifactType string `json:"artifactType,omitempty"`
 	// ScanInterval is the (minimum) length of time to wait between
-	// scans of the image repository.
+	// scans of the image repository. If not given, the controller's
+	// default is used (ten minutes, unless it's configured otherwise).
 	// +optional
 	ScanInterval *metav1.Duration `json:"scanInterval,omitempty"`
+	// Timeout is how long a scan of the image repository is given
+	// before it's abandoned. If not given, the controller's default
+	// is used.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// FailureThreshold is the number of consecutive failed scans
+	// after which the Ready condition is set to False. Until then, a
+	// ready image repository stays ready, and the failures are
+	// recorded in the `ScanFailing` condition instead; the scans are
+	// retried as usual. If neither this nor FailureGracePeriod is
+	// given, the Ready condition is set to False on the first failure.
+	// +optional
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// FailureGracePeriod is how long scans may keep failing before
+	// the Ready condition is set to False, as with FailureThreshold.
+	// If both are given, the Ready condition is set to False when
+	// either is reached.
+	// +optional
+	FailureGracePeriod *metav1.Duration `json:"failureGracePeriod,omitempty"`
+
+	// SecretRef can be given the name of a secret containing
+	// credentials to use for the image registry. The secret should be
+	// created with `kubectl create secret docker-registry`, or the
+	// equivalent; or else be of type `kubernetes.io/basic-auth`, with
+	// a username and password used whatever the registry; a secret
+	// of any other type is refused. If the secret has no credentials
+	// for the registry, the repository is scanned anonymously.
+	// +optional
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// InlineAuth gives credentials for the image registry in the
+	// ImageRepository itself, for convenience in tests and CI. This
+	// is insecure, since the credentials can be read by anyone who
+	// can read the ImageRepository, and is meant only for ephemeral,
+	// non-production use; it's refused unless the controller is run
+	// with `--allow-inline-auth`. If SecretRef or ServiceAccountName
+	// is also given, that is used instead.
+	// +optional
+	InlineAuth *InlineAuth `json:"inlineAuth,omitempty"`
+
+	// ServiceAccountName names a service account in the same
+	// namespace whose `imagePullSecrets` are searched, in order, for
+	// credentials for the image registry, as the kubelet does when
+	// pulling images for a pod. If SecretRef is also given, the
+	// secret is used instead.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Provider says where the credentials for scanning come from,
+	// when not from `.spec.secretRef` or `.spec.inlineAuth`. With
+	// `aws`, a token for Amazon ECR is got afresh for each scan,
+	// using the controller's AWS credentials: from the environment,
+	// shared config, a web identity (e.g., IAM roles for service
+	// accounts) or the instance profile, in that order. The identity
+	// needs the `ecr:GetAuthorizationToken` and `ecr:BatchGetImage`
+	// permissions, and also `ecr:GetDownloadUrlForLayer` if image
+	// configs are inspected (e.g., for timestamps). With `gcp`, an
+	// access token for Google Container Registry or Artifact Registry
+	// (`gcr.io`, `*.gcr.io` and `*.pkg.dev`) is got using the
+	// controller's Google application default credentials, e.g.,
+	// from GKE workload identity, and reused until it's close to
+	// expiry. With `azure`, a token for the controller's managed
+	// identity (named by `AZURE_CLIENT_ID`, if there's more than one)
+	// is exchanged for a refresh token for Azure Container Registry
+	// (`*.azurecr.io`) for each scan. The default, `generic`, uses
+	// `aws` for images hosted by ECR
+	// (`<account>.dkr.ecr.<region>.amazonaws.com`) when neither a
+	// secret nor inline credentials are given, and otherwise scans
+	// anonymously. Setting `aws`, `gcp` or `azure` takes precedence
+	// over any secret or inline credentials.
+	// +kubebuilder:validation:Enum=generic;aws;gcp;azure
+	// +optional
+	Provider string `json:"provider,omitempty"`
+
+	// Insecure allows the registry to be reached over plain HTTP, and
+	// without verifying its certificate where HTTPS is used; e.g., for
+	// a registry in the cluster, or one with a self-signed
+	// certificate. Defaults to false.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// CertSecretRef names a secret in the same namespace with the
+	// certificate of a CA, PEM-encoded under the key `ca.crt`, to
+	// verify the registry's certificate with, in place of the
+	// system's CAs; e.g., for a registry with a certificate from an
+	// internal CA. It's ignored, with a warning, if `.spec.insecure`
+	// is set.
+	// +optional
+	CertSecretRef *corev1.LocalObjectReference `json:"certSecretRef,omitempty"`
+
+	// ProxySecretRef names a secret in the same namespace giving an
+	// HTTP(S) proxy to reach the registry through, for scans of this
+	// image repository only: its URL under the key `address`, and
+	// optionally credentials for it under `username` and `password`.
+	// When it's not given, the controller's own proxy settings (from
+	// its environment) apply.
+	// +optional
+	ProxySecretRef *corev1.LocalObjectReference `json:"proxySecretRef,omitempty"`
+
+	// CustomHeaders gives extra HTTP headers to send with each
+	// request made to the registry when scanning, e.g., a tenant ID
+	// or key required by an API gateway in front of the
+	// registry. The header values are never logged, and the headers
+	// aren't sent with requests the registry redirects to another
+	// host.
+	// +optional
+	CustomHeaders map[string]string `json:"customHeaders,omitempty"`
+
+	// DoubleFetch tells the controller to list the tags twice, a
+	// short delay apart, and take the union of the results. This
+	// smooths over registries that are eventually consistent across
+	// nodes (e.g., those fronted by a CDN), at the cost of doubling
+	// the number of requests made and lengthening each scan by the
+	// delay. Defaults to false.
+	// +optional
+	DoubleFetch bool `json:"doubleFetch,omitempty"`
+
+	// TagNormalization says how the tags listed by the registry are
+	// cleaned up before they're stored, for registries (or proxies)
+	// that return them with stray whitespace or inconsistent
+	// encoding. One of `None`, `Trim` (the default), which removes
+	// surrounding whitespace and drops empty and duplicate tags, or
+	// `Full`, which also puts tags into Unicode normal form C and
+	// drops tags differing from an earlier one only in case. Only
+	// the normalized tags are kept: they're what policies select
+	// from, and what is reported as the latest image; the raw tags
+	// aren't recorded. Whatever the mode, tags that aren't valid tag
+	// names are dropped, since they can't be pulled.
+	// +kubebuilder:validation:Enum=None;Trim;Full
+	// +optional
+	TagNormalization string `json:"tagNormalization,omitempty"`
+
+	// IncludeSignatureTags tells the controller to keep the tags
+	// cosign uses to store signatures, attestations and SBOMs
+	// (`sha256-<digest>.sig`, `.att` and `.sbom`) along with the
+	// others. By default they are dropped, so they are not counted
+	// in `.status.lastScanResult.tagCount`, and policies don't select
+	// from them. Defaults to false.
+	// +optional
+	IncludeSignatureTags bool `json:"includeSignatureTags,omitempty"`
+
+	// TagFilters narrows down the tags kept from each scan, for
+	// repositories with many more tags than are of interest. The
+	// tags dropped aren't stored, counted in
+	// `.status.lastScanResult.tagCount`, or selected from by
+	// policies.
+	// +optional
+	TagFilters *TagFilters `json:"tagFilters,omitempty"`
+
+	// InspectPlatforms tells the controller to fetch the manifest of
+	// each tag found, to record which platforms (OS and architecture)
+	// it is available for, so that ImagePolicy objects can select by
+	// platform. This costs at least one extra request per tag, per
+	// scan, so is best used with small repositories. Defaults to
+	// false.
+	// +optional
+	InspectPlatforms bool `json:"inspectPlatforms,omitempty"`
+
+	// Platform, given as `os/arch` or `os/arch/variant`, says which
+	// image's digest to record for a tag with a multi-platform image,
+	// when the controller resolves digests. If not given, the digest
+	// of the index (or manifest list) is recorded.
+	// +optional
+	Platform *string `json:"platform,omitempty"`
+
+	// InspectTimestamps tells the controller to fetch the config of
+	// the image at each tag found, to find out when it was created,
+	// and record the span of the creation times in
+	// `.status.oldestTagTime` and `.status.newestTagTime`. This costs
+	// at least two extra requests per tag, per scan, so is best used
+	// with small repositories. Defaults to false.
+	// +optional
+	InspectTimestamps bool `json:"inspectTimestamps,omitempty"`
+
+	// ExpectedRevision is a revision, e.g., a git commit SHA, for
+	// which an image is expected to be pushed. Each scan checks
+	// whether there is a tag for the revision, and records the result
+	// in the `RevisionAvailable` condition.
+	// +optional
+	ExpectedRevision string `json:"expectedRevision,omitempty"`
+
+	// RevisionTagPattern is a regular expression matching the tags
+	// that encode a revision, with a capture group for the revision;
+	// e.g., `^main-([0-9a-f]+)$`. A captured revision at least seven
+	// characters long also matches an expected revision that it is a
+	// prefix of, so tags with short commit SHAs are found. Defaults to
+	// matching tags that are the revision.
+	// +optional
+	RevisionTagPattern string `json:"revisionTagPattern,omitempty"`
+
+	// AuditReferences tells the controller to fetch the manifest of
+	// each tag, and record any references it makes to other
+	// repositories -- the base image annotation, or the URLs of
+	// foreign layers -- in `.status.crossRepositoryReferences`, for
+	// provenance auditing. This costs one extra request per tag, per
+	// scan; to bound the cost, only the first 50 tags listed are
+	// inspected, and at most 100 references are recorded. Defaults
+	// to false.
+	// +optional
+	AuditReferences bool `json:"auditReferences,omitempty"`
+
+	// StableTransitionTime tells the controller to leave the Ready
+	// condition as it is, including its last transition time, when a
+	// successful scan finds the same tags as the scan before it. Only
+	// `.status.lastScanTime` is updated in that case. Defaults to
+	// false.
+	// +optional
+	StableTransitionTime bool `json:"stableTransitionTime,omitempty"`
+
+	// ExportTags, if present, tells the controller to write the tags
+	// found by each successful scan into a ConfigMap owned by this
+	// object, for tooling that would rather read a ConfigMap than an
+	// ImagePolicy.
+	// +optional
+	ExportTags *TagExport `json:"exportTags,omitempty"`
+
+	// DryRun tells the controller to list the tags of the image, to
+	// check that the image can be scanned with the credentials given,
+	// but to record nothing: the number of tags found, or why the scan
+	// failed, is reported in the status, and the tags are left out of
+	// the database, so no policy sees them. Once this is unset, the
+	// image is scanned for real straight away. Defaults to false.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// ForceScan tells the controller to scan the image straight away,
+	// whether or not a scan is due and the tags are recorded; e.g.,
+	// after recovering from an incident. It's set back to false once
+	// the scan has been done. Defaults to false.
+	// +optional
+	ForceScan bool `json:"forceScan,omitempty"`
 
 	// This flag tells the controller to suspend subsequent image scans.
 	// It does not apply to already started scans. Defaults to false.
@@ -42,8 +360,286 @@ type ImageRepositorySpec struct {
 	Suspend bool `json:"suspend,omitempty"`
 }
 
+// SubstituteReference names a ConfigMap or Secret holding values for
+// variable substitution.
+type SubstituteReference struct {
+	// Kind of the object; either `ConfigMap` or `Secret`.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +required
+	Kind string `json:"kind"`
+	// Name of the object, in the same namespace as the
+	// ImageRepository.
+	// +required
+	Name string `json:"name"`
+}
+
+// CrossRepositoryReference records a reference to another repository
+// found in the manifest of a tag.
+type CrossRepositoryReference struct {
+	// Tag is the tag whose manifest has the reference.
+	// +required
+	Tag string `json:"tag"`
+	// Reference is the image or URL referred to.
+	// +required
+	Reference string `json:"reference"`
+}
+
+// TagExport gives the particulars of exporting the tags found by a
+// scan to a ConfigMap.
+type TagExport struct {
+	// ConfigMapName is the name of the ConfigMap to write, in the
+	// same namespace as the ImageRepository. It defaults to the name
+	// of the ImageRepository.
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+
+	// MaxTags is the most tags that will be written to the
+	// ConfigMap; any others are left out, and this is indicated in
+	// the ConfigMap. It defaults to 100.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1000
+	// +optional
+	MaxTags int `json:"maxTags,omitempty"`
+}
+
+const (
+	// AnonymousCredentials means a scan was made without credentials.
+	AnonymousCredentials = "Anonymous"
+	// SecretCredentials means a scan was made with credentials taken
+	// from the secret named in `.spec.secretRef`.
+	SecretCredentials = "Secret"
+	// InlineCredentials means a scan was made with the credentials
+	// given in `.spec.inlineAuth`.
+	InlineCredentials = "Inline"
+	// AWSCredentials means a scan was made with a token for Amazon
+	// ECR, got with the controller's AWS credentials.
+	AWSCredentials = "AWS"
+	// GCPCredentials means a scan was made with an access token for
+	// Google Cloud, got with the controller's Google credentials.
+	GCPCredentials = "GCP"
+	// AzureCredentials means a scan was made with a refresh token for
+	// Azure Container Registry, got with the controller's managed
+	// identity.
+	AzureCredentials = "Azure"
+	// KeychainCredentials means a scan was made with credentials
+	// found in the controller's own docker config, since the image
+	// repository gave none.
+	KeychainCredentials = "Keychain"
+	// ServiceAccountCredentials means a scan was made with credentials
+	// taken from one of the `imagePullSecrets` of the service account
+	// named in `.spec.serviceAccountName`.
+	ServiceAccountCredentials = "ServiceAccount"
+)
+
+// These are the types of registry recognised by the controller.
+const (
+	DockerHubRegistry    = "DockerHub"
+	GitHubRegistry       = "GHCR"
+	ECRRegistry          = "ECR"
+	GoogleRegistry       = "Google"
+	AzureRegistry        = "ACR"
+	QuayRegistry         = "Quay"
+	HarborRegistry       = "Harbor"
+	ArtifactoryRegistry  = "Artifactory"
+	GitLabRegistry       = "GitLab"
+	DistributionRegistry = "Distribution"
+	UnknownRegistry      = "Unknown"
+)
+
+const (
+	// PublicVisibility means the repository can be read anonymously.
+	PublicVisibility = "Public"
+	// PrivateVisibility means the repository can be read only with
+	// credentials.
+	PrivateVisibility = "Private"
+)
+
+// RegistryInfo describes the registry an image repository is hosted
+// on, as detected when scanning it.
+type RegistryInfo struct {
+	// Type is the kind of registry; e.g., `DockerHub`, `GHCR`, `ECR`,
+	// `Harbor`, or `Distribution` for the reference implementation
+	// (and registries that look like it). It's `Unknown` if the kind
+	// of registry couldn't be told.
+	// +required
+	Type string `json:"type"`
+
+	// Server is the `Server` header given by the registry, if any.
+	// +optional
+	Server string `json:"server,omitempty"`
+
+	// APIVersion is the `Docker-Distribution-Api-Version` header
+	// given by the registry, if any.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// CreatedTagOrder is the value of `.status.lastScanResult.latestTagsOrder`
+// when the latest tags are ordered by when their images were created.
+const CreatedTagOrder = "created"
+
+// ImageScanResult is the outcome of scanning one of the images listed
+// in `.spec.images`.
+type ImageScanResult struct {
+	// Image is the name of the image, as listed.
+	Image string `json:"image"`
+	// CanonicalImageName is the name of the image scanned, in full;
+	// the tags found are recorded under this name.
+	// +optional
+	CanonicalImageName string `json:"canonicalImageName,omitempty"`
+	// TagCount is the number of tags found. When the scan fails, it
+	// is the number found by the last successful scan, if any.
+	TagCount int `json:"tagCount"`
+	// Error says why the scan of the image failed; it is empty if the
+	// scan succeeded.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// RepositoryScanResult is the outcome of scanning one of the
+// repositories listed in `.spec.repositories`.
+type RepositoryScanResult struct {
+	// Path is the path of the repository, as listed.
+	Path string `json:"path"`
+	// CanonicalImageName is the name of the repository scanned, in
+	// full; the tags found are recorded under this name.
+	// +optional
+	CanonicalImageName string `json:"canonicalImageName,omitempty"`
+	// TagCount is the number of tags found. When the scan fails, it
+	// is the number found by the last successful scan, if any.
+	TagCount int `json:"tagCount"`
+	// Error says why the scan of the repository failed; it is empty
+	// if the scan succeeded.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// TagFilters gives regular expressions (in Go's syntax) for the tags
+// to keep from a scan. A tag is kept if it matches Include, when
+// that's given, and doesn't match Exclude, when that's given.
+type TagFilters struct {
+	// +optional
+	Include string `json:"include,omitempty"`
+	// +optional
+	Exclude string `json:"exclude,omitempty"`
+}
+
 type ScanResult struct {
 	TagCount int `json:"tagCount"`
+	// UnfilteredTagCount is the number of tags found before
+	// `.spec.tagFilters` were applied; TagCount is the number kept.
+	// +optional
+	UnfilteredTagCount int `json:"unfilteredTagCount,omitempty"`
+	// ListedTagCount is the number of tags as listed by the registry,
+	// before they were cleaned up and filtered.
+	// +optional
+	ListedTagCount int `json:"listedTagCount,omitempty"`
+	// DroppedTagCount is the number of those listed that were dropped
+	// for being empty, duplicates, or not valid tag names (see
+	// `.spec.tagNormalization`); none of these are recorded.
+	// +optional
+	DroppedTagCount int `json:"droppedTagCount,omitempty"`
+	// TagsChanged says whether the scan found the tags different from
+	// those found by the scan before it.
+	// +optional
+	TagsChanged bool `json:"tagsChanged,omitempty"`
+	// RemovedTagCount is the number of tags the scan dropped, having
+	// gone unseen for longer than the controller's tag retention.
+	// +optional
+	RemovedTagCount int `json:"removedTagCount,omitempty"`
+	// TotalTagCount is the number of tags found for `.spec.image` and
+	// the images in `.spec.images` together; it's only given when
+	// there are images listed there.
+	// +optional
+	TotalTagCount int `json:"totalTagCount,omitempty"`
+
+	// LatestTags lists the tags found by the scan, as they were
+	// listed by the registry, for debugging policies. When there are
+	// more than the controller's limit, only the last tags listed are
+	// given, and Truncated is set. If the controller fetches when the
+	// images were created, the latest are given in that order
+	// instead, and LatestTagsOrder says so.
+	// +optional
+	LatestTags []string `json:"latestTags,omitempty"`
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+	// LatestTagsOrder says how LatestTags are ordered: `created`, if
+	// by when the images were created, oldest first; or empty, if as
+	// listed by the registry.
+	// +optional
+	LatestTagsOrder string `json:"latestTagsOrder,omitempty"`
+
+	// LatestDigest is the digest of the manifest at the last tag
+	// listed, when the controller is set to resolve digests. Unlike
+	// the tag, it changes whenever the image is pushed again.
+	// +optional
+	LatestDigest string `json:"latestDigest,omitempty"`
+
+	// Credentials records which credentials were used for the scan.
+	// +optional
+	Credentials *ScanCredentials `json:"credentials,omitempty"`
+
+	// ETag is the entity tag the registry gave the listing of tags
+	// found by the scan, if it gave one and the listing fit in one
+	// page. The next scan asks for the listing only if it has changed
+	// since; if it hasn't, the tags are left as they were recorded.
+	// +optional
+	ETag string `json:"etag,omitempty"`
+
+	// DryRun says whether the scan was a dry run, which recorded
+	// none of the tags it found; see `.spec.dryRun`.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// YieldedFetches is the number of per-tag metadata fetches in the
+	// scan that waited for their turn, because the controller's limit
+	// on fetches across all scans had been reached. If this is often
+	// high, scans are slowed by sharing fetches fairly with others.
+	// +optional
+	YieldedFetches int `json:"yieldedFetches,omitempty"`
+
+	// CacheHint is how long the registry said the listing of tags
+	// would stay fresh for (in its `Cache-Control` header), when that
+	// was longer than the scan interval, and so the next scan was put
+	// off until then. It's bounded by the controller's maximum.
+	// +optional
+	CacheHint *metav1.Duration `json:"cacheHint,omitempty"`
+}
+
+// InlineAuth gives credentials for an image registry: either a
+// username and password, or a registry token.
+type InlineAuth struct {
+	// +optional
+	Username string `json:"username,omitempty"`
+	// +optional
+	Password string `json:"password,omitempty"`
+	// Token is a bearer token to send to the registry.
+	// +optional
+	Token string `json:"token,omitempty"`
+}
+
+// ScanCredentials identifies the credentials used for a scan, without
+// revealing any secret part of them.
+type ScanCredentials struct {
+	// Source says where the credentials came from; `Anonymous` if
+	// none were used, `Secret` if they were taken from a secret,
+	// `Inline` if they were given in the ImageRepository,
+	// `ServiceAccount` if they were taken from an image pull secret
+	// of the service account, `AWS`, `GCP` or `Azure` if they were
+	// got from the cloud provider with the controller's own
+	// credentials, or `Keychain` if they were found in the
+	// controller's own docker config.
+	// +required
+	Source string `json:"source"`
+
+	// SecretName is the name of the secret the credentials were
+	// taken from, if any.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+
+	// Username is the user name given in the credentials, if any.
+	// +optional
+	Username string `json:"username,omitempty"`
 }
 
 // ImageRepositoryStatus defines the observed state of ImageRepository
@@ -61,16 +657,126 @@ type ImageRepositoryStatus struct {
 	// +optional
 	CanonicalImageName string `json:"canonicalImageName,omitempty"`
 
+	// ShortImageName is the name of the image repository without the
+	// Docker Hub registry and `library/` prefix, if it is on Docker
+	// Hub; e.g., `alpine` rather than `docker.io/library/alpine`. For
+	// other registries it is the same as the canonical name.
+	// +optional
+	ShortImageName string `json:"shortImageName,omitempty"`
+
+	// LastScanTime is the time the repository was last scanned,
+	// whether or not the scan succeeded. The next scan is scheduled
+	// relative to this.
+	// +optional
+	LastScanTime *metav1.Time `json:"lastScanTime,omitempty"`
+
+	// FailingSince is the time of the first of the consecutive failed
+	// scans, if the last scan failed.
+	// +optional
+	FailingSince *metav1.Time `json:"failingSince,omitempty"`
+
+	// SuspendedSince is the time the image repository was first
+	// seen to be suspended, if it is suspended.
+	// +optional
+	SuspendedSince *metav1.Time `json:"suspendedSince,omitempty"`
+
 	// LastScanResult contains the number of fetched tags.
 	// +optional
 	LastScanResult ScanResult `json:"lastScanResult,omitempty"`
 
+	// Registry describes the registry the image repository is hosted
+	// on, as seen in the last successful scan.
+	// +optional
+	Registry *RegistryInfo `json:"registry,omitempty"`
+
+	// Visibility says whether the repository could be read without
+	// credentials, as of the last successful scan: `Public` or
+	// `Private`. It is left empty when that isn't known; i.e., when
+	// the repository is scanned with credentials, and the controller
+	// isn't set to probe it anonymously as well.
+	// +optional
+	Visibility string `json:"visibility,omitempty"`
+
+	// OldestTagTime and NewestTagTime are the earliest and latest
+	// creation times of the images at the tags found, when
+	// `.spec.inspectTimestamps` is set. Tags whose images don't give
+	// a creation time (or give the zero time, as reproducible builds
+	// often do) are left out; if none give one, these are not set.
+	// +optional
+	OldestTagTime *metav1.Time `json:"oldestTagTime,omitempty"`
+	// +optional
+	NewestTagTime *metav1.Time `json:"newestTagTime,omitempty"`
+
+	// CrossRepositoryReferences lists the references to other
+	// repositories found in the manifests of the tags, when
+	// `.spec.auditReferences` is set.
+	// +optional
+	CrossRepositoryReferences []CrossRepositoryReference `json:"crossRepositoryReferences,omitempty"`
+
+	// Repositories gives the outcome of the last scan of each of the
+	// repositories listed in `.spec.repositories`, in the same order.
+	// +optional
+	Repositories []RepositoryScanResult `json:"repositories,omitempty"`
+
+	// Images gives the outcome of the last scan of each of the images
+	// listed in `.spec.images`, in the same order.
+	// +optional
+	Images []ImageScanResult `json:"images,omitempty"`
+
+	// ScanFailures is the number of consecutive failed scans, which
+	// determines how long to back off before scanning again. A
+	// successful scan resets it to zero, and a failed scan adds one. A
+	// partial scan, which fetched some but not all pages of tags,
+	// reduces it, but not to zero.
+	// +optional
+	ScanFailures int `json:"scanFailures,omitempty"`
+
+	// RegistryDeprecation gives the deprecation notice sent by the
+	// registry in `Deprecation` or `Sunset` headers during the last
+	// successful scan, if any.
+	// +optional
+	RegistryDeprecation string `json:"registryDeprecation,omitempty"`
+
+	// RateLimit gives the registry's rate limit, as reported in its
+	// responses during the last scan; it's not set if the registry
+	// didn't report one.
+	// +optional
+	RateLimit *RateLimitStatus `json:"rateLimit,omitempty"`
+
 	meta.ReconcileRequestStatus `json:",inline"`
 }
 
+// RateLimitStatus gives a registry's rate limit, as reported in the
+// `RateLimit-Limit` and `RateLimit-Remaining` headers of its
+// responses (as Docker Hub sends), and in the `Retry-After` header of
+// a response refusing a request for going over the limit.
+type RateLimitStatus struct {
+	// Limit is the number of requests allowed in the window.
+	// +optional
+	Limit int `json:"limit,omitempty"`
+	// Remaining is the number of requests left in the window.
+	// +optional
+	Remaining int `json:"remaining"`
+	// Window is the period the limit applies to, if the registry
+	// said.
+	// +optional
+	Window *metav1.Duration `json:"window,omitempty"`
+	// RetryAfter is when the registry said to try again, having
+	// refused a request for going over the limit.
+	// +optional
+	RetryAfter *metav1.Time `json:"retryAfter,omitempty"`
+}
+
+// DefaultMaxConditionMessageLength is the suggested maximum length,
+// in bytes, of a condition message; see TruncateConditionMessages.
+const DefaultMaxConditionMessageLength = 1024
+
+const truncatedSuffix = "..."
+
 // SetImageRepositoryReadiness sets the ready condition with the given status, reason and message.
 func SetImageRepositoryReadiness(ir ImageRepository, status corev1.ConditionStatus, reason, message string) ImageRepository {
-	ir.Status.Conditions = []Condition{
+	// the ready condition always comes first; any others follow it
+	conditions := []Condition{
 		{
 			Type:               ReadyCondition,
 			Status:             status,
@@ -79,10 +785,83 @@ func SetImageRepositoryReadiness(ir ImageRepository, status corev1.ConditionStat
 			Message:            message,
 		},
 	}
+	for _, c := range ir.Status.Conditions {
+		if c.Type != ReadyCondition {
+			conditions = append(conditions, c)
+		}
+	}
+	ir.Status.Conditions = conditions
 	ir.Status.ObservedGeneration = ir.ObjectMeta.Generation
 	return ir
 }
 
+// SetImageRepositoryCondition sets a condition other than the ready
+// condition, replacing any existing condition of the same type. The
+// transition time is only changed if the status changes.
+func SetImageRepositoryCondition(ir ImageRepository, conditionType string, status corev1.ConditionStatus, reason, message string) ImageRepository {
+	condition := Condition{
+		Type:               conditionType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	conditions := make([]Condition, 0, len(ir.Status.Conditions)+1)
+	found := false
+	for _, c := range ir.Status.Conditions {
+		if c.Type == conditionType {
+			if c.Status == status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			c, found = condition, true
+		}
+		conditions = append(conditions, c)
+	}
+	if !found {
+		conditions = append(conditions, condition)
+	}
+	ir.Status.Conditions = conditions
+	return ir
+}
+
+// RemoveImageRepositoryCondition removes the condition of the given
+// type, if present.
+func RemoveImageRepositoryCondition(ir ImageRepository, conditionType string) ImageRepository {
+	var conditions []Condition
+	for _, c := range ir.Status.Conditions {
+		if c.Type != conditionType {
+			conditions = append(conditions, c)
+		}
+	}
+	ir.Status.Conditions = conditions
+	return ir
+}
+
+// TruncateConditionMessages truncates the message of each condition
+// longer than max bytes, ending it with an ellipsis. A max of zero or
+// less leaves the messages as they are.
+func TruncateConditionMessages(conditions []Condition, max int) {
+	for i := range conditions {
+		conditions[i].Message = truncateMessage(conditions[i].Message, max)
+	}
+}
+
+// truncateMessage shortens the message to at most max bytes, ending
+// with an ellipsis, without splitting a multi-byte character.
+func truncateMessage(message string, max int) string {
+	if max <= 0 || len(message) <= max {
+		return message
+	}
+	if max <= len(truncatedSuffix) {
+		return truncatedSuffix[:max]
+	}
+	cut := max - len(truncatedSuffix)
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut] + truncatedSuffix
+}
+
 func GetLastTransitionTime(ir ImageRepository) *metav1.Time {
 	for _, condition := range ir.Status.Conditions {
 		if condition.Type == ReadyCondition {
@@ -93,6 +872,23 @@ func GetLastTransitionTime(ir ImageRepository) *metav1.Time {
 	return nil
 }
 
+// GetLastScanTime returns the time the image repository was last
+// scanned. For an image repository last scanned before
+// `.status.lastScanTime` was recorded, this is the last transition
+// time of the Ready condition, unless that records a suspension
+// rather than a scan; and if it's never been scanned, nil.
+func GetLastScanTime(ir ImageRepository) *metav1.Time {
+	if ir.Status.LastScanTime != nil {
+		return ir.Status.LastScanTime
+	}
+	for _, condition := range ir.Status.Conditions {
+		if condition.Type == ReadyCondition && condition.Reason != SuspendedReason {
+			return &condition.LastTransitionTime
+		}
+	}
+	return nil
+}
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Last scan",type=string,JSONPath=`.status.lastScanTime`
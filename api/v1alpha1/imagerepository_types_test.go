@@ -0,0 +1,42 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestTruncateConditionMessages(t *testing.T) {
+	g := NewWithT(t)
+
+	message := func(msg string, max int) string {
+		conditions := []Condition{{Type: ReadyCondition, Message: msg}}
+		TruncateConditionMessages(conditions, max)
+		return conditions[0].Message
+	}
+
+	g.Expect(message("short", 10)).To(Equal("short"))
+	g.Expect(message("exactly 10", 10)).To(Equal("exactly 10"))
+	g.Expect(message("a little too long", 10)).To(Equal("a littl..."))
+	// multi-byte characters are not split
+	g.Expect(message("ääääääääää", 10)).To(Equal("äää..."))
+
+	g.Expect(message(strings.Repeat("x", 5000), 0)).To(HaveLen(5000))
+}
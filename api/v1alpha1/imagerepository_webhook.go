@@ -0,0 +1,143 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DefaultMinScanInterval is the suggested shortest
+// `.spec.scanInterval` for ImageRepositoryValidator to admit.
+const DefaultMinScanInterval = time.Minute
+
+// ImageRepositoryValidator is the validating webhook for
+// ImageRepository objects.
+// +kubebuilder:object:generate=false
+type ImageRepositoryValidator struct {
+	// MinScanInterval is the shortest `.spec.scanInterval` admitted.
+	// A value of zero or less means any interval is admitted.
+	MinScanInterval time.Duration
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the validator with the manager's
+// webhook server.
+func (v *ImageRepositoryValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(imageRepositoryWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-image-toolkit-fluxcd-io-v1alpha1-imagerepository,mutating=false,failurePolicy=fail,groups=image.toolkit.fluxcd.io,resources=imagerepositories,versions=v1alpha1,name=vimagerepository.image.toolkit.fluxcd.io
+
+const imageRepositoryWebhookPath = "/validate-image-toolkit-fluxcd-io-v1alpha1-imagerepository"
+
+var _ admission.Handler = &ImageRepositoryValidator{}
+var _ admission.DecoderInjector = &ImageRepositoryValidator{}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *ImageRepositoryValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler; creations and updates are
+// admitted if the ImageRepository is valid, and deletions are always
+// admitted.
+func (v *ImageRepositoryValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation == admissionv1beta1.Delete {
+		return admission.Allowed("")
+	}
+	var repo ImageRepository
+	if err := v.decoder.Decode(req, &repo); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := v.Validate(&repo); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// Validate checks the ImageRepository is one the controller can
+// scan.
+func (v *ImageRepositoryValidator) Validate(r *ImageRepository) error {
+	// an image with variables in it can only be checked once they're
+	// substituted, which is done when it's reconciled
+	if len(r.Spec.SubstituteFrom) == 0 {
+		var opts []name.Option
+		if r.Spec.Insecure {
+			opts = append(opts, name.Insecure)
+		}
+		if _, err := name.ParseReference(r.Spec.Image, opts...); err != nil {
+			return fmt.Errorf("invalid .spec.image: %w", err)
+		}
+		for i, image := range r.Spec.Images {
+			if _, err := name.NewRepository(image, opts...); err != nil {
+				return fmt.Errorf("invalid .spec.images[%d]: %w", i, err)
+			}
+		}
+	}
+	if interval := r.Spec.ScanInterval; interval != nil && v.MinScanInterval > 0 && interval.Duration < v.MinScanInterval {
+		return fmt.Errorf(".spec.scanInterval of %s is shorter than the minimum of %s", interval.Duration, v.MinScanInterval)
+	}
+	if platform := r.Spec.Platform; platform != nil && !validPlatform(*platform) {
+		return fmt.Errorf("invalid .spec.platform: %q is not of the form os/arch or os/arch/variant", *platform)
+	}
+	if filters := r.Spec.TagFilters; filters != nil {
+		if err := filters.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that the include and exclude patterns compile.
+func (f *TagFilters) Validate() error {
+	if _, err := regexp.Compile(f.Include); err != nil {
+		return fmt.Errorf("invalid .spec.tagFilters.include: %w", err)
+	}
+	if _, err := regexp.Compile(f.Exclude); err != nil {
+		return fmt.Errorf("invalid .spec.tagFilters.exclude: %w", err)
+	}
+	return nil
+}
+
+// validPlatform says whether the platform is given as `os/arch` or
+// `os/arch/variant`.
+func validPlatform(platform string) bool {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
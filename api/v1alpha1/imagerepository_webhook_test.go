@@ -0,0 +1,108 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestValidateImageRepository(t *testing.T) {
+	g := NewWithT(t)
+
+	v := &ImageRepositoryValidator{MinScanInterval: DefaultMinScanInterval}
+	validate := func(change func(*ImageRepositorySpec)) error {
+		repo := ImageRepository{
+			Spec: ImageRepositorySpec{Image: "ghcr.io/org/app"},
+		}
+		if change != nil {
+			change(&repo.Spec)
+		}
+		return v.Validate(&repo)
+	}
+
+	g.Expect(validate(nil)).To(Succeed())
+
+	err := validate(func(spec *ImageRepositorySpec) {
+		spec.Image = "ghcr.io/Org/App:::"
+	})
+	g.Expect(err).To(MatchError(HavePrefix("invalid .spec.image: ")))
+	// an image with variables is checked once they're substituted
+	g.Expect(validate(func(spec *ImageRepositorySpec) {
+		spec.Image = "${REGISTRY}/app"
+		spec.SubstituteFrom = []SubstituteReference{{Kind: "ConfigMap", Name: "vars"}}
+	})).To(Succeed())
+
+	interval := func(d time.Duration) func(*ImageRepositorySpec) {
+		return func(spec *ImageRepositorySpec) {
+			spec.ScanInterval = &metav1.Duration{Duration: d}
+		}
+	}
+	g.Expect(validate(interval(5 * time.Minute))).To(Succeed())
+	g.Expect(validate(interval(10 * time.Millisecond))).To(MatchError(ContainSubstring("shorter than the minimum of 1m0s")))
+	v.MinScanInterval = 0
+	g.Expect(validate(interval(10 * time.Millisecond))).To(Succeed())
+
+	platform := func(p string) func(*ImageRepositorySpec) {
+		return func(spec *ImageRepositorySpec) {
+			spec.Platform = &p
+		}
+	}
+	g.Expect(validate(platform("linux/arm/v7"))).To(Succeed())
+	g.Expect(validate(platform("arm64"))).To(MatchError(HavePrefix("invalid .spec.platform: ")))
+
+	filters := func(include, exclude string) func(*ImageRepositorySpec) {
+		return func(spec *ImageRepositorySpec) {
+			spec.TagFilters = &TagFilters{Include: include, Exclude: exclude}
+		}
+	}
+	g.Expect(validate(filters(`^v\d+`, `-rc$`))).To(Succeed())
+	g.Expect(validate(filters(`^v(\d+`, ""))).To(MatchError(HavePrefix("invalid .spec.tagFilters.include: ")))
+	g.Expect(validate(filters("", `[`))).To(MatchError(HavePrefix("invalid .spec.tagFilters.exclude: ")))
+}
+
+func TestImageRepositoryValidatorHandle(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(AddToScheme(s)).To(Succeed())
+	decoder, err := admission.NewDecoder(s)
+	g.Expect(err).ToNot(HaveOccurred())
+	v := &ImageRepositoryValidator{MinScanInterval: time.Minute}
+	g.Expect(v.InjectDecoder(decoder)).To(Succeed())
+
+	request := func(op admissionv1beta1.Operation, interval string) admission.Request {
+		obj := `{"apiVersion":"image.toolkit.fluxcd.io/v1alpha1","kind":"ImageRepository",` +
+			`"spec":{"image":"ghcr.io/org/app","scanInterval":"` + interval + `"}}`
+		return admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: op,
+			Object:    runtime.RawExtension{Raw: []byte(obj)},
+		}}
+	}
+	g.Expect(v.Handle(context.TODO(), request(admissionv1beta1.Create, "5m")).Allowed).To(BeTrue())
+	g.Expect(v.Handle(context.TODO(), request(admissionv1beta1.Update, "5s")).Allowed).To(BeFalse())
+	g.Expect(v.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Delete,
+	}}).Allowed).To(BeTrue())
+}
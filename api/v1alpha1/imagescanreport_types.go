@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const ImageScanReportKind = "ImageScanReport"
+
+// ImageScanReportSpec defines the parameters for assembling a report
+// on the image repositories in a namespace.
+type ImageScanReportSpec struct {
+	// Interval is how often the report is assembled again. If not
+	// given, the controller's default is used.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// ImageScanReportStatus summarises the image repositories in the
+// namespace of the report, as of the time it was assembled.
+type ImageScanReportStatus struct {
+	// AssembledTime is when the report was last assembled.
+	// +optional
+	AssembledTime *metav1.Time `json:"assembledTime,omitempty"`
+	// Total is the number of image repositories in the namespace.
+	Total int `json:"total"`
+	// Ready is the number of those image repositories that are
+	// ready; i.e., whose Ready condition is True.
+	Ready int `json:"ready"`
+	// NotReady is the number of those image repositories that are
+	// not ready, including any not yet scanned.
+	NotReady int `json:"notReady"`
+	// Repositories summarises each image repository, those not ready
+	// first, then in order of name. At most 500 are listed; the rest
+	// are counted in `omitted`.
+	// +optional
+	Repositories []ImageRepositorySummary `json:"repositories,omitempty"`
+	// Omitted is the number of image repositories left out of
+	// `repositories` to keep the report within bounds.
+	// +optional
+	Omitted int `json:"omitted,omitempty"`
+	// ObservedGeneration is the last generation of the report
+	// assembled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// ImageRepositorySummary gives the state of an image repository, as
+// reported by its status.
+type ImageRepositorySummary struct {
+	// Name is the name of the image repository.
+	Name string `json:"name"`
+	// Image is the canonical name of the image scanned.
+	// +optional
+	Image string `json:"image,omitempty"`
+	// Ready is the status of the Ready condition; `Unknown` if there
+	// is no such condition.
+	Ready corev1.ConditionStatus `json:"ready"`
+	// Reason and Message are those of the Ready condition; e.g.,
+	// why the last scan failed.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+	// TagCount is the number of tags found in the last scan.
+	// +optional
+	TagCount int `json:"tagCount,omitempty"`
+	// LastScanTime is when the image repository was last scanned.
+	// +optional
+	LastScanTime *metav1.Time `json:"lastScanTime,omitempty"`
+	// ScanFailures is the number of consecutive failed scans.
+	// +optional
+	ScanFailures int `json:"scanFailures,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Total",type=integer,JSONPath=`.status.total`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.ready`
+// +kubebuilder:printcolumn:name="Not ready",type=integer,JSONPath=`.status.notReady`
+// +kubebuilder:printcolumn:name="Assembled",type=string,JSONPath=`.status.assembledTime`
+
+// ImageScanReport is the Schema for the imagescanreports API. It
+// reports on all the image repositories in its namespace.
+type ImageScanReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageScanReportSpec   `json:"spec,omitempty"`
+	Status ImageScanReportStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageScanReportList contains a list of ImageScanReport
+type ImageScanReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageScanReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageScanReport{}, &ImageScanReportList{})
+}
@@ -21,8 +21,9 @@ limitations under the License.
 package v1alpha1
 
 import (
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
@@ -41,13 +42,65 @@ func (in *Condition) DeepCopy() *Condition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CrossRepositoryReference) DeepCopyInto(out *CrossRepositoryReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CrossRepositoryReference.
+func (in *CrossRepositoryReference) DeepCopy() *CrossRepositoryReference {
+	if in == nil {
+		return nil
+	}
+	out := new(CrossRepositoryReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatePolicy) DeepCopyInto(out *DatePolicy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatePolicy.
+func (in *DatePolicy) DeepCopy() *DatePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DatePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExtensionPolicy) DeepCopyInto(out *ExtensionPolicy) {
+	*out = *in
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExtensionPolicy.
+func (in *ExtensionPolicy) DeepCopy() *ExtensionPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtensionPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImagePolicy) DeepCopyInto(out *ImagePolicy) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePolicy.
@@ -76,6 +129,16 @@ func (in *ImagePolicyChoice) DeepCopyInto(out *ImagePolicyChoice) {
 		*out = new(SemVerPolicy)
 		**out = **in
 	}
+	if in.Date != nil {
+		in, out := &in.Date, &out.Date
+		*out = new(DatePolicy)
+		**out = **in
+	}
+	if in.Extension != nil {
+		in, out := &in.Extension, &out.Extension
+		*out = new(ExtensionPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePolicyChoice.
@@ -124,7 +187,17 @@ func (in *ImagePolicyList) DeepCopyObject() runtime.Object {
 func (in *ImagePolicySpec) DeepCopyInto(out *ImagePolicySpec) {
 	*out = *in
 	out.ImageRepositoryRef = in.ImageRepositoryRef
+	if in.AdditionalImageRepositoryRefs != nil {
+		in, out := &in.AdditionalImageRepositoryRefs, &out.AdditionalImageRepositoryRefs
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
 	in.Policy.DeepCopyInto(&out.Policy)
+	if in.FloatingTags != nil {
+		in, out := &in.FloatingTags, &out.FloatingTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePolicySpec.
@@ -140,6 +213,18 @@ func (in *ImagePolicySpec) DeepCopy() *ImagePolicySpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImagePolicyStatus) DeepCopyInto(out *ImagePolicyStatus) {
 	*out = *in
+	if in.NewerTags != nil {
+		in, out := &in.NewerTags, &out.NewerTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImagePolicyStatus.
@@ -214,9 +299,76 @@ func (in *ImageRepositoryList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImageRepositorySpec) DeepCopyInto(out *ImageRepositorySpec) {
 	*out = *in
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SubstituteFrom != nil {
+		in, out := &in.SubstituteFrom, &out.SubstituteFrom
+		*out = make([]SubstituteReference, len(*in))
+		copy(*out, *in)
+	}
 	if in.ScanInterval != nil {
 		in, out := &in.ScanInterval, &out.ScanInterval
-		*out = new(v1.Duration)
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.FailureGracePeriod != nil {
+		in, out := &in.FailureGracePeriod, &out.FailureGracePeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.InlineAuth != nil {
+		in, out := &in.InlineAuth, &out.InlineAuth
+		*out = new(InlineAuth)
+		**out = **in
+	}
+	if in.CertSecretRef != nil {
+		in, out := &in.CertSecretRef, &out.CertSecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.ProxySecretRef != nil {
+		in, out := &in.ProxySecretRef, &out.ProxySecretRef
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.CustomHeaders != nil {
+		in, out := &in.CustomHeaders, &out.CustomHeaders
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.TagFilters != nil {
+		in, out := &in.TagFilters, &out.TagFilters
+		*out = new(TagFilters)
+		**out = **in
+	}
+	if in.Platform != nil {
+		in, out := &in.Platform, &out.Platform
+		*out = new(string)
+		**out = **in
+	}
+	if in.ExportTags != nil {
+		in, out := &in.ExportTags, &out.ExportTags
+		*out = new(TagExport)
 		**out = **in
 	}
 }
@@ -241,7 +393,52 @@ func (in *ImageRepositoryStatus) DeepCopyInto(out *ImageRepositoryStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
-	out.LastScanResult = in.LastScanResult
+	if in.LastScanTime != nil {
+		in, out := &in.LastScanTime, &out.LastScanTime
+		*out = (*in).DeepCopy()
+	}
+	if in.FailingSince != nil {
+		in, out := &in.FailingSince, &out.FailingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.SuspendedSince != nil {
+		in, out := &in.SuspendedSince, &out.SuspendedSince
+		*out = (*in).DeepCopy()
+	}
+	in.LastScanResult.DeepCopyInto(&out.LastScanResult)
+	if in.Registry != nil {
+		in, out := &in.Registry, &out.Registry
+		*out = new(RegistryInfo)
+		**out = **in
+	}
+	if in.OldestTagTime != nil {
+		in, out := &in.OldestTagTime, &out.OldestTagTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NewestTagTime != nil {
+		in, out := &in.NewestTagTime, &out.NewestTagTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CrossRepositoryReferences != nil {
+		in, out := &in.CrossRepositoryReferences, &out.CrossRepositoryReferences
+		*out = make([]CrossRepositoryReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]RepositoryScanResult, len(*in))
+		copy(*out, *in)
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageScanResult, len(*in))
+		copy(*out, *in)
+	}
+	if in.RateLimit != nil {
+		in, out := &in.RateLimit, &out.RateLimit
+		*out = new(RateLimitStatus)
+		(*in).DeepCopyInto(*out)
+	}
 	out.ReconcileRequestStatus = in.ReconcileRequestStatus
 }
 
@@ -255,9 +452,247 @@ func (in *ImageRepositoryStatus) DeepCopy() *ImageRepositoryStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageRepositorySummary) DeepCopyInto(out *ImageRepositorySummary) {
+	*out = *in
+	if in.LastScanTime != nil {
+		in, out := &in.LastScanTime, &out.LastScanTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageRepositorySummary.
+func (in *ImageRepositorySummary) DeepCopy() *ImageRepositorySummary {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageRepositorySummary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageScanReport) DeepCopyInto(out *ImageScanReport) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageScanReport.
+func (in *ImageScanReport) DeepCopy() *ImageScanReport {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageScanReport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageScanReport) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageScanReportList) DeepCopyInto(out *ImageScanReportList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ImageScanReport, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageScanReportList.
+func (in *ImageScanReportList) DeepCopy() *ImageScanReportList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageScanReportList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImageScanReportList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageScanReportSpec) DeepCopyInto(out *ImageScanReportSpec) {
+	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageScanReportSpec.
+func (in *ImageScanReportSpec) DeepCopy() *ImageScanReportSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageScanReportSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageScanReportStatus) DeepCopyInto(out *ImageScanReportStatus) {
+	*out = *in
+	if in.AssembledTime != nil {
+		in, out := &in.AssembledTime, &out.AssembledTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]ImageRepositorySummary, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageScanReportStatus.
+func (in *ImageScanReportStatus) DeepCopy() *ImageScanReportStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageScanReportStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageScanResult) DeepCopyInto(out *ImageScanResult) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageScanResult.
+func (in *ImageScanResult) DeepCopy() *ImageScanResult {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageScanResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InlineAuth) DeepCopyInto(out *InlineAuth) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InlineAuth.
+func (in *InlineAuth) DeepCopy() *InlineAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(InlineAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RateLimitStatus) DeepCopyInto(out *RateLimitStatus) {
+	*out = *in
+	if in.Window != nil {
+		in, out := &in.Window, &out.Window
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.RetryAfter != nil {
+		in, out := &in.RetryAfter, &out.RetryAfter
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RateLimitStatus.
+func (in *RateLimitStatus) DeepCopy() *RateLimitStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RateLimitStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryInfo) DeepCopyInto(out *RegistryInfo) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryInfo.
+func (in *RegistryInfo) DeepCopy() *RegistryInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RepositoryScanResult) DeepCopyInto(out *RepositoryScanResult) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RepositoryScanResult.
+func (in *RepositoryScanResult) DeepCopy() *RepositoryScanResult {
+	if in == nil {
+		return nil
+	}
+	out := new(RepositoryScanResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScanCredentials) DeepCopyInto(out *ScanCredentials) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScanCredentials.
+func (in *ScanCredentials) DeepCopy() *ScanCredentials {
+	if in == nil {
+		return nil
+	}
+	out := new(ScanCredentials)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ScanResult) DeepCopyInto(out *ScanResult) {
 	*out = *in
+	if in.LatestTags != nil {
+		in, out := &in.LatestTags, &out.LatestTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(ScanCredentials)
+		**out = **in
+	}
+	if in.CacheHint != nil {
+		in, out := &in.CacheHint, &out.CacheHint
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScanResult.
@@ -284,3 +719,48 @@ func (in *SemVerPolicy) DeepCopy() *SemVerPolicy {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SubstituteReference) DeepCopyInto(out *SubstituteReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SubstituteReference.
+func (in *SubstituteReference) DeepCopy() *SubstituteReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SubstituteReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagExport) DeepCopyInto(out *TagExport) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagExport.
+func (in *TagExport) DeepCopy() *TagExport {
+	if in == nil {
+		return nil
+	}
+	out := new(TagExport)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagFilters) DeepCopyInto(out *TagFilters) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagFilters.
+func (in *TagFilters) DeepCopy() *TagFilters {
+	if in == nil {
+		return nil
+	}
+	out := new(TagFilters)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,408 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+type dockerConfig struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+// authFromSecret creates an Authenticator for the registry given,
+// from a secret of type `kubernetes.io/dockerconfigjson` (as made by
+// `kubectl create secret docker-registry`), or of type
+// `kubernetes.io/basic-auth`, whose username and password are used
+// for any registry. It returns a nil Authenticator, and no error, if
+// a docker config secret has no entry for the registry; the scan then
+// falls back to anonymous access. A secret of any other type is
+// refused.
+func authFromSecret(secret corev1.Secret, registry string) (authn.Authenticator, string, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		return authFromDockerConfigSecret(secret, registry)
+	case corev1.SecretTypeBasicAuth:
+		return authFromBasicAuthSecret(secret)
+	default:
+		return nil, "", fmt.Errorf("unknown secret type %q for secret %q", secret.Type, secret.Name)
+	}
+}
+
+// authFromDockerConfigSecret creates an Authenticator for the registry
+// from the entry for it in a `kubernetes.io/dockerconfigjson` secret,
+// as authFromSecret does.
+func authFromDockerConfigSecret(secret corev1.Secret, registry string) (authn.Authenticator, string, error) {
+	configData, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return nil, "", fmt.Errorf("secret %q has no %q key", secret.Name, corev1.DockerConfigJsonKey)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, "", fmt.Errorf("unable to parse %q in secret %q: %w", corev1.DockerConfigJsonKey, secret.Name, err)
+	}
+
+	host, ok := matchAuthsEntry(config.Auths, registry)
+	if !ok {
+		return nil, "", nil
+	}
+	auth := config.Auths[host]
+	if auth.Auth != "" {
+		username, password, err := decodeAuth(auth.Auth)
+		if err != nil {
+			return nil, "", fmt.Errorf("entry for %q in secret %q: %w", host, secret.Name, err)
+		}
+		auth.Username, auth.Password, auth.Auth = username, password, ""
+	}
+	return authn.FromConfig(auth), auth.Username, nil
+}
+
+// caCertKey is the key for the CA certificate in a secret named by
+// `.spec.certSecretRef`.
+const caCertKey = "ca.crt"
+
+// transportFromCertSecret returns a transport like the base given
+// (or http.DefaultTransport, if it isn't an *http.Transport), but
+// which trusts only the CA certificates in the secret's `ca.crt`.
+// Each call makes a new transport, with its own pool of connections,
+// so it's kept in a transportCache to be reused.
+func transportFromCertSecret(secret corev1.Secret, base http.RoundTripper) (*http.Transport, error) {
+	caData, ok := secret.Data[caCertKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %q has no %q key", secret.Name, caCertKey)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no PEM-encoded certificates found in %q in secret %q", caCertKey, secret.Name)
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.RootCAs = pool
+	return t, nil
+}
+
+// authFromBasicAuthSecret creates an Authenticator from the username
+// and password in a secret of type `kubernetes.io/basic-auth`.
+func authFromBasicAuthSecret(secret corev1.Secret) (authn.Authenticator, string, error) {
+	username := string(secret.Data[corev1.BasicAuthUsernameKey])
+	password := string(secret.Data[corev1.BasicAuthPasswordKey])
+	if username == "" || password == "" {
+		return nil, "", fmt.Errorf("secret %q must have both %q and %q keys",
+			secret.Name, corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: username, Password: password}), username, nil
+}
+
+// dockerHubHosts are the names Docker Hub goes by in docker config
+// entries; all of them are taken to mean the same registry.
+var dockerHubHosts = map[string]bool{
+	name.DefaultRegistry:   true, // index.docker.io
+	"docker.io":            true,
+	"registry-1.docker.io": true,
+}
+
+// matchAuthsEntry returns the key of the entry in the `auths` of a
+// docker config that's for the registry given. An entry naming the
+// registry exactly is preferred; failing that, an entry for Docker
+// Hub under any of its names will do for Docker Hub.
+func matchAuthsEntry(auths map[string]authn.AuthConfig, registry string) (string, bool) {
+	keys := make([]string, 0, len(auths))
+	for key := range auths {
+		keys = append(keys, key)
+	}
+	// so that the same entry is chosen each time
+	sort.Strings(keys)
+	for _, key := range keys {
+		if registryHost(key) == registry {
+			return key, true
+		}
+	}
+	if dockerHubHosts[registry] {
+		for _, key := range keys {
+			if dockerHubHosts[registryHost(key)] {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// registryHost returns the host part of a key in the `auths` of a
+// docker config, which may be a bare host or a URL; e.g.,
+// `https://index.docker.io/v1/`.
+func registryHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			return u.Host
+		}
+	}
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// decodeAuth splits the base64-encoded `username:password` found in
+// the `auth` field of a docker config entry.
+func decodeAuth(auth string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to decode auth field: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("auth field is not of the form username:password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// errInlineAuthDisabled is returned for an image repository giving
+// inline credentials, when they aren't allowed.
+var errInlineAuthDisabled = errors.New("inline credentials in .spec.inlineAuth are not allowed; the controller must be run with --allow-inline-auth")
+
+// authOptions says how the controller may get credentials, beyond
+// what an image repository's spec says.
+type authOptions struct {
+	// allowInline lets inline credentials be used.
+	allowInline bool
+	// ecrToken gets tokens for ECR; if nil, fetchECRToken is used.
+	ecrToken ecrTokenFunc
+	// gcpTokens gives tokens for Google Cloud; if nil, the
+	// controller's default credentials are used.
+	gcpTokens oauth2.TokenSource
+	// acrTokens gets tokens for ACR; if nil, defaultACRTokens is
+	// used.
+	acrTokens *acrTokenExchanger
+	// keychain, if not nil, is consulted for credentials when an
+	// image repository gives none.
+	keychain authn.Keychain
+}
+
+// credentialsFor returns the Authenticator to use for scanning the
+// image repository, or nil if it's to be scanned anonymously, along
+// with a record of the credentials suitable for the status. ECR
+// tokens are used if the provider is AWS, or if the image is hosted
+// by ECR and no other credentials are given; Google Cloud and ACR
+// tokens are used if the provider is GCP or Azure; inline
+// credentials are used only if allowed, and there's no secret given;
+// and failing all those, the keychain is consulted, if there is one.
+func credentialsFor(ctx context.Context, c client.Reader, log logr.Logger, imageRepo imagev1alpha1.ImageRepository, ref name.Reference, opts authOptions) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	anonymous := &imagev1alpha1.ScanCredentials{Source: imagev1alpha1.AnonymousCredentials}
+	registry := ref.Context().RegistryStr()
+	region, isECR := ecrRegion(registry)
+	if imageRepo.Spec.Provider == imagev1alpha1.AWSProvider ||
+		isECR && imageRepo.Spec.SecretRef == nil && imageRepo.Spec.ServiceAccountName == "" && imageRepo.Spec.InlineAuth == nil {
+		if !isECR {
+			return nil, nil, fmt.Errorf("provider %q given, but %s is not an ECR registry", imagev1alpha1.AWSProvider, registry)
+		}
+		return authFromECR(ctx, region, opts.ecrToken)
+	}
+	if imageRepo.Spec.Provider == imagev1alpha1.GCPProvider {
+		if !isGCPHost(registry) {
+			return nil, nil, fmt.Errorf("provider %q given, but %s is not a Google Cloud registry", imagev1alpha1.GCPProvider, registry)
+		}
+		return authFromGCP(opts.gcpTokens)
+	}
+	if imageRepo.Spec.Provider == imagev1alpha1.AzureProvider {
+		if !isACRHost(registry) {
+			return nil, nil, fmt.Errorf("provider %q given, but %s is not an Azure Container Registry", imagev1alpha1.AzureProvider, registry)
+		}
+		return authFromACR(ctx, registry, opts.acrTokens)
+	}
+
+	if imageRepo.Spec.SecretRef == nil {
+		if imageRepo.Spec.ServiceAccountName != "" {
+			return authFromServiceAccount(ctx, c, log, imageRepo, registry)
+		}
+		if inline := imageRepo.Spec.InlineAuth; inline != nil {
+			if !opts.allowInline {
+				return nil, nil, errInlineAuthDisabled
+			}
+			return authFromInline(*inline)
+		}
+		if opts.keychain != nil {
+			return authFromKeychain(opts.keychain, ref.Context().Registry)
+		}
+		return nil, anonymous, nil
+	}
+
+	var secret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{
+		Namespace: imageRepo.GetNamespace(),
+		Name:      imageRepo.Spec.SecretRef.Name,
+	}, &secret); err != nil {
+		return nil, nil, err
+	}
+	auth, username, err := authFromSecret(secret, registry)
+	if err != nil {
+		return nil, nil, err
+	}
+	if auth == nil {
+		// this is recorded as anonymous in the status, so it can be
+		// seen that the secret didn't apply
+		log.Info("secret has no credentials for registry, scanning anonymously",
+			"request", types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()},
+			"secret", secret.Name, "registry", registry)
+		return nil, anonymous, nil
+	}
+	return auth, &imagev1alpha1.ScanCredentials{
+		Source:     imagev1alpha1.SecretCredentials,
+		SecretName: secret.Name,
+		Username:   username,
+	}, nil
+}
+
+// authFromServiceAccount creates an Authenticator from the first of
+// the `imagePullSecrets` of the image repository's service account
+// with credentials for the registry. As with the kubelet, a pull
+// secret that doesn't exist is passed over; if none has credentials
+// for the registry, it's scanned anonymously.
+func authFromServiceAccount(ctx context.Context, c client.Reader, log logr.Logger, imageRepo imagev1alpha1.ImageRepository, registry string) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	var sa corev1.ServiceAccount
+	if err := c.Get(ctx, types.NamespacedName{
+		Namespace: imageRepo.GetNamespace(),
+		Name:      imageRepo.Spec.ServiceAccountName,
+	}, &sa); err != nil {
+		return nil, nil, fmt.Errorf("unable to get service account %q: %w", imageRepo.Spec.ServiceAccountName, err)
+	}
+	for _, pullSecret := range sa.ImagePullSecrets {
+		var secret corev1.Secret
+		if err := c.Get(ctx, types.NamespacedName{
+			Namespace: imageRepo.GetNamespace(),
+			Name:      pullSecret.Name,
+		}, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				log.Info("image pull secret of service account not found, skipping it",
+					"serviceAccount", sa.Name, "secret", pullSecret.Name)
+				continue
+			}
+			return nil, nil, err
+		}
+		auth, username, err := authFromSecret(secret, registry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if auth != nil {
+			return auth, &imagev1alpha1.ScanCredentials{
+				Source:     imagev1alpha1.ServiceAccountCredentials,
+				SecretName: secret.Name,
+				Username:   username,
+			}, nil
+		}
+	}
+	return nil, &imagev1alpha1.ScanCredentials{Source: imagev1alpha1.AnonymousCredentials}, nil
+}
+
+// authFromInline creates an Authenticator from the inline credentials
+// of an image repository.
+func authFromInline(inline imagev1alpha1.InlineAuth) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	basic := inline.Username != "" || inline.Password != ""
+	if basic == (inline.Token != "") {
+		return nil, nil, errors.New(".spec.inlineAuth must give either a username and password, or a token")
+	}
+	auth := authn.FromConfig(authn.AuthConfig{
+		Username:      inline.Username,
+		Password:      inline.Password,
+		RegistryToken: inline.Token,
+	})
+	return auth, &imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.InlineCredentials,
+		Username: inline.Username,
+	}, nil
+}
+
+// authFromECR creates an Authenticator that gets a fresh token for
+// the ECR registries in the region each time it's used.
+func authFromECR(ctx context.Context, region string, token ecrTokenFunc) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	if token == nil {
+		token = fetchECRToken
+	}
+	auth := &ecrAuthenticator{ctx: ctx, region: region, token: token}
+	return auth, &imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.AWSCredentials,
+		Username: "AWS",
+	}, nil
+}
+
+// authFromGCP creates an Authenticator that uses the tokens given, or
+// else those got with the controller's default Google Cloud
+// credentials.
+func authFromGCP(tokens oauth2.TokenSource) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	if tokens == nil {
+		var err error
+		if tokens, err = defaultGCPTokenSource(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &gcpAuthenticator{tokens: tokens}, &imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.GCPCredentials,
+		Username: gcpUsername,
+	}, nil
+}
+
+// authFromACR creates an Authenticator that gets a fresh ACR refresh
+// token for the registry each time it's used.
+func authFromACR(ctx context.Context, registry string, tokens *acrTokenExchanger) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	if tokens == nil {
+		tokens = defaultACRTokens
+	}
+	return &acrAuthenticator{ctx: ctx, registry: registry, tokens: tokens}, &imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.AzureCredentials,
+		Username: acrUsername,
+	}, nil
+}
+
+// authFromKeychain looks up credentials for the registry in the
+// keychain; if it has none, the scan is anonymous.
+func authFromKeychain(keychain authn.Keychain, registry name.Registry) (authn.Authenticator, *imagev1alpha1.ScanCredentials, error) {
+	auth, err := keychain.Resolve(registry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to look up credentials for %s in keychain: %w", registry.RegistryStr(), err)
+	}
+	if auth == authn.Anonymous {
+		return nil, &imagev1alpha1.ScanCredentials{Source: imagev1alpha1.AnonymousCredentials}, nil
+	}
+	credentials := &imagev1alpha1.ScanCredentials{Source: imagev1alpha1.KeychainCredentials}
+	if config, err := auth.Authorization(); err == nil {
+		credentials.Username = config.Username
+	}
+	return auth, credentials, nil
+}
@@ -0,0 +1,637 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func dockerConfigSecret(name string, auths map[string]string) *corev1.Secret {
+	var entries []string
+	for host, auth := range auths {
+		entries = append(entries, fmt.Sprintf(`%q: {"auth": %q}`, host, auth))
+	}
+	secret := &corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths": {` + strings.Join(entries, ",") + `}}`),
+		},
+	}
+	secret.Name = name
+	secret.Namespace = "default"
+	return secret
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestAuthFromSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := dockerConfigSecret("creds", map[string]string{
+		"https://index.docker.io/v1/": basicAuth("hub-user", "hub-pass"),
+		"ghcr.io":                     basicAuth("gh-user", "gh-pass"),
+	})
+
+	auth, username, err := authFromSecret(*secret, "index.docker.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(username).To(Equal("hub-user"))
+	config, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config.Password).To(Equal("hub-pass"))
+
+	auth, username, err = authFromSecret(*secret, "ghcr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).ToNot(BeNil())
+	g.Expect(username).To(Equal("gh-user"))
+
+	auth, _, err = authFromSecret(*secret, "quay.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(auth).To(BeNil())
+
+	_, _, err = authFromSecret(corev1.Secret{}, "ghcr.io")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestAuthFromSecretDockerHubAliases(t *testing.T) {
+	// Docker Hub goes by several names, and `kubectl create secret
+	// docker-registry` uses the URL form by default
+	for _, key := range []string{
+		"https://index.docker.io/v1/",
+		"index.docker.io",
+		"docker.io",
+		"https://docker.io",
+		"registry-1.docker.io",
+		"https://registry-1.docker.io/v2/",
+	} {
+		t.Run(key, func(t *testing.T) {
+			g := NewWithT(t)
+			secret := dockerConfigSecret("creds", map[string]string{
+				key: basicAuth("hub-user", "hub-pass"),
+			})
+			ref, err := name.ParseReference("library/alpine")
+			g.Expect(err).ToNot(HaveOccurred())
+			auth, username, err := authFromSecret(*secret, ref.Context().RegistryStr())
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth).ToNot(BeNil())
+			g.Expect(username).To(Equal("hub-user"))
+
+			// the aliases are only for Docker Hub
+			auth, _, err = authFromSecret(*secret, "ghcr.io")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(auth).To(BeNil())
+		})
+	}
+}
+
+func TestAuthFromSecretPrefersExactHost(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := dockerConfigSecret("creds", map[string]string{
+		"docker.io":       basicAuth("alias-user", "alias-pass"),
+		"index.docker.io": basicAuth("hub-user", "hub-pass"),
+	})
+	_, username, err := authFromSecret(*secret, "index.docker.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(username).To(Equal("hub-user"))
+}
+
+func TestAuthFromBasicAuthSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	secret := corev1.Secret{
+		Type: corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("harbor-user"),
+			corev1.BasicAuthPasswordKey: []byte("harbor-pass"),
+		},
+	}
+	secret.Name = "basic"
+
+	// it's used for whichever registry
+	for _, registry := range []string{"harbor.example.com", "ghcr.io"} {
+		auth, username, err := authFromSecret(secret, registry)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(username).To(Equal("harbor-user"))
+		config, err := auth.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(config.Username).To(Equal("harbor-user"))
+		g.Expect(config.Password).To(Equal("harbor-pass"))
+	}
+
+	delete(secret.Data, corev1.BasicAuthPasswordKey)
+	_, _, err := authFromSecret(secret, "harbor.example.com")
+	g.Expect(err).To(MatchError(ContainSubstring(`must have both "username" and "password" keys`)))
+}
+
+func TestAuthFromSecretRejectsUnknownType(t *testing.T) {
+	g := NewWithT(t)
+
+	// an Opaque secret isn't taken as a docker config secret, even
+	// with the key for one
+	secret := dockerConfigSecret("opaque", map[string]string{
+		"ghcr.io": basicAuth("gh-user", "gh-pass"),
+	})
+	secret.Type = corev1.SecretTypeOpaque
+	_, _, err := authFromSecret(*secret, "ghcr.io")
+	g.Expect(err).To(MatchError(ContainSubstring(`unknown secret type "Opaque"`)))
+
+	secret.Type = corev1.SecretTypeTLS
+	_, _, err = authFromSecret(*secret, "ghcr.io")
+	g.Expect(err).To(MatchError(ContainSubstring("unknown secret type")))
+}
+
+func TestScanRecordsCredentials(t *testing.T) {
+	g := NewWithT(t)
+
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	})
+	public := httptest.NewServer(stub)
+	defer public.Close()
+	publicHost := strings.TrimPrefix(public.URL, "http://")
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "scanner" || password != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer private.Close()
+	privateHost := strings.TrimPrefix(private.URL, "http://")
+
+	r := &ImageRepositoryReconciler{
+		Client: fake.NewFakeClient(
+			dockerConfigSecret("registry-creds", map[string]string{privateHost: basicAuth("scanner", "hunter2")}),
+			dockerConfigSecret("other-creds", map[string]string{"quay.io": basicAuth("someone", "else")}),
+		),
+		Log:      ctrl.Log,
+		Database: NewDatabase(),
+	}
+	scan := func(image string, secretRef *corev1.LocalObjectReference) (imagev1alpha1.ImageRepository, error) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     image,
+				SecretRef: secretRef,
+			},
+		}
+		repo.Namespace = "default"
+		repo.Name = "scanned"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	repo, err := scan(publicHost+"/app", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source: imagev1alpha1.AnonymousCredentials,
+	}))
+
+	repo, err = scan(privateHost+"/app", &corev1.LocalObjectReference{Name: "registry-creds"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:     imagev1alpha1.SecretCredentials,
+		SecretName: "registry-creds",
+		Username:   "scanner",
+	}))
+
+	// a secret without credentials for the registry falls back to
+	// anonymous access, and that is what's recorded
+	repo, err = scan(publicHost+"/app", &corev1.LocalObjectReference{Name: "other-creds"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.AnonymousCredentials))
+
+	_, err = scan(privateHost+"/app", &corev1.LocalObjectReference{Name: "other-creds"})
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = scan(privateHost+"/app", &corev1.LocalObjectReference{Name: "missing"})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestScanWithServiceAccount(t *testing.T) {
+	g := NewWithT(t)
+
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	})
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer private.Close()
+	privateHost := strings.TrimPrefix(private.URL, "http://")
+
+	sa := &corev1.ServiceAccount{
+		ImagePullSecrets: []corev1.LocalObjectReference{
+			{Name: "missing"},
+			{Name: "other-creds"},
+			{Name: "registry-creds"},
+		},
+	}
+	sa.Name = "scanner"
+	sa.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client: fake.NewFakeClient(
+			sa,
+			dockerConfigSecret("registry-creds", map[string]string{privateHost: basicAuth("scanner", "hunter2")}),
+			dockerConfigSecret("other-creds", map[string]string{"quay.io": basicAuth("someone", "else")}),
+			dockerConfigSecret("explicit-creds", map[string]string{privateHost: basicAuth("explicit", "hunter2")}),
+		),
+		Log:      ctrl.Log,
+		Database: NewDatabase(),
+	}
+	image := privateHost + "/app"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	scan := func(serviceAccount string, secretRef *corev1.LocalObjectReference) (imagev1alpha1.ImageRepository, error) {
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:              image,
+				ServiceAccountName: serviceAccount,
+				SecretRef:          secretRef,
+			},
+		}
+		repo.Namespace = "default"
+		repo.Name = "scanned"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// the first pull secret with credentials for the registry is
+	// used, passing over any that don't exist
+	repo, err := scan("scanner", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:     imagev1alpha1.ServiceAccountCredentials,
+		SecretName: "registry-creds",
+		Username:   "scanner",
+	}))
+
+	// a secret given explicitly takes precedence
+	repo, err = scan("scanner", &corev1.LocalObjectReference{Name: "explicit-creds"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.SecretCredentials))
+	g.Expect(repo.Status.LastScanResult.Credentials.Username).To(Equal("explicit"))
+
+	_, err = scan("nobody", nil)
+	g.Expect(err).To(MatchError(ContainSubstring(`unable to get service account "nobody"`)))
+}
+
+func TestScanWithInlineAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	})
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		basicOK := ok && username == "scanner" && password == "hunter2"
+		if !basicOK && r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer private.Close()
+	privateHost := strings.TrimPrefix(private.URL, "http://")
+
+	r := &ImageRepositoryReconciler{
+		Client: fake.NewFakeClient(
+			dockerConfigSecret("registry-creds", map[string]string{privateHost: basicAuth("scanner", "hunter2")}),
+		),
+		Log:      ctrl.Log,
+		Database: NewDatabase(),
+	}
+	ref, err := name.ParseReference(privateHost + "/app")
+	g.Expect(err).ToNot(HaveOccurred())
+	scan := func(inline *imagev1alpha1.InlineAuth, secretRef *corev1.LocalObjectReference) (imagev1alpha1.ImageRepository, error) {
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:      privateHost + "/app",
+				InlineAuth: inline,
+				SecretRef:  secretRef,
+			},
+		}
+		repo.Namespace = "default"
+		repo.Name = "inline"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// inline credentials are refused by default
+	repo, err := scan(&imagev1alpha1.InlineAuth{Username: "scanner", Password: "hunter2"}, nil)
+	g.Expect(err).To(MatchError(errInlineAuthDisabled))
+	ready := readyCondition(repo)
+	g.Expect(ready).ToNot(BeNil())
+	g.Expect(ready.Reason).To(Equal(imagev1alpha1.InlineAuthDisabledReason))
+
+	r.AllowInlineAuth = true
+	repo, err = scan(&imagev1alpha1.InlineAuth{Username: "scanner", Password: "hunter2"}, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.InlineCredentials,
+		Username: "scanner",
+	}))
+
+	repo, err = scan(&imagev1alpha1.InlineAuth{Token: "s3cret"}, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source: imagev1alpha1.InlineCredentials,
+	}))
+
+	_, err = scan(&imagev1alpha1.InlineAuth{Username: "scanner", Password: "wrong"}, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	// it's one or the other
+	_, err = scan(&imagev1alpha1.InlineAuth{Username: "scanner", Password: "hunter2", Token: "s3cret"}, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("either a username and password, or a token")))
+	_, err = scan(&imagev1alpha1.InlineAuth{}, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	// a secret is preferred
+	repo, err = scan(&imagev1alpha1.InlineAuth{Username: "scanner", Password: "wrong"},
+		&corev1.LocalObjectReference{Name: "registry-creds"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.SecretCredentials))
+}
+
+func TestECRRegion(t *testing.T) {
+	g := NewWithT(t)
+	for host, region := range map[string]string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com":          "eu-west-1",
+		"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com": "us-gov-west-1",
+		"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn":      "cn-north-1",
+	} {
+		r, ok := ecrRegion(host)
+		g.Expect(ok).To(BeTrue(), host)
+		g.Expect(r).To(Equal(region))
+	}
+	for _, host := range []string{
+		"public.ecr.aws",
+		"index.docker.io",
+		"12345.dkr.ecr.eu-west-1.amazonaws.com",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com.example.com",
+	} {
+		_, ok := ecrRegion(host)
+		g.Expect(ok).To(BeFalse(), host)
+	}
+}
+
+// hostRewriter sends all requests to the server given, whichever
+// host they are for.
+type hostRewriter struct {
+	host string
+}
+
+func (rt *hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = rt.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestScanWithECRAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("AWS", "ecr-token")
+	defer reg.Close()
+	_, err := reg.pushImages("app", "v1", "v2")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var regions []string
+	r := &ImageRepositoryReconciler{
+		Client: fake.NewFakeClient(dockerConfigSecret("registry-creds", map[string]string{
+			"123456789012.dkr.ecr.eu-west-1.amazonaws.com": basicAuth("AWS", "ecr-token"),
+		})),
+		Log:       ctrl.Log,
+		Database:  NewDatabase(),
+		Transport: &hostRewriter{host: reg.host()},
+		ecrToken: func(_ context.Context, region string) (string, string, error) {
+			regions = append(regions, region)
+			return "AWS", "ecr-token", nil
+		},
+	}
+	scan := func(image, provider string, secretRef *corev1.LocalObjectReference) (imagev1alpha1.ImageRepository, error) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     image,
+				Provider:  provider,
+				SecretRef: secretRef,
+			},
+		}
+		repo.Namespace = "default"
+		repo.Name = "ecr"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// an image hosted by ECR uses a token got afresh for each scan
+	ecrImage := "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app"
+	repo, err := scan(ecrImage, "", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.AWSCredentials,
+		Username: "AWS",
+	}))
+	g.Expect(regions).ToNot(BeEmpty())
+	g.Expect(regions[0]).To(Equal("eu-west-1"))
+	fetched := len(regions)
+	_, err = scan(ecrImage, imagev1alpha1.AWSProvider, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(len(regions)).To(BeNumerically(">", fetched))
+
+	// failing to get a token fails the scan
+	r.ecrToken = func(context.Context, string) (string, string, error) {
+		return "", "", fmt.Errorf("no credentials")
+	}
+	_, err = scan(ecrImage, "", nil)
+	g.Expect(err).To(MatchError(ContainSubstring("no credentials")))
+
+	// a secret is used if given, unless the provider says otherwise
+	secretRef := &corev1.LocalObjectReference{Name: "registry-creds"}
+	repo, err = scan(ecrImage, "", secretRef)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.SecretCredentials))
+	_, err = scan(ecrImage, imagev1alpha1.AWSProvider, secretRef)
+	g.Expect(err).To(MatchError(ContainSubstring("no credentials")))
+
+	// and the provider can only be used with ECR
+	_, err = scan(reg.host()+"/app", imagev1alpha1.AWSProvider, nil)
+	g.Expect(err).To(MatchError(ContainSubstring("is not an ECR registry")))
+}
+
+func TestIsGCPHost(t *testing.T) {
+	g := NewWithT(t)
+	for _, host := range []string{"gcr.io", "eu.gcr.io", "us-central1-docker.pkg.dev"} {
+		g.Expect(isGCPHost(host)).To(BeTrue(), host)
+	}
+	for _, host := range []string{"index.docker.io", "notgcr.io", "pkg.dev.example.com"} {
+		g.Expect(isGCPHost(host)).To(BeFalse(), host)
+	}
+}
+
+// countingTokenSource gives the same token each time, counting how
+// many times it's asked.
+type countingTokenSource struct {
+	token string
+	err   error
+	count int
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.count++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &oauth2.Token{AccessToken: s.token}, nil
+}
+
+func TestScanWithGCPAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry(gcpUsername, "gcp-token")
+	defer reg.Close()
+	_, err := reg.pushImages("app", "v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tokens := &countingTokenSource{token: "gcp-token"}
+	r := &ImageRepositoryReconciler{
+		Client:    fake.NewFakeClient(),
+		Log:       ctrl.Log,
+		Database:  NewDatabase(),
+		Transport: &hostRewriter{host: reg.host()},
+		gcpTokens: tokens,
+	}
+	scan := func(image, provider string) (imagev1alpha1.ImageRepository, error) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: image, Provider: provider},
+		}
+		repo.Namespace = "default"
+		repo.Name = "gcp"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	for _, image := range []string{"gcr.io/app", "europe-west1-docker.pkg.dev/app"} {
+		repo, err := scan(image, imagev1alpha1.GCPProvider)
+		g.Expect(err).ToNot(HaveOccurred(), image)
+		g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(1))
+		g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+			Source:   imagev1alpha1.GCPCredentials,
+			Username: gcpUsername,
+		}))
+	}
+	g.Expect(tokens.count).To(BeNumerically(">=", 2))
+
+	// without the provider, Google registries are scanned anonymously
+	_, err = scan("gcr.io/app", "")
+	g.Expect(err).To(HaveOccurred())
+
+	tokens.err = fmt.Errorf("no credentials")
+	_, err = scan("gcr.io/app", imagev1alpha1.GCPProvider)
+	g.Expect(err).To(MatchError(ContainSubstring("no credentials")))
+
+	_, err = scan(reg.host()+"/app", imagev1alpha1.GCPProvider)
+	g.Expect(err).To(MatchError(ContainSubstring("is not a Google Cloud registry")))
+}
+
+// mapKeychain resolves credentials by registry host.
+type mapKeychain map[string]authn.Authenticator
+
+func (k mapKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k[target.RegistryStr()]; ok {
+		return auth, nil
+	}
+	return authn.Anonymous, nil
+}
+
+func TestScanWithKeychain(t *testing.T) {
+	g := NewWithT(t)
+
+	private := newTestRegistry("node-user", "node-pass")
+	defer private.Close()
+	privateImage, err := private.pushImages("app", "v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	public := newTestRegistry("", "")
+	defer public.Close()
+	publicImage, err := public.pushImages("app", "v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClient(private.credentials("registry-creds")),
+		Log:      ctrl.Log,
+		Database: NewDatabase(),
+	}
+	scan := func(image string, secretRef *corev1.LocalObjectReference) (imagev1alpha1.ImageRepository, error) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: image, SecretRef: secretRef},
+		}
+		repo.Namespace = "default"
+		repo.Name = "keychain"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// without a keychain, there are no credentials to be had
+	_, err = scan(privateImage, nil)
+	g.Expect(err).To(HaveOccurred())
+
+	r.Keychain = mapKeychain{private.host(): private.auth()}
+	repo, err := scan(privateImage, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.KeychainCredentials,
+		Username: "node-user",
+	}))
+
+	// a registry not in the keychain is scanned anonymously
+	repo, err = scan(publicImage, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.AnonymousCredentials))
+
+	// and a secret is preferred
+	repo, err = scan(privateImage, &corev1.LocalObjectReference{Name: "registry-creds"})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.Credentials.Source).To(Equal(imagev1alpha1.SecretCredentials))
+}
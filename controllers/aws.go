@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// ecrHostRegexp matches the hosts of Amazon ECR registries, capturing
+// the region; e.g., `123456789012.dkr.ecr.eu-west-1.amazonaws.com`.
+var ecrHostRegexp = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrRegion returns the region of the ECR registry at the host given,
+// and whether it is one.
+func ecrRegion(host string) (string, bool) {
+	m := ecrHostRegexp.FindStringSubmatch(host)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// ecrTokenFunc gets a username and password for the ECR registries
+// in a region.
+type ecrTokenFunc func(ctx context.Context, region string) (string, string, error)
+
+// fetchECRToken gets a token for the ECR registries in the region
+// using the default AWS credential chain: the environment, shared
+// config, a web identity, then the instance profile.
+func fetchECRToken(ctx context.Context, region string) (string, string, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region)},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	out, err := ecr.New(sess).GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", "", err
+	}
+	if len(out.AuthorizationData) == 0 {
+		return "", "", errors.New("no authorization data returned by ECR")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(out.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return "", "", fmt.Errorf("unable to decode ECR authorization token: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("ECR authorization token is not of the form username:password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// ecrAuthenticator is an Authenticator that gets a token from ECR
+// each time it's asked for credentials, so that a token is never
+// used after it has expired.
+type ecrAuthenticator struct {
+	ctx    context.Context
+	region string
+	token  ecrTokenFunc
+}
+
+func (a *ecrAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	username, password, err := a.token(a.ctx, a.region)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ECR token for region %s: %w", a.region, err)
+	}
+	return &authn.AuthConfig{Username: username, Password: password}, nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const (
+	// azureIMDSTokenURL is where a token for the managed identity of
+	// the node (or pod, with AAD pod identity) is got.
+	azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// azureResource is the resource that AAD tokens are asked for.
+	azureResource = "https://management.azure.com/"
+	// acrUsername is the username that ACR expects along with a
+	// refresh token.
+	acrUsername = "00000000-0000-0000-0000-000000000000"
+	// aadTokenEarlyExpiry is how long before its expiry an AAD token
+	// is got again.
+	aadTokenEarlyExpiry = 5 * time.Minute
+)
+
+// isACRHost says whether the host is that of Azure Container
+// Registry.
+func isACRHost(host string) bool {
+	for _, suffix := range []string{".azurecr.io", ".azurecr.cn", ".azurecr.us"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acrTokenExchanger gets ACR refresh tokens by exchanging an AAD
+// token for the managed identity. The AAD token is kept until it's
+// close to expiry; refresh tokens are short-lived, so one is got for
+// each scan.
+type acrTokenExchanger struct {
+	client *http.Client
+	// imdsURL is where AAD tokens are got from, and clientID names
+	// the managed identity to use, if there's more than one.
+	imdsURL  string
+	clientID string
+	now      func() time.Time
+
+	mu        sync.Mutex
+	aadToken  string
+	aadExpiry time.Time
+}
+
+func newACRTokenExchanger(rt http.RoundTripper) *acrTokenExchanger {
+	return &acrTokenExchanger{
+		client:   &http.Client{Transport: rt, Timeout: defaultScanTimeout},
+		imdsURL:  azureIMDSTokenURL,
+		clientID: os.Getenv("AZURE_CLIENT_ID"),
+		now:      time.Now,
+	}
+}
+
+// defaultACRTokens is used by all scans not given another exchanger,
+// so that they share the AAD token.
+var defaultACRTokens = newACRTokenExchanger(http.DefaultTransport)
+
+// aadAccessToken returns an AAD token for the managed identity, got
+// afresh if the one kept is missing or about to expire.
+func (x *acrTokenExchanger) aadAccessToken(ctx context.Context) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.aadToken != "" && x.now().Before(x.aadExpiry.Add(-aadTokenEarlyExpiry)) {
+		return x.aadToken, nil
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureResource}}
+	if x.clientID != "" {
+		query.Set("client_id", x.clientID)
+	}
+	req, err := http.NewRequest("GET", x.imdsURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := x.do(req.WithContext(ctx), &token); err != nil {
+		return "", fmt.Errorf("unable to get AAD token for managed identity: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no AAD token returned for managed identity")
+	}
+	expiresIn, err := strconv.Atoi(token.ExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse expiry of AAD token: %w", err)
+	}
+	x.aadToken, x.aadExpiry = token.AccessToken, x.now().Add(time.Duration(expiresIn)*time.Second)
+	return x.aadToken, nil
+}
+
+// refreshToken exchanges an AAD token for a refresh token for the
+// registry.
+func (x *acrTokenExchanger) refreshToken(ctx context.Context, registry string) (string, error) {
+	aadToken, err := x.aadAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {aadToken},
+	}
+	req, err := http.NewRequest("POST", "https://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := x.do(req.WithContext(ctx), &token); err != nil {
+		return "", fmt.Errorf("unable to exchange AAD token for ACR refresh token: %w", err)
+	}
+	if token.RefreshToken == "" {
+		return "", errors.New("no refresh token returned by ACR")
+	}
+	return token.RefreshToken, nil
+}
+
+// do makes the request, and decodes the JSON response into v.
+func (x *acrTokenExchanger) do(req *http.Request, v interface{}) error {
+	res, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// acrAuthenticator is an Authenticator that gets a refresh token
+// for the registry each time it's asked for credentials.
+type acrAuthenticator struct {
+	ctx      context.Context
+	registry string
+	tokens   *acrTokenExchanger
+}
+
+func (a *acrAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	token, err := a.tokens.refreshToken(a.ctx, a.registry)
+	if err != nil {
+		return nil, err
+	}
+	return &authn.AuthConfig{Username: acrUsername, Password: token}, nil
+}
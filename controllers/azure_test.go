@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// fakeAzure stands in for the instance metadata service and the ACR
+// token exchange, counting the tokens it hands out.
+type fakeAzure struct {
+	aadTokens     int
+	exchanges     int
+	exchangeFails bool
+	clientID      string
+}
+
+func (f *fakeAzure) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	switch {
+	case req.URL.Host == "169.254.169.254":
+		if req.Header.Get("Metadata") != "true" || req.URL.Query().Get("resource") != azureResource {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		f.clientID = req.URL.Query().Get("client_id")
+		f.aadTokens++
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": fmt.Sprintf("aad-%d", f.aadTokens),
+			"expires_in":   "3600",
+		})
+	case req.URL.Path == "/oauth2/exchange" && req.Method == "POST":
+		if err := req.ParseForm(); err != nil || f.exchangeFails {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.WriteString(`{"errors":[{"code":"UNAUTHORIZED"}]}`)
+			break
+		}
+		if req.PostForm.Get("grant_type") != "access_token" || req.PostForm.Get("service") != req.URL.Host {
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+		f.exchanges++
+		json.NewEncoder(w).Encode(map[string]string{
+			"refresh_token": "refresh-for-" + req.PostForm.Get("access_token"),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return w.Result(), nil
+}
+
+func TestACRTokenExchange(t *testing.T) {
+	g := NewWithT(t)
+
+	azure := &fakeAzure{}
+	now := time.Now()
+	tokens := newACRTokenExchanger(azure)
+	tokens.clientID = "my-identity"
+	tokens.now = func() time.Time { return now }
+
+	token, err := tokens.refreshToken(context.TODO(), "myregistry.azurecr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("refresh-for-aad-1"))
+	g.Expect(azure.clientID).To(Equal("my-identity"))
+
+	// the AAD token is kept, but it's exchanged each time
+	now = now.Add(50 * time.Minute)
+	token, err = tokens.refreshToken(context.TODO(), "myregistry.azurecr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("refresh-for-aad-1"))
+	g.Expect(azure.aadTokens).To(Equal(1))
+	g.Expect(azure.exchanges).To(Equal(2))
+
+	// until it's close to expiry
+	now = now.Add(6 * time.Minute)
+	token, err = tokens.refreshToken(context.TODO(), "myregistry.azurecr.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(token).To(Equal("refresh-for-aad-2"))
+
+	azure.exchangeFails = true
+	_, err = tokens.refreshToken(context.TODO(), "myregistry.azurecr.io")
+	g.Expect(err).To(MatchError(ContainSubstring("UNAUTHORIZED")))
+}
+
+func TestScanWithACRAuth(t *testing.T) {
+	g := NewWithT(t)
+
+	// the refresh token is the password, as ACR expects
+	reg := newTestRegistry(acrUsername, "refresh-for-aad-1")
+	defer reg.Close()
+	_, err := reg.pushImages("app", "v1", "v2")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	azure := &fakeAzure{}
+	r := &ImageRepositoryReconciler{
+		Client:    fake.NewFakeClient(),
+		Log:       ctrl.Log,
+		Database:  NewDatabase(),
+		Transport: &hostRewriter{host: reg.host()},
+		acrTokens: newACRTokenExchanger(azure),
+	}
+	scan := func(image, provider string) (imagev1alpha1.ImageRepository, error) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: image, Provider: provider},
+		}
+		repo.Namespace = "default"
+		repo.Name = "acr"
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	repo, err := scan("myregistry.azurecr.io/app", imagev1alpha1.AzureProvider)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+		Source:   imagev1alpha1.AzureCredentials,
+		Username: acrUsername,
+	}))
+
+	// a refresh token is got for each scan
+	exchanges := azure.exchanges
+	_, err = scan("myregistry.azurecr.io/app", imagev1alpha1.AzureProvider)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(azure.exchanges).To(BeNumerically(">", exchanges))
+	g.Expect(azure.aadTokens).To(Equal(1))
+
+	azure.exchangeFails = true
+	_, err = scan("myregistry.azurecr.io/app", imagev1alpha1.AzureProvider)
+	g.Expect(err).To(MatchError(ContainSubstring("unable to exchange AAD token")))
+
+	_, err = scan(reg.host()+"/app", imagev1alpha1.AzureProvider)
+	g.Expect(err).To(MatchError(ContainSubstring("is not an Azure Container Registry")))
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFileName is the name of the file the persistent database is
+// kept in, within the storage path given.
+const boltFileName = "tags.db"
+
+var (
+	tagsBucket      = []byte("tags")
+	digestsBucket   = []byte("digests")
+	platformsBucket = []byte("platforms")
+	// tagIndexBucket has a bucket for each repo, with a key for each
+	// of its tags, so a tag can be looked up without reading them
+	// all.
+	tagIndexBucket = []byte("tagindex")
+	tagTimesBucket = []byte("tagtimes")
+)
+
+// BoltDatabase is a database kept in a file on disk, so that the
+// tags recorded survive the controller restarting, and image
+// repositories aren't all scanned again straight away. It's safe for
+// use by concurrent reconciles.
+type BoltDatabase struct {
+	db *bolt.DB
+}
+
+// NewBoltDatabase opens the database in the directory given,
+// creating it if need be. Only one process can have the database
+// open at a time; if another does, this gives up after a while
+// rather than waiting indefinitely.
+func NewBoltDatabase(dir string) (*BoltDatabase, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, boltFileName), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database in %s: %w", dir, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{tagsBucket, digestsBucket, platformsBucket, tagIndexBucket, tagTimesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{db: db}, nil
+}
+
+// Close closes the database file.
+func (b *BoltDatabase) Close() error {
+	return b.db.Close()
+}
+
+// Tags returns the tags recorded for the repo.
+func (b *BoltDatabase) Tags(repo string) ([]string, error) {
+	var tags []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(tagsBucket), repo, &tags)
+	})
+	return tags, err
+}
+
+// HasTag says whether the tag is recorded for the repo, by looking
+// it up in the repo's index of tags. There's an index for every repo
+// with tags recorded, even none, so a repo without one has no tags.
+func (b *BoltDatabase) HasTag(repo, tag string) (bool, error) {
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if index := tx.Bucket(tagIndexBucket).Bucket([]byte(repo)); index != nil {
+			found = index.Get([]byte(tag)) != nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// SetTags records the tags for the repo, replacing any previously
+// recorded along with their digests.
+func (b *BoltDatabase) SetTags(ctx context.Context, repo string, tags []string) error {
+	return b.SetTagsWithDigests(ctx, repo, tags, nil)
+}
+
+// SetTagsWithDigests records the tags for the repo, as SetTags does,
+// along with the digest for each tag in digests; it needn't give a
+// digest for every tag. Both are written together, or neither is.
+func (b *BoltDatabase) SetTagsWithDigests(ctx context.Context, repo string, tags []string, digests map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(tagsBucket), repo, tags); err != nil {
+			return err
+		}
+		if err := putTagIndex(tx.Bucket(tagIndexBucket), repo, tags); err != nil {
+			return err
+		}
+		if len(digests) == 0 {
+			return tx.Bucket(digestsBucket).Delete([]byte(repo))
+		}
+		return putJSON(tx.Bucket(digestsBucket), repo, digests)
+	})
+}
+
+// TagDigest returns the digest recorded for the tag in the repo; or
+// an empty string, if there is none or it can't be read.
+func (b *BoltDatabase) TagDigest(repo, tag string) string {
+	var digests map[string]string
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(digestsBucket), repo, &digests)
+	}); err != nil {
+		return ""
+	}
+	return digests[tag]
+}
+
+// TagPlatforms returns the platforms recorded for the tag in the
+// repo; or none, if they can't be read.
+func (b *BoltDatabase) TagPlatforms(repo, tag string) []string {
+	var platforms map[string][]string
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(platformsBucket), repo, &platforms)
+	}); err != nil {
+		return nil
+	}
+	return platforms[tag]
+}
+
+// SetTagPlatforms records the platforms for each tag in the repo,
+// replacing any previously recorded.
+func (b *BoltDatabase) SetTagPlatforms(ctx context.Context, repo string, platforms map[string][]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(platformsBucket), repo, platforms)
+	})
+}
+
+// TagTimes returns when each of the repo's tags was first and last
+// found by a scan; or none, if they can't be read.
+func (b *BoltDatabase) TagTimes(repo string) map[string]TagTimes {
+	var times map[string]TagTimes
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(tagTimesBucket), repo, &times)
+	}); err != nil {
+		return nil
+	}
+	return times
+}
+
+// SetTagTimes records when each of the repo's tags was first and last
+// found by a scan, replacing any previously recorded.
+func (b *BoltDatabase) SetTagTimes(ctx context.Context, repo string, times map[string]TagTimes) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(tagTimesBucket), repo, times)
+	})
+}
+
+// Delete drops everything recorded for the repo.
+func (b *BoltDatabase) Delete(ctx context.Context, repo string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{tagsBucket, digestsBucket, platformsBucket, tagTimesBucket} {
+			if err := tx.Bucket(bucket).Delete([]byte(repo)); err != nil {
+				return err
+			}
+		}
+		return deleteTagIndex(tx.Bucket(tagIndexBucket), repo)
+	})
+}
+
+// putTagIndex replaces the index of the repo's tags in the bucket
+// given. The index is made even if there are no tags, since HasTag
+// takes a missing index to mean there are none recorded.
+func putTagIndex(bucket *bolt.Bucket, repo string, tags []string) error {
+	if err := deleteTagIndex(bucket, repo); err != nil {
+		return err
+	}
+	index, err := bucket.CreateBucket([]byte(repo))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := index.Put([]byte(tag), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTagIndex drops the index of the repo's tags from the bucket
+// given, if there is one.
+func deleteTagIndex(bucket *bolt.Bucket, repo string) error {
+	if err := bucket.DeleteBucket([]byte(repo)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+// getJSON decodes the value at the key in the bucket into v, leaving
+// v alone if there is no such key.
+func getJSON(bucket *bolt.Bucket, key string, v interface{}) error {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(bucket *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltDatabase(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "bolt-db")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// the directory is created if it's not there
+	path := filepath.Join(dir, "data")
+	db, err := NewBoltDatabase(path)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(db.Tags("repo-a")).To(BeEmpty())
+	g.Expect(db.SetTags(context.TODO(), "repo-a", []string{"a1", "a2"})).To(Succeed())
+	g.Expect(db.SetTagsWithDigests(context.TODO(), "repo-b", []string{"b1"}, map[string]string{"b1": "sha256:b1"})).To(Succeed())
+	g.Expect(db.SetTagPlatforms(context.TODO(), "repo-a", map[string][]string{"a1": {"linux/amd64"}})).To(Succeed())
+	seen := time.Unix(1600000000, 0).UTC()
+	times := map[string]TagTimes{"a1": {FirstSeen: seen, LastSeen: seen.Add(time.Hour)}}
+	g.Expect(db.SetTagTimes(context.TODO(), "repo-a", times)).To(Succeed())
+	g.Expect(db.SetTagTimes(context.TODO(), "repo-b", times)).To(Succeed())
+	g.Expect(db.Tags("repo-a")).To(Equal([]string{"a1", "a2"}))
+	g.Expect(db.TagPlatforms("repo-a", "a1")).To(Equal([]string{"linux/amd64"}))
+	g.Expect(db.TagPlatforms("repo-a", "a2")).To(BeEmpty())
+	g.Expect(db.TagDigest("repo-b", "b1")).To(Equal("sha256:b1"))
+	g.Expect(db.TagDigest("repo-a", "a1")).To(BeEmpty())
+
+	g.Expect(db.Delete(context.TODO(), "repo-b")).To(Succeed())
+	g.Expect(db.Tags("repo-b")).To(BeEmpty())
+	g.Expect(db.TagDigest("repo-b", "b1")).To(BeEmpty())
+	g.Expect(db.TagTimes("repo-b")).To(BeEmpty())
+
+	// what's recorded is there when the database is opened again
+	g.Expect(db.Close()).To(Succeed())
+	db, err = NewBoltDatabase(path)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+	g.Expect(db.Tags("repo-a")).To(Equal([]string{"a1", "a2"}))
+	g.Expect(db.TagPlatforms("repo-a", "a1")).To(Equal([]string{"linux/amd64"}))
+	g.Expect(db.TagTimes("repo-a")).To(Equal(times))
+
+	// a cancelled write isn't made
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	g.Expect(db.SetTags(ctx, "repo-a", nil)).ToNot(Succeed())
+	g.Expect(db.Tags("repo-a")).To(HaveLen(2))
+}
+
+func TestBoltDatabaseConcurrentWrites(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "bolt-db")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	db, err := NewBoltDatabase(dir)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repo := fmt.Sprintf("repo-%d", i)
+			for j := 0; j < 10; j++ {
+				if err := db.SetTags(context.TODO(), repo, []string{fmt.Sprintf("%d", j)}); err != nil {
+					t.Error(err)
+				}
+				if _, err := db.Tags(repo); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		g.Expect(db.Tags(fmt.Sprintf("repo-%d", i))).To(Equal([]string{"9"}))
+	}
+}
+
+func TestBoltDatabaseHasTag(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "bolt-db")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	db, err := NewBoltDatabase(dir)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer db.Close()
+
+	g.Expect(db.HasTag("repo-a", "a1")).To(BeFalse())
+	g.Expect(db.SetTags(context.TODO(), "repo-a", []string{"a1", "a2"})).To(Succeed())
+	g.Expect(db.HasTag("repo-a", "a1")).To(BeTrue())
+	g.Expect(db.HasTag("repo-a", "a3")).To(BeFalse())
+
+	// the index is replaced along with the tags
+	g.Expect(db.SetTags(context.TODO(), "repo-a", []string{"a2", "a3"})).To(Succeed())
+	g.Expect(db.HasTag("repo-a", "a1")).To(BeFalse())
+	g.Expect(db.HasTag("repo-a", "a3")).To(BeTrue())
+
+	g.Expect(db.Delete(context.TODO(), "repo-a")).To(Succeed())
+	g.Expect(db.HasTag("repo-a", "a2")).To(BeFalse())
+
+	// a repo with no tags still has an index
+	g.Expect(db.SetTags(context.TODO(), "repo-b", nil)).To(Succeed())
+	g.Expect(db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(tagIndexBucket).Bucket([]byte("repo-b")) == nil {
+			return errors.New("no index for repo-b")
+		}
+		return nil
+	})).To(Succeed())
+	g.Expect(db.HasTag("repo-b", "b1")).To(BeFalse())
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// scanBudgetRemaining has a series for each registry and account that
+// has been scanned under a limit, giving the scans left in the
+// budget. It goes below zero when scans are waiting for their turn.
+var scanBudgetRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "image_reflector_scan_budget_remaining",
+	Help: "The scans left in the shared budget for each registry and account; negative when scans are waiting.",
+}, []string{"registry", "account"})
+
+func init() {
+	metrics.Registry.MustRegister(scanBudgetRemaining)
+}
+
+// ScanLimit is the most scans of a registry allowed, per account,
+// in a period.
+type ScanLimit struct {
+	Scans  int
+	Period time.Duration
+}
+
+// ParseScanLimits parses a comma-separated list of limits, each of
+// the form `<registry>=<scans>/<period>`; e.g.,
+// `index.docker.io=200/6h`.
+func ParseScanLimits(limits string) (map[string]ScanLimit, error) {
+	parsed := map[string]ScanLimit{}
+	for _, entry := range strings.Split(limits, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("scan limit %q is not of the form <registry>=<scans>/<period>", entry)
+		}
+		rate := strings.SplitN(parts[1], "/", 2)
+		if len(rate) != 2 {
+			return nil, fmt.Errorf("scan limit %q is not of the form <registry>=<scans>/<period>", entry)
+		}
+		scans, err := strconv.Atoi(rate[0])
+		if err != nil || scans < 1 {
+			return nil, fmt.Errorf("scan limit %q: number of scans must be a positive integer", entry)
+		}
+		period, err := time.ParseDuration(rate[1])
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("scan limit %q: period must be a positive duration", entry)
+		}
+		parsed[parts[0]] = ScanLimit{Scans: scans, Period: period}
+	}
+	return parsed, nil
+}
+
+// budgetKey identifies a budget: rate limits are per account, so all
+// image repositories scanned with the same account on a registry
+// draw from the same budget, whichever secret the credentials come
+// from. Anonymous scans have an empty account.
+type budgetKey struct {
+	registry string
+	account  string
+}
+
+// bucket is a token bucket, with a token for each scan. It may go
+// into debt, when scans are given a turn in the future.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+const (
+	// activityWeight is the weight given to the latest scan of an
+	// image repository in its activity, against that of the scans
+	// before it.
+	activityWeight = 0.3
+	// maxPassedOver is the most times a waiting scan can have its
+	// turn taken by a more active image repository.
+	maxPassedOver = 5
+)
+
+// turn is when an image repository waiting on a budget may scan.
+type turn struct {
+	at  time.Time
+	key budgetKey
+	// passedOver counts the times the turn has been put back, to let
+	// a more active image repository go first.
+	passedOver int
+}
+
+// ScanBudget paces the scans of image repositories that share an
+// account on a registry, so that their combined rate stays within
+// the registry's limit. Each scan takes a turn from the budget for
+// its registry and account; if there's none left, it's given a time
+// to come back, after the scans already waiting, and its turn is
+// kept for it until then. Registries without a limit aren't paced.
+//
+// If PrioritizeActive is set, a scan that has to wait goes ahead of
+// those waiting for image repositories less active than its own. An
+// image repository's activity is a moving average of how often its
+// scans find the tags changed, weighting recent scans more; one not
+// yet seen to change counts as inactive. The times of the turns are
+// kept, so the pace is the same; a scan put back finds out when it
+// comes back for its turn. So that the least active image
+// repositories still get scanned, a turn is put back at most five
+// times.
+type ScanBudget struct {
+	limits map[string]ScanLimit
+	// PrioritizeActive gives the earlier turns to the image
+	// repositories whose scans most often find the tags changed.
+	PrioritizeActive bool
+
+	mu      sync.Mutex
+	buckets map[budgetKey]*bucket
+	// turns records, for image repositories told to come back later,
+	// when their turn is.
+	turns map[types.NamespacedName]turn
+	// activity records, for each image repository scanned, the
+	// moving average of changes found per scan.
+	activity map[types.NamespacedName]float64
+}
+
+// NewScanBudget returns a budget enforcing the limits given, keyed
+// by registry host (e.g., `index.docker.io`).
+func NewScanBudget(limits map[string]ScanLimit) *ScanBudget {
+	return &ScanBudget{
+		limits:   limits,
+		buckets:  map[budgetKey]*bucket{},
+		turns:    map[types.NamespacedName]turn{},
+		activity: map[types.NamespacedName]float64{},
+	}
+}
+
+// observe records whether a scan of the image repository found its
+// tags changed, in the repository's activity.
+func (b *ScanBudget) observe(repo types.NamespacedName, changed bool) {
+	var sample float64
+	if changed {
+		sample = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.activity[repo] = (1-activityWeight)*b.activity[repo] + activityWeight*sample
+}
+
+// forget drops what's recorded for the image repository; e.g., when
+// it's deleted.
+func (b *ScanBudget) forget(repo types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.activity, repo)
+	delete(b.turns, repo)
+}
+
+// reserve takes a turn to scan the image repository given, and
+// returns how long to wait before scanning; zero means the scan can
+// go ahead now. Calling it again for the same image repository
+// before its turn doesn't take another turn.
+func (b *ScanBudget) reserve(repo types.NamespacedName, registry, account string, now time.Time) time.Duration {
+	limit, ok := b.limits[registry]
+	if !ok {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if turn, ok := b.turns[repo]; ok {
+		if wait := turn.at.Sub(now); wait > 0 {
+			return wait
+		}
+		delete(b.turns, repo)
+		return 0
+	}
+
+	key := budgetKey{registry: registry, account: account}
+	perScan := limit.Period / time.Duration(limit.Scans)
+	bkt, ok := b.buckets[key]
+	if !ok {
+		bkt = &bucket{tokens: float64(limit.Scans), updated: now}
+		b.buckets[key] = bkt
+	}
+	if elapsed := now.Sub(bkt.updated); elapsed > 0 {
+		bkt.tokens += float64(elapsed) / float64(perScan)
+		if bkt.tokens > float64(limit.Scans) {
+			bkt.tokens = float64(limit.Scans)
+		}
+		bkt.updated = now
+	}
+
+	bkt.tokens--
+	scanBudgetRemaining.WithLabelValues(registry, account).Set(bkt.tokens)
+	if bkt.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-bkt.tokens * float64(perScan))
+	b.turns[repo] = turn{at: now.Add(wait), key: key}
+	if b.PrioritizeActive {
+		b.prioritize(repo)
+	}
+	return b.turns[repo].at.Sub(now)
+}
+
+// prioritize moves the turn just given to the image repository ahead
+// of those waiting on the same budget for less active image
+// repositories, swapping times with each; a turn already put back
+// maxPassedOver times is not passed.
+func (b *ScanBudget) prioritize(repo types.NamespacedName) {
+	key := b.turns[repo].key
+	var queue []types.NamespacedName
+	for name, t := range b.turns {
+		if t.key == key && name != repo {
+			queue = append(queue, name)
+		}
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return b.turns[queue[i]].at.Before(b.turns[queue[j]].at)
+	})
+
+	activity := b.activity[repo]
+	for i := len(queue) - 1; i >= 0; i-- {
+		ahead := b.turns[queue[i]]
+		if ahead.passedOver >= maxPassedOver || b.activity[queue[i]] >= activity {
+			break
+		}
+		mine := b.turns[repo]
+		b.turns[repo] = turn{at: ahead.at, key: key}
+		b.turns[queue[i]] = turn{at: mine.at, key: key, passedOver: ahead.passedOver + 1}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestParseScanLimits(t *testing.T) {
+	g := NewWithT(t)
+
+	limits, err := ParseScanLimits("index.docker.io=200/6h, ghcr.io=10/1m")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(limits).To(Equal(map[string]ScanLimit{
+		"index.docker.io": {Scans: 200, Period: 6 * time.Hour},
+		"ghcr.io":         {Scans: 10, Period: time.Minute},
+	}))
+
+	for _, bad := range []string{"index.docker.io", "=1/1h", "index.docker.io=200", "index.docker.io=0/1h", "index.docker.io=1/never"} {
+		_, err := ParseScanLimits(bad)
+		g.Expect(err).To(HaveOccurred(), bad)
+	}
+}
+
+func TestScanBudgetSharedAccount(t *testing.T) {
+	g := NewWithT(t)
+
+	const registry = "budget.example.com"
+	budget := NewScanBudget(map[string]ScanLimit{
+		registry: {Scans: 2, Period: time.Minute},
+	})
+	repo := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+	now := time.Now()
+
+	// two scans are in the budget; the rest are given turns, one
+	// every 30s, between them
+	g.Expect(budget.reserve(repo("a"), registry, "alice", now)).To(BeZero())
+	g.Expect(budget.reserve(repo("b"), registry, "alice", now)).To(BeZero())
+	g.Expect(budget.reserve(repo("c"), registry, "alice", now)).To(Equal(30 * time.Second))
+	g.Expect(budget.reserve(repo("d"), registry, "alice", now)).To(Equal(time.Minute))
+	g.Expect(testutil.ToFloat64(scanBudgetRemaining.WithLabelValues(registry, "alice"))).To(Equal(-2.0))
+
+	// another account, or a registry without a limit, isn't held up
+	g.Expect(budget.reserve(repo("e"), registry, "bob", now)).To(BeZero())
+	g.Expect(budget.reserve(repo("f"), "other.example.com", "alice", now)).To(BeZero())
+
+	// coming back early doesn't take another turn
+	g.Expect(budget.reserve(repo("c"), registry, "alice", now.Add(10*time.Second))).To(Equal(20 * time.Second))
+	g.Expect(budget.reserve(repo("c"), registry, "alice", now.Add(30*time.Second))).To(BeZero())
+	g.Expect(budget.reserve(repo("d"), registry, "alice", now.Add(time.Minute))).To(BeZero())
+
+	// over a longer stretch, the scans between all the image
+	// repositories stay within the limit
+	scansAt := map[time.Duration]int{}
+	next := map[string]time.Time{}
+	names := []string{"a", "b", "c", "d", "g", "h"}
+	start := now.Add(time.Minute)
+	for t := time.Duration(0); t < 10*time.Minute; t += time.Second {
+		at := start.Add(t)
+		for _, n := range names {
+			if at.Before(next[n]) {
+				continue
+			}
+			if wait := budget.reserve(repo(n), registry, "alice", at); wait > 0 {
+				next[n] = at.Add(wait)
+				continue
+			}
+			scansAt[t]++
+			next[n] = at.Add(time.Second)
+		}
+	}
+	for t := time.Duration(0); t+time.Minute <= 10*time.Minute; t += time.Second {
+		var inWindow int
+		for at, n := range scansAt {
+			if at >= t && at < t+time.Minute {
+				inWindow += n
+			}
+		}
+		// a full bucket can be spent just before a minute's worth
+		// of scans is let through
+		g.Expect(inWindow).To(BeNumerically("<=", 2+2), "window starting at %s", t)
+	}
+	var total int
+	for _, n := range scansAt {
+		total += n
+	}
+	g.Expect(total).To(BeNumerically(">=", 19))
+}
+
+func TestScanBudgetPrioritizesActiveRepositories(t *testing.T) {
+	g := NewWithT(t)
+
+	const registry = "busy.example.com"
+	budget := NewScanBudget(map[string]ScanLimit{
+		registry: {Scans: 1, Period: 10 * time.Second},
+	})
+	budget.PrioritizeActive = true
+	repo := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+	// "active" has found new tags in most of its scans; "quiet"
+	// never has, and the others haven't been seen to change
+	for _, changed := range []bool{true, true, false, true} {
+		budget.observe(repo("active"), changed)
+		budget.observe(repo("quiet"), false)
+	}
+	now := time.Now()
+
+	g.Expect(budget.reserve(repo("first"), registry, "", now)).To(BeZero())
+	g.Expect(budget.reserve(repo("quiet"), registry, "", now)).To(Equal(10 * time.Second))
+	g.Expect(budget.reserve(repo("idle"), registry, "", now)).To(Equal(20 * time.Second))
+
+	// under contention, the active image repository goes ahead of
+	// those waiting, taking the earliest turn
+	g.Expect(budget.reserve(repo("active"), registry, "", now)).To(Equal(10 * time.Second))
+	// the others find out they've been put back when they come for
+	// their turn
+	g.Expect(budget.reserve(repo("quiet"), registry, "", now.Add(10*time.Second))).To(Equal(10 * time.Second))
+	g.Expect(budget.reserve(repo("idle"), registry, "", now.Add(20*time.Second))).To(Equal(10 * time.Second))
+	g.Expect(budget.reserve(repo("active"), registry, "", now.Add(10*time.Second))).To(BeZero())
+
+	// without priority, it's first come, first served
+	fifo := NewScanBudget(map[string]ScanLimit{
+		registry: {Scans: 1, Period: 10 * time.Second},
+	})
+	fifo.observe(repo("active"), true)
+	g.Expect(fifo.reserve(repo("first"), registry, "", now)).To(BeZero())
+	g.Expect(fifo.reserve(repo("quiet"), registry, "", now)).To(Equal(10 * time.Second))
+	g.Expect(fifo.reserve(repo("active"), registry, "", now)).To(Equal(20 * time.Second))
+}
+
+func TestScanBudgetPriorityDoesNotStarve(t *testing.T) {
+	g := NewWithT(t)
+
+	const registry = "busy.example.com"
+	budget := NewScanBudget(map[string]ScanLimit{
+		registry: {Scans: 1, Period: time.Second},
+	})
+	budget.PrioritizeActive = true
+	repo := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+	now := time.Now()
+
+	g.Expect(budget.reserve(repo("first"), registry, "", now)).To(BeZero())
+	g.Expect(budget.reserve(repo("quiet"), registry, "", now)).To(Equal(time.Second))
+	// a stream of more active image repositories can put the quiet
+	// one back only so many times
+	for i := 0; i < maxPassedOver+3; i++ {
+		active := repo(fmt.Sprintf("active-%d", i))
+		budget.observe(active, true)
+		budget.reserve(active, registry, "", now)
+	}
+	g.Expect(budget.reserve(repo("quiet"), registry, "", now)).To(Equal(time.Duration(maxPassedOver+1) * time.Second))
+
+	// a deleted image repository gives up its turn and is forgotten
+	budget.forget(repo("active-0"))
+	g.Expect(budget.activity).ToNot(HaveKey(repo("active-0")))
+	g.Expect(budget.turns).ToNot(HaveKey(repo("active-0")))
+}
+
+func TestScanBudgetPacesReconciles(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var scans int
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		scans++
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	// two secrets for the same account, and one for another account
+	objs := []runtime.Object{
+		dockerConfigSecret("alice-one", map[string]string{registry: basicAuth("alice", "pw")}),
+		dockerConfigSecret("alice-two", map[string]string{registry: basicAuth("alice", "pw")}),
+		dockerConfigSecret("bob", map[string]string{registry: basicAuth("bob", "pw")}),
+	}
+	repos := map[string]string{
+		"one":   "alice-one",
+		"two":   "alice-two",
+		"three": "alice-one",
+		"four":  "bob",
+	}
+	for name, secret := range repos {
+		repo := &imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     registry + "/" + name,
+				SecretRef: &corev1.LocalObjectReference{Name: secret},
+			},
+		}
+		repo.Name = name
+		repo.Namespace = "default"
+		objs = append(objs, repo)
+	}
+
+	c := &secretCountingClient{Client: fake.NewFakeClientWithScheme(s, objs...)}
+	r := &ImageRepositoryReconciler{
+		Client:   c,
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+		ScanBudget: NewScanBudget(map[string]ScanLimit{
+			registry: {Scans: 2, Period: time.Hour},
+		}),
+	}
+
+	var delayed []string
+	for _, name := range []string{"one", "two", "three", "four"} {
+		repoName := types.NamespacedName{Namespace: "default", Name: name}
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+		if repoAfter.Status.LastScanTime == nil {
+			delayed = append(delayed, name)
+			g.Expect(result.RequeueAfter).To(BeNumerically("~", 30*time.Minute, time.Second))
+		}
+	}
+
+	// "three" shares an account with "one" and "two", which used up
+	// the budget; "four" has its own
+	g.Expect(delayed).To(Equal([]string{"three"}))
+	g.Expect(scans).To(Equal(3))
+	// the credentials are resolved once for each reconcile, for both
+	// the budget and the scan
+	g.Expect(c.secretGets).To(Equal(4))
+}
+
+// secretCountingClient counts the secrets got through it.
+type secretCountingClient struct {
+	client.Client
+	mu         sync.Mutex
+	secretGets int
+}
+
+func (c *secretCountingClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		c.mu.Lock()
+		c.secretGets++
+		c.mu.Unlock()
+	}
+	return c.Client.Get(ctx, key, obj)
+}
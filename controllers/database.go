@@ -17,29 +17,206 @@ limitations under the License.
 package controllers
 
 import (
+	"container/list"
+	"context"
 	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
+var databaseEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "image_reflector_database_evictions_total",
+	Help: "Number of image repositories whose tags were evicted from the database to stay within the maximum number of tags stored.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(databaseEvictions)
+}
+
 type database struct {
-	mu       sync.RWMutex
-	repoTags map[string][]string
+	mu            sync.RWMutex
+	repoTags      map[string][]string
+	repoTagSets   map[string]map[string]struct{}
+	repoDigests   map[string]map[string]string
+	repoPlatforms map[string]map[string][]string
+	repoTagTimes  map[string]map[string]TagTimes
+
+	// maxTags is the most tags to store, across all repos; zero means
+	// no limit.
+	maxTags   int
+	totalTags int
+	// scanned orders the repos from least to most recently given tags,
+	// for eviction; elements indexes it by repo.
+	scanned  *list.List
+	elements map[string]*list.Element
 }
 
 func NewDatabase() *database {
+	return NewBoundedDatabase(0)
+}
+
+// NewBoundedDatabase returns a database which stores at most maxTags
+// tags across all repos, or any number if maxTags is zero. When the
+// limit is exceeded, the repos least recently given tags are evicted
+// until it is met again, never evicting the repo just given tags;
+// evicted repos will be rescanned when they are next due.
+func NewBoundedDatabase(maxTags int) *database {
 	return &database{
-		repoTags: map[string][]string{},
+		repoTags:      map[string][]string{},
+		repoTagSets:   map[string]map[string]struct{}{},
+		repoDigests:   map[string]map[string]string{},
+		repoPlatforms: map[string]map[string][]string{},
+		repoTagTimes:  map[string]map[string]TagTimes{},
+		maxTags:       maxTags,
+		scanned:       list.New(),
+		elements:      map[string]*list.Element{},
 	}
 }
 
-func (db *database) Tags(repo string) []string {
+// Tags returns the tags recorded for the repo. It never fails, since
+// the tags are held in memory. The tags are copied, so the caller may
+// do as it likes with them.
+func (db *database) Tags(repo string) ([]string, error) {
 	db.mu.RLock()
-	tags := db.repoTags[repo]
+	var tags []string
+	if recorded, ok := db.repoTags[repo]; ok {
+		tags = append(make([]string, 0, len(recorded)), recorded...)
+	}
+	db.mu.RUnlock()
+	return tags, nil
+}
+
+// HasTag says whether the tag is recorded for the repo. It never
+// fails, since the tags are held in memory.
+func (db *database) HasTag(repo, tag string) (bool, error) {
+	db.mu.RLock()
+	_, ok := db.repoTagSets[repo][tag]
 	db.mu.RUnlock()
-	return tags
+	return ok, nil
 }
 
-func (db *database) SetTags(repo string, tags []string) {
+// SetTags records the tags for the repo, replacing any previously
+// recorded along with their digests, and evicts other repos if that
+// takes the database over its limit. It never fails, since the tags
+// are held in memory.
+func (db *database) SetTags(ctx context.Context, repo string, tags []string) error {
+	return db.SetTagsWithDigests(ctx, repo, tags, nil)
+}
+
+// SetTagsWithDigests records the tags for the repo, as SetTags does,
+// along with the digest for each tag in digests; it needn't give a
+// digest for every tag.
+func (db *database) SetTagsWithDigests(ctx context.Context, repo string, tags []string, digests map[string]string) error {
 	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.totalTags += len(tags) - len(db.repoTags[repo])
 	db.repoTags[repo] = tags
+	tagSet := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		tagSet[tag] = struct{}{}
+	}
+	db.repoTagSets[repo] = tagSet
+	if len(digests) > 0 {
+		db.repoDigests[repo] = digests
+	} else {
+		delete(db.repoDigests, repo)
+	}
+	if elem, ok := db.elements[repo]; ok {
+		db.scanned.MoveToBack(elem)
+	} else {
+		db.elements[repo] = db.scanned.PushBack(repo)
+	}
+
+	if db.maxTags <= 0 {
+		return nil
+	}
+	for db.totalTags > db.maxTags && db.scanned.Len() > 1 {
+		db.evict(db.scanned.Front().Value.(string))
+	}
+	return nil
+}
+
+// evict drops everything recorded for the repo, counting it as an
+// eviction. The lock must be held.
+func (db *database) evict(repo string) {
+	db.remove(repo)
+	databaseEvictions.Inc()
+}
+
+// Delete drops everything recorded for the repo; e.g., when it's no
+// longer scanned. It never fails, since the tags are held in memory.
+func (db *database) Delete(ctx context.Context, repo string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.elements[repo]; ok {
+		db.remove(repo)
+	}
+	delete(db.repoPlatforms, repo)
+	delete(db.repoTagTimes, repo)
+	return nil
+}
+
+// remove drops everything recorded for the repo, which must have
+// been given tags. The lock must be held.
+func (db *database) remove(repo string) {
+	db.totalTags -= len(db.repoTags[repo])
+	delete(db.repoTags, repo)
+	delete(db.repoTagSets, repo)
+	delete(db.repoDigests, repo)
+	delete(db.repoPlatforms, repo)
+	delete(db.repoTagTimes, repo)
+	db.scanned.Remove(db.elements[repo])
+	delete(db.elements, repo)
+}
+
+// TagDigest returns the digest recorded for the tag in the repo, or
+// an empty string if there is none.
+func (db *database) TagDigest(repo, tag string) string {
+	db.mu.RLock()
+	digest := db.repoDigests[repo][tag]
+	db.mu.RUnlock()
+	return digest
+}
+
+// TagPlatforms returns the platforms recorded for the tag in the
+// repo, each given as `os/arch` or `os/arch/variant`.
+func (db *database) TagPlatforms(repo, tag string) []string {
+	db.mu.RLock()
+	platforms := db.repoPlatforms[repo][tag]
+	db.mu.RUnlock()
+	return platforms
+}
+
+// SetTagPlatforms records the platforms for each tag in the repo,
+// replacing any previously recorded. It never fails, since the
+// platforms are held in memory.
+func (db *database) SetTagPlatforms(ctx context.Context, repo string, platforms map[string][]string) error {
+	db.mu.Lock()
+	db.repoPlatforms[repo] = platforms
+	db.mu.Unlock()
+	return nil
+}
+
+// TagTimes returns when each of the repo's tags was first and last
+// found by a scan.
+func (db *database) TagTimes(repo string) map[string]TagTimes {
+	db.mu.RLock()
+	times := db.repoTagTimes[repo]
+	db.mu.RUnlock()
+	return times
+}
+
+// SetTagTimes records when each of the repo's tags was first and last
+// found by a scan, replacing any previously recorded. They're only
+// kept while the repo's tags are. It never fails, since the times are
+// held in memory.
+func (db *database) SetTagTimes(ctx context.Context, repo string, times map[string]TagTimes) error {
+	db.mu.Lock()
+	if _, ok := db.elements[repo]; ok {
+		db.repoTagTimes[repo] = times
+	}
 	db.mu.Unlock()
+	return nil
 }
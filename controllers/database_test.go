@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBoundedDatabaseEvicts(t *testing.T) {
+	g := NewWithT(t)
+
+	evictions := testutil.ToFloat64(databaseEvictions)
+	db := NewBoundedDatabase(5)
+
+	db.SetTags(context.TODO(), "repo-a", []string{"a1", "a2"})
+	g.Expect(db.SetTagPlatforms(context.TODO(), "repo-a", map[string][]string{"a1": {"linux/amd64"}})).To(Succeed())
+	db.SetTags(context.TODO(), "repo-b", []string{"b1", "b2"})
+	g.Expect(db.Tags("repo-a")).To(HaveLen(2))
+	g.Expect(db.Tags("repo-b")).To(HaveLen(2))
+
+	// rescanning repo-a makes repo-b the least recently scanned
+	db.SetTags(context.TODO(), "repo-a", []string{"a1", "a2", "a3"})
+	g.Expect(testutil.ToFloat64(databaseEvictions) - evictions).To(Equal(0.0))
+
+	// this takes the total over the cap, so repo-b goes first
+	db.SetTags(context.TODO(), "repo-c", []string{"c1", "c2"})
+	g.Expect(db.Tags("repo-b")).To(BeEmpty())
+	g.Expect(db.Tags("repo-a")).To(HaveLen(3))
+	g.Expect(db.Tags("repo-c")).To(HaveLen(2))
+	g.Expect(testutil.ToFloat64(databaseEvictions) - evictions).To(Equal(1.0))
+
+	// a repo that exceeds the cap by itself evicts all the others, but
+	// is kept
+	db.SetTags(context.TODO(), "repo-d", []string{"d1", "d2", "d3", "d4", "d5", "d6"})
+	g.Expect(db.Tags("repo-a")).To(BeEmpty())
+	g.Expect(db.TagPlatforms("repo-a", "a1")).To(BeEmpty())
+	g.Expect(db.Tags("repo-c")).To(BeEmpty())
+	g.Expect(db.Tags("repo-d")).To(HaveLen(6))
+	g.Expect(testutil.ToFloat64(databaseEvictions) - evictions).To(Equal(3.0))
+}
+
+func TestUnboundedDatabase(t *testing.T) {
+	g := NewWithT(t)
+
+	db := NewDatabase()
+	for _, repo := range []string{"repo-a", "repo-b", "repo-c"} {
+		db.SetTags(context.TODO(), repo, make([]string, 1000))
+	}
+	for _, repo := range []string{"repo-a", "repo-b", "repo-c"} {
+		g.Expect(db.Tags(repo)).To(HaveLen(1000))
+	}
+}
+
+func TestDatabaseDelete(t *testing.T) {
+	g := NewWithT(t)
+
+	db := NewBoundedDatabase(4)
+	db.SetTags(context.TODO(), "a", []string{"1", "2"})
+	g.Expect(db.SetTagPlatforms(context.TODO(), "a", map[string][]string{"1": {"linux/amd64"}})).To(Succeed())
+	g.Expect(db.SetTagTimes(context.TODO(), "a", map[string]TagTimes{"1": {}})).To(Succeed())
+	db.SetTags(context.TODO(), "b", []string{"1", "2"})
+
+	evictions := testutil.ToFloat64(databaseEvictions)
+	g.Expect(db.Delete(context.TODO(), "a")).To(Succeed())
+	g.Expect(db.Delete(context.TODO(), "never-scanned")).To(Succeed())
+	g.Expect(db.Tags("a")).To(BeEmpty())
+	g.Expect(db.TagPlatforms("a", "1")).To(BeEmpty())
+	g.Expect(db.TagTimes("a")).To(BeEmpty())
+	g.Expect(testutil.ToFloat64(databaseEvictions)).To(Equal(evictions))
+
+	// the deleted tags no longer count against the limit
+	db.SetTags(context.TODO(), "c", []string{"1", "2"})
+	g.Expect(db.Tags("b")).To(Equal([]string{"1", "2"}))
+	g.Expect(db.Tags("c")).To(Equal([]string{"1", "2"}))
+}
+
+func TestDatabaseHasTag(t *testing.T) {
+	g := NewWithT(t)
+
+	db := NewBoundedDatabase(3)
+	g.Expect(db.HasTag("a", "1")).To(BeFalse())
+	db.SetTags(context.TODO(), "a", []string{"1", "2"})
+	g.Expect(db.HasTag("a", "1")).To(BeTrue())
+	g.Expect(db.HasTag("a", "3")).To(BeFalse())
+
+	db.SetTags(context.TODO(), "a", []string{"2", "3"})
+	g.Expect(db.HasTag("a", "1")).To(BeFalse())
+	g.Expect(db.HasTag("a", "3")).To(BeTrue())
+
+	// evicted tags are gone from the index too
+	db.SetTags(context.TODO(), "b", []string{"1", "2"})
+	g.Expect(db.HasTag("a", "2")).To(BeFalse())
+	g.Expect(db.HasTag("b", "2")).To(BeTrue())
+}
+
+func TestDatabaseTagsAreCopied(t *testing.T) {
+	g := NewWithT(t)
+
+	db := NewDatabase()
+	g.Expect(db.SetTags(context.TODO(), "repo", append(make([]string, 0, 10), "1.0.0", "1.1.0"))).To(Succeed())
+
+	// appending to, or changing, the tags returned doesn't reach
+	// those recorded
+	known, _ := db.Tags("repo")
+	_ = unionTags(known, []string{"2.0.0"})
+	known = append(known, "3.0.0")
+	known[0] = "changed"
+	g.Expect(db.Tags("repo")).To(Equal([]string{"1.0.0", "1.1.0"}))
+}
+
+func TestUnionTagsLeavesArgumentsAlone(t *testing.T) {
+	g := NewWithT(t)
+
+	a := append(make([]string, 0, 10), "1.0.0", "1.1.0")
+	union := unionTags(a, []string{"1.1.0", "2.0.0"})
+	g.Expect(union).To(Equal([]string{"1.0.0", "1.1.0", "2.0.0"}))
+	g.Expect(a[:cap(a)][2]).To(BeEmpty())
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// manifestMediaTypes are those accepted when asking for the digest of
+// a tag's manifest. A registry may give a different digest for the
+// same tag depending on what's accepted, so this includes all those
+// that might be pulled.
+var manifestMediaTypes = []string{
+	string(types.OCIImageIndex),
+	string(types.OCIManifestSchema1),
+	string(types.DockerManifestList),
+	string(types.DockerManifestSchema2),
+}
+
+// fetchDigests asks for the digest of the manifest at each of the
+// tags given, with a HEAD request so nothing else is fetched, and
+// returns a map of tag to digest. A tag whose digest can't be got is
+// left out, rather than failing the lot. If auth is nil, the
+// registry is asked anonymously. The fetches run with the fetcher
+// given, as in fetchPlatforms.
+//
+// If a platform is given, a tag with a multi-platform image (i.e., an
+// index or manifest list) is given the digest of the image in it for
+// that platform, rather than the digest of the index; and is left out
+// if there's no image for the platform.
+func fetchDigests(ctx context.Context, repo name.Repository, tags []string, rt http.RoundTripper, auth authn.Authenticator, platform *v1.Platform, f *fetcher) (map[string]string, error) {
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+	tr, err := transport.New(repo.Registry, auth, rt, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: tr}
+
+	// the child image of an index is found with remote.Get, which
+	// doesn't take a context, so it's bound to each request by the
+	// transport instead
+	var options []remote.Option
+	if platform != nil {
+		options = []remote.Option{
+			remote.WithTransport(&contextTransport{inner: rt, ctx: ctx}),
+			remote.WithAuth(auth),
+			remote.WithPlatform(*platform),
+		}
+	}
+
+	found := make([]string, len(tags))
+	err = f.forEachTag(ctx, tags, func(i int, tag string) {
+		found[i], _ = digestForTag(ctx, client, repo.Tag(tag), options...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string, len(tags))
+	for i, tag := range tags {
+		if found[i] != "" {
+			digests[tag] = found[i]
+		}
+	}
+	return digests, nil
+}
+
+// digestForTag returns the digest the registry gives for the manifest
+// at the tag. If options are given and the manifest is for an index,
+// the image for the platform in the options is looked up in the
+// index, and its digest returned instead.
+func digestForTag(ctx context.Context, client *http.Client, tag name.Tag, options ...remote.Option) (string, error) {
+	uri := &url.URL{
+		Scheme: tag.Registry.Scheme(),
+		Host:   tag.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", tag.RepositoryStr(), tag.TagStr()),
+	}
+	req, err := http.NewRequest(http.MethodHead, uri.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ","))
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := transport.CheckError(res, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	switch types.MediaType(res.Header.Get("Content-Type")) {
+	case types.OCIImageIndex, types.DockerManifestList:
+		if len(options) > 0 {
+			return platformDigestForTag(tag, options...)
+		}
+	}
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("no digest given for %s", tag)
+	}
+	return digest, nil
+}
+
+// platformDigestForTag returns the digest of the image for the
+// platform given in the options, from the index at the tag.
+func platformDigestForTag(tag name.Tag, options ...remote.Option) (string, error) {
+	desc, err := remote.Get(tag, options...)
+	if err != nil {
+		return "", err
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestScanRecordsDigests(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	imageName := reg.host() + "/digested"
+	pushed := map[string]string{}
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		img, err := random.Image(512, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		ref, err := name.NewTag(imageName + ":" + tag)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(remote.Write(ref, img)).To(Succeed())
+		digest, err := img.Digest()
+		g.Expect(err).ToNot(HaveOccurred())
+		pushed[tag] = digest.String()
+	}
+
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	db := NewDatabase()
+	r := &ImageRepositoryReconciler{Database: db}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+	dbKey := ref.Context().String()
+
+	// digests aren't resolved unless asked for
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.LatestDigest).To(BeEmpty())
+	g.Expect(db.TagDigest(dbKey, "v3")).To(BeEmpty())
+
+	// only the latest tags have their digests resolved
+	r.DigestTagLimit = 2
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	tags, err := db.Tags(dbKey)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(HaveLen(3))
+	latest := tags[len(tags)-1]
+	g.Expect(repo.Status.LastScanResult.LatestDigest).To(Equal(pushed[latest]))
+	g.Expect(db.TagDigest(dbKey, tags[1])).To(Equal(pushed[tags[1]]))
+	g.Expect(db.TagDigest(dbKey, tags[0])).To(BeEmpty())
+
+	// recording the tags without digests drops those recorded
+	g.Expect(db.SetTags(context.TODO(), dbKey, tags)).To(Succeed())
+	g.Expect(db.TagDigest(dbKey, latest)).To(BeEmpty())
+}
+
+func TestFetchDigestsLeavesOutUnknownTags(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+	imageName, err := reg.pushImages("partly", "v1")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repo, err := name.NewRepository(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	digests, err := fetchDigests(context.TODO(), repo, []string{"v1", "missing"}, http.DefaultTransport, nil, nil, &fetcher{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(digests).To(HaveKey("v1"))
+	g.Expect(digests).ToNot(HaveKey("missing"))
+}
+
+func TestFetchDigestsForPlatform(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	imageName := reg.host() + "/multi"
+	amd64, err := random.Image(512, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	arm64, err := random.Image(512, 1)
+	g.Expect(err).ToNot(HaveOccurred())
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	ref, err := name.NewTag(imageName + ":1.0")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(remote.WriteIndex(ref, index)).To(Succeed())
+
+	indexDigest, err := index.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+	arm64Digest, err := arm64.Digest()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	fetch := func(platform *v1.Platform) map[string]string {
+		digests, err := fetchDigests(context.TODO(), ref.Context(), []string{"1.0"}, http.DefaultTransport, nil, platform, &fetcher{})
+		g.Expect(err).ToNot(HaveOccurred())
+		return digests
+	}
+
+	// without a platform, it's the index's digest
+	g.Expect(fetch(nil)).To(Equal(map[string]string{"1.0": indexDigest.String()}))
+	// with one, it's the digest of the image for that platform
+	g.Expect(fetch(&v1.Platform{OS: "linux", Architecture: "arm64"})).To(Equal(map[string]string{"1.0": arm64Digest.String()}))
+	// and if there's no image for the platform, there's no digest
+	g.Expect(fetch(&v1.Platform{OS: "windows", Architecture: "amd64"})).To(BeEmpty())
+}
+
+func TestParsePlatform(t *testing.T) {
+	g := NewWithT(t)
+
+	p, err := parsePlatform("linux/arm64")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(p).To(Equal(v1.Platform{OS: "linux", Architecture: "arm64"}))
+	p, err = parsePlatform("linux/arm/v7")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(p).To(Equal(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	for _, invalid := range []string{"", "linux", "linux/", "linux/arm/v7/extra"} {
+		_, err := parsePlatform(invalid)
+		g.Expect(err).To(HaveOccurred(), invalid)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kuberecorder "k8s.io/client-go/tools/record"
+
+	"github.com/fluxcd/pkg/recorder"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+type eventObject interface {
+	runtime.Object
+	metav1.Object
+}
+
+// eventRecorders holds the recorders for the events emitted by a
+// reconciler; either may be nil, in which case the events are not
+// sent there.
+type eventRecorders struct {
+	kube     kuberecorder.EventRecorder
+	external *recorder.EventRecorder
+	log      logr.Logger
+}
+
+// event records a Kubernetes event for the object, and forwards it
+// to the notification controller. The severity is one of
+// recorder.EventSeverityInfo or recorder.EventSeverityError, which
+// are mapped to Kubernetes events of type Normal and Warning
+// respectively. The object reference in the forwarded event is
+// constructed from the kind given, rather than relying on the
+// object's TypeMeta, which is not always filled in.
+func (e eventRecorders) event(obj eventObject, kind, severity, reason, msg string, metadata map[string]string) {
+	if e.kube != nil {
+		eventType := corev1.EventTypeNormal
+		if severity == recorder.EventSeverityError {
+			eventType = corev1.EventTypeWarning
+		}
+		e.kube.Event(obj, eventType, reason, msg)
+	}
+	if e.external != nil {
+		objRef := corev1.ObjectReference{
+			Kind:            kind,
+			APIVersion:      imagev1alpha1.GroupVersion.String(),
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		}
+		if err := e.external.Eventf(objRef, metadata, severity, reason, "%s", msg); err != nil && e.log != nil {
+			e.log.Error(err, "unable to send event", "kind", kind, "name", obj.GetName(), "namespace", obj.GetNamespace())
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/fluxcd/pkg/recorder"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestReconcileSendsExternalEvents(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var received []recorder.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event recorder.Event
+		g.Expect(json.NewDecoder(r.Body).Decode(&event)).To(Succeed())
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+
+	var available bool
+	registry := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"v1", "v2"}, available
+	}))
+	defer registry.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	imageName := strings.TrimPrefix(registry.URL, "http://") + "/app"
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "apps"
+
+	external, err := recorder.NewEventRecorder(receiver.URL, "image-reflector-controller")
+	g.Expect(err).ToNot(HaveOccurred())
+	r := &ImageRepositoryReconciler{
+		Client:                fake.NewFakeClientWithScheme(s, repo),
+		Log:                   ctrl.Log,
+		Database:              NewDatabase(),
+		ExternalEventRecorder: external,
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "apps", Name: "app"}}
+
+	// a failed scan is reported with error severity (the repository
+	// isn't found, so it's not retried straight away)
+	_, err = r.Reconcile(req)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// and a successful scan with info severity (a scan is requested,
+	// since it'd otherwise wait for the next scan to be due)
+	available = true
+	var current imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), req.NamespacedName, &current)).To(Succeed())
+	current.Annotations = map[string]string{meta.ReconcileAtAnnotation: "now"}
+	g.Expect(r.Update(context.TODO(), &current)).To(Succeed())
+	_, err = r.Reconcile(req)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(received).To(HaveLen(2))
+	for _, event := range received {
+		g.Expect(event.InvolvedObject.Kind).To(Equal(imagev1alpha1.ImageRepositoryKind))
+		g.Expect(event.InvolvedObject.APIVersion).To(Equal("image.toolkit.fluxcd.io/v1alpha1"))
+		g.Expect(event.InvolvedObject.Namespace).To(Equal("apps"))
+		g.Expect(event.InvolvedObject.Name).To(Equal("app"))
+		g.Expect(event.ReportingController).To(Equal("image-reflector-controller"))
+		g.Expect(event.Metadata).To(HaveKeyWithValue("image", imageName))
+	}
+	g.Expect(received[0].Severity).To(Equal(recorder.EventSeverityError))
+	g.Expect(received[0].Reason).To(Equal(imagev1alpha1.ReconciliationFailedReason))
+	g.Expect(received[1].Severity).To(Equal(recorder.EventSeverityInfo))
+	g.Expect(received[1].Reason).To(Equal(imagev1alpha1.ReconciliationSucceededReason))
+	g.Expect(received[1].Message).To(Equal("successful scan, found 2 tags"))
+}
+
+func TestReconcileEmitsEventsOnTransitions(t *testing.T) {
+	g := NewWithT(t)
+
+	var tags []string
+	var available bool
+	registry := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return tags, available
+	}))
+	defer registry.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: strings.TrimPrefix(registry.URL, "http://") + "/app",
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "apps"
+
+	events := record.NewFakeRecorder(10)
+	r := &ImageRepositoryReconciler{
+		Client:        fake.NewFakeClientWithScheme(s, repo),
+		Log:           ctrl.Log,
+		Database:      NewDatabase(),
+		EventRecorder: events,
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "apps", Name: "app"}}
+	scan := func() {
+		var current imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), req.NamespacedName, &current)).To(Succeed())
+		current.Annotations = map[string]string{meta.ReconcileAtAnnotation: time.Now().String()}
+		g.Expect(r.Update(context.TODO(), &current)).To(Succeed())
+		_, err := r.Reconcile(req)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	// a failure is reported once, however many times it's repeated
+	scan()
+	g.Expect(events.Events).To(Receive(HavePrefix("Warning " + imagev1alpha1.ReconciliationFailedReason)))
+	scan()
+	g.Expect(events.Events).ToNot(Receive())
+
+	// but failing for another reason is reported
+	r.Transport = listingFailsWith(http.StatusUnauthorized)
+	scan()
+	g.Expect(events.Events).To(Receive(HavePrefix("Warning " + imagev1alpha1.ReconciliationFailedReason)))
+	r.Transport = nil
+
+	// the first successful scan is reported
+	tags, available = []string{"v1"}, true
+	scan()
+	g.Expect(events.Events).To(Receive(Equal("Normal " + imagev1alpha1.ReconciliationSucceededReason + " successful scan, found 1 tags")))
+
+	// but not another finding the same number of tags
+	scan()
+	g.Expect(events.Events).ToNot(Receive())
+
+	// whereas a change in the number of tags is (after the tags that
+	// changed)
+	tags = []string{"v1", "v2"}
+	scan()
+	g.Expect(events.Events).To(Receive(HavePrefix("Normal TagsChanged")))
+	g.Expect(events.Events).To(Receive(Equal("Normal " + imagev1alpha1.ReconciliationSucceededReason + " successful scan, found 2 tags")))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// defaultExportMaxTags is the number of tags written to an
+	// export ConfigMap when `.spec.exportTags.maxTags` is not given.
+	defaultExportMaxTags = 100
+
+	// These are the keys used in an export ConfigMap.
+	exportImageKey     = "image"
+	exportTagsKey      = "tags"
+	exportTagCountKey  = "tagCount"
+	exportTruncatedKey = "truncated"
+)
+
+// exportTags writes the tags recorded for the image repository into
+// the ConfigMap given in its spec, creating the ConfigMap (owned by
+// the image repository, so it's garbage collected along with it) if
+// necessary.
+func (r *ImageRepositoryReconciler) exportTags(ctx context.Context, repo *imagev1alpha1.ImageRepository) error {
+	export := repo.Spec.ExportTags
+	if export == nil {
+		return nil
+	}
+
+	var cm corev1.ConfigMap
+	cm.Namespace = repo.GetNamespace()
+	cm.Name = export.ConfigMapName
+	if cm.Name == "" {
+		cm.Name = repo.GetName()
+	}
+
+	maxTags := export.MaxTags
+	if maxTags <= 0 {
+		maxTags = defaultExportMaxTags
+	}
+
+	tags, err := r.Database.Tags(scannedDatabaseKey(r.DatabaseKey, *repo))
+	if err != nil {
+		return err
+	}
+	truncated := len(tags) > maxTags
+	if truncated {
+		tags = tags[:maxTags]
+	}
+
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, &cm, func() error {
+		cm.Data = map[string]string{
+			exportImageKey:     repo.Status.CanonicalImageName,
+			exportTagsKey:      strings.Join(tags, "\n"),
+			exportTagCountKey:  strconv.Itoa(repo.Status.LastScanResult.TagCount),
+			exportTruncatedKey: strconv.FormatBool(truncated),
+		}
+		return controllerutil.SetControllerReference(repo, &cm, r.Scheme)
+	})
+	return err
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// defaultExtensionTimeout is how long a tag selection extension is
+// given to return, if the reconciler doesn't say.
+const defaultExtensionTimeout = 5 * time.Second
+
+// TagSelector is an extension for selecting a tag by rules of its
+// own, for policies that name it in `.spec.policy.extension`. To add
+// an extension, build the controller with it in the TagSelectors of
+// the ImagePolicyReconciler.
+//
+// Select is given its own copy of the tags to choose from, and of the
+// parameters from the policy. It must return one of the tags, or the
+// empty string if none is to be selected. It's given a bounded time
+// to return, after which the selection fails and its result is
+// ignored; it ought to give up when the context is done.
+type TagSelector interface {
+	Select(ctx context.Context, tags []string, params map[string]string) (string, error)
+}
+
+// TagSelectorFunc adapts a func to the TagSelector interface.
+type TagSelectorFunc func(ctx context.Context, tags []string, params map[string]string) (string, error)
+
+func (f TagSelectorFunc) Select(ctx context.Context, tags []string, params map[string]string) (string, error) {
+	return f(ctx, tags, params)
+}
+
+// BuiltinTagSelectors returns the extensions that come with the
+// controller:
+//
+//   - `alphabetical` orders the tags lexically;
+//   - `numerical` orders the tags that are numbers by value, and
+//     skips the others.
+//
+// Both take the parameter `order`: `asc` (the default) selects the
+// last tag in ascending order, and `desc` the first.
+func BuiltinTagSelectors() map[string]TagSelector {
+	return map[string]TagSelector{
+		"alphabetical": TagSelectorFunc(selectAlphabetical),
+		"numerical":    TagSelectorFunc(selectNumerical),
+	}
+}
+
+// selectWithExtension selects a tag from those given with the
+// extension named in the policy, within the timeout.
+func selectWithExtension(ctx context.Context, selectors map[string]TagSelector, policy *imagev1alpha1.ExtensionPolicy, tags []string, timeout time.Duration) (string, error) {
+	selector, ok := selectors[policy.Name]
+	if !ok {
+		return "", fmt.Errorf("no tag selection extension named %q", policy.Name)
+	}
+	if timeout <= 0 {
+		timeout = defaultExtensionTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// the extension gets copies, so it can't change what the
+	// controller goes on to use
+	candidates := append([]string(nil), tags...)
+	params := make(map[string]string, len(policy.Parameters))
+	for k, v := range policy.Parameters {
+		params[k] = v
+	}
+
+	type result struct {
+		tag string
+		err error
+	}
+	// buffered, so an extension that returns after the timeout
+	// doesn't block forever
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		tag, err := selector.Select(ctx, candidates, params)
+		done <- result{tag: tag, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return "", fmt.Errorf("tag selection extension %q failed: %w", policy.Name, res.err)
+		}
+		if res.tag == "" {
+			return "", nil
+		}
+		for _, tag := range tags {
+			if tag == res.tag {
+				return tag, nil
+			}
+		}
+		return "", fmt.Errorf("tag selection extension %q selected %q, which is not one of the tags", policy.Name, res.tag)
+	case <-ctx.Done():
+		return "", fmt.Errorf("tag selection extension %q did not return within %s", policy.Name, timeout)
+	}
+}
+
+// sortOrder returns whether the `order` parameter asks for the tags
+// in ascending order.
+func sortOrder(params map[string]string) (bool, error) {
+	switch order := params["order"]; order {
+	case "", "asc":
+		return true, nil
+	case "desc":
+		return false, nil
+	default:
+		return false, fmt.Errorf("order must be asc or desc, not %q", order)
+	}
+}
+
+func selectAlphabetical(ctx context.Context, tags []string, params map[string]string) (string, error) {
+	asc, err := sortOrder(params)
+	if err != nil || len(tags) == 0 {
+		return "", err
+	}
+	sort.Strings(tags)
+	if asc {
+		return tags[len(tags)-1], nil
+	}
+	return tags[0], nil
+}
+
+func selectNumerical(ctx context.Context, tags []string, params map[string]string) (string, error) {
+	asc, err := sortOrder(params)
+	if err != nil {
+		return "", err
+	}
+	var selected string
+	var selectedValue float64
+	for _, tag := range tags {
+		value, err := strconv.ParseFloat(tag, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		// tags of the same value (e.g., `1` and `1.0`) are ordered
+		// lexically, so the result doesn't depend on the order given
+		if selected == "" || (asc && value > selectedValue) || (!asc && value < selectedValue) ||
+			(value == selectedValue && tag > selected) {
+			selected, selectedValue = tag, value
+		}
+	}
+	return selected, nil
+}
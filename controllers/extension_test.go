@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestSelectWithExtension(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"build-7", "build-12", "build-9"}
+	selectors := map[string]TagSelector{
+		// selects the tag with the longest name, or the one named by
+		// the parameter `pick`
+		"longest": TagSelectorFunc(func(ctx context.Context, tags []string, params map[string]string) (string, error) {
+			if pick, ok := params["pick"]; ok {
+				return pick, nil
+			}
+			var longest string
+			for _, tag := range tags {
+				if len(tag) > len(longest) {
+					longest = tag
+				}
+			}
+			// what's given can be changed without affecting the caller
+			tags[0] = "changed"
+			params["changed"] = "yes"
+			return longest, nil
+		}),
+		"failing": TagSelectorFunc(func(context.Context, []string, map[string]string) (string, error) {
+			return "", errors.New("no good")
+		}),
+		"slow": TagSelectorFunc(func(ctx context.Context, tags []string, _ map[string]string) (string, error) {
+			time.Sleep(time.Second)
+			return tags[0], nil
+		}),
+		"panicking": TagSelectorFunc(func(context.Context, []string, map[string]string) (string, error) {
+			panic("oops")
+		}),
+	}
+	selectTag := func(name string, params map[string]string) (string, error) {
+		return selectWithExtension(context.TODO(), selectors, &imagev1alpha1.ExtensionPolicy{Name: name, Parameters: params},
+			tags, 50*time.Millisecond)
+	}
+
+	params := map[string]string{}
+	g.Expect(selectTag("longest", params)).To(Equal("build-12"))
+	g.Expect(tags[0]).To(Equal("build-7"))
+	g.Expect(params).To(BeEmpty())
+
+	// nothing selected is fine; something other than one of the tags
+	// isn't
+	g.Expect(selectTag("longest", map[string]string{"pick": ""})).To(Equal(""))
+	_, err := selectTag("longest", map[string]string{"pick": "build-100"})
+	g.Expect(err).To(MatchError(ContainSubstring("not one of the tags")))
+
+	_, err = selectTag("failing", nil)
+	g.Expect(err).To(MatchError(ContainSubstring("no good")))
+	_, err = selectTag("panicking", nil)
+	g.Expect(err).To(MatchError(ContainSubstring("oops")))
+	_, err = selectTag("unknown", nil)
+	g.Expect(err).To(MatchError(ContainSubstring(`no tag selection extension named "unknown"`)))
+
+	start := time.Now()
+	_, err = selectTag("slow", nil)
+	g.Expect(err).To(MatchError(ContainSubstring("did not return within 50ms")))
+	g.Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+}
+
+func TestBuiltinTagSelectors(t *testing.T) {
+	g := NewWithT(t)
+
+	selectors := BuiltinTagSelectors()
+	selectTag := func(name string, tags []string, order string) (string, error) {
+		params := map[string]string{}
+		if order != "" {
+			params["order"] = order
+		}
+		return selectWithExtension(context.TODO(), selectors, &imagev1alpha1.ExtensionPolicy{Name: name, Parameters: params},
+			tags, time.Second)
+	}
+
+	tags := []string{"beta", "alpha", "gamma", "10", "9", "1.5", "1.50", "NaN"}
+	g.Expect(selectTag("alphabetical", tags, "")).To(Equal("gamma"))
+	g.Expect(selectTag("alphabetical", tags, "asc")).To(Equal("gamma"))
+	g.Expect(selectTag("alphabetical", tags, "desc")).To(Equal("1.5"))
+	g.Expect(selectTag("alphabetical", nil, "")).To(Equal(""))
+
+	g.Expect(selectTag("numerical", tags, "")).To(Equal("10"))
+	g.Expect(selectTag("numerical", tags, "desc")).To(Equal("1.50"))
+	g.Expect(selectTag("numerical", []string{"alpha"}, "")).To(Equal(""))
+
+	_, err := selectTag("numerical", tags, "sideways")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestPolicySelectsWithExtension(t *testing.T) {
+	g := NewWithT(t)
+
+	const image = "registry.example.com/extended"
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+	repo.Name = "extended"
+	repo.Namespace = "default"
+	repo.Status.CanonicalImageName = image
+
+	pol := &imagev1alpha1.ImagePolicy{
+		Spec: imagev1alpha1.ImagePolicySpec{
+			ImageRepositoryRef: corev1.LocalObjectReference{Name: repo.Name},
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				Extension: &imagev1alpha1.ExtensionPolicy{
+					Name:       "suffixed",
+					Parameters: map[string]string{"suffix": "-rc"},
+				},
+			},
+		},
+	}
+	pol.Name = "extended"
+	pol.Namespace = "default"
+	polName := types.NamespacedName{Namespace: pol.Namespace, Name: pol.Name}
+
+	var given []string
+	db := NewDatabase()
+	db.SetTags(context.TODO(), image, []string{"a-rc", "b", "c-rc", "latest"})
+	r := &ImagePolicyReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo, pol),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+		TagSelectors: map[string]TagSelector{
+			"suffixed": TagSelectorFunc(func(_ context.Context, tags []string, params map[string]string) (string, error) {
+				given = tags
+				var selected string
+				for _, tag := range tags {
+					if strings.HasSuffix(tag, params["suffix"]) && tag > selected {
+						selected = tag
+					}
+				}
+				return selected, nil
+			}),
+		},
+	}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: polName})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var polAfter imagev1alpha1.ImagePolicy
+	g.Expect(r.Get(context.TODO(), polName, &polAfter)).To(Succeed())
+	g.Expect(polAfter.Status.LatestImage).To(Equal(image + ":c-rc"))
+	// the extension is given the candidate tags, so floating tags are
+	// left out
+	g.Expect(given).To(ConsistOf("a-rc", "b", "c-rc"))
+	g.Expect(polAfter.Status.MatchingTags).To(Equal(3))
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// FetchPool bounds the number of per-tag metadata fetches in flight
+// across all scans. Each fetch takes a turn from the pool and gives
+// it back when done; turns are handed out in the order they were
+// asked for, so a scan of a large repository yields to other scans
+// after each fetch, rather than holding on to its share until it has
+// finished.
+type FetchPool struct {
+	mu      sync.Mutex
+	free    int
+	waiting []chan struct{}
+}
+
+// NewFetchPool returns a pool allowing `size` fetches at once.
+func NewFetchPool(size int) *FetchPool {
+	return &FetchPool{free: size}
+}
+
+// acquire takes a turn from the pool, waiting if there's none free,
+// and says whether it had to wait. It returns early with an error if
+// the context is done before a turn is free.
+func (p *FetchPool) acquire(ctx context.Context) (bool, error) {
+	p.mu.Lock()
+	if p.free > 0 && len(p.waiting) == 0 {
+		p.free--
+		p.mu.Unlock()
+		return false, nil
+	}
+	turn := make(chan struct{}, 1)
+	p.waiting = append(p.waiting, turn)
+	p.mu.Unlock()
+
+	select {
+	case <-turn:
+		return true, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i := range p.waiting {
+			if p.waiting[i] == turn {
+				p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+				return true, ctx.Err()
+			}
+		}
+		// the turn was handed over just as the context was done; it
+		// has to be passed on.
+		p.releaseLocked()
+		return true, ctx.Err()
+	}
+}
+
+// release gives back a turn, handing it to the longest waiting fetch
+// if there is one.
+func (p *FetchPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releaseLocked()
+}
+
+func (p *FetchPool) releaseLocked() {
+	if len(p.waiting) > 0 {
+		turn := p.waiting[0]
+		p.waiting = p.waiting[1:]
+		turn <- struct{}{}
+		return
+	}
+	p.free++
+}
+
+// fetcher runs the per-tag metadata fetches for a scan, no more than
+// `concurrency` at a time (or just one, if concurrency is less than
+// one), and each taking a turn from the pool if there is one. It
+// counts the fetches that had to wait for a turn. If progress is not
+// nil, it's called after each fetch with the number done so far, out
+// of all those to do.
+type fetcher struct {
+	concurrency int
+	pool        *FetchPool
+	progress    func(done, total int)
+
+	yielded int64
+}
+
+// forEachTag calls fetch for each of the tags, with its index. It's
+// up to fetch to put its result somewhere, which is safe if it uses
+// only the index given. Tags not yet started when the context is
+// done are skipped, and the context's error returned.
+func (f *fetcher) forEachTag(ctx context.Context, tags []string, fetch func(i int, tag string)) error {
+	concurrency := f.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(tags) {
+		concurrency = len(tags)
+	}
+
+	var done int64
+	fetchAndReport := func(i int) {
+		fetch(i, tags[i])
+		if f.progress != nil {
+			f.progress(int(atomic.AddInt64(&done, 1)), len(tags))
+		}
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() != nil {
+					continue
+				}
+				if f.pool == nil {
+					fetchAndReport(i)
+					continue
+				}
+				waited, err := f.pool.acquire(ctx)
+				if err != nil {
+					continue
+				}
+				if waited {
+					atomic.AddInt64(&f.yielded, 1)
+				}
+				fetchAndReport(i)
+				f.pool.release()
+			}
+		}()
+	}
+
+feed:
+	for i := range tags {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// yieldedFetches returns the number of fetches so far that waited
+// for a turn from the pool.
+func (f *fetcher) yieldedFetches() int {
+	return int(atomic.LoadInt64(&f.yielded))
+}
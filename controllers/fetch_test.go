@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// inflightTransport counts the requests for manifests it is handling
+// at once, and records the most seen. Each is slowed down a little,
+// so they overlap if they're made concurrently.
+type inflightTransport struct {
+	inner http.RoundTripper
+
+	mu       sync.Mutex
+	inflight int
+	most     int
+}
+
+func (t *inflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/manifests/") {
+		return t.inner.RoundTrip(req)
+	}
+	t.mu.Lock()
+	t.inflight++
+	if t.inflight > t.most {
+		t.most = t.inflight
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.inflight--
+		t.mu.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return t.inner.RoundTrip(req)
+}
+
+func TestFetchPlatformsConcurrently(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	// each tag is an image for a different architecture, so it's
+	// plain if the results are mixed up
+	repo, err := name.NewRepository(reg.host() + "/app")
+	g.Expect(err).ToNot(HaveOccurred())
+	var tags []string
+	for i := 0; i < 12; i++ {
+		tag := fmt.Sprintf("v%d", i)
+		img, err := random.Image(512, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		config, err := img.ConfigFile()
+		g.Expect(err).ToNot(HaveOccurred())
+		config.OS = "linux"
+		config.Architecture = fmt.Sprintf("arch%d", i)
+		img, err = mutate.ConfigFile(img, config)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(remote.Write(repo.Tag(tag), img)).To(Succeed())
+		tags = append(tags, tag)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		transport := &inflightTransport{inner: http.DefaultTransport}
+		platforms, err := fetchPlatforms(context.TODO(), repo, tags, transport, nil, &fetcher{concurrency: concurrency})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(platforms).To(HaveLen(len(tags)))
+		for i, tag := range tags {
+			g.Expect(platforms[tag]).To(Equal([]string{fmt.Sprintf("linux/arch%d", i)}))
+		}
+		g.Expect(transport.most).To(BeNumerically("<=", concurrency))
+		g.Expect(transport.most).To(BeNumerically(">", concurrency/2))
+	}
+}
+
+func TestForEachTagStopsWhenCancelled(t *testing.T) {
+	g := NewWithT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var done []string
+	f := &fetcher{concurrency: 2}
+	err := f.forEachTag(ctx, []string{"a", "b", "c", "d", "e"}, func(i int, tag string) {
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, tag)
+		cancel()
+	})
+	g.Expect(err).To(Equal(context.Canceled))
+	g.Expect(len(done)).To(BeNumerically("<", 5))
+}
+
+func TestFetchPoolSharesFairly(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	var largeTags []string
+	for i := 0; i < 40; i++ {
+		largeTags = append(largeTags, fmt.Sprintf("v%d", i))
+	}
+	large, err := reg.pushImages("large", largeTags...)
+	g.Expect(err).ToNot(HaveOccurred())
+	var small []string
+	for i := 0; i < 5; i++ {
+		repo, err := reg.pushImages(fmt.Sprintf("small-%d", i), "v1", "v2")
+		g.Expect(err).ToNot(HaveOccurred())
+		small = append(small, repo)
+	}
+
+	transport := &inflightTransport{inner: http.DefaultTransport}
+	r := &ImageRepositoryReconciler{
+		Database:                 NewDatabase(),
+		Transport:                transport,
+		MetadataFetchConcurrency: 3,
+		MetadataFetchPool:        NewFetchPool(3),
+	}
+	scan := func(image string) (imagev1alpha1.ImageRepository, time.Time) {
+		ref, err := name.ParseReference(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		repo, err := r.scan(context.TODO(), imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:            image,
+				InspectPlatforms: true,
+			},
+		}, ref)
+		g.Expect(err).ToNot(HaveOccurred())
+		return repo, time.Now()
+	}
+
+	var wg sync.WaitGroup
+	var largeRepo imagev1alpha1.ImageRepository
+	var largeDone time.Time
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		largeRepo, largeDone = scan(large)
+	}()
+
+	// give the large scan time to take every turn in the pool
+	time.Sleep(50 * time.Millisecond)
+	smallDone := make([]time.Time, len(small))
+	for i := range small {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, smallDone[i] = scan(small[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// the small scans each take their turn, rather than waiting for
+	// the large scan to finish
+	for i := range small {
+		g.Expect(smallDone[i].Before(largeDone)).To(BeTrue(), "small repository %d finished after the large one", i)
+	}
+	g.Expect(largeRepo.Status.LastScanResult.YieldedFetches).To(BeNumerically(">", 0))
+	g.Expect(transport.most).To(BeNumerically("<=", 3))
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestFinalizerDropsTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+	image := strings.TrimPrefix(srv.URL, "http://") + "/app"
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	// two image repositories scanning the same image
+	var repos []runtime.Object
+	for _, n := range []string{"first", "second"} {
+		repo := &imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+		}
+		repo.Name = n
+		repo.Namespace = "default"
+		repos = append(repos, repo)
+	}
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repos...),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	reconcile := func(n string) imagev1alpha1.ImageRepository {
+		repoName := types.NamespacedName{Namespace: "default", Name: n}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var repo imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &repo)).To(Succeed())
+		return repo
+	}
+	// the fake client deletes objects straight away, so deletion is
+	// simulated by setting the deletion timestamp
+	markDeleted := func(repo imagev1alpha1.ImageRepository) {
+		now := metav1.Now()
+		repo.SetDeletionTimestamp(&now)
+		g.Expect(r.Update(context.TODO(), &repo)).To(Succeed())
+	}
+
+	first := reconcile("first")
+	g.Expect(first.GetFinalizers()).To(ContainElement(imagev1alpha1.ImageRepositoryFinalizer))
+	second := reconcile("second")
+	dbKey := first.Status.CanonicalImageName
+	g.Expect(r.Database.Tags(dbKey)).To(Equal([]string{"1.0.0"}))
+
+	// the tags are still needed by the other image repository
+	markDeleted(first)
+	first = reconcile("first")
+	g.Expect(first.GetFinalizers()).To(BeEmpty())
+	g.Expect(r.Database.Tags(dbKey)).To(Equal([]string{"1.0.0"}))
+
+	// but not once it's being deleted too
+	markDeleted(second)
+	second = reconcile("second")
+	g.Expect(second.GetFinalizers()).To(BeEmpty())
+	g.Expect(r.Database.Tags(dbKey)).To(BeEmpty())
+}
+
+// failingDeleteDatabase fails to drop anything while failDelete is
+// set.
+type failingDeleteDatabase struct {
+	*database
+	failDelete bool
+}
+
+func (db *failingDeleteDatabase) Delete(ctx context.Context, repo string) error {
+	if db.failDelete {
+		return errors.New("database unavailable")
+	}
+	return db.database.Delete(ctx, repo)
+}
+
+func TestFinalizerKeptUntilTagsDropped(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: strings.TrimPrefix(srv.URL, "http://") + "/app"},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	db := &failingDeleteDatabase{database: NewDatabase()}
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+	}
+	repoName := types.NamespacedName{Namespace: "default", Name: "app"}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var scanned imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &scanned)).To(Succeed())
+	now := metav1.Now()
+	scanned.SetDeletionTimestamp(&now)
+	g.Expect(r.Update(context.TODO(), &scanned)).To(Succeed())
+
+	// the finalizer stays while the tags can't be dropped
+	db.failDelete = true
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).To(HaveOccurred())
+	var deleting imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &deleting)).To(Succeed())
+	g.Expect(deleting.GetFinalizers()).To(ContainElement(imagev1alpha1.ImageRepositoryFinalizer))
+	g.Expect(db.Tags(deleting.Status.CanonicalImageName)).ToNot(BeEmpty())
+
+	// and goes once they can be
+	db.failDelete = false
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+	var deleted imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &deleted)).To(Succeed())
+	g.Expect(deleted.GetFinalizers()).To(BeEmpty())
+	g.Expect(db.Tags(deleted.Status.CanonicalImageName)).To(BeEmpty())
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// gcpScope is the OAuth2 scope asked for with Google credentials.
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+	// gcpUsername is the username that Google registries expect
+	// along with an access token.
+	gcpUsername = "oauth2accesstoken"
+)
+
+// isGCPHost says whether the host is that of Google Container
+// Registry or Artifact Registry.
+func isGCPHost(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, ".pkg.dev")
+}
+
+// gcpTokens is the source of tokens got with the controller's
+// default Google credentials. It's shared by all scans, so that a
+// token is reused until it's close to expiry, rather than got anew
+// for each scan.
+var gcpTokens struct {
+	sync.Mutex
+	source oauth2.TokenSource
+}
+
+// defaultGCPTokenSource returns the shared source of tokens, finding
+// the controller's default Google credentials the first time it's
+// called successfully.
+func defaultGCPTokenSource() (oauth2.TokenSource, error) {
+	gcpTokens.Lock()
+	defer gcpTokens.Unlock()
+	if gcpTokens.source == nil {
+		source, err := google.DefaultTokenSource(context.Background(), gcpScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find Google credentials: %w", err)
+		}
+		gcpTokens.source = source
+	}
+	return gcpTokens.source, nil
+}
+
+// gcpAuthenticator is an Authenticator that presents an access token
+// got from the token source, as Google registries expect.
+type gcpAuthenticator struct {
+	tokens oauth2.TokenSource
+}
+
+func (a *gcpAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	token, err := a.tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get Google access token: %w", err)
+	}
+	return &authn.AuthConfig{Username: gcpUsername, Password: token.AccessToken}, nil
+}
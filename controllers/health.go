@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// DatabaseChecker returns a health check for the database given. A
+// database that can be found unhealthy (e.g., the persistent one,
+// whose file may be closed or unwritable) is checked each time; any
+// other is always healthy.
+func DatabaseChecker(db interface{}) healthz.Checker {
+	checker, ok := db.(interface{ Check() error })
+	if !ok {
+		return healthz.Ping
+	}
+	return func(*http.Request) error {
+		return checker.Check()
+	}
+}
+
+// Check says whether the database can be written, with a transaction
+// that changes nothing.
+func (b *BoltDatabase) Check() error {
+	if err := b.db.Update(func(*bolt.Tx) error { return nil }); err != nil {
+		return fmt.Errorf("database is not writable: %w", err)
+	}
+	return nil
+}
+
+// ScanHealth keeps track of whether scans are reaching registries,
+// across all image repositories. It's unhealthy when scans have been
+// failing to reach a registry, and none has succeeded for longer than
+// the grace period; as would happen if the controller's network
+// connectivity were lost. Scans that reach a registry but fail
+// anyway, e.g., because credentials are refused, don't count.
+type ScanHealth struct {
+	grace time.Duration
+
+	mu           sync.Mutex
+	lastSuccess  time.Time
+	failingSince time.Time
+}
+
+// NewScanHealth returns a ScanHealth with the grace period given,
+// counted from now until a scan has succeeded.
+func NewScanHealth(grace time.Duration) *ScanHealth {
+	return &ScanHealth{grace: grace, lastSuccess: time.Now()}
+}
+
+// observe records the outcome of a scan. It's safe to call on a nil
+// ScanHealth, which records nothing.
+func (h *ScanHealth) observe(err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err == nil:
+		h.lastSuccess = now
+		h.failingSince = time.Time{}
+	case isConnectivityFailure(err) && h.failingSince.IsZero():
+		h.failingSince = now
+	}
+}
+
+// check returns an error if scans have been failing to reach
+// registries, and none has succeeded within the grace period.
+func (h *ScanHealth) check(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failingSince.IsZero() || now.Sub(h.lastSuccess) <= h.grace {
+		return nil
+	}
+	return fmt.Errorf("no scan has succeeded since %s, and scans have been failing to reach registries since %s",
+		h.lastSuccess.Format(time.RFC3339), h.failingSince.Format(time.RFC3339))
+}
+
+// Check is a healthz.Checker for the scans.
+func (h *ScanHealth) Check(*http.Request) error {
+	return h.check(time.Now())
+}
+
+// isConnectivityFailure says whether a scan failed without getting a
+// response from the registry: it timed out, or the request couldn't
+// be made at all.
+func isConnectivityFailure(err error) bool {
+	var timeout *scanTimeoutError
+	var urlErr *url.Error
+	return errors.As(err, &timeout) || errors.As(err, &urlErr)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestScanHealth(t *testing.T) {
+	g := NewWithT(t)
+
+	h := NewScanHealth(time.Minute)
+	start := h.lastSuccess
+	unreachable := &scanTimeoutError{timeout: time.Second, err: context.DeadlineExceeded}
+
+	// failures that got a response from the registry don't count
+	h.observe(errors.New("unauthorized"), start.Add(time.Second))
+	g.Expect(h.check(start.Add(time.Hour))).To(Succeed())
+
+	// failures to reach a registry are tolerated for the grace period
+	h.observe(unreachable, start.Add(time.Second))
+	g.Expect(h.check(start.Add(time.Minute))).To(Succeed())
+	g.Expect(h.check(start.Add(2 * time.Minute))).ToNot(Succeed())
+
+	// and a success puts things right
+	h.observe(nil, start.Add(3*time.Minute))
+	g.Expect(h.check(start.Add(time.Hour))).To(Succeed())
+
+	// a nil ScanHealth records nothing
+	var none *ScanHealth
+	none.observe(unreachable, start)
+}
+
+func TestDatabaseChecker(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(DatabaseChecker(NewDatabase())(&http.Request{})).To(Succeed())
+
+	dir, err := ioutil.TempDir("", "bolt-db")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+	db, err := NewBoltDatabase(dir)
+	g.Expect(err).ToNot(HaveOccurred())
+	check := DatabaseChecker(db)
+	g.Expect(check(&http.Request{})).To(Succeed())
+	g.Expect(db.Close()).To(Succeed())
+	g.Expect(check(&http.Request{})).ToNot(Succeed())
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// registryRequestWait records how long requests to each registry
+// host waited for a turn, when requests per host are limited.
+var registryRequestWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "image_reflector_registry_request_wait_seconds",
+	Help:    "Time requests waited for a turn under the limit on in-flight requests to each registry host.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+}, []string{"host"})
+
+func init() {
+	metrics.Registry.MustRegister(registryRequestWait)
+}
+
+// HostLimiter bounds the number of requests in flight to each
+// registry host, across all scans. A request is in flight from when
+// it's sent until its response body is closed.
+type HostLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// NewHostLimiter returns a limiter allowing `limit` requests in
+// flight to each host.
+func NewHostLimiter(limit int) *HostLimiter {
+	return &HostLimiter{
+		limit: limit,
+		hosts: map[string]chan struct{}{},
+	}
+}
+
+// semaphore returns the semaphore for the host, making it if need be.
+func (l *HostLimiter) semaphore(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.hosts[host] = sem
+	}
+	return sem
+}
+
+// transport returns a transport that sends requests with the one
+// given, each taking a turn from the limiter. It's safe to call on a
+// nil limiter, which returns the transport as it is.
+func (l *HostLimiter) transport(inner http.RoundTripper) http.RoundTripper {
+	if l == nil || l.limit <= 0 {
+		return inner
+	}
+	return &hostLimitTransport{inner: inner, limiter: l}
+}
+
+// hostLimitTransport is an http.RoundTripper that waits for a turn
+// for the request's host before sending it, and gives the turn back
+// once the response has been read.
+type hostLimitTransport struct {
+	inner   http.RoundTripper
+	limiter *HostLimiter
+}
+
+func (t *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	sem := t.limiter.semaphore(host)
+	start := time.Now()
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	registryRequestWait.WithLabelValues(host).Observe(time.Since(start).Seconds())
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { <-sem })
+	}
+	res, err := t.inner.RoundTrip(req)
+	if err != nil {
+		release()
+		return res, err
+	}
+	res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// releasingBody calls release when it's closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
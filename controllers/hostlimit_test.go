@@ -0,0 +1,133 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestHostLimiterBoundsRequestsInFlight(t *testing.T) {
+	g := NewWithT(t)
+
+	var inFlight, most int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			m := atomic.LoadInt64(&most)
+			if n <= m || atomic.CompareAndSwapInt64(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewHostLimiter(2).transport(http.DefaultTransport)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(srv.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	g.Expect(atomic.LoadInt64(&most)).To(BeNumerically("<=", 2))
+	g.Expect(atomic.LoadInt64(&most)).To(BeNumerically(">=", 1))
+}
+
+func TestHostLimiterHoldsTurnUntilBodyClosed(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewHostLimiter(1).transport(http.DefaultTransport)}
+	res, err := client.Get(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// another request waits while the first's body is open, and gives
+	// up when its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = client.Do(req.WithContext(ctx))
+	g.Expect(err).To(HaveOccurred())
+
+	// closing the body (even twice) gives the turn back
+	g.Expect(res.Body.Close()).To(Succeed())
+	res.Body.Close()
+	res, err = client.Get(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	res.Body.Close()
+}
+
+func TestHostLimiterNilIsNoLimit(t *testing.T) {
+	g := NewWithT(t)
+	var l *HostLimiter
+	g.Expect(l.transport(http.DefaultTransport)).To(BeIdenticalTo(http.DefaultTransport))
+}
+
+func TestScanWithHostLimiter(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/limited"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	// with only one request at a time, every request in the scan has
+	// to give its turn back for the scan to finish
+	r := &ImageRepositoryReconciler{
+		Database:    NewDatabase(),
+		HostLimiter: NewHostLimiter(1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		repo, err = r.scan(ctx, repo, ref)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+}
@@ -18,10 +18,20 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
+	"time"
 
 	semver "github.com/Masterminds/semver/v3"
 	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	kuberecorder "k8s.io/client-go/tools/record"
@@ -42,7 +52,15 @@ import (
 const imageRepoKey = ".spec.imageRepository.name"
 
 type DatabaseReader interface {
-	Tags(repo string) []string
+	Tags(repo string) ([]string, error)
+	// HasTag says whether the tag is recorded for the repo, without
+	// reading all the tags.
+	HasTag(repo, tag string) (bool, error)
+	TagDigest(repo, tag string) string
+	TagPlatforms(repo, tag string) []string
+	// TagTimes returns when each of the repo's tags was first and
+	// last found by a scan.
+	TagTimes(repo string) map[string]TagTimes
 }
 
 // ImagePolicyReconciler reconciles a ImagePolicy object
@@ -53,6 +71,63 @@ type ImagePolicyReconciler struct {
 	Database              DatabaseReader
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *recorder.EventRecorder
+	// WatchNamespaces restricts the reconciler to objects in the
+	// given namespaces; if empty, all namespaces are watched.
+	WatchNamespaces []string
+	// DatabaseKey says which name image repositories' tags are keyed
+	// on in the database; it must agree with the
+	// ImageRepositoryReconciler.
+	DatabaseKey string
+	// Transport is the base transport used for requests to
+	// registries, when verifying digests. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// UserAgent is given as the User-Agent of requests to registries,
+	// as with the ImageRepositoryReconciler.
+	UserAgent string
+	// DisablePerObjectMetrics leaves all image policies out of the
+	// metrics that have a series per object, as though each were
+	// annotated to opt out.
+	DisablePerObjectMetrics bool
+	// AllowInlineAuth lets the credentials given in an image
+	// repository's `.spec.inlineAuth` be used, e.g., to verify
+	// digests.
+	AllowInlineAuth bool
+	// Keychain, if not nil, is consulted for credentials for image
+	// repositories that don't give any, e.g., to verify digests.
+	Keychain authn.Keychain
+	// TagSelectors are the extensions that policies can name in
+	// `.spec.policy.extension`; if nil, BuiltinTagSelectors are used.
+	TagSelectors map[string]TagSelector
+	// ExtensionTimeout is how long an extension is given to select a
+	// tag. If zero, it's five seconds.
+	ExtensionTimeout time.Duration
+	// MaxConditionMessageLength is the longest, in bytes, a status
+	// condition message is written; longer messages are truncated.
+	// Zero means messages are never truncated.
+	MaxConditionMessageLength int
+
+	// transports keeps the transports made for image repositories
+	// that skip verifying certificates.
+	transports transportCache
+	// ecrToken gets tokens for ECR; if nil, fetchECRToken is used.
+	ecrToken ecrTokenFunc
+	// gcpTokens gives tokens for Google Cloud; if nil, the
+	// controller's default credentials are used.
+	gcpTokens oauth2.TokenSource
+	// acrTokens gets tokens for ACR; if nil, defaultACRTokens is
+	// used.
+	acrTokens *acrTokenExchanger
+}
+
+func (r *ImagePolicyReconciler) authOptions() authOptions {
+	return authOptions{
+		allowInline: r.AllowInlineAuth,
+		ecrToken:    r.ecrToken,
+		gcpTokens:   r.gcpTokens,
+		acrTokens:   r.acrTokens,
+		keychain:    r.Keychain,
+	}
 }
 
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagepolicies,verbs=get;list;watch;create;update;patch;delete
@@ -64,6 +139,9 @@ func (r *ImagePolicyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 
 	var pol imagev1alpha1.ImagePolicy
 	if err := r.Get(ctx, req.NamespacedName, &pol); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			policySelections.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
@@ -87,24 +165,203 @@ func (r *ImagePolicyReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, nil
 	}
 
-	policy := pol.Spec.Policy
+	repos := []imagev1alpha1.ImageRepository{repo}
+	for _, ref := range pol.Spec.AdditionalImageRepositoryRefs {
+		var additional imagev1alpha1.ImageRepository
+		if err := r.Get(ctx, types.NamespacedName{Namespace: pol.Namespace, Name: ref.Name}, &additional); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				// the others may still be selected from
+				log.Info("additional ImageRepository does not exist", "name", ref.Name)
+				continue
+			}
+			return ctrl.Result{}, err
+		}
+		if additional.Status.CanonicalImageName == "" {
+			log.Info("additional ImageRepository has not been scanned yet", "name", ref.Name)
+			continue
+		}
+		repos = append(repos, additional)
+	}
 
-	switch {
-	case policy.SemVer != nil:
-		latest, err := r.calculateLatestImageSemver(&policy, repo.Status.CanonicalImageName)
+	// each tag is taken from the first image repository it's found
+	// in; a tag missing from some of the image repositories can still
+	// be selected, from one it's in.
+	var tags []string
+	tagRepos := map[string]imagev1alpha1.ImageRepository{}
+	for _, source := range repos {
+		candidates, err := candidateTags(r.Database, scannedDatabaseKey(r.DatabaseKey, source), pol.Spec)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
-		if latest != "" {
-			pol.Status.LatestImage = repo.Spec.Image + ":" + latest
-			err = r.Status().Update(ctx, &pol)
+		for _, tag := range candidates {
+			if _, ok := tagRepos[tag]; !ok {
+				tagRepos[tag] = source
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	var (
+		latest string
+		err    error
+	)
+	if ext := pol.Spec.Policy.Extension; ext != nil {
+		selectors := r.TagSelectors
+		if selectors == nil {
+			selectors = BuiltinTagSelectors()
 		}
+		latest, err = selectWithExtension(ctx, selectors, ext, tags, r.ExtensionTimeout)
+	} else {
+		latest, err = selectLatest(tags, repo.Spec.ArtifactType, pol.Spec.Policy)
+	}
+	if err != nil {
 		return ctrl.Result{}, err
-	default:
-		// no recognised policy, do nothing
 	}
+	statusBefore := pol.Status.DeepCopy()
+	if pol.Status.MatchingTags, err = countMatching(tags, repo.Spec.ArtifactType, pol.Spec.Policy); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	pol.Status.NewerTags = nil
+	pol = imagev1alpha1.RemoveImagePolicyCondition(pol, imagev1alpha1.BaselineValidCondition)
+	if baseline := pol.Spec.Baseline; baseline != "" {
+		newer, err := newerTags(tags, repo.Spec.ArtifactType, pol.Spec.Policy, baseline)
+		if err != nil {
+			// this won't come right until the spec is changed, so
+			// it's reported rather than retried
+			pol = imagev1alpha1.SetImagePolicyCondition(pol, imagev1alpha1.BaselineValidCondition,
+				corev1.ConditionFalse, imagev1alpha1.BaselineInvalidReason, err.Error())
+		}
+		pol.Status.NewerTags = newer
+	}
+
+	if latest != "" {
+		repo = tagRepos[latest]
+		image := repo.Spec.Image
+		if len(repo.Spec.SubstituteFrom) > 0 {
+			// the image as given has unresolved variables in it
+			image = repo.Status.CanonicalImageName
+		}
+		previous := pol.Status.LatestImage
+		latestImage := image + ":" + latest
+		if pol.Spec.VerifyDigest {
+			digest, err := r.digestOf(ctx, repo, latest)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if latestImage == previous && pol.Status.LatestDigest != "" && digest != pol.Status.LatestDigest {
+				return ctrl.Result{}, r.reportMutatedSelection(ctx, pol, digest)
+			}
+			pol.Status.LatestDigest = digest
+		} else {
+			pol.Status.LatestDigest = ""
+		}
+		pol = imagev1alpha1.RemoveImagePolicyCondition(pol, imagev1alpha1.MutatedSelectionCondition)
+		pol.Status.LatestImage = latestImage
+		pol.Status.LatestImageRepository = repo.Name
+		err = r.updateStatus(ctx, &pol)
+		if err == nil {
+			perObject := !r.DisablePerObjectMetrics && perObjectMetrics(&pol, &repo)
+			policySelections.record(req.NamespacedName, image, latest, perObject)
+		}
+		if err == nil && pol.Status.LatestImage != previous {
+			r.event(pol, recorder.EventSeverityInfo, imagev1alpha1.ReconciliationSucceededReason,
+				fmt.Sprintf("latest image for %s resolved to %s", repo.Status.CanonicalImageName, pol.Status.LatestImage))
+		}
+	} else if !apiequality.Semantic.DeepEqual(statusBefore, &pol.Status) {
+		// nothing is selected, but that nothing matches is worth
+		// knowing
+		err = r.updateStatus(ctx, &pol)
+	}
+	return ctrl.Result{}, err
+}
+
+// updateStatus writes the status of the policy.
+func (r *ImagePolicyReconciler) updateStatus(ctx context.Context, pol *imagev1alpha1.ImagePolicy) error {
+	imagev1alpha1.TruncateConditionMessages(pol.Status.Conditions, r.MaxConditionMessageLength)
+	return r.Status().Update(ctx, pol)
+}
+
+// digestOf fetches the digest of the image at the tag in the image
+// repository, with the credentials and headers used to scan it.
+func (r *ImagePolicyReconciler) digestOf(ctx context.Context, repo imagev1alpha1.ImageRepository, tag string) (string, error) {
+	ref, err := name.ParseReference(repo.Status.CanonicalImageName+":"+tag, nameOptions(repo.Spec)...)
+	if err != nil {
+		return "", err
+	}
+	auth, _, err := credentialsFor(ctx, r.Client, r.Log, repo, ref, r.authOptions())
+	if err != nil {
+		return "", err
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	repoName := types.NamespacedName{Namespace: repo.GetNamespace(), Name: repo.GetName()}
+	if repo.Spec.Insecure {
+		base := transport
+		transport, _ = r.transports.get(repoName, transportKey{base: base, insecure: true}, func() (http.RoundTripper, error) {
+			return insecureTransport(base), nil
+		})
+	} else {
+		r.transports.forget(repoName)
+	}
+	if headers := repo.Spec.CustomHeaders; len(headers) > 0 {
+		transport = &headerTransport{
+			inner:   transport,
+			headers: headers,
+			host:    ref.Context().RegistryStr(),
+		}
+	}
+	transport = withUserAgent(transport, r.UserAgent)
+	options := []remote.Option{
+		remote.WithTransport(&contextTransport{inner: transport, ctx: ctx}),
+	}
+	if auth != nil {
+		options = append(options, remote.WithAuth(auth))
+	}
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// reportMutatedSelection records that the selected tag now refers to
+// the digest given, rather than that recorded when it was selected.
+// The latest image is left as it is. An event is emitted the first
+// time each new digest is seen.
+func (r *ImagePolicyReconciler) reportMutatedSelection(ctx context.Context, pol imagev1alpha1.ImagePolicy, digest string) error {
+	msg := fmt.Sprintf("tag of latest image %s has been pushed again; it refers to %s, rather than %s as when it was selected",
+		pol.Status.LatestImage, digest, pol.Status.LatestDigest)
+	reported := false
+	for _, c := range pol.Status.Conditions {
+		if c.Type == imagev1alpha1.MutatedSelectionCondition && c.Message == msg {
+			reported = true
+		}
+	}
+	pol = imagev1alpha1.SetImagePolicyCondition(pol, imagev1alpha1.MutatedSelectionCondition,
+		corev1.ConditionTrue, imagev1alpha1.DigestChangedReason, msg)
+	if err := r.updateStatus(ctx, &pol); err != nil {
+		return err
+	}
+	if !reported {
+		r.event(pol, recorder.EventSeverityError, imagev1alpha1.MutatedSelectionCondition, msg)
+	}
+	return nil
+}
 
-	return ctrl.Result{}, nil
+// event emits an event about the policy, to be seen with `kubectl
+// describe` and by the notification controller.
+func (r *ImagePolicyReconciler) event(pol imagev1alpha1.ImagePolicy, severity, reason, msg string) {
+	eventRecorders{
+		kube:     r.EventRecorder,
+		external: r.ExternalEventRecorder,
+		log:      r.Log,
+	}.event(&pol, imagev1alpha1.ImagePolicyKind, severity, reason, msg, map[string]string{
+		"latestImage": pol.Status.LatestImage,
+	})
 }
 
 func (r *ImagePolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
@@ -112,7 +369,11 @@ func (r *ImagePolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// it's easy to list those out when an image repo changes.
 	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &imagev1alpha1.ImagePolicy{}, imageRepoKey, func(obj runtime.Object) []string {
 		pol := obj.(*imagev1alpha1.ImagePolicy)
-		return []string{pol.Spec.ImageRepositoryRef.Name}
+		names := []string{pol.Spec.ImageRepositoryRef.Name}
+		for _, ref := range pol.Spec.AdditionalImageRepositoryRefs {
+			names = append(names, ref.Name)
+		}
+		return names
 	}); err != nil {
 		return err
 	}
@@ -124,30 +385,90 @@ func (r *ImagePolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			&handler.EnqueueRequestsFromMapFunc{
 				ToRequests: handler.ToRequestsFunc(r.imagePoliciesForRepository),
 			}).
+		WithEventFilter(namespacesPredicate(r.WatchNamespaces)).
 		Complete(r)
 }
 
 // ---
 
-func (r *ImagePolicyReconciler) calculateLatestImageSemver(pol *imagev1alpha1.ImagePolicyChoice, canonImage string) (string, error) {
-	tags := r.Database.Tags(canonImage)
+// calculateLatestImageSemver returns the tag with the highest version
+// within the policy's range. If chart is true, the tags are taken to
+// be Helm chart versions, which have any `+` replaced with `_` when
+// pushed to an OCI registry, since `+` is not allowed in tags.
+func calculateLatestImageSemver(pol *imagev1alpha1.ImagePolicyChoice, tags []string, chart bool) (string, error) {
 	constraint, err := semver.NewConstraint(pol.SemVer.Range)
 	if err != nil {
 		// FIXME this'll get a stack trace in the log, but may not deserve it
 		return "", err
 	}
 	var latestVersion *semver.Version
+	var latestTag string
 	for _, tag := range tags {
-		if v, err := semver.NewVersion(tag); err == nil {
+		version := tag
+		if chart {
+			version = strings.ReplaceAll(tag, "_", "+")
+		}
+		if v, err := semver.NewVersion(version); err == nil {
 			if constraint.Check(v) && (latestVersion == nil || v.GreaterThan(latestVersion)) {
 				latestVersion = v
+				latestTag = tag
 			}
 		}
 	}
-	if latestVersion != nil {
-		return latestVersion.Original(), nil
+	return latestTag, nil
+}
+
+// calculateLatestImageDate returns the tag with the latest date, as
+// extracted by the policy's pattern and parsed using its layout. Tags
+// that don't match, or don't parse, are skipped; tags with the same
+// date are ordered lexically, so that the result is deterministic.
+func calculateLatestImageDate(pol *imagev1alpha1.ImagePolicyChoice, tags []string) (string, error) {
+	dateOf, err := tagDates(pol.Date)
+	if err != nil {
+		return "", err
 	}
-	return "", nil
+
+	var latestDate time.Time
+	var latestTag string
+	for _, tag := range tags {
+		date, ok := dateOf(tag)
+		if !ok {
+			continue
+		}
+		if latestTag == "" || date.After(latestDate) || (date.Equal(latestDate) && tag > latestTag) {
+			latestDate = date
+			latestTag = tag
+		}
+	}
+	return latestTag, nil
+}
+
+// tagDates validates the date policy, and returns a func for getting
+// the date from a tag according to the policy; it returns false if
+// the tag doesn't match the pattern, or the date doesn't parse.
+func tagDates(pol *imagev1alpha1.DatePolicy) (func(tag string) (time.Time, bool), error) {
+	if err := pol.Validate(); err != nil {
+		return nil, err
+	}
+	pattern := regexp.MustCompile(pol.Pattern)
+	group := 1
+	for i, name := range pattern.SubexpNames() {
+		if name == "date" {
+			group = i
+			break
+		}
+	}
+	return func(tag string) (time.Time, bool) {
+		match := pattern.FindStringSubmatch(tag)
+		if match == nil {
+			return time.Time{}, false
+		}
+		date, err := time.Parse(pol.Layout, match[group])
+		if err != nil {
+			return time.Time{}, false
+		}
+		return date, true
+	}, nil
 }
 
 func (r *ImagePolicyReconciler) imagePoliciesForRepository(obj handler.MapObject) []reconcile.Request {
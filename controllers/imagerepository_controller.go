@@ -18,18 +18,41 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"go.opentelemetry.io/otel/label"
+	"golang.org/x/oauth2"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	kuberecorder "k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/fluxcd/pkg/recorder"
@@ -38,13 +61,24 @@ import (
 	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
 )
 
+// secretRefKey is the field on which image repositories are indexed
+// by the secret they use.
+const secretRefKey = ".spec.secretRef.name"
+
 const (
-	scanTimeout         = 10 * time.Second
+	defaultScanTimeout  = 10 * time.Second
 	defaultScanInterval = 10 * time.Minute
+	// doubleFetchDelay is how long to wait between the two listings
+	// when `.spec.doubleFetch` is set.
+	doubleFetchDelay = time.Second
 )
 
 type DatabaseWriter interface {
-	SetTags(repo string, tags []string)
+	SetTags(ctx context.Context, repo string, tags []string) error
+	SetTagsWithDigests(ctx context.Context, repo string, tags []string, digests map[string]string) error
+	SetTagPlatforms(ctx context.Context, repo string, platforms map[string][]string) error
+	SetTagTimes(ctx context.Context, repo string, times map[string]TagTimes) error
+	Delete(ctx context.Context, repo string) error
 }
 
 // ImageRepositoryReconciler reconciles a ImageRepository object
@@ -58,13 +92,181 @@ type ImageRepositoryReconciler struct {
 	}
 	EventRecorder         kuberecorder.EventRecorder
 	ExternalEventRecorder *recorder.EventRecorder
+	// WatchNamespaces restricts the reconciler to objects in the
+	// given namespaces; if empty, all namespaces are watched.
+	WatchNamespaces []string
+	// Transport is the base transport used for requests to
+	// registries. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// StartupScanRamp is the length of the window after startup over
+	// which scans that are due are spread out, so as not to hit
+	// registries with every scan at once. Zero means no ramp.
+	StartupScanRamp time.Duration
+	// FailureBackoff is how long to wait before scanning again after
+	// a failed scan; it doubles with each consecutive failure, up to
+	// the scan interval. If zero, failed scans are retried according
+	// to the controller's rate limiting instead.
+	FailureBackoff time.Duration
+	// MaxFailureBackoff caps the backoff after failed scans; if zero,
+	// the scan interval caps it.
+	MaxFailureBackoff time.Duration
+	// PartialScanCredit is the number of failures forgiven by a scan
+	// that fetched some, but not all, pages of tags.
+	PartialScanCredit int
+	// DatabaseKey says which name to key each image repository's
+	// tags on in the database; CanonicalNameKey (the default) or
+	// ShortNameKey. It must be the same for all reconcilers sharing
+	// the database.
+	DatabaseKey string
+	// MetadataFetchConcurrency is the most requests for per-tag
+	// metadata (e.g., platforms) made at once during a scan of an
+	// image repository. Less than one is treated as one.
+	MetadataFetchConcurrency int
+	// MetadataFetchPool, if not nil, bounds the per-tag metadata
+	// fetches in flight across all scans, and shares them fairly
+	// among the scans.
+	MetadataFetchPool *FetchPool
+	// NetworkRetries is the number of times a request to a registry
+	// is retried within a scan, if it fails to resolve the registry's
+	// host or with a temporary network error; and NetworkRetryDelay
+	// is how long to wait before the first retry, doubling after.
+	NetworkRetries    int
+	NetworkRetryDelay time.Duration
+	// ScanBudget, if not nil, paces the scans of image repositories
+	// sharing an account on a registry, to keep their combined rate
+	// within the registry's limit.
+	ScanBudget *ScanBudget
+	// MaxConcurrentScans is the most image repositories reconciled
+	// at once; if zero, there's just the one.
+	MaxConcurrentScans int
+	// HostLimiter, if not nil, bounds the requests in flight to each
+	// registry host across all scans.
+	HostLimiter *HostLimiter
+	// ProbeVisibility, if true, makes each scan of an image
+	// repository with credentials also try listing its tags
+	// anonymously, to find out whether it's public. This costs
+	// another request to the registry per scan.
+	ProbeVisibility bool
+	// ProgressInterval is how often the progress of a scan is
+	// written to the status of the image repository, once it has
+	// been going that long. Zero means progress isn't reported.
+	ProgressInterval time.Duration
+	// MaxCacheHint bounds how long the next scan of an image
+	// repository is put off, when the registry says its listing of
+	// tags stays fresh for longer than the scan interval. Zero means
+	// such hints are ignored.
+	MaxCacheHint time.Duration
+	// RestrictRedirects, if true, fails a scan when the registry
+	// redirects a request to a host other than its own and those in
+	// AllowedRedirectHosts; a host there may be given as
+	// `*.<domain>`, to allow any host within the domain.
+	RestrictRedirects    bool
+	AllowedRedirectHosts []string
+	// AllowInlineAuth lets image repositories give credentials in
+	// `.spec.inlineAuth`; otherwise, scans of those that do fail.
+	AllowInlineAuth bool
+	// Keychain, if not nil, is consulted for credentials for image
+	// repositories that don't give any; e.g., authn.DefaultKeychain,
+	// which reads the controller's docker config.
+	Keychain authn.Keychain
+	// StatusTagLimit is the most tags listed in
+	// `.status.lastScanResult.latestTags`; zero means none are.
+	StatusTagLimit int
+	// DigestTagLimit is how many of the latest tags found by each
+	// scan have their digests resolved and recorded; zero means none
+	// do. Resolving each takes a request to the registry.
+	DigestTagLimit int
+	// TimestampTagLimit is how many of the latest tags found by each
+	// scan have the creation times of their images fetched, so that
+	// `.status.lastScanResult.latestTags` can be given in the order
+	// the images were created; zero means none do, and the tags are
+	// given in the order listed. Fetching each takes requests to the
+	// registry.
+	TimestampTagLimit int
+	// TagChangeLogLimit is the most tags named in each of the samples
+	// of those added and removed logged when a scan finds the tags
+	// have changed; zero means only how many is logged.
+	TagChangeLogLimit int
+	// MaxResponseSize is the largest response to a request for a
+	// listing of tags accepted from a registry, in bytes; a scan
+	// getting a larger response fails. Zero means no limit.
+	MaxResponseSize int64
+	// DisablePerObjectMetrics leaves all image repositories out of
+	// the metrics that have a series per object, as though each were
+	// annotated to opt out.
+	DisablePerObjectMetrics bool
+	// PushReceiver, if not nil, has image repositories scanned as
+	// soon as it gets a push notification for the image they scan.
+	PushReceiver *PushReceiver
+	// ScanHealth, if not nil, is told the outcome of each scan, for
+	// the readiness check.
+	ScanHealth *ScanHealth
+	// ScanTimeout is how long a scan is given, for image repositories
+	// that don't give a timeout themselves. If zero, it's ten
+	// seconds.
+	ScanTimeout time.Duration
+	// DefaultScanInterval is the scan interval for image repositories
+	// that don't give one themselves. If zero, it's ten minutes.
+	DefaultScanInterval time.Duration
+	// MinScanInterval is the shortest scan interval used; an image
+	// repository giving a shorter one is scanned at this interval
+	// instead. Zero means there's no minimum.
+	MinScanInterval time.Duration
+	// MaxConditionMessageLength is the longest, in bytes, a status
+	// condition message is written; longer messages are truncated.
+	// Zero means messages are never truncated.
+	MaxConditionMessageLength int
+	// TagRetention is how long a tag that's no longer found by scans
+	// stays recorded, in case it's only missing from a listing for a
+	// while. Zero means it's dropped by the first scan not to find it.
+	// When a tag was last seen is only recorded to within a tenth of
+	// this, so it may be dropped that much sooner.
+	TagRetention time.Duration
+	// UserAgent is given as the User-Agent of requests to registries,
+	// unless an image repository gives its own in
+	// `.spec.customHeaders`. If empty, that of the registry client
+	// library is.
+	UserAgent string
+
+	startedAt time.Time
+	// secretChanges records changes to the secrets the image
+	// repositories use.
+	secretChanges secretChanges
+	// transports keeps the transports made for image repositories
+	// that skip verifying certificates or trust their own.
+	transports transportCache
+	// ecrToken gets tokens for ECR; if nil, fetchECRToken is used.
+	ecrToken ecrTokenFunc
+	// gcpTokens gives tokens for Google Cloud; if nil, the
+	// controller's default credentials are used.
+	gcpTokens oauth2.TokenSource
+	// acrTokens gets tokens for ACR; if nil, defaultACRTokens is
+	// used.
+	acrTokens *acrTokenExchanger
+}
+
+func (r *ImageRepositoryReconciler) authOptions() authOptions {
+	return authOptions{
+		allowInline: r.AllowInlineAuth,
+		ecrToken:    r.ecrToken,
+		gcpTokens:   r.gcpTokens,
+		acrTokens:   r.acrTokens,
+		keychain:    r.Keychain,
+	}
 }
 
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagerepositories,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagerepositories/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
 
-func (r *ImageRepositoryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+func (r *ImageRepositoryReconciler) Reconcile(req ctrl.Request) (result ctrl.Result, err error) {
+	ctx, span := startSpan(context.Background(), "ImageRepository.Reconcile",
+		label.String("namespace", req.Namespace), label.String("name", req.Name))
+	defer func() {
+		endSpan(ctx, span, err)
+	}()
 
 	// NB: In general, if an error is returned then controller-runtime
 	// will requeue the request with back-off. In the following this
@@ -73,21 +275,53 @@ func (r *ImageRepositoryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 
 	var imageRepo imagev1alpha1.ImageRepository
 	if err := r.Get(ctx, req.NamespacedName, &imageRepo); err != nil {
+		if apierrors.IsNotFound(err) {
+			repositoryReadiness.forget(req.NamespacedName)
+			repositoryTags.DeleteLabelValues(req.Namespace, req.Name)
+			r.PushReceiver.forget(req.NamespacedName)
+			r.secretChanges.forget(req.NamespacedName)
+			r.transports.forget(req.NamespacedName)
+			if r.ScanBudget != nil {
+				r.ScanBudget.forget(req.NamespacedName)
+			}
+		}
 		// _Might_ get requeued
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	log := r.Log.WithValues("controller", strings.ToLower(imagev1alpha1.ImageRepositoryKind), "request", req.NamespacedName)
 
+	if !imageRepo.GetDeletionTimestamp().IsZero() {
+		return ctrl.Result{}, r.reconcileDelete(ctx, imageRepo)
+	}
+	if !controllerutil.ContainsFinalizer(&imageRepo, imagev1alpha1.ImageRepositoryFinalizer) {
+		controllerutil.AddFinalizer(&imageRepo, imagev1alpha1.ImageRepositoryFinalizer)
+		if err := r.Update(ctx, &imageRepo); err != nil {
+			log.Error(err, "unable to add finalizer")
+			return ctrl.Result{Requeue: true}, err
+		}
+	}
+
+	// this counts image repositories that aren't due a scan, e.g.,
+	// after a restart; updateStatus keeps the count up to date
+	repositoryReadiness.record(imageRepo)
+
 	if imageRepo.Spec.Suspend {
 		msg := "ImageRepository is suspended, skipping reconciliation"
+		if imageRepo.Status.SuspendedSince == nil {
+			suspendedAt := metav1.Now()
+			imageRepo.Status.SuspendedSince = &suspendedAt
+		}
+		// the Ready condition is about to record the suspension, so
+		// make sure the time of the last scan isn't lost with it
+		imageRepo.Status.LastScanTime = imagev1alpha1.GetLastScanTime(imageRepo)
 		status := imagev1alpha1.SetImageRepositoryReadiness(
 			imageRepo,
 			corev1.ConditionFalse,
 			imagev1alpha1.SuspendedReason,
 			msg,
 		)
-		if err := r.Status().Update(ctx, &status); err != nil {
+		if err := r.updateStatus(ctx, &status); err != nil {
 			log.Error(err, "unable to update status")
 			return ctrl.Result{Requeue: true}, err
 		}
@@ -95,7 +329,22 @@ func (r *ImageRepositoryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 		return ctrl.Result{}, nil
 	}
 
-	ref, err := name.ParseReference(imageRepo.Spec.Image)
+	image, err := r.resolveImage(ctx, imageRepo)
+	if err != nil {
+		status := imagev1alpha1.SetImageRepositoryReadiness(
+			imageRepo,
+			corev1.ConditionFalse,
+			imagev1alpha1.SubstitutionFailedReason,
+			err.Error(),
+		)
+		if err := r.updateStatus(ctx, &status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		log.Error(err, "Unable to resolve image name", "imageName", imageRepo.Spec.Image)
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	ref, err := name.ParseReference(image, nameOptions(imageRepo.Spec)...)
 	if err != nil {
 		status := imagev1alpha1.SetImageRepositoryReadiness(
 			imageRepo,
@@ -103,57 +352,547 @@ func (r *ImageRepositoryReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 			imagev1alpha1.ImageURLInvalidReason,
 			err.Error(),
 		)
-		if err := r.Status().Update(ctx, &status); err != nil {
+		if err := r.updateStatus(ctx, &status); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		log.Error(err, "Unable to parse image name", "imageName", image)
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	if _, err := newTagFilter(imageRepo.Spec.TagFilters); err != nil {
+		status := imagev1alpha1.SetImageRepositoryReadiness(
+			imageRepo,
+			corev1.ConditionFalse,
+			imagev1alpha1.TagFilterInvalidReason,
+			err.Error(),
+		)
+		if err := r.updateStatus(ctx, &status); err != nil {
 			return ctrl.Result{Requeue: true}, err
 		}
-		log.Error(err, "Unable to parse image name", "imageName", imageRepo.Spec.Image)
+		log.Error(err, "Unable to parse tag filters")
 		return ctrl.Result{Requeue: true}, err
 	}
 
+	// if the image has been changed, what was recorded for the old
+	// one is dropped, so it's not left behind in the database; and
+	// the new image is scanned straight away.
+	imageChanged := false
+	if previous := imageRepo.Status.CanonicalImageName; previous != "" && previous != ref.Context().String() {
+		imageChanged = true
+		if err := r.forgetImage(ctx, imageRepo); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+		msg := fmt.Sprintf("image changed from %s to %s", previous, ref.Context().String())
+		log.Info(msg)
+		r.event(imageRepo, recorder.EventSeverityInfo, "ImageChanged", msg)
+	}
+
 	imageRepo.Status.CanonicalImageName = ref.Context().String()
+	imageRepo.Status.ShortImageName = shortImageName(ref.Context())
 
 	now := time.Now()
 	ok, when := r.shouldScan(imageRepo, now)
+	ok = ok || imageChanged
+
+	// on resuming, the next scan is when it would have been had the
+	// image repository not been suspended.
+	if imageRepo.Status.SuspendedSince != nil {
+		imageRepo.Status.SuspendedSince = nil
+		if !ok {
+			status := imagev1alpha1.SetImageRepositoryReadiness(
+				imageRepo,
+				corev1.ConditionUnknown,
+				imagev1alpha1.ProgressingReason,
+				fmt.Sprintf("ImageRepository resumed, next scan in %s", when),
+			)
+			if err := r.updateStatus(ctx, &status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			log.Info("resumed", "next run", when.String())
+			return ctrl.Result{RequeueAfter: when}, nil
+		}
+	}
+
+	// a secret that's gone is reported straight away, rather than
+	// when the next scan fails for want of it
+	if !ok && imageRepo.Spec.SecretRef != nil {
+		secretName := types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.Spec.SecretRef.Name}
+		if err := r.Get(ctx, secretName, &corev1.Secret{}); apierrors.IsNotFound(err) {
+			status := imagev1alpha1.SetImageRepositoryReadiness(
+				imageRepo,
+				corev1.ConditionFalse,
+				imagev1alpha1.SecretNotFoundReason,
+				err.Error(),
+			)
+			if err := r.updateStatus(ctx, &status); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			log.Error(err, "secret for scanning not found", "secret", secretName.Name)
+			return ctrl.Result{RequeueAfter: when}, nil
+		}
+	}
+
 	if ok {
-		ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+		if delay := r.startupDelay(req.NamespacedName, now); delay > 0 {
+			log.Info("delaying scan to spread out scans after startup", "delay", delay.String())
+			return ctrl.Result{RequeueAfter: delay}, nil
+		}
+
+		// the status is written with the outer context, so that a
+		// scan that times out is still recorded
+		scanCtx, cancel := context.WithTimeout(ctx, r.scanTimeout(imageRepo))
 		defer cancel()
 
-		reconciledRepo, reconcileErr := r.scan(ctx, imageRepo, ref)
-		if err = r.Status().Update(ctx, &reconciledRepo); err != nil {
+		// the credentials are needed for the scan budget as well as
+		// the scan, and resolving them can mean fetching secrets or
+		// tokens, so it's done once for both
+		auth := r.resolveAuth(scanCtx, imageRepo, ref)
+		if delay := r.budgetDelay(imageRepo, ref, auth, now); delay > 0 {
+			log.Info("delaying scan to keep within the registry's rate limit", "delay", delay.String())
+			return ctrl.Result{RequeueAfter: delay}, nil
+		}
+
+		reconciledRepo, reconcileErr := r.scanWithAuth(scanCtx, imageRepo, ref, auth)
+		recordScan(reconciledRepo, reconcileErr, !r.DisablePerObjectMetrics && perObjectMetrics(&reconciledRepo))
+		r.ScanHealth.observe(reconcileErr, time.Now())
+		if reconciledRepo.Spec.ForceScan {
+			if err = r.resetForceScan(ctx, &reconciledRepo); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+		}
+		if err = r.updateStatus(ctx, &reconciledRepo); err != nil {
 			return ctrl.Result{Requeue: true}, err
 		}
 
 		if reconcileErr != nil {
+			// the message in the Ready condition may have been
+			// truncated, so make sure the whole error is logged
+			log.Error(reconcileErr, "scan failed", "failures", reconciledRepo.Status.ScanFailures)
+			if failureReason(imageRepo) != failureReason(reconciledRepo) {
+				r.event(reconciledRepo, recorder.EventSeverityError, imagev1alpha1.ReconciliationFailedReason, reconcileErr.Error())
+			}
+			// a registry that's said when to come back is taken at
+			// its word
+			if wait := retryAfter(reconciledRepo, time.Now()); wait > 0 {
+				log.Info("registry rate limit exceeded, waiting to scan again", "delay", wait.String())
+				return ctrl.Result{RequeueAfter: wait}, nil
+			}
+			// retrying straight away won't help when the registry
+			// has refused the credentials or doesn't have the
+			// repository, so that waits for the next scan
+			if r.FailureBackoff > 0 || isPermanentScanFailure(reconcileErr) {
+				return ctrl.Result{RequeueAfter: withJitter(r.scanInterval(reconciledRepo))}, nil
+			}
 			return ctrl.Result{Requeue: true}, reconcileErr
-		} else {
-			log.Info(fmt.Sprintf("reconciliation finished in %s, next run in %s",
-				time.Now().Sub(now).String(),
-				when),
-			)
 		}
+		if !isReady(imageRepo) || imageRepo.Status.ScanFailures > 0 ||
+			imageRepo.Status.LastScanResult.TagCount != reconciledRepo.Status.LastScanResult.TagCount {
+			r.event(reconciledRepo, recorder.EventSeverityInfo, imagev1alpha1.ReconciliationSucceededReason,
+				readyMessage(reconciledRepo))
+		}
+		if err := r.exportTags(ctx, &reconciledRepo); err != nil {
+			log.Error(err, "unable to export tags to ConfigMap")
+			return ctrl.Result{Requeue: true}, err
+		}
+		log.Info(fmt.Sprintf("reconciliation finished in %s, next run in %s",
+			time.Now().Sub(now).String(),
+			when),
+		)
 	}
 
 	return ctrl.Result{RequeueAfter: when}, nil
 }
 
+// scanAuth is what comes of resolving the credentials for scanning
+// an image repository: the authenticator and a description of the
+// credentials, or the error that stopped them being resolved.
+type scanAuth struct {
+	auth        authn.Authenticator
+	credentials *imagev1alpha1.ScanCredentials
+	err         error
+}
+
+// resolveAuth resolves the credentials for scanning the image
+// repository. An error is kept in the result, to be reported by the
+// scan.
+func (r *ImageRepositoryReconciler) resolveAuth(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, ref name.Reference) scanAuth {
+	authCtx, authSpan := startSpan(ctx, "credentials", repositoryLabels(ref.Context())...)
+	auth, credentials, err := credentialsFor(authCtx, r.Client, r.Log, imageRepo, ref, r.authOptions())
+	endSpan(authCtx, authSpan, err)
+	return scanAuth{auth: auth, credentials: credentials, err: err}
+}
+
+// scan resolves the credentials for the image repository, and scans
+// it with them.
 func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, ref name.Reference) (imagev1alpha1.ImageRepository, error) {
-	canonicalName := ref.Context().String()
+	return r.scanWithAuth(ctx, imageRepo, ref, r.resolveAuth(ctx, imageRepo, ref))
+}
+
+// scanWithAuth scans the image repository with the credentials
+// already resolved for it.
+func (r *ImageRepositoryReconciler) scanWithAuth(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, ref name.Reference, resolved scanAuth) (scanned imagev1alpha1.ImageRepository, scanErr error) {
+	dbKey := databaseKey(r.DatabaseKey, ref.Context())
+
+	ctx, span := startSpan(ctx, "ImageRepository.scan", repositoryLabels(ref.Context())...)
+	defer func() {
+		endSpan(ctx, span, scanErr)
+	}()
+
+	progress := newScanProgress(ctx, r.Client, r.Log, imageRepo, r.ProgressInterval)
+	defer func() {
+		progress.carryOver(&scanned)
+	}()
+
+	// the image repository only fails if none of the images it
+	// scans could be scanned
+	var images []imagev1alpha1.ImageScanResult
+	defer func() {
+		if scanErr != nil && anyImageScanned(images) {
+			r.Log.Error(scanErr, "scan of image failed, but some listed images were scanned",
+				"namespace", scanned.GetNamespace(), "name", scanned.GetName())
+			scanned, scanErr = partiallyScanned(scanned, scanErr), nil
+		}
+	}()
+
+	scanTime := metav1.Now()
+	imageRepo.Status.LastScanTime = &scanTime
+	imageRepo.Status.LastScanResult.DryRun = imageRepo.Spec.DryRun
+	// the ETag is only kept by a scan that records the listing it's for
+	ifChangedSince := r.listingETag(imageRepo, dbKey)
+	imageRepo.Status.LastScanResult.ETag = ""
+
+	// an error from a scan cut short by its timeout says so, since
+	// the remedy is to give the scan longer
+	timedOut := func(err error) error {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return &scanTimeoutError{timeout: r.scanTimeout(imageRepo), err: err}
+		}
+		return err
+	}
+	failed := func(err error) (imagev1alpha1.ImageRepository, error) {
+		imageRepo.Status.ScanFailures++
+		err = timedOut(err)
+		return scanFailed(imageRepo, scanFailureReason(err), err, time.Now()), err
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	base, repoName := transport, types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()}
+	switch {
+	case imageRepo.Spec.Insecure:
+		if imageRepo.Spec.CertSecretRef != nil {
+			r.event(imageRepo, recorder.EventSeverityError, "InsecureOverridesCertSecret",
+				"both .spec.insecure and .spec.certSecretRef are given; the registry's certificate is not verified")
+		}
+		transport, _ = r.transports.get(repoName, transportKey{base: base, insecure: true}, func() (http.RoundTripper, error) {
+			return insecureTransport(base), nil
+		})
+	case imageRepo.Spec.CertSecretRef != nil:
+		var secret corev1.Secret
+		secretName := types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.Spec.CertSecretRef.Name}
+		if err := r.getSecret(ctx, secretName, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				imageRepo.Status.ScanFailures++
+				return scanFailed(imageRepo, imagev1alpha1.SecretNotFoundReason, err, time.Now()), err
+			}
+			return failed(err)
+		}
+		key := transportKey{base: base, caHash: sha256.Sum256(secret.Data[caCertKey])}
+		certTransport, err := r.transports.get(repoName, key, func() (http.RoundTripper, error) {
+			return transportFromCertSecret(secret, base)
+		})
+		if err != nil {
+			return failed(err)
+		}
+		transport = certTransport
+	default:
+		r.transports.forget(repoName)
+	}
+	if imageRepo.Spec.ProxySecretRef != nil {
+		var secret corev1.Secret
+		secretName := types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.Spec.ProxySecretRef.Name}
+		if err := r.getSecret(ctx, secretName, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				imageRepo.Status.ScanFailures++
+				return scanFailed(imageRepo, imagev1alpha1.SecretNotFoundReason, err, time.Now()), err
+			}
+			return failed(err)
+		}
+		proxyURL, err := proxyURLFromSecret(secret)
+		if err != nil {
+			return failed(err)
+		}
+		if transport, err = proxyTransport(transport, proxyURL); err != nil {
+			return failed(err)
+		}
+	}
+	// each attempt at a request takes its own turn, so a request
+	// waiting to be retried doesn't hold up others to the registry
+	transport = r.HostLimiter.transport(transport)
+	if r.NetworkRetries > 0 {
+		transport = &retryTransport{
+			inner:   transport,
+			retries: r.NetworkRetries,
+			delay:   r.NetworkRetryDelay,
+		}
+	}
+	if r.MaxResponseSize > 0 {
+		transport = &responseSizeTransport{
+			inner: transport,
+			limit: r.MaxResponseSize,
+		}
+	}
+	if r.RestrictRedirects {
+		transport = &redirectTransport{
+			inner:   transport,
+			allowed: r.AllowedRedirectHosts,
+		}
+	}
+	// custom headers may carry credentials, so they're left out of
+	// any anonymous probe
+	probeTransport := transport
+	if headers := imageRepo.Spec.CustomHeaders; len(headers) > 0 {
+		transport = &headerTransport{
+			inner:   transport,
+			headers: headers,
+			host:    ref.Context().RegistryStr(),
+		}
+	}
+	transport = withUserAgent(transport, r.UserAgent)
+	probeTransport = withUserAgent(probeTransport, r.UserAgent)
+	rateLimits := &rateLimitTransport{inner: transport}
+	defer func() {
+		scanned.Status.RateLimit = rateLimits.status()
+	}()
+	deprecations := &deprecationTransport{inner: rateLimits}
+	cacheControl := &cacheControlTransport{inner: deprecations}
+	firstResponse := &firstResponseTransport{inner: cacheControl}
+	transport = firstResponse
 
-	// TODO: implement auth
-	tags, err := remote.ListWithContext(ctx, ref.Context())
+	auth, credentials, err := resolved.auth, resolved.credentials, resolved.err
+	if apierrors.IsNotFound(err) {
+		imageRepo.Status.ScanFailures++
+		return scanFailed(imageRepo, imagev1alpha1.SecretNotFoundReason, err, time.Now()), err
+	}
 	if err != nil {
-		return imagev1alpha1.SetImageRepositoryReadiness(
-			imageRepo,
-			corev1.ConditionFalse,
-			imagev1alpha1.ReconciliationFailedReason,
-			err.Error(),
-		), err
+		return failed(err)
+	}
+
+	// a dry run only checks that `.spec.image` can be scanned
+	if !imageRepo.Spec.DryRun {
+		imageRepo.Status.Repositories = r.scanRepositories(ctx, imageRepo, ref.Context().Registry, auth, transport)
+		images = r.scanImages(ctx, imageRepo, transport)
+		imageRepo.Status.Images = images
+	}
+
+	filter, err := newTagFilter(imageRepo.Spec.TagFilters)
+	if err != nil {
+		imageRepo.Status.ScanFailures++
+		return scanFailed(imageRepo, imagev1alpha1.TagFilterInvalidReason, err, time.Now()), err
+	}
+	var listed, dropped, unfiltered int
+	var etag string
+	list := func() ([]string, error) {
+		start := time.Now()
+		listCtx, listSpan := startSpan(ctx, "list tags", repositoryLabels(ref.Context())...)
+		var tags []string
+		var err error
+		tags, etag, err = listTagsSince(listCtx, ref.Context(), auth, transport, ifChangedSince, func(pages, tags int) {
+			progress.report(fmt.Sprintf("listing tags, fetched %d page(s) with %d tags so far", pages, tags))
+		})
+		endSpan(listCtx, listSpan, err)
+		scanListDuration.Observe(time.Since(start).Seconds())
+		listed = len(tags)
+		tags, dropped = cleanTags(tags, ref.Context(), imageRepo.Spec)
+		unfiltered = len(tags)
+		return filter.apply(tags), err
+	}
+	tags, err := list()
+	if errors.Is(err, errNotModified) {
+		return notModifiedScanned(imageRepo, etag), nil
+	}
+	if err == nil && imageRepo.Spec.DoubleFetch {
+		tags, err = fetchAgain(ctx, tags, list)
+	}
+	if err != nil {
+		var partial *partialListError
+		if !errors.As(err, &partial) || imageRepo.Spec.DryRun {
+			return failed(err)
+		}
+		// Some tags were fetched; these are added to those already
+		// known, so nothing is lost, but the scan still counts
+		// against the backoff (see scanFailuresAfterPartialScan). The
+		// digests recorded for them are kept too.
+		known, dbErr := r.Database.Tags(dbKey)
+		if dbErr == nil {
+			union := unionTags(known, tags)
+			dbErr = r.Database.SetTagsWithDigests(ctx, dbKey, union, recordedDigests(r.Database, dbKey, union))
+		}
+		if dbErr != nil {
+			return failed(fmt.Errorf("unable to record tags: %w", dbErr))
+		}
+		imageRepo.Status.ScanFailures = scanFailuresAfterPartialScan(imageRepo.Status.ScanFailures, r.PartialScanCredit)
+		err = timedOut(err)
+		return scanFailed(imageRepo, scanFailureReason(err), err, time.Now()), err
+	}
+
+	imageRepo.Status.LastScanResult.ListedTagCount = listed
+	imageRepo.Status.LastScanResult.DroppedTagCount = dropped
+	if dropped > 0 {
+		r.logger().Info("dropped empty, duplicate or invalid tags listed by the registry",
+			"imagerepository", types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()},
+			"repository", ref.Context().String(), "listed", listed, "dropped", dropped)
+	}
+
+	if imageRepo.Spec.DryRun {
+		return dryRunScanned(imageRepo, tags, unfiltered, credentials), nil
+	}
+
+	metadata := &fetcher{
+		concurrency: r.MetadataFetchConcurrency,
+		pool:        r.MetadataFetchPool,
+		progress: func(done, total int) {
+			progress.report(fmt.Sprintf("fetching metadata, done %d/%d tags", done, total))
+		},
+	}
+
+	// digests are resolved for the latest tags only, since each
+	// takes a request
+	var digests map[string]string
+	if latest, _ := lastTags(tags, r.DigestTagLimit); len(latest) > 0 {
+		var platform *v1.Platform
+		if imageRepo.Spec.Platform != nil {
+			p, err := parsePlatform(*imageRepo.Spec.Platform)
+			if err != nil {
+				return failed(fmt.Errorf("invalid .spec.platform: %w", err))
+			}
+			platform = &p
+		}
+		if digests, err = fetchDigests(ctx, ref.Context(), latest, transport, auth, platform, metadata); err != nil {
+			return failed(err)
+		}
+	}
+
+	// a scan is only a success if the tags it found are recorded
+	previous, err := r.Database.Tags(dbKey)
+	if err != nil {
+		return failed(fmt.Errorf("unable to read recorded tags: %w", err))
+	}
+	// tags recorded before but not found this time are kept until
+	// they've gone unseen for the retention period
+	knownTimes := r.Database.TagTimes(dbKey)
+	tagTimes, retained, removed := updateTagTimes(knownTimes, previous, tags, time.Now(), r.TagRetention)
+	recorded := append(tags[:len(tags):len(tags)], retained...)
+	unchanged := sameTags(previous, recorded)
+	// the tags are only written when there's something new to record,
+	// to spare a persistent database the writes
+	if !unchanged || !sameDigests(r.Database, dbKey, recorded, digests) {
+		writeCtx, writeSpan := startSpan(ctx, "record tags", label.String("key", dbKey), label.Int("tags", len(recorded)))
+		err := r.Database.SetTagsWithDigests(writeCtx, dbKey, recorded, digests)
+		endSpan(writeCtx, writeSpan, err)
+		if err != nil {
+			return failed(fmt.Errorf("unable to record tags: %w", err))
+		}
+	}
+	if !sameTagTimes(knownTimes, tagTimes) {
+		if err := r.Database.SetTagTimes(ctx, dbKey, tagTimes); err != nil {
+			return failed(fmt.Errorf("unable to record when tags were seen: %w", err))
+		}
+	}
+	if !unchanged {
+		addedTags, removedTags := diffTags(previous, recorded)
+		logTagChanges(r.logger().WithValues("imagerepository", types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()},
+			"repository", ref.Context().String()), addedTags, removedTags, r.TagChangeLogLimit)
+		if previous != nil {
+			r.event(imageRepo, recorder.EventSeverityInfo, "TagsChanged", summarizeTagChanges(addedTags, removedTags))
+		}
+	}
+	// the first scan finds nothing out about how often the tags
+	// change, so it doesn't count towards the activity
+	if r.ScanBudget != nil && previous != nil {
+		r.ScanBudget.observe(types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()}, !unchanged)
+	}
+
+	if imageRepo.Spec.InspectPlatforms && imageRepo.Spec.ArtifactType != imagev1alpha1.ChartArtifactType {
+		platforms, err := fetchPlatforms(ctx, ref.Context(), tags, transport, auth, metadata)
+		if err != nil {
+			return failed(err)
+		}
+		if err := r.Database.SetTagPlatforms(ctx, dbKey, platforms); err != nil {
+			return failed(fmt.Errorf("unable to record platforms: %w", err))
+		}
+	}
+
+	var oldestTagTime, newestTagTime *metav1.Time
+	var timestamps map[string]time.Time
+	if imageRepo.Spec.InspectTimestamps && imageRepo.Spec.ArtifactType != imagev1alpha1.ChartArtifactType {
+		if timestamps, err = fetchTimestamps(ctx, ref.Context(), tags, transport, auth, metadata); err != nil {
+			return failed(err)
+		}
+		if oldest, newest := tagTimeSpan(timestamps); oldest != nil {
+			oldestTagTime, newestTagTime = &metav1.Time{Time: *oldest}, &metav1.Time{Time: *newest}
+		}
+	}
+	imageRepo.Status.OldestTagTime, imageRepo.Status.NewestTagTime = oldestTagTime, newestTagTime
+
+	// the latest tags are those last listed, unless the images at
+	// some of them can be put in the order they were created; the
+	// timestamps are only fetched here if they weren't above
+	latestTags, latestOrder := tags, ""
+	if candidates, _ := lastTags(tags, r.TimestampTagLimit); len(candidates) > 0 && imageRepo.Spec.ArtifactType != imagev1alpha1.ChartArtifactType {
+		if timestamps == nil {
+			if timestamps, err = fetchTimestamps(ctx, ref.Context(), candidates, transport, auth, metadata); err != nil {
+				return failed(err)
+			}
+		}
+		if sorted, ok := sortByCreated(candidates, timestamps); ok {
+			latestTags, latestOrder = sorted, imagev1alpha1.CreatedTagOrder
+		}
 	}
 
-	// TODO: add context and error handling to database ops
-	r.Database.SetTags(canonicalName, tags)
+	if imageRepo.Spec.AuditReferences {
+		refs, err := fetchCrossRepositoryReferences(ctx, ref.Context(), tags, transport, auth, metadata)
+		if err != nil {
+			return failed(err)
+		}
+		imageRepo.Status.CrossRepositoryReferences = refs
+	} else {
+		imageRepo.Status.CrossRepositoryReferences = nil
+	}
 
 	imageRepo.Status.LastScanResult.TagCount = len(tags)
+	imageRepo.Status.LastScanResult.TagsChanged = !unchanged
+	imageRepo.Status.LastScanResult.RemovedTagCount = removed
+	imageRepo.Status.LastScanResult.ETag = etag
+	imageRepo.Status.LastScanResult.TotalTagCount = totalTagCount(len(tags), images)
+	imageRepo.Status.LastScanResult.UnfilteredTagCount = unfiltered
+	imageRepo.Status.LastScanResult.LatestTags, _ = lastTags(latestTags, r.StatusTagLimit)
+	imageRepo.Status.LastScanResult.Truncated = r.StatusTagLimit > 0 && len(tags) > r.StatusTagLimit
+	imageRepo.Status.LastScanResult.LatestTagsOrder = latestOrder
+	imageRepo.Status.LastScanResult.LatestDigest = ""
+	if len(tags) > 0 {
+		imageRepo.Status.LastScanResult.LatestDigest = digests[tags[len(tags)-1]]
+	}
+	imageRepo.Status.LastScanResult.Credentials = credentials
+	imageRepo.Status.LastScanResult.YieldedFetches = metadata.yieldedFetches()
+	registry := detectRegistry(ref.Context().RegistryStr(), firstResponse.firstHeader())
+	imageRepo.Status.Registry = &registry
+	imageRepo.Status.LastScanResult.CacheHint = r.cacheHint(imageRepo, cacheControl.freshFor())
+	imageRepo.Status.Visibility = r.visibility(ctx, ref.Context(), credentials, probeTransport)
+	imageRepo.Status.ScanFailures = 0
+	imageRepo.Status.FailingSince = nil
+	imageRepo = imagev1alpha1.RemoveImageRepositoryCondition(imageRepo, imagev1alpha1.ScanFailingCondition)
+
+	// report a deprecation notice once, rather than on every scan
+	if notice := deprecations.notice(); notice != imageRepo.Status.RegistryDeprecation {
+		if notice != "" {
+			r.event(imageRepo, recorder.EventSeverityError, "RegistryDeprecation",
+				"registry reports that the API used for scanning is deprecated: "+notice)
+		}
+		imageRepo.Status.RegistryDeprecation = notice
+	}
 
 	// if the reconcile request annotation was set, consider it
 	// handled (NB it doesn't matter here if it was changed since last
@@ -162,26 +901,552 @@ func (r *ImageRepositoryReconciler) scan(ctx context.Context, imageRepo imagev1a
 		imageRepo.Status.SetLastHandledReconcileRequest(token)
 	}
 
-	return imagev1alpha1.SetImageRepositoryReadiness(
+	// if asked, a scan that found nothing new leaves the Ready
+	// condition alone, so its last transition time marks the last
+	// time the tags changed.
+	if imageRepo.Spec.StableTransitionTime && unchanged && isReady(imageRepo) {
+		imageRepo.Status.ObservedGeneration = imageRepo.GetGeneration()
+		return checkRevision(imageRepo, tags), nil
+	}
+
+	found := "tags"
+	if imageRepo.Spec.ArtifactType == imagev1alpha1.ChartArtifactType {
+		found = "chart versions"
+	}
+	imageRepo = imagev1alpha1.SetImageRepositoryReadiness(
 		imageRepo,
 		corev1.ConditionTrue,
 		imagev1alpha1.ReconciliationSucceededReason,
-		fmt.Sprintf("successful scan, found %v tags", len(tags)),
-	), nil
+		fmt.Sprintf("successful scan, found %v %s", len(tags), found),
+	)
+	return checkRevision(imageRepo, tags), nil
+}
+
+// lastTags returns the last tags of those given, up to the limit, and
+// whether any were left out.
+func lastTags(tags []string, limit int) ([]string, bool) {
+	if limit <= 0 || len(tags) == 0 {
+		return nil, false
+	}
+	if len(tags) <= limit {
+		return append([]string(nil), tags...), false
+	}
+	return append([]string(nil), tags[len(tags)-limit:]...), true
+}
+
+// reconcileDelete drops what's recorded for an image repository
+// being deleted, then lets it go by removing the finalizer.
+func (r *ImageRepositoryReconciler) reconcileDelete(ctx context.Context, imageRepo imagev1alpha1.ImageRepository) error {
+	if !controllerutil.ContainsFinalizer(&imageRepo, imagev1alpha1.ImageRepositoryFinalizer) {
+		return nil
+	}
+	if imageRepo.Status.CanonicalImageName != "" {
+		if err := r.forgetImage(ctx, imageRepo); err != nil {
+			return err
+		}
+	}
+	controllerutil.RemoveFinalizer(&imageRepo, imagev1alpha1.ImageRepositoryFinalizer)
+	return r.Update(ctx, &imageRepo)
+}
+
+// forgetImage drops the tags recorded for the image repository, as
+// last scanned, from the database; unless another image repository
+// shares them, by scanning the same image. Image repositories being
+// deleted don't count, so that when those sharing an image are all
+// deleted at once, the tags are still dropped. If they can't be
+// dropped, the error is returned, so that an image repository being
+// deleted keeps its finalizer until they are.
+func (r *ImageRepositoryReconciler) forgetImage(ctx context.Context, imageRepo imagev1alpha1.ImageRepository) error {
+	dbKey := scannedDatabaseKey(r.DatabaseKey, imageRepo)
+	var repos imagev1alpha1.ImageRepositoryList
+	if err := r.List(ctx, &repos); err != nil {
+		return err
+	}
+	for _, other := range repos.Items {
+		if other.GetNamespace() == imageRepo.GetNamespace() && other.GetName() == imageRepo.GetName() {
+			continue
+		}
+		if !other.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		if scannedDatabaseKey(r.DatabaseKey, other) == dbKey {
+			return nil
+		}
+	}
+	if err := r.Database.Delete(ctx, dbKey); err != nil {
+		return fmt.Errorf("unable to drop recorded tags: %w", err)
+	}
+	return nil
+}
+
+// visibility returns the visibility to record for an image
+// repository that has just been scanned with the credentials given.
+// A successful anonymous scan shows the repository to be public;
+// otherwise it's probed anonymously, if the reconciler is set to do
+// so, or else recorded as unknown.
+func (r *ImageRepositoryReconciler) visibility(ctx context.Context, repo name.Repository, credentials *imagev1alpha1.ScanCredentials, rt http.RoundTripper) string {
+	if credentials.Source == imagev1alpha1.AnonymousCredentials {
+		return imagev1alpha1.PublicVisibility
+	}
+	if !r.ProbeVisibility {
+		return ""
+	}
+	public, err := probeAnonymousAccess(ctx, repo, rt)
+	if err != nil {
+		r.Log.Error(err, "unable to probe anonymous access to image repository", "repository", repo.String())
+		return ""
+	}
+	if public {
+		return imagev1alpha1.PublicVisibility
+	}
+	return imagev1alpha1.PrivateVisibility
+}
+
+// budgetDelay takes a turn from the scan budget for the image
+// repository, scanned with the credentials given, and returns how
+// long to wait before scanning it. Credentials that couldn't be
+// resolved are taken to be anonymous, since the scan will fail before
+// it gets to the registry anyway.
+func (r *ImageRepositoryReconciler) budgetDelay(imageRepo imagev1alpha1.ImageRepository, ref name.Reference, auth scanAuth, now time.Time) time.Duration {
+	if r.ScanBudget == nil {
+		return 0
+	}
+	var account string
+	if auth.err == nil && auth.credentials != nil {
+		account = auth.credentials.Username
+	}
+	repoName := types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()}
+	return r.ScanBudget.reserve(repoName, ref.Context().RegistryStr(), account, now)
+}
+
+// resetForceScan sets `.spec.forceScan` back to false once the scan
+// it asked for has been done. The status of the image repository is
+// kept as it is, to be written after; and since the change to the
+// spec isn't one that needs another scan, the generation it makes is
+// counted as observed, if the one before it was.
+func (r *ImageRepositoryReconciler) resetForceScan(ctx context.Context, repo *imagev1alpha1.ImageRepository) error {
+	status, generation := repo.Status, repo.GetGeneration()
+	patch := client.MergeFrom(repo.DeepCopy())
+	repo.Spec.ForceScan = false
+	if err := r.Patch(ctx, repo, patch); err != nil {
+		return err
+	}
+	if status.ObservedGeneration == generation {
+		status.ObservedGeneration = repo.GetGeneration()
+	}
+	repo.Status = status
+	return nil
+}
+
+// updateStatus writes the status of the image repository, and counts
+// it according to its Ready condition.
+func (r *ImageRepositoryReconciler) updateStatus(ctx context.Context, repo *imagev1alpha1.ImageRepository) error {
+	imagev1alpha1.TruncateConditionMessages(repo.Status.Conditions, r.MaxConditionMessageLength)
+	if err := r.Status().Update(ctx, repo); err != nil {
+		return err
+	}
+	repositoryReadiness.record(*repo)
+	return nil
+}
+
+// scanTimeout returns how long a scan of the image repository is
+// given.
+func (r *ImageRepositoryReconciler) scanTimeout(repo imagev1alpha1.ImageRepository) time.Duration {
+	if repo.Spec.Timeout != nil && repo.Spec.Timeout.Duration > 0 {
+		return repo.Spec.Timeout.Duration
+	}
+	if r.ScanTimeout > 0 {
+		return r.ScanTimeout
+	}
+	return defaultScanTimeout
+}
+
+// scanTimeoutError is the error from a scan that took longer than
+// it was given.
+type scanTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *scanTimeoutError) Error() string {
+	return fmt.Sprintf("scan timed out after %s (set .spec.timeout to give it longer): %s", e.timeout, e.err.Error())
+}
+
+func (e *scanTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// scanFailureReason gives the reason to record for a scan that
+// failed with the error given.
+func scanFailureReason(err error) string {
+	var redirect *unexpectedRedirectError
+	if errors.As(err, &redirect) {
+		return imagev1alpha1.UnexpectedRedirectReason
+	}
+	if errors.Is(err, errInlineAuthDisabled) {
+		return imagev1alpha1.InlineAuthDisabledReason
+	}
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return imagev1alpha1.ResponseTooLargeReason
+	}
+	var timeout *scanTimeoutError
+	if errors.As(err, &timeout) {
+		return imagev1alpha1.ScanTimeoutReason
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return imagev1alpha1.AuthenticationFailedReason
+		case http.StatusNotFound:
+			return imagev1alpha1.RepositoryNotFoundReason
+		case http.StatusTooManyRequests:
+			return imagev1alpha1.RateLimitedReason
+		}
+	}
+	return imagev1alpha1.ReconciliationFailedReason
+}
+
+// isPermanentScanFailure says whether a scan failed with the error
+// given in a way that won't come right by itself on retrying; e.g.,
+// the registry refused the credentials. Other failures, e.g., a
+// network error or a 5xx response, are taken to be transient.
+func isPermanentScanFailure(err error) bool {
+	switch scanFailureReason(err) {
+	case imagev1alpha1.AuthenticationFailedReason, imagev1alpha1.RepositoryNotFoundReason:
+		return true
+	}
+	return false
+}
+
+// scanFailed records a failed scan in the status of the image
+// repository; the failure must already have been counted in
+// `.status.scanFailures`. Usually this sets the Ready condition to
+// False; but if the image repository is ready and still within the
+// grace given in its spec, the Ready condition is left as it is, and
+// the ScanFailing condition is set instead.
+func scanFailed(repo imagev1alpha1.ImageRepository, reason string, err error, now time.Time) imagev1alpha1.ImageRepository {
+	if repo.Status.FailingSince == nil {
+		since := metav1.NewTime(now)
+		repo.Status.FailingSince = &since
+	}
+	if isReady(repo) && inFailureGrace(repo, now) {
+		return imagev1alpha1.SetImageRepositoryCondition(repo, imagev1alpha1.ScanFailingCondition,
+			corev1.ConditionTrue, reason,
+			fmt.Sprintf("%d consecutive scans failed; the last with: %s", repo.Status.ScanFailures, err.Error()))
+	}
+	repo = imagev1alpha1.RemoveImageRepositoryCondition(repo, imagev1alpha1.ScanFailingCondition)
+	return imagev1alpha1.SetImageRepositoryReadiness(repo, corev1.ConditionFalse, reason, err.Error())
+}
+
+// listingETag returns the ETag of the listing of tags found by the
+// last scan of the image repository, if the next scan can ask for the
+// listing only if it's changed since. It can't if the last scan's
+// tags might not be those recorded, e.g., because the database was
+// dropped; or if they'd be treated differently now, because the spec
+// has changed; or if the listing is to be fetched twice anyway, or
+// there are other images to scan.
+//
+// Since an unchanged listing skips the rest of the scan, a tag moved
+// to another image isn't noticed until the listing next changes.
+func (r *ImageRepositoryReconciler) listingETag(repo imagev1alpha1.ImageRepository, dbKey string) string {
+	etag := repo.Status.LastScanResult.ETag
+	if etag == "" || !isReady(repo) || repo.Spec.DryRun || repo.Spec.DoubleFetch || len(repo.Spec.Images) > 0 ||
+		repo.Status.ObservedGeneration != repo.GetGeneration() {
+		return ""
+	}
+	if tags, err := r.Database.Tags(dbKey); err != nil || (len(tags) == 0 && repo.Status.LastScanResult.TagCount > 0) {
+		return ""
+	}
+	return etag
+}
+
+// notModifiedScanned returns the image repository as having been
+// scanned successfully, by a scan the registry told nothing had
+// changed since the last, so that found the tags as recorded.
+func notModifiedScanned(repo imagev1alpha1.ImageRepository, etag string) imagev1alpha1.ImageRepository {
+	repo.Status.LastScanResult.ETag = etag
+	repo.Status.LastScanResult.TagsChanged = false
+	repo.Status.LastScanResult.RemovedTagCount = 0
+	repo.Status.ScanFailures = 0
+	repo.Status.FailingSince = nil
+	if token, ok := meta.ReconcileAnnotationValue(repo.GetAnnotations()); ok {
+		repo.Status.SetLastHandledReconcileRequest(token)
+	}
+	return imagev1alpha1.RemoveImageRepositoryCondition(repo, imagev1alpha1.ScanFailingCondition)
+}
+
+// dryRunScanned returns the image repository as having been scanned
+// successfully in a dry run, which found the tags given but recorded
+// none of them.
+func dryRunScanned(repo imagev1alpha1.ImageRepository, tags []string, unfiltered int, credentials *imagev1alpha1.ScanCredentials) imagev1alpha1.ImageRepository {
+	repo.Status.LastScanResult.TagCount = len(tags)
+	repo.Status.LastScanResult.UnfilteredTagCount = unfiltered
+	repo.Status.LastScanResult.Credentials = credentials
+	repo.Status.ScanFailures = 0
+	repo.Status.FailingSince = nil
+	if token, ok := meta.ReconcileAnnotationValue(repo.GetAnnotations()); ok {
+		repo.Status.SetLastHandledReconcileRequest(token)
+	}
+	repo = imagev1alpha1.RemoveImageRepositoryCondition(repo, imagev1alpha1.ScanFailingCondition)
+	return imagev1alpha1.SetImageRepositoryReadiness(repo, corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason,
+		fmt.Sprintf("dry run: successful scan, found %d tags; none were recorded", len(tags)))
+}
+
+// getSecret fetches the secret, in a span of its own.
+func (r *ImageRepositoryReconciler) getSecret(ctx context.Context, key types.NamespacedName, secret *corev1.Secret) error {
+	ctx, span := startSpan(ctx, "get secret", label.String("namespace", key.Namespace), label.String("secret", key.Name))
+	err := r.Get(ctx, key, secret)
+	endSpan(ctx, span, err)
+	return err
+}
+
+// anyImageScanned says whether any of the images listed in
+// `.spec.images` was scanned successfully.
+func anyImageScanned(images []imagev1alpha1.ImageScanResult) bool {
+	for _, result := range images {
+		if result.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// totalTagCount returns the number of tags found for `.spec.image`
+// and the images listed in `.spec.images` together; or zero if there
+// are none listed.
+func totalTagCount(tagCount int, images []imagev1alpha1.ImageScanResult) int {
+	if len(images) == 0 {
+		return 0
+	}
+	for _, result := range images {
+		tagCount += result.TagCount
+	}
+	return tagCount
+}
+
+// partiallyScanned returns the image repository, whose scan of
+// `.spec.image` failed with the error given, as ready nonetheless,
+// since some of the images in `.spec.images` were scanned.
+func partiallyScanned(repo imagev1alpha1.ImageRepository, err error) imagev1alpha1.ImageRepository {
+	var n int
+	for _, result := range repo.Status.Images {
+		if result.Error == "" {
+			n++
+		}
+	}
+	repo.Status.ScanFailures = 0
+	repo.Status.FailingSince = nil
+	repo.Status.LastScanResult.TotalTagCount = totalTagCount(repo.Status.LastScanResult.TagCount, repo.Status.Images)
+	repo = imagev1alpha1.RemoveImageRepositoryCondition(repo, imagev1alpha1.ScanFailingCondition)
+	return imagev1alpha1.SetImageRepositoryReadiness(repo, corev1.ConditionTrue, imagev1alpha1.PartiallyScannedReason,
+		fmt.Sprintf("scanned %d of %d images in .spec.images, but the scan of .spec.image failed: %s", n, len(repo.Status.Images), err.Error()))
+}
+
+// inFailureGrace says whether the failing image repository has yet
+// to reach the failure threshold or grace period given in its spec.
+// An unset threshold or period is never reached; but if neither is
+// set, there is no grace.
+func inFailureGrace(repo imagev1alpha1.ImageRepository, now time.Time) bool {
+	threshold, grace := repo.Spec.FailureThreshold, repo.Spec.FailureGracePeriod
+	if threshold <= 0 && grace == nil {
+		return false
+	}
+	if threshold > 0 && repo.Status.ScanFailures >= threshold {
+		return false
+	}
+	if grace != nil && repo.Status.FailingSince != nil && now.Sub(repo.Status.FailingSince.Time) >= grace.Duration {
+		return false
+	}
+	return true
+}
+
+// fetchAgain waits a short while, then lists the tags for the
+// repository a second time, returning the union of the first listing
+// and the second.
+func fetchAgain(ctx context.Context, first []string, list func() ([]string, error)) ([]string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(doubleFetchDelay):
+	}
+	// if the second listing was partial, what it did get is still
+	// worth having
+	second, err := list()
+	return unionTags(first, second), err
+}
+
+// unionTags returns the tags in a, followed by those tags in b that
+// are not in a. Neither a nor b is modified.
+func unionTags(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a))
+	for _, tag := range a {
+		seen[tag] = struct{}{}
+	}
+	union := append([]string(nil), a...)
+	for _, tag := range b {
+		if _, ok := seen[tag]; !ok {
+			seen[tag] = struct{}{}
+			union = append(union, tag)
+		}
+	}
+	return union
+}
+
+// sameTags says whether the two lists of tags have the same members,
+// regardless of order.
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, tag := range a {
+		seen[tag]++
+	}
+	for _, tag := range b {
+		if seen[tag] == 0 {
+			return false
+		}
+		seen[tag]--
+	}
+	return true
+}
+
+// sameDigests says whether the digests given are those recorded in
+// the database for the tags; a tag without a digest given must have
+// none recorded.
+func sameDigests(db DatabaseReader, repo string, tags []string, digests map[string]string) bool {
+	for _, tag := range tags {
+		if db.TagDigest(repo, tag) != digests[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordedDigests returns the digests recorded for those of the tags
+// that have one.
+func recordedDigests(db DatabaseReader, repo string, tags []string) map[string]string {
+	digests := map[string]string{}
+	for _, tag := range tags {
+		if digest := db.TagDigest(repo, tag); digest != "" {
+			digests[tag] = digest
+		}
+	}
+	return digests
+}
+
+// diffTags returns the tags in b and not in a, and those in a and not
+// in b, each in the order they're listed.
+func diffTags(a, b []string) (added, removed []string) {
+	inA := make(map[string]bool, len(a))
+	for _, tag := range a {
+		inA[tag] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, tag := range b {
+		inB[tag] = true
+		if !inA[tag] {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range a {
+		if !inB[tag] {
+			removed = append(removed, tag)
+		}
+	}
+	return added, removed
+}
+
+// maxTagsInSummary is the most tags named in each part of a summary
+// of changes to the tags.
+const maxTagsInSummary = 10
+
+// summarizeTagChanges describes the tags added and removed, naming
+// up to maxTagsInSummary of each.
+func summarizeTagChanges(added, removed []string) string {
+	list := func(tags []string) string {
+		if len(tags) <= maxTagsInSummary {
+			return strings.Join(tags, ", ")
+		}
+		return fmt.Sprintf("%s and %d more", strings.Join(tags[:maxTagsInSummary], ", "), len(tags)-maxTagsInSummary)
+	}
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, fmt.Sprintf("%d added (%s)", len(added), list(added)))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, fmt.Sprintf("%d removed (%s)", len(removed), list(removed)))
+	}
+	return "tags changed: " + strings.Join(parts, ", ")
+}
+
+// logger returns the reconciler's logger, or one that discards
+// everything if it has none.
+func (r *ImageRepositoryReconciler) logger() logr.Logger {
+	if r.Log == nil {
+		return ctrllog.NullLogger{}
+	}
+	return r.Log
+}
+
+// logTagChanges logs the tags added and removed, giving how many of
+// each there are, and up to limit of each by name, so that a scan
+// finding thousands of new tags doesn't log them all.
+func logTagChanges(log logr.Logger, added, removed []string, limit int) {
+	keysAndValues := []interface{}{"addedCount", len(added), "removedCount", len(removed)}
+	if limit > 0 {
+		sample := func(tags []string) []string {
+			if len(tags) > limit {
+				return tags[:limit]
+			}
+			return tags
+		}
+		keysAndValues = append(keysAndValues, "added", sample(added), "removed", sample(removed))
+	}
+	log.Info("tags changed", keysAndValues...)
+}
+
+// isReady says whether the image repository's Ready condition is
+// True.
+func isReady(repo imagev1alpha1.ImageRepository) bool {
+	for _, condition := range repo.Status.Conditions {
+		if condition.Type == imagev1alpha1.ReadyCondition {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
 }
 
 // shouldScan takes an image repo and the time now, and says whether
 // the repository should be scanned now, and how long to wait for the
 // next scan.
 func (r *ImageRepositoryReconciler) shouldScan(repo imagev1alpha1.ImageRepository, now time.Time) (bool, time.Duration) {
-	scanInterval := defaultScanInterval
-	if repo.Spec.ScanInterval != nil {
-		scanInterval = repo.Spec.ScanInterval.Duration
+	scanInterval := r.scanInterval(repo)
+
+	// never scanned, or asked to scan regardless; do it now
+	lastScanTime := imagev1alpha1.GetLastScanTime(repo)
+	if lastScanTime == nil || repo.Spec.ForceScan {
+		return true, scanInterval
+	}
+
+	// the spec has changed since it was last reconciled, and the
+	// change may well make a difference to the scan, so it's not left
+	// until the next is due; unless the change is to resume scanning,
+	// which keeps to the schedule
+	if repo.Status.ObservedGeneration != repo.GetGeneration() && repo.Status.SuspendedSince == nil {
+		return true, scanInterval
 	}
 
-	// never scanned; do it now
-	lastTransitionTime := imagev1alpha1.GetLastTransitionTime(repo)
-	if lastTransitionTime == nil {
+	// has there been a push to the image since the last scan?
+	if pushedAt, ok := r.PushReceiver.lastPush(types.NamespacedName{Namespace: repo.GetNamespace(), Name: repo.GetName()}); ok && pushedAt.After(lastScanTime.Time) {
+		return true, scanInterval
+	}
+
+	// has a secret it uses changed since the last scan, e.g., because
+	// the credentials were rotated?
+	if r.secretChanges.changedSince(types.NamespacedName{Namespace: repo.GetNamespace(), Name: repo.GetName()}, lastScanTime.Time) {
 		return true, scanInterval
 	}
 
@@ -194,27 +1459,327 @@ func (r *ImageRepositoryReconciler) shouldScan(repo imagev1alpha1.ImageRepositor
 		}
 	}
 
-	// when recovering, it's possible that the resource has a last
-	// scan time, but there's no records because the database has been
-	// dropped and created again.
+	// a registry that refused the last scan for going over its rate
+	// limit said when to come back; once that's past, scan again
+	if rl := repo.Status.RateLimit; repo.Status.ScanFailures > 0 && rl != nil && rl.RetryAfter != nil && !now.Before(rl.RetryAfter.Time) {
+		return true, scanInterval
+	}
 
-	// FIXME If the repo exists, has been
-	// scanned, and doesn't have any tags, this will mean a scan every
-	// time the resource comes up for reconciliation.
-	if tags := r.Database.Tags(repo.Status.CanonicalImageName); len(tags) == 0 {
+	// a dry run records nothing, so doesn't count as a scan once the
+	// image repository is no longer in dry-run mode; and while it is,
+	// there's nothing in the database to check
+	if repo.Status.LastScanResult.DryRun != repo.Spec.DryRun {
 		return true, scanInterval
 	}
+	if !repo.Spec.DryRun {
+		// when recovering, it's possible that the resource has a last
+		// scan time, but there's no records because the database has been
+		// dropped and created again. That's told apart from a repository
+		// that was scanned and genuinely has no tags by the count of tags
+		// the last scan found, so the latter waits for the next scan as
+		// usual. If the tags can't be read, scan anyway; the scan will
+		// fail for the same reason, and say so in the status.
+		if tags, err := r.Database.Tags(scannedDatabaseKey(r.DatabaseKey, repo)); err != nil || (len(tags) == 0 && repo.Status.LastScanResult.TagCount > 0) {
+			return true, scanInterval
+		}
+		// likewise for each of the images listed in `.spec.images`
+		for _, result := range repo.Status.Images {
+			image, err := name.NewRepository(result.CanonicalImageName)
+			if err != nil || result.TagCount == 0 {
+				continue
+			}
+			if tags, err := r.Database.Tags(databaseKey(r.DatabaseKey, image)); err != nil || len(tags) == 0 {
+				return true, scanInterval
+			}
+		}
+	}
 
-	when := scanInterval - now.Sub(lastTransitionTime.Time)
+	when := scanInterval - now.Sub(lastScanTime.Time)
 	if when < time.Second {
 		return true, scanInterval
 	}
 	return false, when
 }
 
+// scanInterval returns how long to wait between the last scan of the
+// image repo and the next. This is the scan interval given in the
+// spec (or the default, and no shorter than the minimum), unless
+// recent scans have failed, in which case it's the failure backoff
+// (if configured), doubled for each failure after the first up to
+// MaxFailureBackoff or else the scan interval; or, if the last scan
+// succeeded and the registry said the tags would stay fresh for
+// longer, the cache hint (bounded by MaxCacheHint). The scan interval
+// is lengthened for an image repository on Docker Hub when the rate
+// limit it last reported is running low (see rateLimitedInterval).
+//
+// The number of consecutive failures, in `.status.scanFailures`,
+// moves between states like this:
+//
+//   - a successful scan resets it to zero;
+//   - a failed scan adds one;
+//   - a partial scan, in which some but not all pages of tags were
+//     fetched, takes off PartialScanCredit, but leaves at least one.
+//
+// So a partial scan is never taken as a clean success, and a registry
+// that persistently fails part way through a listing stays backed off
+// rather than flipping between backing off and scanning at full rate.
+func (r *ImageRepositoryReconciler) scanInterval(repo imagev1alpha1.ImageRepository) time.Duration {
+	scanInterval := rateLimitedInterval(repo, r.specScanInterval(repo))
+	failures := repo.Status.ScanFailures
+	if failures == 0 {
+		if hint := repo.Status.LastScanResult.CacheHint; hint != nil && r.MaxCacheHint > 0 && hint.Duration > scanInterval {
+			if hint.Duration > r.MaxCacheHint {
+				return r.MaxCacheHint
+			}
+			return hint.Duration
+		}
+	}
+	if failures == 0 || r.FailureBackoff <= 0 {
+		return scanInterval
+	}
+	limit := scanInterval
+	if r.MaxFailureBackoff > 0 {
+		limit = r.MaxFailureBackoff
+	}
+	backoff := r.FailureBackoff
+	for i := 1; i < failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff < limit {
+		return backoff
+	}
+	return limit
+}
+
+// withJitter returns the duration given plus up to a tenth again, at
+// random, so that image repositories that failed together (e.g.,
+// because their registry was down) don't all retry at once.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+// specScanInterval returns the scan interval given in the spec of the
+// image repository, or the reconciler's default; either way, no
+// shorter than the reconciler's minimum.
+func (r *ImageRepositoryReconciler) specScanInterval(repo imagev1alpha1.ImageRepository) time.Duration {
+	interval := r.DefaultScanInterval
+	if interval <= 0 {
+		interval = defaultScanInterval
+	}
+	if repo.Spec.ScanInterval != nil {
+		interval = repo.Spec.ScanInterval.Duration
+	}
+	if interval < r.MinScanInterval {
+		return r.MinScanInterval
+	}
+	return interval
+}
+
+// cacheHint returns the freshness window given by the registry, if
+// it's to put off the next scan of the image repository; i.e., if
+// hints are heeded, and it's longer than the scan interval. It's
+// bounded by the maximum given to the reconciler.
+func (r *ImageRepositoryReconciler) cacheHint(repo imagev1alpha1.ImageRepository, freshFor time.Duration) *metav1.Duration {
+	if r.MaxCacheHint <= 0 || freshFor <= r.specScanInterval(repo) {
+		return nil
+	}
+	if freshFor > r.MaxCacheHint {
+		freshFor = r.MaxCacheHint
+	}
+	return &metav1.Duration{Duration: freshFor}
+}
+
+// scanFailuresAfterPartialScan returns the count of consecutive
+// failures following a partial scan; see scanInterval.
+func scanFailuresAfterPartialScan(failures, credit int) int {
+	if failures -= credit; failures < 1 {
+		return 1
+	}
+	return failures
+}
+
+// startupDelay returns how much longer a scan of the named object
+// should wait, to spread scans out over the startup ramp. Each object
+// gets a fixed slot in the ramp window, derived from its name, so
+// that the scans are spread evenly no matter the order in which the
+// objects are reconciled. Once the window has passed, the delay is
+// always zero.
+func (r *ImageRepositoryReconciler) startupDelay(objectName types.NamespacedName, now time.Time) time.Duration {
+	if r.StartupScanRamp <= 0 || now.Sub(r.startedAt) >= r.StartupScanRamp {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(objectName.String()))
+	slot := time.Duration(h.Sum64() % uint64(r.StartupScanRamp))
+	return r.startedAt.Add(slot).Sub(now)
+}
+
+// readyMessage returns the message of the image repo's ready
+// condition.
+func readyMessage(repo imagev1alpha1.ImageRepository) string {
+	for _, c := range repo.Status.Conditions {
+		if c.Type == imagev1alpha1.ReadyCondition {
+			return c.Message
+		}
+	}
+	return ""
+}
+
+// failureReason returns the reason recorded for the failure of the
+// image repository's scans, or an empty string if its last scan
+// didn't fail. Events for failures are only emitted when this
+// changes, so a repository failing in the same way doesn't report it
+// on every scan.
+func failureReason(repo imagev1alpha1.ImageRepository) string {
+	if repo.Status.ScanFailures == 0 {
+		return ""
+	}
+	var reason string
+	for _, c := range repo.Status.Conditions {
+		switch {
+		case c.Type == imagev1alpha1.ScanFailingCondition:
+			return c.Reason
+		case c.Type == imagev1alpha1.ReadyCondition && c.Status == corev1.ConditionFalse:
+			reason = c.Reason
+		}
+	}
+	return reason
+}
+
+// event emits an event about the image repo, to be seen with
+// `kubectl describe` and by the notification controller.
+func (r *ImageRepositoryReconciler) event(repo imagev1alpha1.ImageRepository, severity, reason, msg string) {
+	metadata := map[string]string{}
+	if repo.Status.CanonicalImageName != "" {
+		metadata["image"] = repo.Status.CanonicalImageName
+	}
+	eventRecorders{
+		kube:     r.EventRecorder,
+		external: r.ExternalEventRecorder,
+		log:      r.Log,
+	}.event(&repo, imagev1alpha1.ImageRepositoryKind, severity, reason, msg, metadata)
+}
+
 func (r *ImageRepositoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&imagev1alpha1.ImageRepository{}).
-		WithEventFilter(predicates.ChangePredicate{}).
-		Complete(r)
+	r.startedAt = time.Now()
+
+	// index the image repositories by the secrets they use, so those
+	// affected by a secret changing or being deleted can be found
+	// without listing them all.
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &imagev1alpha1.ImageRepository{}, secretRefKey, func(obj runtime.Object) []string {
+		repo := obj.(*imagev1alpha1.ImageRepository)
+		var names []string
+		if repo.Spec.SecretRef != nil {
+			names = append(names, repo.Spec.SecretRef.Name)
+		}
+		if repo.Spec.CertSecretRef != nil {
+			names = append(names, repo.Spec.CertSecretRef.Name)
+		}
+		if repo.Spec.ProxySecretRef != nil {
+			names = append(names, repo.Spec.ProxySecretRef.Name)
+		}
+		return names
+	}); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&imagev1alpha1.ImageRepository{}, builder.WithPredicates(predicates.ChangePredicate{})).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.imageRepositoriesForSecret),
+			},
+			builder.WithPredicates(predicate.Funcs{
+				// the secrets already there at startup are seen as
+				// created, but aren't a change
+				CreateFunc: func(e event.CreateEvent) bool {
+					return e.Meta.GetCreationTimestamp().Time.After(r.startedAt)
+				},
+				UpdateFunc: func(e event.UpdateEvent) bool {
+					return secretDataChanged(e.ObjectOld, e.ObjectNew)
+				},
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			})).
+		WithEventFilter(namespacesPredicate(r.WatchNamespaces))
+	if r.PushReceiver != nil {
+		b = b.Watches(&source.Channel{Source: r.PushReceiver.events}, &handler.EnqueueRequestForObject{})
+	}
+	if r.MaxConcurrentScans > 0 {
+		b = b.WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentScans})
+	}
+	return b.Complete(r)
+}
+
+// imageRepositoriesForSecret returns a request for each image
+// repository that uses the secret for scanning, and records that the
+// secret changed for each, so it's scanned again.
+func (r *ImageRepositoryReconciler) imageRepositoriesForSecret(obj handler.MapObject) []reconcile.Request {
+	ctx := context.Background()
+	var repos imagev1alpha1.ImageRepositoryList
+	if err := r.List(ctx, &repos, client.InNamespace(obj.Meta.GetNamespace()), client.MatchingFields{secretRefKey: obj.Meta.GetName()}); err != nil {
+		r.Log.Error(err, "failed to list ImageRepository for Secret")
+		return nil
+	}
+	now := time.Now()
+	reqs := make([]reconcile.Request, len(repos.Items), len(repos.Items))
+	for i := range repos.Items {
+		reqs[i].NamespacedName.Name = repos.Items[i].GetName()
+		reqs[i].NamespacedName.Namespace = repos.Items[i].GetNamespace()
+		r.secretChanges.record(reqs[i].NamespacedName, now)
+	}
+	return reqs
+}
+
+// secretDataChanged says whether an update to a secret changed what
+// it holds, rather than only its metadata.
+func secretDataChanged(old, new runtime.Object) bool {
+	oldSecret, ok := old.(*corev1.Secret)
+	if !ok {
+		return false
+	}
+	newSecret, ok := new.(*corev1.Secret)
+	if !ok {
+		return false
+	}
+	return oldSecret.Type != newSecret.Type ||
+		!reflect.DeepEqual(oldSecret.Data, newSecret.Data) ||
+		!reflect.DeepEqual(oldSecret.StringData, newSecret.StringData)
+}
+
+// secretChanges records, for each image repository, when a secret it
+// uses last changed. The zero value is ready to use.
+type secretChanges struct {
+	mu      sync.Mutex
+	changed map[types.NamespacedName]time.Time
+}
+
+// record notes that a secret used by the image repository changed at
+// the time given.
+func (s *secretChanges) record(repo types.NamespacedName, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed == nil {
+		s.changed = map[types.NamespacedName]time.Time{}
+	}
+	s.changed[repo] = at
+}
+
+// changedSince says whether a secret used by the image repository has
+// changed since the time given.
+func (s *secretChanges) changedSince(repo types.NamespacedName, since time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.changed[repo]
+	return ok && at.After(since)
+}
+
+// forget drops what's recorded for the image repository.
+func (s *secretChanges) forget(repo types.NamespacedName) {
+	s.mu.Lock()
+	delete(s.changed, repo)
+	s.mu.Unlock()
 }
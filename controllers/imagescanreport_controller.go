@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// maxReportedRepositories is the most image repositories
+	// summarised in a report.
+	maxReportedRepositories = 500
+	defaultReportInterval   = 5 * time.Minute
+)
+
+// ImageScanReportReconciler assembles ImageScanReport objects, each
+// summarising the image repositories in its namespace, and assembles
+// them again on an interval.
+type ImageScanReportReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// WatchNamespaces restricts the reconciler to objects in the
+	// given namespaces; if empty, all namespaces are watched.
+	WatchNamespaces []string
+	// DefaultInterval is how often a report is assembled, if it
+	// doesn't give an interval itself. If zero, it's five minutes.
+	DefaultInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagescanreports,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagescanreports/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=image.toolkit.fluxcd.io,resources=imagerepositories,verbs=get;list;watch
+
+func (r *ImageScanReportReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+
+	var report imagev1alpha1.ImageScanReport
+	if err := r.Get(ctx, req.NamespacedName, &report); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log := r.Log.WithValues("controller", strings.ToLower(imagev1alpha1.ImageScanReportKind), "request", req.NamespacedName)
+
+	var repos imagev1alpha1.ImageRepositoryList
+	if err := r.List(ctx, &repos, client.InNamespace(report.GetNamespace())); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := assembleScanReport(repos.Items, maxReportedRepositories)
+	now := metav1.Now()
+	status.AssembledTime = &now
+	status.ObservedGeneration = report.GetGeneration()
+	report.Status = status
+	if err := r.Status().Update(ctx, &report); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	interval := r.interval(report)
+	log.V(1).Info("assembled report", "repositories", status.Total, "next run", interval.String())
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+func (r *ImageScanReportReconciler) interval(report imagev1alpha1.ImageScanReport) time.Duration {
+	if report.Spec.Interval != nil && report.Spec.Interval.Duration > 0 {
+		return report.Spec.Interval.Duration
+	}
+	if r.DefaultInterval > 0 {
+		return r.DefaultInterval
+	}
+	return defaultReportInterval
+}
+
+func (r *ImageScanReportReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// writing the status doesn't change the generation, so this
+	// stops each report from being assembled again as soon as it's
+	// written; it's assembled again on the interval instead.
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&imagev1alpha1.ImageScanReport{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		WithEventFilter(namespacesPredicate(r.WatchNamespaces)).
+		Complete(r)
+}
+
+// assembleScanReport summarises the image repositories given: it
+// counts them, and lists up to max of them, those not ready first
+// and otherwise in order of name.
+func assembleScanReport(repos []imagev1alpha1.ImageRepository, max int) imagev1alpha1.ImageScanReportStatus {
+	var status imagev1alpha1.ImageScanReportStatus
+	summaries := make([]imagev1alpha1.ImageRepositorySummary, 0, len(repos))
+	for _, repo := range repos {
+		summary := imagev1alpha1.ImageRepositorySummary{
+			Name:         repo.GetName(),
+			Image:        repo.Status.CanonicalImageName,
+			Ready:        corev1.ConditionUnknown,
+			TagCount:     repo.Status.LastScanResult.TagCount,
+			LastScanTime: imagev1alpha1.GetLastScanTime(repo),
+			ScanFailures: repo.Status.ScanFailures,
+		}
+		for _, c := range repo.Status.Conditions {
+			if c.Type == imagev1alpha1.ReadyCondition {
+				summary.Ready, summary.Reason, summary.Message = c.Status, c.Reason, c.Message
+			}
+		}
+		if summary.Ready == corev1.ConditionTrue {
+			status.Ready++
+		} else {
+			status.NotReady++
+		}
+		summaries = append(summaries, summary)
+	}
+	status.Total = len(repos)
+
+	sort.Slice(summaries, func(i, j int) bool {
+		iReady, jReady := summaries[i].Ready == corev1.ConditionTrue, summaries[j].Ready == corev1.ConditionTrue
+		if iReady != jReady {
+			return jReady
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	if len(summaries) > max {
+		status.Omitted = len(summaries) - max
+		summaries = summaries[:max]
+	}
+	status.Repositories = summaries
+	return status
+}
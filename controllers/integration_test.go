@@ -0,0 +1,203 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// These exercise the whole path from an ImageRepository being
+// created, through scanning an in-memory registry, to the tags being
+// stored and an ImagePolicy being calculated from them.
+
+var _ = Describe("Scanning a registry that requires credentials", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("scans with the credentials from the secret and calculates the policy", func() {
+		imgRepo, err := privateRegistry.pushImages("private-app", "1.0.0", "1.1.0", "2.0.0-rc.1", "latest")
+		Expect(err).ToNot(HaveOccurred())
+
+		secret := privateRegistry.credentials("private-registry-creds")
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		repoName := types.NamespacedName{Name: "private-app", Namespace: "default"}
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     imgRepo,
+				SecretRef: &corev1.LocalObjectReference{Name: secret.Name},
+			},
+		}
+		repo.Name = repoName.Name
+		repo.Namespace = repoName.Namespace
+		Expect(k8sClient.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && len(repoAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.Conditions[0].Status).To(Equal(corev1.ConditionTrue))
+		Expect(repoAfter.Status.CanonicalImageName).To(Equal(imgRepo))
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(4))
+		Expect(repoAfter.Status.LastScanResult.Credentials).To(Equal(&imagev1alpha1.ScanCredentials{
+			Source:     imagev1alpha1.SecretCredentials,
+			SecretName: secret.Name,
+			Username:   "scanner",
+		}))
+		Expect(imageRepoReconciler.Database.Tags(imgRepo)).To(ConsistOf("1.0.0", "1.1.0", "2.0.0-rc.1", "latest"))
+
+		polName := types.NamespacedName{Name: "private-app-1x", Namespace: "default"}
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{Name: repoName.Name},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+				},
+			},
+		}
+		pol.Name = polName.Name
+		pol.Namespace = polName.Namespace
+		Expect(k8sClient.Create(ctx, &pol)).To(Succeed())
+
+		var polAfter imagev1alpha1.ImagePolicy
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), polName, &polAfter)
+			return err == nil && polAfter.Status.LatestImage != ""
+		}, timeout, interval).Should(BeTrue())
+		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":1.1.0"))
+	})
+
+	It("fails the scan when no credentials are given", func() {
+		imgRepo, err := privateRegistry.pushImages("private-app-anonymous", "1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+
+		repoName := types.NamespacedName{Name: "private-app-anonymous", Namespace: "default"}
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image: imgRepo,
+			},
+		}
+		repo.Name = repoName.Name
+		repo.Namespace = repoName.Namespace
+		Expect(k8sClient.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && len(repoAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.Conditions[0].Status).To(Equal(corev1.ConditionFalse))
+		Expect(repoAfter.Status.Conditions[0].Reason).To(Equal(imagev1alpha1.AuthenticationFailedReason))
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(0))
+	})
+
+	It("reports a deleted secret without waiting for the next scan", func() {
+		imgRepo, err := privateRegistry.pushImages("private-app-deleted-secret", "1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+
+		secret := privateRegistry.credentials("deleted-registry-creds")
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		repoName := types.NamespacedName{Name: "private-app-deleted-secret", Namespace: "default"}
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     imgRepo,
+				SecretRef: &corev1.LocalObjectReference{Name: secret.Name},
+			},
+		}
+		repo.Name = repoName.Name
+		repo.Namespace = repoName.Namespace
+		Expect(k8sClient.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && len(repoAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.Conditions[0].Status).To(Equal(corev1.ConditionTrue))
+
+		// the scan interval is far longer than the test, so only the
+		// deletion can cause a reconciliation
+		Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && repoAfter.Status.Conditions[0].Status == corev1.ConditionFalse
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.Conditions[0].Reason).To(Equal(imagev1alpha1.SecretNotFoundReason))
+		Expect(repoAfter.Status.Conditions[0].Message).To(ContainSubstring(secret.Name))
+	})
+
+	It("scans again when the credentials in the secret change", func() {
+		imgRepo, err := privateRegistry.pushImages("private-app-rotated-secret", "1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+
+		// the credentials are wrong to begin with
+		secret := dockerConfigSecret("rotated-registry-creds", map[string]string{
+			privateRegistry.host(): basicAuth(privateRegistry.username, "stale"),
+		})
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		repoName := types.NamespacedName{Name: "private-app-rotated-secret", Namespace: "default"}
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:     imgRepo,
+				SecretRef: &corev1.LocalObjectReference{Name: secret.Name},
+			},
+		}
+		repo.Name = repoName.Name
+		repo.Namespace = repoName.Namespace
+		Expect(k8sClient.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && len(repoAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.Conditions[0].Reason).To(Equal(imagev1alpha1.AuthenticationFailedReason))
+
+		// a failure to authenticate waits for the next scan, which is
+		// far longer than the test, so only the change to the secret
+		// can cause another
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, secret)).To(Succeed())
+		secret.Data = privateRegistry.credentials(secret.Name).Data
+		Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), repoName, &repoAfter)
+			return err == nil && repoAfter.Status.Conditions[0].Status == corev1.ConditionTrue
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(1))
+	})
+})
@@ -0,0 +1,245 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// partialListError is returned by listTags when at least one page of
+// tags was fetched before the listing failed.
+type partialListError struct {
+	pages int
+	err   error
+}
+
+func (e *partialListError) Error() string {
+	return fmt.Sprintf("listing failed after %d page(s) of tags: %s", e.pages, e.err.Error())
+}
+
+func (e *partialListError) Unwrap() error {
+	return e.err
+}
+
+// errNotModified is returned by listTagsSince when the registry says
+// the tags haven't changed since the listing with the ETag given.
+var errNotModified = errors.New("tags not modified since the last listing")
+
+// maxReauthentications is the most times a listing of tags will
+// authenticate again, after being refused part way through.
+const maxReauthentications = 2
+
+// listTags lists the tags in the repository, following the `Link`
+// header from page to page, as remote.ListWithContext does. Unlike
+// remote.ListWithContext, if it fails after fetching some pages it
+// returns the tags fetched so far, along with a *partialListError.
+// If auth is nil, the repository is accessed anonymously.
+//
+// Some registries (e.g., ACR) issue tokens that can expire part way
+// through listing a large repository, and refuse later pages. So if
+// a page after the first is refused, listTags authenticates again and
+// asks for the same page, a bounded number of times.
+//
+// If progress is not nil, it's called after each page is fetched,
+// with the number of pages and tags so far.
+func listTags(ctx context.Context, repo name.Repository, auth authn.Authenticator, rt http.RoundTripper, progress func(pages, tags int)) ([]string, error) {
+	tags, _, err := listTagsSince(ctx, repo, auth, rt, "", progress)
+	return tags, err
+}
+
+// listTagsSince lists the tags in the repository as listTags does;
+// but if an ETag from an earlier listing is given, the registry is
+// asked for the listing only if it's changed since, and if it says
+// it hasn't, errNotModified is returned. A registry that doesn't
+// support conditional requests just gives the listing. The ETag of
+// the listing is returned, if the registry gave one and the listing
+// fit in one page, since otherwise it says nothing of the later pages.
+func listTagsSince(ctx context.Context, repo name.Repository, auth authn.Authenticator, rt http.RoundTripper, etag string, progress func(pages, tags int)) ([]string, string, error) {
+	if auth == nil {
+		auth = authn.Anonymous
+	}
+	authenticate := func() (*http.Client, error) {
+		tr, err := transport.New(repo.Registry, auth, rt, []string{repo.Scope(transport.PullScope)})
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: tr}, nil
+	}
+	client, err := authenticate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	uri := &url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.Registry.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/tags/list", repo.RepositoryStr()),
+		// ECR returns an error if n > 1000
+		RawQuery: "n=1000",
+	}
+
+	tags := []string{}
+	pages, reauthentications := 0, 0
+	fail := func(err error) ([]string, string, error) {
+		if pages > 0 {
+			return tags, "", &partialListError{pages: pages, err: err}
+		}
+		return nil, "", err
+	}
+	var listingETag string
+
+	for uri != nil {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		req, err := http.NewRequest("GET", uri.String(), nil)
+		if err != nil {
+			return fail(err)
+		}
+		if pages == 0 && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return fail(err)
+		}
+		if pages == 0 && etag != "" && res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			return nil, etag, errNotModified
+		}
+		refused := res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden
+		if refused && pages > 0 && reauthentications < maxReauthentications {
+			res.Body.Close()
+			reauthentications++
+			if client, err = authenticate(); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = transport.CheckError(res, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return fail(err)
+		}
+		tags = append(tags, page.Tags...)
+		pages++
+		if progress != nil {
+			progress(pages, len(tags))
+		}
+
+		if uri, err = nextPageURL(res); err != nil {
+			return fail(err)
+		}
+		if pages == 1 && uri == nil {
+			listingETag = res.Header.Get("ETag")
+		}
+	}
+	return tags, listingETag, nil
+}
+
+// probeAnonymousAccess says whether the repository's tags can be
+// listed without credentials. It asks for a single tag, to keep the
+// cost down. A refusal, or the repository not being found (which is
+// how some registries refuse anonymous requests), means it can't; any
+// other failure is returned as an error, since nothing can be told
+// from it.
+func probeAnonymousAccess(ctx context.Context, repo name.Repository, rt http.RoundTripper) (bool, error) {
+	refused := func(err error) bool {
+		var terr *transport.Error
+		if !errors.As(err, &terr) {
+			return false
+		}
+		switch terr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return true
+		}
+		return false
+	}
+
+	tr, err := transport.New(repo.Registry, authn.Anonymous, rt, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		if refused(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	uri := &url.URL{
+		Scheme:   repo.Registry.Scheme(),
+		Host:     repo.Registry.RegistryStr(),
+		Path:     fmt.Sprintf("/v2/%s/tags/list", repo.RepositoryStr()),
+		RawQuery: "n=1",
+	}
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := (&http.Client{Transport: tr}).Do(req.WithContext(ctx))
+	if err != nil {
+		if refused(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer res.Body.Close()
+	if err := transport.CheckError(res, http.StatusOK); err != nil {
+		if refused(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// nextPageURL returns the URL of the next page of results given in
+// the `Link` header of the response, or nil if there is none.
+func nextPageURL(res *http.Response) (*url.URL, error) {
+	link := res.Header.Get("Link")
+	if link == "" {
+		return nil, nil
+	}
+	if link[0] != '<' {
+		return nil, fmt.Errorf("failed to parse link header: missing '<' in: %s", link)
+	}
+	end := strings.Index(link, ">")
+	if end == -1 {
+		return nil, fmt.Errorf("failed to parse link header: missing '>' in: %s", link)
+	}
+	next, err := url.Parse(link[1:end])
+	if err != nil {
+		return nil, err
+	}
+	if res.Request == nil || res.Request.URL == nil {
+		return nil, nil
+	}
+	return res.Request.URL.ResolveReference(next), nil
+}
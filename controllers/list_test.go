@@ -0,0 +1,301 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// flakyRegistry serves a tag list in two pages, and can be told to
+// fail the first or second page.
+type flakyRegistry struct {
+	mu       sync.Mutex
+	failPage int
+}
+
+func (f *flakyRegistry) fail(page int) {
+	f.mu.Lock()
+	f.failPage = page
+	f.mu.Unlock()
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	failPage := f.failPage
+	f.mu.Unlock()
+
+	page, tags := 1, []string{"v1", "v2"}
+	if r.URL.Query().Get("last") != "" {
+		page, tags = 2, []string{"v3"}
+	}
+	if page == failPage {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if page == 1 {
+		w.Header().Set("Link", `<`+r.URL.Path+`?last=v2&n=1000>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tags": tags})
+}
+
+func TestListTagsPartial(t *testing.T) {
+	g := NewWithT(t)
+
+	flaky := &flakyRegistry{}
+	srv := httptest.NewServer(flaky)
+	defer srv.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/flaky")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := listTags(context.TODO(), repo, nil, http.DefaultTransport, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"v1", "v2", "v3"}))
+
+	flaky.fail(2)
+	tags, err = listTags(context.TODO(), repo, nil, http.DefaultTransport, nil)
+	var partial *partialListError
+	g.Expect(errors.As(err, &partial)).To(BeTrue())
+	g.Expect(tags).To(Equal([]string{"v1", "v2"}))
+
+	flaky.fail(1)
+	tags, err = listTags(context.TODO(), repo, nil, http.DefaultTransport, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(errors.As(err, &partial)).To(BeFalse())
+	g.Expect(tags).To(BeEmpty())
+}
+
+func TestScanFailuresWithPartialScans(t *testing.T) {
+	g := NewWithT(t)
+
+	flaky := &flakyRegistry{}
+	srv := httptest.NewServer(flaky)
+	defer srv.Close()
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/flaky"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{
+		Database:          NewDatabase(),
+		FailureBackoff:    time.Second,
+		PartialScanCredit: 1,
+	}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+		},
+	}
+	scan := func(failPage int) {
+		flaky.fail(failPage)
+		repo, _ = r.scan(context.TODO(), repo, ref)
+	}
+
+	// a partial scan is not a clean success
+	scan(2)
+	g.Expect(repo.Status.ScanFailures).To(Equal(1))
+	g.Expect(repo.Status.Conditions[0].Status).To(Equal(corev1.ConditionFalse))
+	g.Expect(r.Database.Tags(ref.Context().String())).To(ConsistOf("v1", "v2"))
+
+	scan(0)
+	g.Expect(repo.Status.ScanFailures).To(Equal(0))
+	g.Expect(r.Database.Tags(ref.Context().String())).To(ConsistOf("v1", "v2", "v3"))
+
+	// alternating failure and partial success stays backed off
+	scan(1)
+	scan(1)
+	g.Expect(repo.Status.ScanFailures).To(Equal(2))
+	g.Expect(r.scanInterval(repo)).To(Equal(2 * time.Second))
+	scan(2)
+	g.Expect(repo.Status.ScanFailures).To(Equal(1))
+	scan(1)
+	g.Expect(repo.Status.ScanFailures).To(Equal(2))
+	scan(2)
+	g.Expect(repo.Status.ScanFailures).To(Equal(1))
+	scan(2)
+	g.Expect(repo.Status.ScanFailures).To(Equal(1))
+	g.Expect(r.scanInterval(repo)).To(Equal(time.Second))
+	// the tags from partial scans don't lose those already known
+	g.Expect(r.Database.Tags(ref.Context().String())).To(ConsistOf("v1", "v2", "v3"))
+
+	scan(0)
+	g.Expect(repo.Status.ScanFailures).To(Equal(0))
+	g.Expect(r.scanInterval(repo)).To(Equal(defaultScanInterval))
+}
+
+func TestScanIntervalBackoff(t *testing.T) {
+	g := NewWithT(t)
+
+	r := &ImageRepositoryReconciler{FailureBackoff: time.Second}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			ScanInterval: &metav1.Duration{Duration: time.Minute},
+		},
+	}
+	intervalAfter := func(failures int) time.Duration {
+		repo.Status.ScanFailures = failures
+		return r.scanInterval(repo)
+	}
+	g.Expect(intervalAfter(0)).To(Equal(time.Minute))
+	g.Expect(intervalAfter(1)).To(Equal(time.Second))
+	g.Expect(intervalAfter(3)).To(Equal(4 * time.Second))
+	g.Expect(intervalAfter(100)).To(Equal(time.Minute))
+
+	// a maximum caps the backoff, even beyond the scan interval
+	r.MaxFailureBackoff = 10 * time.Second
+	g.Expect(intervalAfter(3)).To(Equal(4 * time.Second))
+	g.Expect(intervalAfter(100)).To(Equal(10 * time.Second))
+	r.MaxFailureBackoff = time.Hour
+	g.Expect(intervalAfter(100)).To(Equal(time.Hour))
+
+	// without a backoff, failures don't change the interval
+	r.FailureBackoff = 0
+	g.Expect(intervalAfter(3)).To(Equal(time.Minute))
+}
+
+func TestSpecScanInterval(t *testing.T) {
+	g := NewWithT(t)
+
+	given := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			ScanInterval: &metav1.Duration{Duration: 5 * time.Second},
+		},
+	}
+	unset := imagev1alpha1.ImageRepository{}
+
+	r := &ImageRepositoryReconciler{}
+	g.Expect(r.specScanInterval(given)).To(Equal(5 * time.Second))
+	g.Expect(r.specScanInterval(unset)).To(Equal(defaultScanInterval))
+
+	// the default can be changed
+	r.DefaultScanInterval = time.Hour
+	g.Expect(r.specScanInterval(given)).To(Equal(5 * time.Second))
+	g.Expect(r.specScanInterval(unset)).To(Equal(time.Hour))
+
+	// and an interval shorter than the minimum is raised to it
+	r.MinScanInterval = time.Minute
+	g.Expect(r.specScanInterval(given)).To(Equal(time.Minute))
+	g.Expect(r.specScanInterval(unset)).To(Equal(time.Hour))
+	g.Expect(r.scanInterval(given)).To(Equal(time.Minute))
+}
+
+func TestWithJitter(t *testing.T) {
+	g := NewWithT(t)
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := withJitter(10 * time.Second)
+		g.Expect(d).To(BeNumerically(">=", 10*time.Second))
+		g.Expect(d).To(BeNumerically("<=", 11*time.Second))
+		seen[d] = true
+	}
+	g.Expect(len(seen)).To(BeNumerically(">", 1))
+	g.Expect(withJitter(0)).To(BeZero())
+}
+
+// expiringTokenRegistry serves a tag list in four pages, to requests
+// with a bearer token from its token endpoint. The third page is
+// refused to the first token issued (as though it had expired), or to
+// any token if alwaysRefuse is set.
+type expiringTokenRegistry struct {
+	mu           sync.Mutex
+	issued       int
+	alwaysRefuse bool
+}
+
+func (reg *expiringTokenRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/token":
+		reg.issued++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": fmt.Sprintf("token-%d", reg.issued)})
+		return
+	case r.URL.Path == "/v2/" || r.Header.Get("Authorization") == "":
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case !strings.HasSuffix(r.URL.Path, "/tags/list"):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		page, _ = strconv.Atoi(p)
+	}
+	if page == 3 && (reg.alwaysRefuse || r.Header.Get("Authorization") == "Bearer token-1") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if page < 4 {
+		w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tags": []string{fmt.Sprintf("v%d", page)}})
+}
+
+func TestListTagsReauthenticates(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := &expiringTokenRegistry{}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/big")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tags, err := listTags(context.TODO(), repo, nil, http.DefaultTransport, nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"v1", "v2", "v3", "v4"}))
+	g.Expect(reg.issued).To(Equal(2))
+
+	// a registry that keeps refusing is given up on, keeping the
+	// pages fetched before
+	reg.issued = 0
+	reg.alwaysRefuse = true
+	tags, err = listTags(context.TODO(), repo, nil, http.DefaultTransport, nil)
+	var partial *partialListError
+	g.Expect(errors.As(err, &partial)).To(BeTrue())
+	g.Expect(tags).To(Equal([]string{"v1", "v2"}))
+	g.Expect(reg.issued).To(Equal(1 + maxReauthentications))
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// policySelection has a series for each image policy, giving the
+// image and tag it has selected. There's only ever one series for
+// each policy, so the number of series is bounded by the number of
+// policies.
+var policySelection = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "image_reflector_policy_selected_info",
+	Help: "The image and tag selected by each ImagePolicy; the value is always 1.",
+}, []string{"namespace", "name", "image", "tag"})
+
+// policiesSelected counts the image policies that have selected an
+// image, including those left out of the per-object metrics.
+var policiesSelected = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "image_reflector_policies_selected",
+	Help: "The number of ImagePolicy objects that have selected an image.",
+})
+
+// imageRepositories counts the image repositories by the status and
+// reason of their Ready condition; e.g., how many are ready, and how
+// many failed their last scan. An image repository without a Ready
+// condition counts as Unknown, with no reason.
+var imageRepositories = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "image_reflector_image_repositories",
+	Help: "The number of ImageRepository objects, by the status and reason of their Ready condition.",
+}, []string{"status", "reason"})
+
+// scanListDuration is how long listing the tags of an image
+// repository takes, including following pages.
+var scanListDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "image_reflector_scan_list_duration_seconds",
+	Help:    "How long listing the tags of an image repository took, in seconds.",
+	Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+})
+
+// repositoryTags has a series for each image repository, giving the
+// number of tags found by its last successful scan. A sudden drop
+// usually means something is wrong with the registry.
+var repositoryTags = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "image_reflector_image_repository_tags",
+	Help: "The number of tags found by the last successful scan of each ImageRepository.",
+}, []string{"namespace", "name"})
+
+// scanFailures counts failed scans by the reason recorded for them.
+var scanFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "image_reflector_scan_failures_total",
+	Help: "The number of failed scans of image repositories, by reason.",
+}, []string{"reason"})
+
+func init() {
+	metrics.Registry.MustRegister(policySelection, policiesSelected, imageRepositories,
+		scanListDuration, repositoryTags, scanFailures)
+}
+
+// recordScan records the outcome of a scan of the image repository
+// in the metrics. The number of tags is only recorded if perObject
+// is true; otherwise, any series for the image repository is
+// removed.
+func recordScan(repo imagev1alpha1.ImageRepository, scanErr error, perObject bool) {
+	if scanErr != nil {
+		scanFailures.WithLabelValues(scanFailureReasonOf(repo)).Inc()
+		return
+	}
+	if perObject {
+		repositoryTags.WithLabelValues(repo.GetNamespace(), repo.GetName()).Set(float64(repo.Status.LastScanResult.TagCount))
+	} else {
+		repositoryTags.DeleteLabelValues(repo.GetNamespace(), repo.GetName())
+	}
+}
+
+// scanFailureReasonOf returns the reason recorded for the failure of
+// the last scan of the image repository: that of the ScanFailing
+// condition, if the failure is within the grace given, or else that
+// of the Ready condition.
+func scanFailureReasonOf(repo imagev1alpha1.ImageRepository) string {
+	var reason string
+	for _, c := range repo.Status.Conditions {
+		switch {
+		case c.Type == imagev1alpha1.ScanFailingCondition && c.Status == corev1.ConditionTrue:
+			return c.Reason
+		case c.Type == imagev1alpha1.ReadyCondition:
+			reason = c.Reason
+		}
+	}
+	return reason
+}
+
+// readiness is the status and reason of an image repository's Ready
+// condition, as counted in imageRepositories.
+type readiness struct {
+	status, reason string
+}
+
+// readinessMetrics keeps track of how each image repository is
+// counted, so that it can be moved from one count to another when
+// its Ready condition changes, and taken out when it's deleted.
+type readinessMetrics struct {
+	mu        sync.Mutex
+	readiness map[types.NamespacedName]readiness
+}
+
+var repositoryReadiness = &readinessMetrics{
+	readiness: map[types.NamespacedName]readiness{},
+}
+
+// record counts the image repository according to its Ready
+// condition, in place of how it was counted before.
+func (m *readinessMetrics) record(repo imagev1alpha1.ImageRepository) {
+	current := readiness{status: string(corev1.ConditionUnknown)}
+	for _, c := range repo.Status.Conditions {
+		if c.Type == imagev1alpha1.ReadyCondition {
+			current = readiness{status: string(c.Status), reason: c.Reason}
+		}
+	}
+	name := types.NamespacedName{Namespace: repo.GetNamespace(), Name: repo.GetName()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.readiness[name]; ok {
+		if previous == current {
+			return
+		}
+		imageRepositories.WithLabelValues(previous.status, previous.reason).Dec()
+	}
+	m.readiness[name] = current
+	imageRepositories.WithLabelValues(current.status, current.reason).Inc()
+}
+
+// forget stops counting the image repository, if it's counted.
+func (m *readinessMetrics) forget(repo types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.readiness[repo]; ok {
+		imageRepositories.WithLabelValues(previous.status, previous.reason).Dec()
+		delete(m.readiness, repo)
+	}
+}
+
+// perObjectMetrics says whether the image policy, and the image
+// repository it selects from, are to have per-object metrics; i.e.,
+// whether neither has opted out with PerObjectMetricsAnnotation.
+func perObjectMetrics(objects ...metav1.Object) bool {
+	for _, obj := range objects {
+		if obj.GetAnnotations()[imagev1alpha1.PerObjectMetricsAnnotation] == "false" {
+			return false
+		}
+	}
+	return true
+}
+
+// selectionMetrics keeps track of the labels of the series for each
+// image policy, so that the series can be removed when the selection
+// changes or the policy is deleted. A policy left out of per-object
+// metrics is kept track of with no labels, so it's still counted.
+type selectionMetrics struct {
+	mu     sync.Mutex
+	labels map[types.NamespacedName][]string
+}
+
+var policySelections = &selectionMetrics{
+	labels: map[types.NamespacedName][]string{},
+}
+
+// record sets the selection for the image policy, replacing any
+// series for a previous selection. If perObject is false, the
+// selection is counted, but has no series of its own.
+func (m *selectionMetrics) record(policy types.NamespacedName, image, tag string, perObject bool) {
+	var labels []string
+	if perObject {
+		labels = []string{policy.Namespace, policy.Name, image, tag}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous := m.labels[policy]; previous != nil {
+		policySelection.DeleteLabelValues(previous...)
+	}
+	m.labels[policy] = labels
+	if labels != nil {
+		policySelection.WithLabelValues(labels...).Set(1)
+	}
+	policiesSelected.Set(float64(len(m.labels)))
+}
+
+// forget removes the series for the image policy, if there is one,
+// and stops counting it.
+func (m *selectionMetrics) forget(policy types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous := m.labels[policy]; previous != nil {
+		policySelection.DeleteLabelValues(previous...)
+	}
+	delete(m.labels, policy)
+	policiesSelected.Set(float64(len(m.labels)))
+}
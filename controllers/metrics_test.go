@@ -0,0 +1,327 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestPolicySelectionMetric(t *testing.T) {
+	g := NewWithT(t)
+
+	const image = "registry.example.com/metrics-app"
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+	repo.Name = "metrics-app"
+	repo.Namespace = "default"
+	repo.Status.CanonicalImageName = image
+
+	pol := &imagev1alpha1.ImagePolicy{
+		Spec: imagev1alpha1.ImagePolicySpec{
+			ImageRepositoryRef: corev1.LocalObjectReference{Name: repo.Name},
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+			},
+		},
+	}
+	pol.Name = "metrics-app-1x"
+	pol.Namespace = "default"
+	polName := types.NamespacedName{Namespace: pol.Namespace, Name: pol.Name}
+
+	db := NewDatabase()
+	r := &ImagePolicyReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo, pol),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+	}
+	reconcile := func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: polName})
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	// DeleteLabelValues says whether there was such a series, without
+	// creating it as WithLabelValues would; so it's used here (on
+	// series that ought not to exist) to check for absence.
+	absent := func(tag string) bool {
+		return !policySelection.DeleteLabelValues(pol.Namespace, pol.Name, image, tag)
+	}
+
+	db.SetTags(context.TODO(), image, []string{"1.0.0"})
+	reconcile()
+	g.Expect(testutil.ToFloat64(policySelection.WithLabelValues(pol.Namespace, pol.Name, image, "1.0.0"))).To(Equal(1.0))
+
+	// a new selection replaces the series
+	db.SetTags(context.TODO(), image, []string{"1.0.0", "1.1.0"})
+	reconcile()
+	g.Expect(testutil.ToFloat64(policySelection.WithLabelValues(pol.Namespace, pol.Name, image, "1.1.0"))).To(Equal(1.0))
+	g.Expect(absent("1.0.0")).To(BeTrue())
+
+	// deleting the policy removes the series
+	g.Expect(r.Delete(context.TODO(), pol)).To(Succeed())
+	reconcile()
+	g.Expect(absent("1.1.0")).To(BeTrue())
+}
+
+func TestPolicySelectionMetricOptOut(t *testing.T) {
+	g := NewWithT(t)
+
+	const image = "registry.example.com/quiet-app"
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+	repo.Name = "quiet-app"
+	repo.Namespace = "default"
+	repo.Annotations = map[string]string{imagev1alpha1.PerObjectMetricsAnnotation: "false"}
+	repo.Status.CanonicalImageName = image
+
+	newPolicy := func(name string) *imagev1alpha1.ImagePolicy {
+		pol := &imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{Name: repo.Name},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+				},
+			},
+		}
+		pol.Name = name
+		pol.Namespace = "default"
+		return pol
+	}
+	pol := newPolicy("quiet-app-1x")
+	other := newPolicy("quiet-app-other")
+
+	db := NewDatabase()
+	db.SetTags(context.TODO(), image, []string{"1.0.0"})
+	r := &ImagePolicyReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo, pol, other),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+	}
+	reconcile := func(pol *imagev1alpha1.ImagePolicy) {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: pol.Namespace, Name: pol.Name}})
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	absent := func(pol *imagev1alpha1.ImagePolicy) bool {
+		return !policySelection.DeleteLabelValues(pol.Namespace, pol.Name, image, "1.0.0")
+	}
+
+	before := testutil.ToFloat64(policiesSelected)
+
+	// the image repository opts out, so neither policy gets a series,
+	// but both are counted
+	reconcile(pol)
+	reconcile(other)
+	g.Expect(absent(pol)).To(BeTrue())
+	g.Expect(absent(other)).To(BeTrue())
+	g.Expect(testutil.ToFloat64(policiesSelected)).To(Equal(before + 2))
+
+	// deleting a policy that opted out stops it being counted
+	g.Expect(r.Delete(context.TODO(), other)).To(Succeed())
+	reconcile(other)
+	g.Expect(testutil.ToFloat64(policiesSelected)).To(Equal(before + 1))
+
+	// opting back in gives the policy a series; the controller flag
+	// takes it away again
+	var repoAfter imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), types.NamespacedName{Namespace: repo.Namespace, Name: repo.Name}, &repoAfter)).To(Succeed())
+	repoAfter.Annotations = nil
+	g.Expect(r.Update(context.TODO(), &repoAfter)).To(Succeed())
+	reconcile(pol)
+	g.Expect(testutil.ToFloat64(policySelection.WithLabelValues(pol.Namespace, pol.Name, image, "1.0.0"))).To(Equal(1.0))
+
+	r.DisablePerObjectMetrics = true
+	reconcile(pol)
+	g.Expect(absent(pol)).To(BeTrue())
+	g.Expect(testutil.ToFloat64(policiesSelected)).To(Equal(before + 1))
+}
+
+func TestImageRepositoriesMetric(t *testing.T) {
+	g := NewWithT(t)
+
+	var failing bool
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, !failing
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:   strings.TrimPrefix(srv.URL, "http://") + "/counted",
+			Suspend: true,
+		},
+	}
+	repo.Name = "counted"
+	repo.Namespace = "default"
+	repoName := types.NamespacedName{Namespace: repo.Namespace, Name: repo.Name}
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	reconcile := func() {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	update := func(change func(*imagev1alpha1.ImageRepository)) {
+		var current imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &current)).To(Succeed())
+		change(&current)
+		g.Expect(r.Update(context.TODO(), &current)).To(Succeed())
+	}
+
+	// other tests count image repositories too, so it's the change
+	// in each count that's looked at
+	buckets := []readiness{
+		{status: string(corev1.ConditionFalse), reason: imagev1alpha1.SuspendedReason},
+		{status: string(corev1.ConditionTrue), reason: imagev1alpha1.ReconciliationSucceededReason},
+		{status: string(corev1.ConditionFalse), reason: imagev1alpha1.RepositoryNotFoundReason},
+	}
+	counts := func() []float64 {
+		var values []float64
+		for _, b := range buckets {
+			values = append(values, testutil.ToFloat64(imageRepositories.WithLabelValues(b.status, b.reason)))
+		}
+		return values
+	}
+	before := counts()
+	changes := func() []float64 {
+		var delta []float64
+		for i, v := range counts() {
+			delta = append(delta, v-before[i])
+		}
+		return delta
+	}
+
+	reconcile()
+	g.Expect(changes()).To(Equal([]float64{1, 0, 0}))
+
+	// resuming scans, and so moves to ready
+	update(func(repo *imagev1alpha1.ImageRepository) {
+		repo.Spec.Suspend = false
+	})
+	reconcile()
+	g.Expect(changes()).To(Equal([]float64{0, 1, 0}))
+
+	// reconciling again without a change leaves the counts alone
+	reconcile()
+	g.Expect(changes()).To(Equal([]float64{0, 1, 0}))
+
+	// a failed scan moves it to failed
+	failing = true
+	update(func(repo *imagev1alpha1.ImageRepository) {
+		repo.Annotations = map[string]string{meta.ReconcileAtAnnotation: "now"}
+	})
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(changes()).To(Equal([]float64{0, 0, 1}))
+
+	// deleting it takes it out of the counts
+	var current imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &current)).To(Succeed())
+	g.Expect(r.Delete(context.TODO(), &current)).To(Succeed())
+	reconcile()
+	g.Expect(changes()).To(Equal([]float64{0, 0, 0}))
+}
+
+func TestScanMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	var failing bool
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0"}, !failing
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: strings.TrimPrefix(srv.URL, "http://") + "/measured",
+		},
+	}
+	repo.Name = "measured"
+	repo.Namespace = "default"
+	repoName := types.NamespacedName{Namespace: repo.Namespace, Name: repo.Name}
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	scanAgain := func() error {
+		var current imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &current)).To(Succeed())
+		current.Annotations = map[string]string{meta.ReconcileAtAnnotation: time.Now().String()}
+		g.Expect(r.Update(context.TODO(), &current)).To(Succeed())
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		return err
+	}
+
+	failuresBefore := testutil.ToFloat64(scanFailures.WithLabelValues(imagev1alpha1.RepositoryNotFoundReason))
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(testutil.ToFloat64(repositoryTags.WithLabelValues(repo.Namespace, repo.Name))).To(Equal(2.0))
+
+	// a failed scan is counted by its reason, and leaves the number
+	// of tags as it was
+	failing = true
+	g.Expect(scanAgain()).To(Succeed())
+	g.Expect(testutil.ToFloat64(scanFailures.WithLabelValues(imagev1alpha1.RepositoryNotFoundReason))).To(Equal(failuresBefore + 1))
+	g.Expect(testutil.ToFloat64(repositoryTags.WithLabelValues(repo.Namespace, repo.Name))).To(Equal(2.0))
+
+	// opting out removes the series
+	failing = false
+	r.DisablePerObjectMetrics = true
+	g.Expect(scanAgain()).To(Succeed())
+	g.Expect(repositoryTags.DeleteLabelValues(repo.Namespace, repo.Name)).To(BeFalse())
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// CanonicalNameKey keys the database on the canonical name of
+	// each image repository; e.g., `index.docker.io/library/alpine`.
+	CanonicalNameKey = "canonical"
+	// ShortNameKey keys the database on the short name of each image
+	// repository; e.g., `alpine`.
+	ShortNameKey = "short"
+)
+
+// shortImageName returns the name of the image repository, leaving
+// out the Docker Hub registry and the `library/` prefix of its
+// official images; e.g., `alpine` rather than
+// `index.docker.io/library/alpine`, and `fluxcd/flux` rather than
+// `index.docker.io/fluxcd/flux`. The names of repositories in other
+// registries are left whole.
+func shortImageName(repo name.Repository) string {
+	if repo.RegistryStr() != name.DefaultRegistry {
+		return repo.String()
+	}
+	return strings.TrimPrefix(repo.RepositoryStr(), "library/")
+}
+
+// nameOptions returns the options for parsing the names of images in
+// the image repository.
+func nameOptions(spec imagev1alpha1.ImageRepositorySpec) []name.Option {
+	if spec.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// databaseKey returns the key for the image repository in the
+// database, according to the keying given (one of CanonicalNameKey
+// or ShortNameKey; empty means canonical). Scans, scheduling and
+// policies must all get the key from here, so that they agree.
+func databaseKey(keying string, repo name.Repository) string {
+	if keying == ShortNameKey {
+		return shortImageName(repo)
+	}
+	return repo.String()
+}
+
+// scannedDatabaseKey returns the database key for an image repo that
+// has been scanned, going by the canonical name in its status.
+func scannedDatabaseKey(keying string, imageRepo imagev1alpha1.ImageRepository) string {
+	canonical := imageRepo.Status.CanonicalImageName
+	if keying != ShortNameKey || canonical == "" {
+		return canonical
+	}
+	repo, err := name.NewRepository(canonical)
+	if err != nil {
+		return canonical
+	}
+	return databaseKey(keying, repo)
+}
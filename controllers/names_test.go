@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestShortImageName(t *testing.T) {
+	g := NewWithT(t)
+
+	short := func(image string) string {
+		repo, err := name.NewRepository(image)
+		g.Expect(err).ToNot(HaveOccurred())
+		return shortImageName(repo)
+	}
+	g.Expect(short("alpine")).To(Equal("alpine"))
+	g.Expect(short("library/alpine")).To(Equal("alpine"))
+	g.Expect(short("docker.io/library/alpine")).To(Equal("alpine"))
+	g.Expect(short("index.docker.io/library/alpine")).To(Equal("alpine"))
+	g.Expect(short("fluxcd/flux")).To(Equal("fluxcd/flux"))
+	g.Expect(short("docker.io/fluxcd/flux")).To(Equal("fluxcd/flux"))
+	// other registries keep the whole name
+	g.Expect(short("ghcr.io/fluxcd/flux")).To(Equal("ghcr.io/fluxcd/flux"))
+	g.Expect(short("localhost:5000/library/alpine")).To(Equal("localhost:5000/library/alpine"))
+}
+
+func TestDatabaseKeyIsConsistent(t *testing.T) {
+	g := NewWithT(t)
+
+	for _, keying := range []string{CanonicalNameKey, ShortNameKey} {
+		r := &ImageRepositoryReconciler{
+			Database:    NewDatabase(),
+			DatabaseKey: keying,
+		}
+		for _, image := range []string{"alpine", "docker.io/library/alpine", "fluxcd/flux", "ghcr.io/fluxcd/flux"} {
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			// as set by a scan
+			r.Database.SetTags(context.TODO(), databaseKey(keying, ref.Context()), []string{"1.0"})
+
+			repo := imagev1alpha1.ImageRepository{}
+			repo.Status.CanonicalImageName = ref.Context().String()
+			repo.Status.ShortImageName = shortImageName(ref.Context())
+			repo = imagev1alpha1.SetImageRepositoryReadiness(repo, corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, "")
+
+			// a policy finds the tags stored by the scan
+			g.Expect(r.Database.Tags(scannedDatabaseKey(keying, repo))).To(Equal([]string{"1.0"}))
+			// and it's not rescanned for want of tags
+			ok, _ := r.shouldScan(repo, time.Now())
+			g.Expect(ok).To(BeFalse())
+		}
+	}
+
+	// the short key for Docker Hub official images
+	ref, err := name.ParseReference("docker.io/library/alpine:3.12")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(databaseKey(ShortNameKey, ref.Context())).To(Equal("alpine"))
+	g.Expect(databaseKey(CanonicalNameKey, ref.Context())).To(Equal("index.docker.io/library/alpine"))
+}
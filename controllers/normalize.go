@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/text/unicode/norm"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// normalizeTags cleans up the tags as listed, according to the mode
+// given (see `.spec.tagNormalization`); an empty mode means
+// TrimTagNormalization. The order of the tags is kept, and where
+// tags are duplicates, the first is kept.
+func normalizeTags(tags []string, mode string) []string {
+	if mode == imagev1alpha1.NoTagNormalization {
+		return tags
+	}
+	full := mode == imagev1alpha1.FullTagNormalization
+
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if full {
+			tag = norm.NFC.String(tag)
+		}
+		if tag == "" {
+			continue
+		}
+		key := tag
+		if full {
+			key = strings.ToLower(tag)
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// validTags returns the tags that are valid tag names, in the order
+// given. A tag that isn't (e.g., one with whitespace or a slash in
+// it, as some proxies list) can't be pulled, and would only confuse
+// the policies selecting from the tags.
+func validTags(tags []string, repo name.Repository, opts ...name.Option) []string {
+	valid := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if t, err := name.NewTag(repo.String()+":"+tag, opts...); err == nil && t.TagStr() == tag {
+			valid = append(valid, tag)
+		}
+	}
+	return valid
+}
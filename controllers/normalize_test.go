@@ -0,0 +1,154 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// dirtyTags has stray whitespace, empty and duplicate tags, tags
+// differing only in case, and the same tag in composed ("é" as one
+// code point) and decomposed ("e" followed by a combining accent)
+// forms.
+var dirtyTags = []string{
+	" 1.0.0", "1.0.0 ", "", "  ", "1.1.0\t", "V2", "v2", "caf\u00e9", "cafe\u0301", "1.1.0",
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{
+			mode: "",
+			want: []string{"1.0.0", "1.1.0", "V2", "v2", "caf\u00e9", "cafe\u0301"},
+		},
+		{
+			mode: imagev1alpha1.TrimTagNormalization,
+			want: []string{"1.0.0", "1.1.0", "V2", "v2", "caf\u00e9", "cafe\u0301"},
+		},
+		{
+			mode: imagev1alpha1.FullTagNormalization,
+			want: []string{"1.0.0", "1.1.0", "V2", "caf\u00e9"},
+		},
+		{
+			mode: imagev1alpha1.NoTagNormalization,
+			want: dirtyTags,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(normalizeTags(dirtyTags, tt.mode)).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestScanNormalizesTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{" 1.0.0", "1.0.0\n", "1.2.0 ", ""}, true
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/dirty"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(r.Database.Tags(image)).To(Equal([]string{"1.0.0", "1.2.0"}))
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+
+	// so a policy selects a clean tag
+	latest, err := SelectLatestTag(r.Database, image, "", imagev1alpha1.ImagePolicySpec{
+		Policy: imagev1alpha1.ImagePolicyChoice{
+			SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(latest).To(Equal("1.2.0"))
+}
+
+func TestValidTags(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := name.NewRepository("example.com/app")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(validTags([]string{
+		"1.0.0", "v1.0.0-rc.1", "latest", "_build", "1.0.0 ", "", "a/b", "a:b", "sha256@abc", strings.Repeat("x", 129),
+	}, repo)).To(Equal([]string{"1.0.0", "v1.0.0-rc.1", "latest", "_build"}))
+}
+
+func TestScanDropsMalformedTags(t *testing.T) {
+	messy := []string{"1.0.0", " 1.0.0", "", "1.1.0", "1.1.0", "bad/tag", "1.2.0\t", "bad tag"}
+	tests := []struct {
+		mode    string
+		want    []string
+		dropped int
+	}{
+		{
+			mode:    imagev1alpha1.TrimTagNormalization,
+			want:    []string{"1.0.0", "1.1.0", "1.2.0"},
+			dropped: 5,
+		},
+		{
+			// duplicates are kept, as listed, but not invalid names
+			mode:    imagev1alpha1.NoTagNormalization,
+			want:    []string{"1.0.0", "1.1.0", "1.1.0"},
+			dropped: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			g := NewWithT(t)
+
+			srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+				return messy, true
+			}))
+			defer srv.Close()
+
+			image := strings.TrimPrefix(srv.URL, "http://") + "/messy"
+			ref, err := name.ParseReference(image)
+			g.Expect(err).ToNot(HaveOccurred())
+			repo := imagev1alpha1.ImageRepository{
+				Spec: imagev1alpha1.ImageRepositorySpec{Image: image, TagNormalization: tt.mode},
+			}
+
+			r := &ImageRepositoryReconciler{Database: NewDatabase()}
+			repo, err = r.scan(context.TODO(), repo, ref)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(r.Database.Tags(image)).To(Equal(tt.want))
+			g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(len(tt.want)))
+			g.Expect(repo.Status.LastScanResult.ListedTagCount).To(Equal(len(messy)))
+			g.Expect(repo.Status.LastScanResult.DroppedTagCount).To(Equal(tt.dropped))
+		})
+	}
+}
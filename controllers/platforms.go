@@ -0,0 +1,152 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// fetchPlatforms fetches the manifest for each of the tags given,
+// and returns a map of tag to the platforms for which it's
+// available. A tag with a manifest that can't be fetched or
+// understood (e.g., an old schema 1 manifest) is recorded as having
+// no platforms, rather than failing the lot. If auth is nil, the
+// manifests are fetched anonymously. The fetcher decides how many
+// manifests are fetched at once.
+func fetchPlatforms(ctx context.Context, repo name.Repository, tags []string, transport http.RoundTripper, auth authn.Authenticator, f *fetcher) (map[string][]string, error) {
+	// remote.Get doesn't take a context, so it's bound to each
+	// request by the transport instead.
+	options := []remote.Option{
+		remote.WithTransport(&contextTransport{inner: transport, ctx: ctx}),
+	}
+	if auth != nil {
+		options = append(options, remote.WithAuth(auth))
+	}
+
+	found := make([][]string, len(tags))
+	err := f.forEachTag(ctx, tags, func(i int, tag string) {
+		found[i], _ = platformsForTag(repo.Tag(tag), options...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	platforms := make(map[string][]string, len(tags))
+	for i, tag := range tags {
+		platforms[tag] = found[i]
+	}
+	return platforms, nil
+}
+
+// platformsForTag returns the platforms for which the image at the
+// tag is available: those listed in the index if it's a multi-arch
+// image, otherwise the platform given in the image's config.
+func platformsForTag(ref name.Reference, options ...remote.Option) ([]string, error) {
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		var platforms []string
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil {
+				platforms = append(platforms, platformString(*m.Platform))
+			}
+		}
+		return platforms, nil
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		if config.OS == "" && config.Architecture == "" {
+			return nil, nil
+		}
+		return []string{platformString(v1.Platform{
+			OS:           config.OS,
+			Architecture: config.Architecture,
+		})}, nil
+	}
+}
+
+// platformString renders a platform as `os/arch` or
+// `os/arch/variant`.
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// parsePlatform parses a platform given as `os/arch` or
+// `os/arch/variant`.
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("platform %q is not of the form os/arch or os/arch/variant", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return v1.Platform{}, fmt.Errorf("platform %q is not of the form os/arch or os/arch/variant", s)
+		}
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformMatches says whether the platform given as `have` satisfies
+// the platform wanted. Each part of `want` must match the
+// corresponding part of `have`; leaving out the variant in `want`
+// matches any variant.
+func platformMatches(want, have string) bool {
+	wantParts, haveParts := strings.Split(want, "/"), strings.Split(have, "/")
+	if len(wantParts) > len(haveParts) {
+		return false
+	}
+	for i := range wantParts {
+		if wantParts[i] != haveParts[i] {
+			return false
+		}
+	}
+	return true
+}
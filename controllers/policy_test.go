@@ -18,12 +18,20 @@ package controllers
 
 import (
 	"context"
+	"io/ioutil"
+	"testing"
 	"time"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
 	// +kubebuilder:scaffold:imports
@@ -94,4 +102,478 @@ var _ = Describe("ImagePolicy controller", func() {
 		}, timeout, interval).Should(BeTrue())
 		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":1.0.2"))
 	})
+
+	It("selects only tags available for the platform given", func() {
+		amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+		arm64 := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+		imgRepo := loadMultiPlatformImages("test-platform-policy", map[string][]v1.Platform{
+			"1.0.0": {amd64},
+			"1.1.0": {amd64, arm64},
+			"1.2.0": {amd64},
+		})
+
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:            imgRepo,
+				InspectPlatforms: true,
+			},
+		}
+		repoObjectName := types.NamespacedName{
+			Name:      "polplatform",
+			Namespace: "default",
+		}
+		repo.Name = repoObjectName.Name
+		repo.Namespace = repoObjectName.Namespace
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		r := imageRepoReconciler
+		Expect(r.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := r.Get(context.Background(), repoObjectName, &repoAfter)
+			return err == nil && repoAfter.Status.LastScanResult.TagCount > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(3))
+		Expect(r.Database.TagPlatforms(imgRepo, "1.1.0")).To(ConsistOf("linux/amd64", "linux/arm64/v8"))
+
+		polName := types.NamespacedName{
+			Name:      "platform-pol",
+			Namespace: repoObjectName.Namespace,
+		}
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{
+					Name: repoObjectName.Name,
+				},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{
+						Range: ">=1.0.0",
+					},
+				},
+				Platform: "linux/arm64",
+			},
+		}
+		pol.Namespace = polName.Namespace
+		pol.Name = polName.Name
+
+		Expect(r.Create(ctx, &pol)).To(Succeed())
+
+		var polAfter imagev1alpha1.ImagePolicy
+		Eventually(func() bool {
+			err := r.Get(context.Background(), polName, &polAfter)
+			return err == nil && polAfter.Status.LatestImage != ""
+		}, timeout, interval).Should(BeTrue())
+		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":1.1.0"))
+	})
+
+	It("calculates a chart version from an OCI chart repository", func() {
+		versions := []string{"0.1.0", "0.2.0", "0.2.1+build.7", "1.0.0"}
+		chartRepo := loadCharts("test-chart-policy", versions)
+
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:        chartRepo,
+				ArtifactType: imagev1alpha1.ChartArtifactType,
+			},
+		}
+		repoObjectName := types.NamespacedName{
+			Name:      "polchart",
+			Namespace: "default",
+		}
+		repo.Name = repoObjectName.Name
+		repo.Namespace = repoObjectName.Namespace
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		r := imageRepoReconciler
+		Expect(r.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := r.Get(context.Background(), repoObjectName, &repoAfter)
+			return err == nil && len(repoAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(len(versions)))
+		Expect(repoAfter.Status.Conditions[0].Message).To(Equal("successful scan, found 4 chart versions"))
+
+		polName := types.NamespacedName{
+			Name:      "chart-pol",
+			Namespace: repoObjectName.Namespace,
+		}
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{
+					Name: repoObjectName.Name,
+				},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{
+						Range: "0.2.x",
+					},
+				},
+			},
+		}
+		pol.Namespace = polName.Namespace
+		pol.Name = polName.Name
+
+		Expect(r.Create(ctx, &pol)).To(Succeed())
+
+		var polAfter imagev1alpha1.ImagePolicy
+		Eventually(func() bool {
+			err := r.Get(context.Background(), polName, &polAfter)
+			return err == nil && polAfter.Status.LatestImage != ""
+		}, timeout, interval).Should(BeTrue())
+		Expect(polAfter.Status.LatestImage).To(Equal(chartRepo + ":0.2.1_build.7"))
+	})
+
+	It("calculates an image from the dates embedded in tags", func() {
+		tags := []string{
+			"app-2024.01.15-build42",
+			"app-2024.02.03-build40",
+			"app-2023.12.31-build50",
+			"app-latest",
+			"app-2024.13.01-build1", // doesn't parse
+		}
+		imgRepo := loadImages("test-date-policy", tags)
+
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image: imgRepo,
+			},
+		}
+		repoObjectName := types.NamespacedName{
+			Name:      "poldate",
+			Namespace: "default",
+		}
+		repo.Name = repoObjectName.Name
+		repo.Namespace = repoObjectName.Namespace
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		r := imageRepoReconciler
+		Expect(r.Create(ctx, &repo)).To(Succeed())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Eventually(func() bool {
+			err := r.Get(context.Background(), repoObjectName, &repoAfter)
+			return err == nil && repoAfter.Status.LastScanResult.TagCount > 0
+		}, timeout, interval).Should(BeTrue())
+		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(len(tags)))
+
+		polName := types.NamespacedName{
+			Name:      "date-pol",
+			Namespace: repoObjectName.Namespace,
+		}
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{
+					Name: repoObjectName.Name,
+				},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					Date: &imagev1alpha1.DatePolicy{
+						Pattern: `^app-(\d{4}\.\d{2}\.\d{2})-build\d+$`,
+						Layout:  "2006.01.02",
+					},
+				},
+			},
+		}
+		pol.Namespace = polName.Namespace
+		pol.Name = polName.Name
+
+		Expect(r.Create(ctx, &pol)).To(Succeed())
+
+		var polAfter imagev1alpha1.ImagePolicy
+		Eventually(func() bool {
+			err := r.Get(context.Background(), polName, &polAfter)
+			return err == nil && polAfter.Status.LatestImage != ""
+		}, timeout, interval).Should(BeTrue())
+		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":app-2024.02.03-build40"))
+	})
+
+	It("holds on to the selected image if its tag is pushed again", func() {
+		imgRepo := loadImages("test-mutated-selection", []string{"1.0.0", "1.1.0"})
+
+		repoName := types.NamespacedName{Name: "mutated", Namespace: "default"}
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image: imgRepo,
+			},
+		}
+		repo.Name = repoName.Name
+		repo.Namespace = repoName.Namespace
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		r := imageRepoReconciler
+		Expect(r.Create(ctx, &repo)).To(Succeed())
+
+		polName := types.NamespacedName{Name: "mutated-pol", Namespace: repoName.Namespace}
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				ImageRepositoryRef: corev1.LocalObjectReference{Name: repoName.Name},
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+				},
+				VerifyDigest: true,
+			},
+		}
+		pol.Name = polName.Name
+		pol.Namespace = polName.Namespace
+		Expect(r.Create(ctx, &pol)).To(Succeed())
+
+		var polAfter imagev1alpha1.ImagePolicy
+		Eventually(func() bool {
+			err := r.Get(context.Background(), polName, &polAfter)
+			return err == nil && polAfter.Status.LatestDigest != ""
+		}, timeout, interval).Should(BeTrue())
+		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":1.1.0"))
+		selectedDigest := polAfter.Status.LatestDigest
+
+		// push a different image to the selected tag, then nudge
+		// the policy into reconciling again
+		loadImages("test-mutated-selection", []string{"1.1.0"})
+		polAfter.Annotations = map[string]string{"test": "poke"}
+		Expect(r.Update(ctx, &polAfter)).To(Succeed())
+
+		Eventually(func() bool {
+			err := r.Get(context.Background(), polName, &polAfter)
+			return err == nil && len(polAfter.Status.Conditions) > 0
+		}, timeout, interval).Should(BeTrue())
+		cond := polAfter.Status.Conditions[0]
+		Expect(cond.Type).To(Equal(imagev1alpha1.MutatedSelectionCondition))
+		Expect(cond.Status).To(Equal(corev1.ConditionTrue))
+		Expect(cond.Reason).To(Equal(imagev1alpha1.DigestChangedReason))
+		Expect(polAfter.Status.LatestImage).To(Equal(imgRepo + ":1.1.0"))
+		Expect(polAfter.Status.LatestDigest).To(Equal(selectedDigest))
+	})
 })
+
+func TestCalculateLatestImageDate(t *testing.T) {
+	g := NewWithT(t)
+
+	latest := func(pattern, layout string, tags ...string) string {
+		tag, err := calculateLatestImageDate(&imagev1alpha1.ImagePolicyChoice{
+			Date: &imagev1alpha1.DatePolicy{Pattern: pattern, Layout: layout},
+		}, tags)
+		g.Expect(err).ToNot(HaveOccurred())
+		return tag
+	}
+
+	// the first group is used, if there's no group named `date`
+	g.Expect(latest(`^nightly-(\d{8})$`, "20060102",
+		"nightly-20231231", "nightly-20240101", "nightly-2024010", "stable")).To(Equal("nightly-20240101"))
+	// a group named `date` takes precedence
+	g.Expect(latest(`^(main|dev)-(?P<date>\d{8}T\d{6})$`, "20060102T150405",
+		"main-20240101T120000", "dev-20240101T090000", "main-20240101T083000")).To(Equal("main-20240101T120000"))
+	// ties are broken lexically
+	g.Expect(latest(`^app-(\d{4}-\d{2}-\d{2})-build\d+$`, "2006-01-02",
+		"app-2024-01-15-build41", "app-2024-01-15-build42")).To(Equal("app-2024-01-15-build42"))
+	// nothing that parses gives no result
+	g.Expect(latest(`^v(\d+)$`, "2006", "latest", "main")).To(Equal(""))
+
+	_, err := calculateLatestImageDate(&imagev1alpha1.ImagePolicyChoice{
+		Date: &imagev1alpha1.DatePolicy{Pattern: `^app-\d+$`, Layout: "2006"},
+	}, []string{"app-2024"})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestValidateDatePolicy(t *testing.T) {
+	g := NewWithT(t)
+
+	validate := func(pattern, layout string) error {
+		pol := imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					Date: &imagev1alpha1.DatePolicy{Pattern: pattern, Layout: layout},
+				},
+			},
+		}
+		return pol.ValidateCreate()
+	}
+
+	g.Expect(validate(`^app-(.+)$`, "2006.01.02")).To(Succeed())
+	g.Expect(validate(`^app-(.+)$`, "20060102T150405")).To(Succeed())
+	g.Expect(validate(`^app-(.+)$`, "nightly")).ToNot(Succeed())
+	g.Expect(validate(`^app-.+$`, "2006.01.02")).ToNot(Succeed())
+	g.Expect(validate(`^app-(.+$`, "2006.01.02")).ToNot(Succeed())
+}
+
+func TestValidateSemVerPolicy(t *testing.T) {
+	g := NewWithT(t)
+
+	newPolicy := func(semverRange string) imagev1alpha1.ImagePolicy {
+		return imagev1alpha1.ImagePolicy{
+			Spec: imagev1alpha1.ImagePolicySpec{
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					SemVer: &imagev1alpha1.SemVerPolicy{Range: semverRange},
+				},
+			},
+		}
+	}
+
+	for _, valid := range []string{"1.x", ">=1.0.0 <2.0.0", "~1.2", "^0.3.0-0", "1.0.0 || 2.x"} {
+		pol := newPolicy(valid)
+		g.Expect(pol.ValidateCreate()).To(Succeed(), valid)
+	}
+	for _, invalid := range []string{"", "not-a-range", ">=1.0.0 <", "1.0.0 ||| 2.0.0"} {
+		pol := newPolicy(invalid)
+		err := pol.ValidateCreate()
+		g.Expect(err).To(HaveOccurred(), invalid)
+		g.Expect(err.Error()).To(HavePrefix("invalid .spec.policy.semver: "))
+	}
+
+	// updates are checked the same way
+	old, pol := newPolicy("1.x"), newPolicy("1.x.x.x")
+	g.Expect(pol.ValidateUpdate(&old)).ToNot(Succeed())
+}
+
+func TestPlatformMatches(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(platformMatches("linux/arm64", "linux/arm64")).To(BeTrue())
+	g.Expect(platformMatches("linux/arm64", "linux/arm64/v8")).To(BeTrue())
+	g.Expect(platformMatches("linux/arm64/v8", "linux/arm64/v8")).To(BeTrue())
+	g.Expect(platformMatches("linux/arm64/v8", "linux/arm64")).To(BeFalse())
+	g.Expect(platformMatches("linux/arm", "linux/arm64")).To(BeFalse())
+	g.Expect(platformMatches("windows/amd64", "linux/amd64")).To(BeFalse())
+}
+
+func TestPolicySelectsFromUnionOfRepositories(t *testing.T) {
+	g := NewWithT(t)
+
+	const (
+		primaryImage = "registry.example.com/app"
+		mirrorImage  = "mirror.example.com/app"
+	)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	imageRepo := func(name, image string) *imagev1alpha1.ImageRepository {
+		repo := &imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+		}
+		repo.Name = name
+		repo.Namespace = "default"
+		repo.Status.CanonicalImageName = image
+		return repo
+	}
+	pol := &imagev1alpha1.ImagePolicy{
+		Spec: imagev1alpha1.ImagePolicySpec{
+			ImageRepositoryRef: corev1.LocalObjectReference{Name: "primary"},
+			AdditionalImageRepositoryRefs: []corev1.LocalObjectReference{
+				{Name: "missing"},
+				{Name: "mirror"},
+			},
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+			},
+			Baseline: "1.0.0",
+		},
+	}
+	pol.Name = "union"
+	pol.Namespace = "default"
+	polName := types.NamespacedName{Namespace: pol.Namespace, Name: pol.Name}
+
+	db := NewDatabase()
+	r := &ImagePolicyReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, imageRepo("primary", primaryImage), imageRepo("mirror", mirrorImage), pol),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+	}
+	reconcile := func() imagev1alpha1.ImagePolicy {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: polName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var polAfter imagev1alpha1.ImagePolicy
+		g.Expect(r.Get(context.TODO(), polName, &polAfter)).To(Succeed())
+		return polAfter
+	}
+
+	// the same versions in both; the primary is preferred
+	db.SetTags(context.TODO(), primaryImage, []string{"1.0.0", "1.1.0"})
+	db.SetTags(context.TODO(), mirrorImage, []string{"1.0.0", "1.1.0"})
+	polAfter := reconcile()
+	g.Expect(polAfter.Status.LatestImage).To(Equal(primaryImage + ":1.1.0"))
+	g.Expect(polAfter.Status.LatestImageRepository).To(Equal("primary"))
+
+	// a version only in the mirror is taken from there
+	db.SetTags(context.TODO(), mirrorImage, []string{"1.0.0", "1.1.0", "1.2.0"})
+	polAfter = reconcile()
+	g.Expect(polAfter.Status.LatestImage).To(Equal(mirrorImage + ":1.2.0"))
+	g.Expect(polAfter.Status.LatestImageRepository).To(Equal("mirror"))
+	g.Expect(polAfter.Status.NewerTags).To(Equal([]string{"1.1.0", "1.2.0"}))
+
+	// and a version only in the primary, from the primary
+	db.SetTags(context.TODO(), primaryImage, []string{"1.0.0", "1.1.0", "1.3.0"})
+	polAfter = reconcile()
+	g.Expect(polAfter.Status.LatestImage).To(Equal(primaryImage + ":1.3.0"))
+	g.Expect(polAfter.Status.LatestImageRepository).To(Equal("primary"))
+	g.Expect(polAfter.Status.NewerTags).To(Equal([]string{"1.1.0", "1.2.0", "1.3.0"}))
+}
+
+func TestPolicyReportsMatchingTags(t *testing.T) {
+	g := NewWithT(t)
+
+	const image = "registry.example.com/matching"
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+	repo.Name = "matching"
+	repo.Namespace = "default"
+	repo.Status.CanonicalImageName = image
+
+	pol := &imagev1alpha1.ImagePolicy{
+		Spec: imagev1alpha1.ImagePolicySpec{
+			ImageRepositoryRef: corev1.LocalObjectReference{Name: repo.Name},
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+			},
+		},
+	}
+	pol.Name = "matching-1x"
+	pol.Namespace = "default"
+	polName := types.NamespacedName{Namespace: pol.Namespace, Name: pol.Name}
+
+	db := NewDatabase()
+	r := &ImagePolicyReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo, pol),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: db,
+	}
+	reconcile := func() imagev1alpha1.ImagePolicy {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: polName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var polAfter imagev1alpha1.ImagePolicy
+		g.Expect(r.Get(context.TODO(), polName, &polAfter)).To(Succeed())
+		return polAfter
+	}
+
+	// floating tags aren't chosen from, so don't count
+	db.SetTags(context.TODO(), image, []string{"1.0.0", "1.1.0", "2.0.0", "latest"})
+	polAfter := reconcile()
+	g.Expect(polAfter.Status.LatestImage).To(Equal(image + ":1.1.0"))
+	g.Expect(polAfter.Status.MatchingTags).To(Equal(2))
+
+	// the count follows the tags
+	db.SetTags(context.TODO(), image, []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"})
+	polAfter = reconcile()
+	g.Expect(polAfter.Status.MatchingTags).To(Equal(3))
+
+	// and the policy; a policy that matches nothing says so, though
+	// it leaves the latest image as it was
+	polAfter.Spec.Policy.SemVer.Range = "3.x"
+	g.Expect(r.Update(context.TODO(), &polAfter)).To(Succeed())
+	polAfter = reconcile()
+	g.Expect(polAfter.Status.MatchingTags).To(BeZero())
+	g.Expect(polAfter.Status.LatestImage).To(Equal(image + ":1.2.0"))
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// namespacesPredicate returns a predicate that only lets through
+// events for objects in one of the namespaces given. An empty list
+// means all namespaces are watched.
+func namespacesPredicate(namespaces []string) predicate.Predicate {
+	if len(namespaces) == 0 {
+		return predicate.Funcs{}
+	}
+	watched := make(map[string]struct{}, len(namespaces))
+	for _, ns := range namespaces {
+		watched[ns] = struct{}{}
+	}
+	return predicate.NewPredicateFuncs(func(meta metav1.Object, _ runtime.Object) bool {
+		_, ok := watched[meta.GetNamespace()]
+		return ok
+	})
+}
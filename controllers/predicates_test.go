@@ -0,0 +1,52 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestNamespacesPredicate(t *testing.T) {
+	g := NewWithT(t)
+
+	repoIn := func(namespace string) event.CreateEvent {
+		repo := &imagev1alpha1.ImageRepository{}
+		repo.Name = "repo"
+		repo.Namespace = namespace
+		return event.CreateEvent{Meta: repo, Object: repo}
+	}
+
+	all := namespacesPredicate(nil)
+	g.Expect(all.Create(repoIn("default"))).To(BeTrue())
+	g.Expect(all.Create(repoIn("elsewhere"))).To(BeTrue())
+
+	some := namespacesPredicate([]string{"tenant-a", "tenant-b"})
+	g.Expect(some.Create(repoIn("tenant-a"))).To(BeTrue())
+	g.Expect(some.Create(repoIn("tenant-b"))).To(BeTrue())
+	g.Expect(some.Create(repoIn("default"))).To(BeFalse())
+
+	out := repoIn("default")
+	g.Expect(some.Update(event.UpdateEvent{
+		MetaOld: out.Meta, ObjectOld: out.Object,
+		MetaNew: out.Meta, ObjectNew: out.Object,
+	})).To(BeFalse())
+}
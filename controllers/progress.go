@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// scanProgress reports the progress of a scan in the status of the
+// image repository, as the Reconciling condition, so that it can be
+// seen with `kubectl describe` while a long scan is underway. To keep
+// the writes down, it reports no more often than every interval, and
+// not at all until an interval has passed since the scan started; so
+// short scans are never reported. An interval of zero turns
+// reporting off.
+//
+// The condition is patched, rather than the whole status updated, so
+// as not to disturb the rest of the status; but each write changes
+// the resource version, which has to be carried over to the status
+// written at the end of the scan (see carryOver). That status leaves
+// out the Reconciling condition, which removes it.
+type scanProgress struct {
+	ctx      context.Context
+	client   client.StatusClient
+	log      logr.Logger
+	interval time.Duration
+
+	mu              sync.Mutex
+	repo            imagev1alpha1.ImageRepository
+	last            time.Time
+	resourceVersion string
+}
+
+func newScanProgress(ctx context.Context, c client.StatusClient, log logr.Logger, repo imagev1alpha1.ImageRepository, interval time.Duration) *scanProgress {
+	return &scanProgress{
+		ctx:      ctx,
+		client:   c,
+		log:      log,
+		interval: interval,
+		repo:     repo,
+		last:     time.Now(),
+	}
+}
+
+// report records the message as the progress of the scan, if it's
+// been long enough since the last report. It's safe to call from
+// more than one goroutine.
+func (p *scanProgress) report(msg string) {
+	if p.interval <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+
+	before := p.repo.DeepCopy()
+	reporting := imagev1alpha1.SetImageRepositoryCondition(p.repo, imagev1alpha1.ReconcilingCondition,
+		corev1.ConditionTrue, imagev1alpha1.ProgressingReason, msg)
+	if err := p.client.Status().Patch(p.ctx, &reporting, client.MergeFrom(before)); err != nil {
+		// the scan can carry on regardless
+		p.log.Error(err, "unable to report progress of scan")
+		return
+	}
+	p.repo = reporting
+	p.resourceVersion = reporting.GetResourceVersion()
+}
+
+// carryOver gives the image repository the resource version from the
+// last report of progress, if there was one, so it can be written
+// without a conflict.
+func (p *scanProgress) carryOver(repo *imagev1alpha1.ImageRepository) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resourceVersion != "" {
+		repo.SetResourceVersion(p.resourceVersion)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// slowPagedRegistry serves a tag list in pages, taking a while over
+// each one.
+type slowPagedRegistry struct {
+	pages int
+	delay time.Duration
+}
+
+func (reg *slowPagedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	time.Sleep(reg.delay)
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		page, _ = strconv.Atoi(p)
+	}
+	if page < reg.pages {
+		w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tags": []string{fmt.Sprintf("v%d", page)}})
+}
+
+// progressRecorder is a client that records the messages of the
+// Reconciling condition in status patches.
+type progressRecorder struct {
+	client.Client
+	mu       sync.Mutex
+	messages []string
+}
+
+func (c *progressRecorder) Status() client.StatusWriter {
+	return &progressRecordingWriter{StatusWriter: c.Client.Status(), recorder: c}
+}
+
+type progressRecordingWriter struct {
+	client.StatusWriter
+	recorder *progressRecorder
+}
+
+func (w *progressRecordingWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if repo, ok := obj.(*imagev1alpha1.ImageRepository); ok {
+		for _, c := range repo.Status.Conditions {
+			if c.Type == imagev1alpha1.ReconcilingCondition {
+				w.recorder.mu.Lock()
+				w.recorder.messages = append(w.recorder.messages, c.Message)
+				w.recorder.mu.Unlock()
+			}
+		}
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func TestScanReportsProgress(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(&slowPagedRegistry{pages: 8, delay: 25 * time.Millisecond})
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/big"
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+	repo.Name = "big"
+	repo.Namespace = "default"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	c := &progressRecorder{Client: fake.NewFakeClientWithScheme(s, repo)}
+	r := &ImageRepositoryReconciler{
+		Client:           c,
+		Log:              zap.LoggerTo(ioutil.Discard, true),
+		Database:         NewDatabase(),
+		ProgressInterval: 60 * time.Millisecond,
+	}
+	repoName := types.NamespacedName{Namespace: repo.Namespace, Name: repo.Name}
+	var before imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &before)).To(Succeed())
+
+	scanned, err := r.scan(context.TODO(), before, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(8))
+
+	// progress was reported during the scan, but throttled
+	c.mu.Lock()
+	messages := c.messages
+	c.mu.Unlock()
+	g.Expect(len(messages)).To(BeNumerically(">=", 1))
+	g.Expect(len(messages)).To(BeNumerically("<", 8))
+	g.Expect(messages[0]).To(MatchRegexp(`^listing tags, fetched \d page\(s\) with \d tags so far$`))
+
+	// the status from the scan can be written over the progress, and
+	// leaves it out
+	g.Expect(r.Status().Update(context.TODO(), &scanned)).To(Succeed())
+	var after imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &after)).To(Succeed())
+	for _, c := range after.Status.Conditions {
+		g.Expect(c.Type).ToNot(Equal(imagev1alpha1.ReconcilingCondition))
+	}
+
+	// a short scan reports nothing
+	c.messages = nil
+	r.ProgressInterval = time.Hour
+	_, err = r.scan(context.TODO(), after, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.messages).To(BeEmpty())
+}
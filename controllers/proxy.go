@@ -0,0 +1,96 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The keys of a secret giving a proxy, as named by an image
+// repository's `.spec.proxySecretRef`.
+const (
+	proxyAddressKey  = "address"
+	proxyUsernameKey = "username"
+	proxyPasswordKey = "password"
+)
+
+// proxyURLFromSecret returns the URL of the proxy given in the
+// secret, with the credentials for it, if any.
+func proxyURLFromSecret(secret corev1.Secret) (*url.URL, error) {
+	address, ok := secret.Data[proxyAddressKey]
+	if !ok || len(address) == 0 {
+		return nil, fmt.Errorf("secret %q has no %q key", secret.Name, proxyAddressKey)
+	}
+	proxyURL, err := url.Parse(string(address))
+	if err != nil {
+		// the error from parsing quotes the address, which may have
+		// credentials in it, so only the reason is given
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid proxy address in secret %q: %w", secret.Name, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy address in secret %q: scheme must be http, https or socks5, not %q", secret.Name, proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy address in secret %q: no host given", secret.Name)
+	}
+	username, password := string(secret.Data[proxyUsernameKey]), string(secret.Data[proxyPasswordKey])
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+	return proxyURL, nil
+}
+
+// proxyTransportKey identifies a transport made by proxyTransport.
+type proxyTransportKey struct {
+	base  http.RoundTripper
+	proxy string
+}
+
+// proxyTransports holds the transports made by proxyTransport, so
+// that each keeps its pool of connections across scans.
+var proxyTransports sync.Map
+
+// proxyTransport returns a transport like the one given, but which
+// sends requests through the proxy given. Only an *http.Transport can
+// be made so; since going around the proxy may not be allowed, any
+// other transport is an error.
+func proxyTransport(rt http.RoundTripper, proxy *url.URL) (http.RoundTripper, error) {
+	key := proxyTransportKey{base: rt, proxy: proxy.String()}
+	if t, ok := proxyTransports.Load(key); ok {
+		return t.(http.RoundTripper), nil
+	}
+	base, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("unable to send requests through a proxy with a transport of type %T", rt)
+	}
+	t := base.Clone()
+	t.Proxy = http.ProxyURL(proxy)
+	actual, _ := proxyTransports.LoadOrStore(key, t)
+	return actual.(http.RoundTripper), nil
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// pushHookPath is the path the push receiver serves under; the
+	// provider is given after it, e.g., `/hook/harbor`.
+	pushHookPath = "/hook/"
+	// maxPushEventSize is the largest push notification accepted.
+	maxPushEventSize = 1 << 20
+)
+
+// Timeouts for the servers the controller runs itself (the push
+// receiver and the tags API), so that slow or idle clients can't hold
+// connections open indefinitely.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = time.Minute
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// newServer returns a server for the handler at the address, with
+// the timeouts above.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+}
+
+// pushEventParsers gives, for each provider the push receiver
+// understands, a func returning the repository an image was pushed
+// to from the body of the provider's notification. To understand
+// another provider, add a parser here.
+var pushEventParsers = map[string]func(body []byte) (string, error){
+	"harbor":    parseHarborPushEvent,
+	"dockerhub": parseDockerHubPushEvent,
+}
+
+// parsePushEvent returns the repository an image was pushed to, as
+// given in a notification from the provider named.
+func parsePushEvent(body []byte, provider string) (string, error) {
+	parse, ok := pushEventParsers[provider]
+	if !ok {
+		return "", fmt.Errorf("unknown provider %q", provider)
+	}
+	return parse(body)
+}
+
+// parseHarborPushEvent parses Harbor's PUSH_ARTIFACT notification.
+// The repository is taken from the URL of the resource pushed, since
+// that includes the registry's host.
+func parseHarborPushEvent(body []byte) (string, error) {
+	var payload struct {
+		Type      string `json:"type"`
+		EventData struct {
+			Resources []struct {
+				ResourceURL string `json:"resource_url"`
+			} `json:"resources"`
+		} `json:"event_data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", err
+	}
+	if payload.Type != "PUSH_ARTIFACT" {
+		return "", fmt.Errorf("not a push event: %q", payload.Type)
+	}
+	if len(payload.EventData.Resources) == 0 || payload.EventData.Resources[0].ResourceURL == "" {
+		return "", fmt.Errorf("no resource in push event")
+	}
+	ref, err := name.ParseReference(payload.EventData.Resources[0].ResourceURL)
+	if err != nil {
+		return "", err
+	}
+	return ref.Context().String(), nil
+}
+
+// parseDockerHubPushEvent parses Docker Hub's push notification,
+// which names the repository without the registry.
+func parseDockerHubPushEvent(body []byte) (string, error) {
+	var payload struct {
+		PushData *struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", err
+	}
+	if payload.PushData == nil {
+		return "", fmt.Errorf("not a push event")
+	}
+	if payload.Repository.RepoName == "" {
+		return "", fmt.Errorf("no repository in push event")
+	}
+	repo, err := name.NewRepository(payload.Repository.RepoName)
+	if err != nil {
+		return "", err
+	}
+	return repo.String(), nil
+}
+
+// PushReceiver serves an endpoint for registries' push notifications,
+// and has the image repositories scanning the repository pushed to
+// scanned straight away, rather than when they're next due. Each
+// provider has its own path, under `/hook/`; e.g., `/hook/harbor`.
+//
+// A notification must carry the token, either in the Authorization
+// header (as is, or as a bearer token) or as the `token` query
+// parameter, for registries that can't be made to send headers.
+type PushReceiver struct {
+	// Addr is the address to listen on.
+	Addr string
+	// Token is the secret that notifications must carry.
+	Token  string
+	Client client.Reader
+	Log    logr.Logger
+	// WatchNamespaces restricts the receiver to image repositories
+	// in the given namespaces; if empty, all namespaces are watched.
+	WatchNamespaces []string
+
+	events chan event.GenericEvent
+	mu     sync.Mutex
+	pushed map[types.NamespacedName]time.Time
+}
+
+// NewPushReceiver returns a receiver for push notifications; it must
+// be given to the ImageRepositoryReconciler, and added to the manager
+// to be started.
+func NewPushReceiver(addr, token string, c client.Reader, log logr.Logger) *PushReceiver {
+	return &PushReceiver{
+		Addr:   addr,
+		Token:  token,
+		Client: c,
+		Log:    log,
+		events: make(chan event.GenericEvent, 100),
+		pushed: map[types.NamespacedName]time.Time{},
+	}
+}
+
+// Start serves the endpoint until stop is closed.
+func (p *PushReceiver) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(pushHookPath, p)
+	srv := newServer(p.Addr, mux)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
+}
+
+func (p *PushReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	provider := strings.TrimPrefix(r.URL.Path, pushHookPath)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPushEventSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	repo, err := parsePushEvent(body, provider)
+	if err != nil {
+		p.Log.Info("ignoring push notification", "provider", provider, "reason", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := p.notify(r.Context(), repo, time.Now())
+	if err != nil {
+		p.Log.Error(err, "unable to find image repositories for push", "repository", repo)
+		http.Error(w, "unable to find image repositories", http.StatusInternalServerError)
+		return
+	}
+	p.Log.Info("received push notification", "provider", provider, "repository", repo, "imageRepositories", n)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authorized says whether the request carries the token.
+func (p *PushReceiver) authorized(r *http.Request) bool {
+	given := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return p.Token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(p.Token)) == 1
+}
+
+// notify records the push to the repository for each image
+// repository scanning it, and has each reconciled; it returns how
+// many there were.
+func (p *PushReceiver) notify(ctx context.Context, repo string, now time.Time) (int, error) {
+	var repos imagev1alpha1.ImageRepositoryList
+	if err := p.Client.List(ctx, &repos); err != nil {
+		return 0, err
+	}
+	watched := map[string]bool{}
+	for _, ns := range p.WatchNamespaces {
+		watched[ns] = true
+	}
+	var n int
+	for i := range repos.Items {
+		imageRepo := &repos.Items[i]
+		if imageRepo.Status.CanonicalImageName != repo {
+			continue
+		}
+		if len(watched) > 0 && !watched[imageRepo.GetNamespace()] {
+			continue
+		}
+		p.mu.Lock()
+		p.pushed[types.NamespacedName{Namespace: imageRepo.GetNamespace(), Name: imageRepo.GetName()}] = now
+		p.mu.Unlock()
+		select {
+		case p.events <- event.GenericEvent{Meta: imageRepo, Object: imageRepo}:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+		n++
+	}
+	return n, nil
+}
+
+// lastPush returns when a push was last received for the image
+// repository, if one has been. It's safe to call on a nil receiver.
+func (p *PushReceiver) lastPush(repo types.NamespacedName) (time.Time, bool) {
+	if p == nil {
+		return time.Time{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.pushed[repo]
+	return t, ok
+}
+
+// forget drops what's recorded for the image repository. It's safe
+// to call on a nil receiver.
+func (p *PushReceiver) forget(repo types.NamespacedName) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	delete(p.pushed, repo)
+	p.mu.Unlock()
+}
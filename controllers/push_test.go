@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const harborPushEvent = `{
+  "type": "PUSH_ARTIFACT",
+  "occur_at": 1586922308,
+  "operator": "admin",
+  "event_data": {
+    "resources": [{
+      "digest": "sha256:8a9e9863dbb6e10edb5adfe917c00da84e1700fa76e7ed02476aa6e6fb8ee0d8",
+      "tag": "1.1.0",
+      "resource_url": "harbor.example.com/team/app:1.1.0"
+    }],
+    "repository": {
+      "name": "app",
+      "namespace": "team",
+      "repo_full_name": "team/app",
+      "repo_type": "private"
+    }
+  }
+}`
+
+const dockerHubPushEvent = `{
+  "callback_url": "https://registry.hub.docker.com/u/someone/app/hook/abc/",
+  "push_data": {
+    "pushed_at": 1417566161,
+    "pusher": "someone",
+    "tag": "latest"
+  },
+  "repository": {
+    "name": "app",
+    "namespace": "someone",
+    "repo_name": "someone/app"
+  }
+}`
+
+func TestParsePushEvent(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := parsePushEvent([]byte(harborPushEvent), "harbor")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo).To(Equal("harbor.example.com/team/app"))
+
+	repo, err = parsePushEvent([]byte(dockerHubPushEvent), "dockerhub")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo).To(Equal("index.docker.io/someone/app"))
+
+	_, err = parsePushEvent([]byte(harborPushEvent), "quay")
+	g.Expect(err).To(MatchError(ContainSubstring("unknown provider")))
+	_, err = parsePushEvent([]byte(`{"type": "DELETE_ARTIFACT"}`), "harbor")
+	g.Expect(err).To(MatchError(ContainSubstring("not a push event")))
+	_, err = parsePushEvent([]byte(`{"type": "PUSH_ARTIFACT", "event_data": {}}`), "harbor")
+	g.Expect(err).To(HaveOccurred())
+	_, err = parsePushEvent([]byte(`{"repository": {"repo_name": "someone/app"}}`), "dockerhub")
+	g.Expect(err).To(MatchError(ContainSubstring("not a push event")))
+	_, err = parsePushEvent([]byte(`not json`), "dockerhub")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestPushReceiver(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	scanned := metav1.NewTime(time.Now().Add(-time.Minute))
+	newRepo := func(namespace, name, image string) *imagev1alpha1.ImageRepository {
+		repo := &imagev1alpha1.ImageRepository{}
+		repo.Name = name
+		repo.Namespace = namespace
+		repo.Status.CanonicalImageName = image
+		repo.Status.LastScanTime = &scanned
+		return repo
+	}
+	app := newRepo("default", "app", "harbor.example.com/team/app")
+	other := newRepo("default", "other", "harbor.example.com/team/other")
+	elsewhere := newRepo("elsewhere", "app", "harbor.example.com/team/app")
+
+	receiver := NewPushReceiver("", "s3cret", fake.NewFakeClientWithScheme(s, app, other, elsewhere),
+		zap.LoggerTo(ioutil.Discard, true))
+	receiver.WatchNamespaces = []string{"default"}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	post := func(path, token string) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(harborPushEvent))
+		g.Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		g.Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// without the token, nothing happens
+	g.Expect(post("/hook/harbor", "")).To(Equal(http.StatusUnauthorized))
+	g.Expect(post("/hook/harbor", "guess")).To(Equal(http.StatusUnauthorized))
+	g.Expect(post("/hook/harbor?token=guess", "")).To(Equal(http.StatusUnauthorized))
+	g.Expect(receiver.events).To(BeEmpty())
+	g.Expect(post("/hook/quay", "s3cret")).To(Equal(http.StatusBadRequest))
+
+	g.Expect(post("/hook/harbor", "s3cret")).To(Equal(http.StatusAccepted))
+	g.Expect(receiver.events).To(HaveLen(1))
+	ev := <-receiver.events
+	g.Expect(ev.Meta.GetNamespace()).To(Equal("default"))
+	g.Expect(ev.Meta.GetName()).To(Equal("app"))
+
+	// the token can also be given in the URL
+	g.Expect(post("/hook/harbor?token=s3cret", "")).To(Equal(http.StatusAccepted))
+	g.Expect(receiver.events).To(HaveLen(1))
+	<-receiver.events
+
+	// the image repository pushed to is due a scan; the others
+	// aren't
+	r := &ImageRepositoryReconciler{Database: NewDatabase(), PushReceiver: receiver}
+	for _, repo := range []*imagev1alpha1.ImageRepository{app, other} {
+		g.Expect(r.Database.SetTags(context.TODO(), repo.Status.CanonicalImageName, []string{"1.0.0"})).To(Succeed())
+	}
+	ok, _ := r.shouldScan(*app, time.Now())
+	g.Expect(ok).To(BeTrue())
+	ok, _ = r.shouldScan(*other, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	// but not once it's been scanned since
+	rescanned := metav1.NewTime(time.Now().Add(time.Second))
+	app.Status.LastScanTime = &rescanned
+	ok, _ = r.shouldScan(*app, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	receiver.forget(types.NamespacedName{Namespace: "default", Name: "app"})
+	_, ok = receiver.lastPush(types.NamespacedName{Namespace: "default", Name: "app"})
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestNewServerSetsTimeouts(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := newServer(":0", http.NotFoundHandler())
+	g.Expect(srv.ReadHeaderTimeout).To(BeNumerically(">", 0))
+	g.Expect(srv.ReadTimeout).To(BeNumerically(">", 0))
+	g.Expect(srv.WriteTimeout).To(BeNumerically(">", 0))
+	g.Expect(srv.IdleTimeout).To(BeNumerically(">", 0))
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// lowRateLimitFraction is the fraction of a registry's rate limit
+	// remaining below which scans are slowed down.
+	lowRateLimitFraction = 0.2
+	// defaultRateLimitWindow is the window taken for a rate limit
+	// that doesn't give one; it's that of Docker Hub.
+	defaultRateLimitWindow = 6 * time.Hour
+)
+
+// rateLimitTransport is an http.RoundTripper that records the rate
+// limit a registry reports in its responses, in the
+// `RateLimit-Limit` and `RateLimit-Remaining` headers (as Docker Hub
+// sends them), and when it says to try again after refusing a
+// request for going over the limit.
+type rateLimitTransport struct {
+	inner http.RoundTripper
+
+	mu         sync.Mutex
+	seen       bool
+	limit      int
+	remaining  int
+	window     time.Duration
+	retryAfter time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the last response is the most up to date, so it wins
+	if limit, window, ok := parseRateLimitHeader(res.Header.Get("RateLimit-Limit")); ok {
+		if remaining, _, ok := parseRateLimitHeader(res.Header.Get("RateLimit-Remaining")); ok {
+			t.seen = true
+			t.limit, t.remaining, t.window = limit, remaining, window
+		}
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		if after, ok := parseRetryAfter(res.Header.Get("Retry-After"), now); ok && after.After(t.retryAfter) {
+			t.retryAfter = after
+		}
+	}
+	return res, nil
+}
+
+// status returns the rate limit reported during the scan, or nil if
+// there was none.
+func (t *rateLimitTransport) status() *imagev1alpha1.RateLimitStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.seen && t.retryAfter.IsZero() {
+		return nil
+	}
+	status := &imagev1alpha1.RateLimitStatus{
+		Limit:     t.limit,
+		Remaining: t.remaining,
+	}
+	if t.window > 0 {
+		status.Window = &metav1.Duration{Duration: t.window}
+	}
+	if !t.retryAfter.IsZero() {
+		status.RetryAfter = &metav1.Time{Time: t.retryAfter}
+	}
+	return status
+}
+
+// parseRateLimitHeader parses the value of a `RateLimit-Limit` or
+// `RateLimit-Remaining` header, e.g., `100;w=21600`, returning the
+// number and the window (zero if not given).
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	parts := strings.Split(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "w=") {
+			continue
+		}
+		if secs, err := strconv.Atoi(strings.TrimPrefix(param, "w=")); err == nil && secs > 0 {
+			window = time.Duration(secs) * time.Second
+		}
+	}
+	return n, window, true
+}
+
+// parseRetryAfter parses the value of a `Retry-After` header, which
+// is either a number of seconds or an HTTP date, and returns the
+// time it gives.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// retryAfter returns how long the registry said to wait before
+// scanning the image repository again, having refused a request for
+// going over its rate limit; or zero if it didn't, or the time is
+// past.
+func retryAfter(repo imagev1alpha1.ImageRepository, now time.Time) time.Duration {
+	rl := repo.Status.RateLimit
+	if rl == nil || rl.RetryAfter == nil {
+		return 0
+	}
+	if wait := rl.RetryAfter.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// rateLimitedInterval returns the scan interval given, lengthened if
+// the image repository is on Docker Hub and the rate limit it last
+// reported is running low. The interval is stretched by the ratio of
+// the limit to what remains, so it grows as the budget runs out, up
+// to the length of the window; with nothing left, it's the window.
+func rateLimitedInterval(repo imagev1alpha1.ImageRepository, interval time.Duration) time.Duration {
+	rl := repo.Status.RateLimit
+	if rl == nil || rl.Limit <= 0 || repo.Status.Registry == nil || repo.Status.Registry.Type != imagev1alpha1.DockerHubRegistry {
+		return interval
+	}
+	if float64(rl.Remaining) >= lowRateLimitFraction*float64(rl.Limit) {
+		return interval
+	}
+	window := defaultRateLimitWindow
+	if rl.Window != nil && rl.Window.Duration > 0 {
+		window = rl.Window.Duration
+	}
+	if window <= interval {
+		return interval
+	}
+	if rl.Remaining <= 0 {
+		return window
+	}
+	stretched := time.Duration(float64(interval) * float64(rl.Limit) / float64(rl.Remaining))
+	if stretched > window {
+		return window
+	}
+	return stretched
+}
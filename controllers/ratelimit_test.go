@@ -0,0 +1,213 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestParseRateLimitHeader(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantN      int
+		wantWindow time.Duration
+		wantOK     bool
+	}{
+		{value: "100;w=21600", wantN: 100, wantWindow: 6 * time.Hour, wantOK: true},
+		{value: "76", wantN: 76, wantOK: true},
+		{value: " 0 ; w=60", wantN: 0, wantWindow: time.Minute, wantOK: true},
+		{value: ""},
+		{value: "lots;w=60"},
+		{value: "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			g := NewWithT(t)
+			n, window, ok := parseRateLimitHeader(tt.value)
+			g.Expect(ok).To(Equal(tt.wantOK))
+			g.Expect(n).To(Equal(tt.wantN))
+			g.Expect(window).To(Equal(tt.wantWindow))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Date(2020, time.November, 2, 10, 0, 0, 0, time.UTC)
+
+	after, ok := parseRetryAfter("120", now)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(after).To(Equal(now.Add(2 * time.Minute)))
+
+	after, ok = parseRetryAfter("Mon, 02 Nov 2020 10:30:00 GMT", now)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(after.Equal(now.Add(30 * time.Minute))).To(BeTrue())
+
+	_, ok = parseRetryAfter("", now)
+	g.Expect(ok).To(BeFalse())
+	_, ok = parseRetryAfter("soon", now)
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestRateLimitedInterval(t *testing.T) {
+	hub := &imagev1alpha1.RegistryInfo{Type: imagev1alpha1.DockerHubRegistry}
+	other := &imagev1alpha1.RegistryInfo{Type: imagev1alpha1.GitHubRegistry}
+	window := &metav1.Duration{Duration: time.Hour}
+
+	tests := []struct {
+		name      string
+		registry  *imagev1alpha1.RegistryInfo
+		rateLimit *imagev1alpha1.RateLimitStatus
+		want      time.Duration
+	}{
+		{name: "no rate limit", registry: hub, want: time.Minute},
+		{name: "plenty left", registry: hub, rateLimit: &imagev1alpha1.RateLimitStatus{Limit: 100, Remaining: 50}, want: time.Minute},
+		{name: "running low", registry: hub, rateLimit: &imagev1alpha1.RateLimitStatus{Limit: 100, Remaining: 10}, want: 10 * time.Minute},
+		{name: "capped at window", registry: hub, rateLimit: &imagev1alpha1.RateLimitStatus{Limit: 100, Remaining: 1, Window: window}, want: time.Hour},
+		{name: "none left", registry: hub, rateLimit: &imagev1alpha1.RateLimitStatus{Limit: 100, Remaining: 0}, want: defaultRateLimitWindow},
+		{name: "not Docker Hub", registry: other, rateLimit: &imagev1alpha1.RateLimitStatus{Limit: 100, Remaining: 0}, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			repo := imagev1alpha1.ImageRepository{}
+			repo.Status.Registry = tt.registry
+			repo.Status.RateLimit = tt.rateLimit
+			g.Expect(rateLimitedInterval(repo, time.Minute)).To(Equal(tt.want))
+		})
+	}
+}
+
+// rateLimitedRegistry returns a transport to a registry that has a
+// single tag, and reports the rate limit given in each response; if
+// tooMany is set, it refuses to list tags, with the Retry-After given.
+func rateLimitedRegistry(limit, remaining string, tooMany bool, retryAfter string) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("RateLimit-Limit", limit)
+		header.Set("RateLimit-Remaining", remaining)
+		code, body := http.StatusOK, ""
+		if strings.HasSuffix(req.URL.Path, "/tags/list") {
+			body = `{"name":"app","tags":["v1.0.0"]}`
+			if tooMany {
+				code, body = http.StatusTooManyRequests, ""
+				header.Set("Retry-After", retryAfter)
+			}
+		}
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func TestScanRecordsRateLimit(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: "registry.example.com/app",
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:    fake.NewFakeClientWithScheme(s, repo),
+		Log:       zap.LoggerTo(ioutil.Discard, true),
+		Database:  NewDatabase(),
+		Transport: rateLimitedRegistry("100;w=21600", "76;w=21600", false, ""),
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var repoAfter imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+	g.Expect(repoAfter.Status.RateLimit).ToNot(BeNil())
+	g.Expect(repoAfter.Status.RateLimit.Limit).To(Equal(100))
+	g.Expect(repoAfter.Status.RateLimit.Remaining).To(Equal(76))
+	g.Expect(repoAfter.Status.RateLimit.Window).To(Equal(&metav1.Duration{Duration: 6 * time.Hour}))
+	g.Expect(repoAfter.Status.RateLimit.RetryAfter).To(BeNil())
+}
+
+func TestScanHonoursRetryAfter(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: "registry.example.com/app",
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:    fake.NewFakeClientWithScheme(s, repo),
+		Log:       zap.LoggerTo(ioutil.Discard, true),
+		Database:  NewDatabase(),
+		Transport: rateLimitedRegistry("100", "0", true, "300"),
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(BeNumerically("~", 5*time.Minute, 10*time.Second))
+
+	var repoAfter imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+	ready := readyCondition(repoAfter)
+	g.Expect(ready).ToNot(BeNil())
+	g.Expect(ready.Reason).To(Equal(imagev1alpha1.RateLimitedReason))
+	g.Expect(repoAfter.Status.RateLimit).ToNot(BeNil())
+	g.Expect(repoAfter.Status.RateLimit.RetryAfter).ToNot(BeNil())
+
+	// once the time given is past, the next scan is due, even with
+	// tags already recorded
+	g.Expect(r.Database.SetTags(context.TODO(), scannedDatabaseKey(r.DatabaseKey, repoAfter), []string{"v1.0.0"})).To(Succeed())
+	retryAt := repoAfter.Status.RateLimit.RetryAfter.Time
+	ok, _ := r.shouldScan(repoAfter, retryAt.Add(-time.Minute))
+	g.Expect(ok).To(BeFalse())
+	ok, _ = r.shouldScan(repoAfter, retryAt.Add(time.Second))
+	g.Expect(ok).To(BeTrue())
+}
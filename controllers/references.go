@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// maxAuditedTags is the most tags whose manifests are inspected
+	// for references, per scan.
+	maxAuditedTags = 50
+	// maxAuditedReferences is the most references recorded.
+	maxAuditedReferences = 100
+	// baseNameAnnotation gives the base image of an image, as
+	// defined by the OCI image spec.
+	baseNameAnnotation = "org.opencontainers.image.base.name"
+)
+
+// referencingManifest has the fields of either an image manifest or
+// an image index that may refer to other repositories.
+type referencingManifest struct {
+	Annotations map[string]string `json:"annotations"`
+	Config      v1.Descriptor     `json:"config"`
+	Layers      []v1.Descriptor   `json:"layers"`
+	Manifests   []v1.Descriptor   `json:"manifests"`
+}
+
+// fetchCrossRepositoryReferences fetches the manifests of (up to
+// maxAuditedTags of) the tags, and returns the references they make
+// to repositories other than repo. Only the top-level manifest of
+// each tag is fetched; the manifests an index refers to are not. A
+// manifest that can't be fetched is skipped, and the fetches run
+// with the fetcher given, as in fetchPlatforms.
+func fetchCrossRepositoryReferences(ctx context.Context, repo name.Repository, tags []string, transport http.RoundTripper, auth authn.Authenticator, f *fetcher) ([]imagev1alpha1.CrossRepositoryReference, error) {
+	options := []remote.Option{
+		remote.WithTransport(&contextTransport{inner: transport, ctx: ctx}),
+	}
+	if auth != nil {
+		options = append(options, remote.WithAuth(auth))
+	}
+
+	if len(tags) > maxAuditedTags {
+		tags = tags[:maxAuditedTags]
+	}
+	found := make([][]string, len(tags))
+	err := f.forEachTag(ctx, tags, func(i int, tag string) {
+		desc, err := remote.Get(repo.Tag(tag), options...)
+		if err != nil {
+			return
+		}
+		var manifest referencingManifest
+		if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+			return
+		}
+		found[i] = crossReferences(repo, manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// assembled in the order of the tags, so the result doesn't
+	// depend on which fetches finished first
+	var refs []imagev1alpha1.CrossRepositoryReference
+	for i, tag := range tags {
+		for _, ref := range found[i] {
+			if len(refs) == maxAuditedReferences {
+				return refs, nil
+			}
+			refs = append(refs, imagev1alpha1.CrossRepositoryReference{Tag: tag, Reference: ref})
+		}
+	}
+	return refs, nil
+}
+
+// crossReferences returns the references in the manifest to
+// repositories other than repo, without duplicates.
+func crossReferences(repo name.Repository, manifest referencingManifest) []string {
+	var refs []string
+	seen := map[string]struct{}{}
+	add := func(ref string) {
+		if _, ok := seen[ref]; !ok {
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+	addBase := func(annotations map[string]string) {
+		base, ok := annotations[baseNameAnnotation]
+		if !ok {
+			return
+		}
+		if baseRef, err := name.ParseReference(base); err != nil || baseRef.Context().String() != repo.String() {
+			add(base)
+		}
+	}
+
+	addBase(manifest.Annotations)
+	descriptors := append([]v1.Descriptor{manifest.Config}, manifest.Layers...)
+	descriptors = append(descriptors, manifest.Manifests...)
+	for _, d := range descriptors {
+		// foreign layers are fetched from elsewhere
+		for _, url := range d.URLs {
+			add(url)
+		}
+		addBase(d.Annotations)
+	}
+	return refs
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const emptyDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestScanAuditsCrossRepositoryReferences(t *testing.T) {
+	g := NewWithT(t)
+
+	var host string
+	manifests := map[string]string{
+		// an image with a base image in another repo, and a foreign layer
+		"v1": fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+			`"annotations":{"org.opencontainers.image.base.name":"docker.io/library/alpine:3.12"},`+
+			`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":0},`+
+			`"layers":[{"mediaType":"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip","digest":%q,"size":0,`+
+			`"urls":["https://mcr.microsoft.com/v2/windows/blobs/sha256:abc"]}]}`, emptyDigest, emptyDigest),
+		// an image based on another tag in the same repo, which is not
+		// a cross-repository reference
+		"v2": fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+			`"annotations":{"org.opencontainers.image.base.name":"%%s/app:v1"},`+
+			`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":0},"layers":[]}`, emptyDigest),
+		// an index with a base image annotation on one of its entries
+		"v3": fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",`+
+			`"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":0,`+
+			`"annotations":{"org.opencontainers.image.base.name":"ghcr.io/acme/base:1.0"}}]}`, emptyDigest),
+	}
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1", "v2", "v3"}, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tag := strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/"); tag != r.URL.Path {
+			manifest, ok := manifests[tag]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if strings.Contains(manifest, "%s") {
+				manifest = fmt.Sprintf(manifest, host)
+			}
+			mediaType := "application/vnd.oci.image.manifest.v1+json"
+			if strings.Contains(manifest, `"manifests"`) {
+				mediaType = "application/vnd.oci.image.index.v1+json"
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Write([]byte(manifest))
+			return
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	imageName := host + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+		},
+	}
+
+	// strictly opt-in
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.CrossRepositoryReferences).To(BeEmpty())
+
+	repo.Spec.AuditReferences = true
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.CrossRepositoryReferences).To(ConsistOf(
+		imagev1alpha1.CrossRepositoryReference{Tag: "v1", Reference: "docker.io/library/alpine:3.12"},
+		imagev1alpha1.CrossRepositoryReference{Tag: "v1", Reference: "https://mcr.microsoft.com/v2/windows/blobs/sha256:abc"},
+		imagev1alpha1.CrossRepositoryReference{Tag: "v3", Reference: "ghcr.io/acme/base:1.0"},
+	))
+}
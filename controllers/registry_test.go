@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testRegistry is an in-memory OCI registry for integration tests. It
+// serves the registry API from go-containerregistry, with tag listing
+// added, and requires basic authentication if given a username.
+type testRegistry struct {
+	server   *httptest.Server
+	username string
+	password string
+}
+
+func newTestRegistry(username, password string) *testRegistry {
+	reg := &testRegistry{
+		username: username,
+		password: password,
+	}
+	tags := &tagListHandler{
+		registryHandler: registry.New(),
+		imagetags:       map[string][]string{},
+	}
+	reg.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reg.username != "" {
+			if u, p, ok := r.BasicAuth(); !ok || u != reg.username || p != reg.password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		tags.ServeHTTP(w, r)
+	}))
+	return reg
+}
+
+func (reg *testRegistry) Close() {
+	reg.server.Close()
+}
+
+// host returns the host (and port) of the registry, as used in image
+// names.
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.server.URL, "http://")
+}
+
+func (reg *testRegistry) auth() authn.Authenticator {
+	if reg.username == "" {
+		return authn.Anonymous
+	}
+	return &authn.Basic{Username: reg.username, Password: reg.password}
+}
+
+// pushImages pushes a random image for each of the tags given to the
+// repository named, and returns the image repo.
+func (reg *testRegistry) pushImages(repo string, tags ...string) (string, error) {
+	imgRepo := reg.host() + "/" + repo
+	for _, tag := range tags {
+		imgRef, err := name.NewTag(imgRepo + ":" + tag)
+		if err != nil {
+			return "", err
+		}
+		img, err := random.Image(512, 1)
+		if err != nil {
+			return "", err
+		}
+		if err := remote.Write(imgRef, img, remote.WithAuth(reg.auth())); err != nil {
+			return "", err
+		}
+	}
+	return imgRepo, nil
+}
+
+// credentials returns a secret, of the kind made by `kubectl create
+// secret docker-registry`, with the credentials for the registry.
+func (reg *testRegistry) credentials(secretName string) *corev1.Secret {
+	return dockerConfigSecret(secretName, map[string]string{
+		reg.host(): basicAuth(reg.username, reg.password),
+	})
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// ecrHost matches the hosts of AWS Elastic Container Registry,
+// which are per account and region.
+var ecrHost = regexp.MustCompile(`^\d{12}\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// detectRegistry describes the registry at the host given, from the
+// host itself if it's one of the well-known registries, otherwise
+// from the headers of a response from the registry.
+func detectRegistry(host string, header http.Header) imagev1alpha1.RegistryInfo {
+	if header == nil {
+		header = http.Header{}
+	}
+	return imagev1alpha1.RegistryInfo{
+		Type:       registryType(host, header),
+		Server:     header.Get("Server"),
+		APIVersion: header.Get("Docker-Distribution-Api-Version"),
+	}
+}
+
+func registryType(host string, header http.Header) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	switch {
+	case host == "docker.io" || host == "index.docker.io" || host == "registry-1.docker.io":
+		return imagev1alpha1.DockerHubRegistry
+	case host == "ghcr.io":
+		return imagev1alpha1.GitHubRegistry
+	case ecrHost.MatchString(host):
+		return imagev1alpha1.ECRRegistry
+	case host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev"):
+		return imagev1alpha1.GoogleRegistry
+	case strings.HasSuffix(host, ".azurecr.io"):
+		return imagev1alpha1.AzureRegistry
+	case host == "quay.io":
+		return imagev1alpha1.QuayRegistry
+	case host == "registry.gitlab.com":
+		return imagev1alpha1.GitLabRegistry
+	}
+
+	// a self-hosted registry, or one behind another name; the
+	// challenge to authenticate usually gives away the token service
+	// in use, if the server doesn't say what it is.
+	server := strings.ToLower(header.Get("Server"))
+	challenge := header.Get("WWW-Authenticate")
+	switch {
+	case header.Get("X-Artifactory-Id") != "" || strings.HasPrefix(server, "artifactory"):
+		return imagev1alpha1.ArtifactoryRegistry
+	case strings.HasPrefix(server, "harbor") || strings.Contains(challenge, "/service/token"):
+		return imagev1alpha1.HarborRegistry
+	case strings.Contains(challenge, "auth.docker.io"):
+		return imagev1alpha1.DockerHubRegistry
+	case strings.Contains(challenge, "ghcr.io/token"):
+		return imagev1alpha1.GitHubRegistry
+	case strings.Contains(challenge, `service="ecr.amazonaws.com"`):
+		return imagev1alpha1.ECRRegistry
+	case strings.Contains(challenge, "/jwt/auth"):
+		return imagev1alpha1.GitLabRegistry
+	case header.Get("Docker-Distribution-Api-Version") != "":
+		return imagev1alpha1.DistributionRegistry
+	}
+	return imagev1alpha1.UnknownRegistry
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestDetectRegistry(t *testing.T) {
+	tests := []struct {
+		host   string
+		header map[string]string
+		want   string
+	}{
+		{host: "index.docker.io", want: imagev1alpha1.DockerHubRegistry},
+		{host: "ghcr.io", want: imagev1alpha1.GitHubRegistry},
+		{host: "123456789012.dkr.ecr.eu-west-1.amazonaws.com", want: imagev1alpha1.ECRRegistry},
+		{host: "europe-docker.pkg.dev", want: imagev1alpha1.GoogleRegistry},
+		{host: "eu.gcr.io", want: imagev1alpha1.GoogleRegistry},
+		{host: "example.azurecr.io", want: imagev1alpha1.AzureRegistry},
+		{host: "quay.io", want: imagev1alpha1.QuayRegistry},
+		{host: "registry.gitlab.com", want: imagev1alpha1.GitLabRegistry},
+		{
+			// a pull-through mirror of Docker Hub
+			host:   "mirror.example.com",
+			header: map[string]string{"WWW-Authenticate": `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`},
+			want:   imagev1alpha1.DockerHubRegistry,
+		},
+		{
+			host:   "harbor.example.com",
+			header: map[string]string{"WWW-Authenticate": `Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`},
+			want:   imagev1alpha1.HarborRegistry,
+		},
+		{
+			host:   "artifacts.example.com",
+			header: map[string]string{"Server": "Artifactory/7.12.5", "X-Artifactory-Id": "abc123"},
+			want:   imagev1alpha1.ArtifactoryRegistry,
+		},
+		{
+			host:   "gitlab.example.com:5050",
+			header: map[string]string{"WWW-Authenticate": `Bearer realm="https://gitlab.example.com/jwt/auth",service="container_registry"`},
+			want:   imagev1alpha1.GitLabRegistry,
+		},
+		{
+			host:   "registry.example.com:5000",
+			header: map[string]string{"Docker-Distribution-Api-Version": "registry/2.0"},
+			want:   imagev1alpha1.DistributionRegistry,
+		},
+		{host: "registry.example.com", want: imagev1alpha1.UnknownRegistry},
+		{host: "registry.example.com", header: map[string]string{"Server": "nginx"}, want: imagev1alpha1.UnknownRegistry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.want, func(t *testing.T) {
+			g := NewWithT(t)
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			g.Expect(detectRegistry(tt.host, header).Type).To(Equal(tt.want))
+		})
+	}
+
+	// no response at all
+	g := NewWithT(t)
+	g.Expect(detectRegistry("registry.example.com", nil)).To(Equal(imagev1alpha1.RegistryInfo{
+		Type: imagev1alpha1.UnknownRegistry,
+	}))
+}
+
+func TestScanRecordsRegistry(t *testing.T) {
+	g := NewWithT(t)
+
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Artifactory/7.12.5")
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err := r.scan(context.TODO(), imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.Registry).To(Equal(&imagev1alpha1.RegistryInfo{
+		Type:       imagev1alpha1.ArtifactoryRegistry,
+		Server:     "Artifactory/7.12.5",
+		APIVersion: "registry/2.0",
+	}))
+}
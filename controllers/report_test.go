@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func reportedRepo(namespace, name string, ready corev1.ConditionStatus, reason string, tags int) *imagev1alpha1.ImageRepository {
+	repo := &imagev1alpha1.ImageRepository{}
+	repo.Name = name
+	repo.Namespace = namespace
+	if ready != "" {
+		repo.Status.CanonicalImageName = "registry.example.com/" + name
+		repo.Status.LastScanResult.TagCount = tags
+		*repo = imagev1alpha1.SetImageRepositoryReadiness(*repo, ready, reason, "message for "+name)
+	}
+	return repo
+}
+
+func TestAssembleScanReport(t *testing.T) {
+	g := NewWithT(t)
+
+	repos := []imagev1alpha1.ImageRepository{
+		*reportedRepo("default", "b-ready", corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, 3),
+		*reportedRepo("default", "a-ready", corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, 5),
+		*reportedRepo("default", "z-failing", corev1.ConditionFalse, imagev1alpha1.ReconciliationFailedReason, 0),
+		*reportedRepo("default", "not-scanned", "", "", 0),
+	}
+	repos[2].Status.ScanFailures = 4
+
+	status := assembleScanReport(repos, 10)
+	g.Expect(status.Total).To(Equal(4))
+	g.Expect(status.Ready).To(Equal(2))
+	g.Expect(status.NotReady).To(Equal(2))
+	g.Expect(status.Omitted).To(BeZero())
+
+	var names []string
+	for _, s := range status.Repositories {
+		names = append(names, s.Name)
+	}
+	g.Expect(names).To(Equal([]string{"not-scanned", "z-failing", "a-ready", "b-ready"}))
+
+	g.Expect(status.Repositories[0].Ready).To(Equal(corev1.ConditionUnknown))
+	g.Expect(status.Repositories[0].LastScanTime).To(BeNil())
+	failing := status.Repositories[1]
+	g.Expect(failing.Ready).To(Equal(corev1.ConditionFalse))
+	g.Expect(failing.Reason).To(Equal(imagev1alpha1.ReconciliationFailedReason))
+	g.Expect(failing.Message).To(Equal("message for z-failing"))
+	g.Expect(failing.ScanFailures).To(Equal(4))
+	ready := status.Repositories[2]
+	g.Expect(ready.Image).To(Equal("registry.example.com/a-ready"))
+	g.Expect(ready.TagCount).To(Equal(5))
+	g.Expect(ready.LastScanTime).ToNot(BeNil())
+}
+
+func TestAssembleScanReportIsBounded(t *testing.T) {
+	g := NewWithT(t)
+
+	var repos []imagev1alpha1.ImageRepository
+	for i := 0; i < 10; i++ {
+		repos = append(repos, *reportedRepo("default", fmt.Sprintf("ready-%02d", i), corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, 1))
+	}
+	repos = append(repos, *reportedRepo("default", "zz-failing", corev1.ConditionFalse, imagev1alpha1.ReconciliationFailedReason, 0))
+
+	status := assembleScanReport(repos, 3)
+	g.Expect(status.Total).To(Equal(11))
+	g.Expect(status.Omitted).To(Equal(8))
+	g.Expect(status.Repositories).To(HaveLen(3))
+	// what's not ready isn't left out
+	g.Expect(status.Repositories[0].Name).To(Equal("zz-failing"))
+}
+
+func TestScanReportReconcile(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	report := &imagev1alpha1.ImageScanReport{
+		Spec: imagev1alpha1.ImageScanReportSpec{
+			Interval: &metav1.Duration{Duration: time.Minute},
+		},
+	}
+	report.Name = "report"
+	report.Namespace = "team"
+
+	r := &ImageScanReportReconciler{
+		Client: fake.NewFakeClientWithScheme(s, report,
+			reportedRepo("team", "app", corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, 2),
+			reportedRepo("team", "broken", corev1.ConditionFalse, imagev1alpha1.ReconciliationFailedReason, 0),
+			reportedRepo("elsewhere", "other", corev1.ConditionTrue, imagev1alpha1.ReconciliationSucceededReason, 1),
+		),
+		Log: zap.LoggerTo(ioutil.Discard, true),
+	}
+	reportName := types.NamespacedName{Namespace: report.Namespace, Name: report.Name}
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: reportName})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(time.Minute))
+
+	var reportAfter imagev1alpha1.ImageScanReport
+	g.Expect(r.Get(context.TODO(), reportName, &reportAfter)).To(Succeed())
+	g.Expect(reportAfter.Status.AssembledTime).ToNot(BeNil())
+	// only the image repositories in the report's namespace count
+	g.Expect(reportAfter.Status.Total).To(Equal(2))
+	g.Expect(reportAfter.Status.Ready).To(Equal(1))
+	g.Expect(reportAfter.Status.Repositories[0].Name).To(Equal("broken"))
+
+	// without an interval, the default is used
+	reportAfter.Spec.Interval = nil
+	g.Expect(r.Update(context.TODO(), &reportAfter)).To(Succeed())
+	r.DefaultInterval = 2 * time.Minute
+	result, err = r.Reconcile(ctrl.Request{NamespacedName: reportName})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(2 * time.Minute))
+}
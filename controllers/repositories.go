@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// cleanTags returns the tags as listed, cleaned up as the image
+// repository's spec says: normalized, less any that aren't valid tag
+// names, and less cosign's tags unless they're to be included. It
+// also returns how many were dropped as empty, duplicate or invalid.
+func cleanTags(tags []string, repo name.Repository, spec imagev1alpha1.ImageRepositorySpec) ([]string, int) {
+	listed := len(tags)
+	tags = validTags(normalizeTags(tags, spec.TagNormalization), repo, nameOptions(spec)...)
+	dropped := listed - len(tags)
+	if !spec.IncludeSignatureTags {
+		tags = withoutSignatureTags(tags)
+	}
+	return tags, dropped
+}
+
+// scanRepositories lists the tags of each of the repositories in
+// `.spec.repositories`, on the registry given, and records them in
+// the database. Each is scanned whatever happens with the others,
+// and the outcome of each is returned, in the order listed.
+func (r *ImageRepositoryReconciler) scanRepositories(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, registry name.Registry, auth authn.Authenticator, rt http.RoundTripper) []imagev1alpha1.RepositoryScanResult {
+	if len(imageRepo.Spec.Repositories) == 0 {
+		return nil
+	}
+	previous := make(map[string]imagev1alpha1.RepositoryScanResult, len(imageRepo.Status.Repositories))
+	for _, result := range imageRepo.Status.Repositories {
+		previous[result.Path] = result
+	}
+
+	results := make([]imagev1alpha1.RepositoryScanResult, 0, len(imageRepo.Spec.Repositories))
+	for _, path := range imageRepo.Spec.Repositories {
+		result := imagev1alpha1.RepositoryScanResult{
+			Path:     path,
+			TagCount: previous[path].TagCount,
+		}
+		if err := r.scanRepository(ctx, imageRepo.Spec, registry, path, auth, rt, &result); err != nil {
+			result.Error = err.Error()
+			r.Log.Error(err, "scan of listed repository failed",
+				"namespace", imageRepo.GetNamespace(), "name", imageRepo.GetName(), "repository", path)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// scanRepository lists the tags of the repository at the path given
+// on the registry, records them, and fills in the result.
+func (r *ImageRepositoryReconciler) scanRepository(ctx context.Context, spec imagev1alpha1.ImageRepositorySpec, registry name.Registry, path string, auth authn.Authenticator, rt http.RoundTripper, result *imagev1alpha1.RepositoryScanResult) error {
+	repo, err := name.NewRepository(registry.Name()+"/"+path, nameOptions(spec)...)
+	if err != nil {
+		return err
+	}
+	result.CanonicalImageName = repo.String()
+	count, err := r.scanTags(ctx, spec, repo, auth, rt)
+	if err != nil {
+		return err
+	}
+	result.TagCount = count
+	return nil
+}
+
+// scanImages lists the tags of each of the images in `.spec.images`,
+// with the credentials for each, and records them in the database.
+// As with scanRepositories, each is scanned whatever happens with the
+// others, and the outcome of each is returned, in the order listed.
+func (r *ImageRepositoryReconciler) scanImages(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, rt http.RoundTripper) []imagev1alpha1.ImageScanResult {
+	if len(imageRepo.Spec.Images) == 0 {
+		return nil
+	}
+	previous := make(map[string]imagev1alpha1.ImageScanResult, len(imageRepo.Status.Images))
+	for _, result := range imageRepo.Status.Images {
+		previous[result.Image] = result
+	}
+
+	results := make([]imagev1alpha1.ImageScanResult, 0, len(imageRepo.Spec.Images))
+	for _, image := range imageRepo.Spec.Images {
+		result := imagev1alpha1.ImageScanResult{
+			Image:    image,
+			TagCount: previous[image].TagCount,
+		}
+		if err := r.scanImage(ctx, imageRepo, image, rt, &result); err != nil {
+			result.Error = err.Error()
+			r.Log.Error(err, "scan of listed image failed",
+				"namespace", imageRepo.GetNamespace(), "name", imageRepo.GetName(), "image", image)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// scanImage lists the tags of the image named, records them, and
+// fills in the result.
+func (r *ImageRepositoryReconciler) scanImage(ctx context.Context, imageRepo imagev1alpha1.ImageRepository, image string, rt http.RoundTripper, result *imagev1alpha1.ImageScanResult) error {
+	repo, err := name.NewRepository(image, nameOptions(imageRepo.Spec)...)
+	if err != nil {
+		return err
+	}
+	result.CanonicalImageName = repo.String()
+	auth, _, err := credentialsFor(ctx, r.Client, r.Log, imageRepo, repo.Tag("latest"), r.authOptions())
+	if err != nil {
+		return err
+	}
+	count, err := r.scanTags(ctx, imageRepo.Spec, repo, auth, rt)
+	if err != nil {
+		return err
+	}
+	result.TagCount = count
+	return nil
+}
+
+// scanTags lists the tags of the repository, records them, and
+// returns how many there were. As with `.spec.image`, tags from a
+// partial listing are added to those already known, but the scan
+// still fails.
+func (r *ImageRepositoryReconciler) scanTags(ctx context.Context, spec imagev1alpha1.ImageRepositorySpec, repo name.Repository, auth authn.Authenticator, rt http.RoundTripper) (int, error) {
+	dbKey := databaseKey(r.DatabaseKey, repo)
+	filter, err := newTagFilter(spec.TagFilters)
+	if err != nil {
+		return 0, err
+	}
+
+	tags, err := listTags(ctx, repo, auth, rt, nil)
+	tags, _ = cleanTags(tags, repo, spec)
+	tags = filter.apply(tags)
+	if err != nil {
+		var partial *partialListError
+		if errors.As(err, &partial) {
+			known, dbErr := r.Database.Tags(dbKey)
+			if dbErr == nil {
+				dbErr = r.Database.SetTags(ctx, dbKey, unionTags(known, tags))
+			}
+			if dbErr != nil {
+				return 0, fmt.Errorf("unable to record tags: %w", dbErr)
+			}
+		}
+		return 0, err
+	}
+	if err := r.Database.SetTags(ctx, dbKey, tags); err != nil {
+		return 0, fmt.Errorf("unable to record tags: %w", err)
+	}
+	return len(tags), nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestScanListedRepositories(t *testing.T) {
+	g := NewWithT(t)
+
+	available := map[string][]string{
+		"org/app":    {"1.0.0", "1.1.0"},
+		"org/worker": {"2.0.0"},
+		"org/cli":    {"0.1.0", "0.2.0", "0.3.0"},
+	}
+	srv := httptest.NewServer(registryStub(func(repo string) ([]string, bool) {
+		tags, ok := available[repo]
+		return tags, ok
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	image := host + "/org/app"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:        image,
+			Repositories: []string{"org/worker", "org/missing", "Not A Path", "org/cli"},
+		},
+	}
+
+	r := &ImageRepositoryReconciler{
+		Database: NewDatabase(),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+	}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(isReady(repo)).To(BeTrue())
+
+	results := repo.Status.Repositories
+	g.Expect(results).To(HaveLen(4))
+	g.Expect(results[0]).To(Equal(imagev1alpha1.RepositoryScanResult{
+		Path:               "org/worker",
+		CanonicalImageName: host + "/org/worker",
+		TagCount:           1,
+	}))
+	g.Expect(results[1].Path).To(Equal("org/missing"))
+	g.Expect(results[1].CanonicalImageName).To(Equal(host + "/org/missing"))
+	g.Expect(results[1].Error).ToNot(BeEmpty())
+	g.Expect(results[2].Path).To(Equal("Not A Path"))
+	g.Expect(results[2].CanonicalImageName).To(BeEmpty())
+	g.Expect(results[2].Error).ToNot(BeEmpty())
+	g.Expect(results[3].TagCount).To(Equal(3))
+	g.Expect(results[3].Error).To(BeEmpty())
+
+	// each is recorded under its own name
+	g.Expect(r.Database.Tags(host + "/org/worker")).To(Equal([]string{"2.0.0"}))
+	g.Expect(r.Database.Tags(host + "/org/cli")).To(Equal([]string{"0.1.0", "0.2.0", "0.3.0"}))
+
+	// a repository that starts failing keeps its last count, and
+	// its tags; one that recovers is counted again
+	delete(available, "org/cli")
+	available["org/missing"] = []string{"3.0.0"}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	results = repo.Status.Repositories
+	g.Expect(results[1].Error).To(BeEmpty())
+	g.Expect(results[1].TagCount).To(Equal(1))
+	g.Expect(results[3].Error).ToNot(BeEmpty())
+	g.Expect(results[3].TagCount).To(Equal(3))
+	g.Expect(r.Database.Tags(host + "/org/cli")).To(HaveLen(3))
+
+	// the listed repositories are scanned even if `.spec.image`
+	// fails
+	delete(available, "org/app")
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(isReady(repo)).To(BeFalse())
+	g.Expect(repo.Status.Repositories).To(HaveLen(4))
+	g.Expect(repo.Status.Repositories[0].Error).To(BeEmpty())
+	g.Expect(repo.Status.Repositories[0].TagCount).To(Equal(1))
+
+	// and none are reported if none are listed
+	repo.Spec.Repositories = nil
+	available["org/app"] = []string{"1.0.0"}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.Repositories).To(BeNil())
+}
+
+func TestScanListedImages(t *testing.T) {
+	g := NewWithT(t)
+
+	available := map[string][]string{
+		"org/app":       {"1.0.0", "1.1.0"},
+		"org/service-a": {"2.0.0"},
+	}
+	stub := registryStub(func(repo string) ([]string, bool) {
+		tags, ok := available[repo]
+		return tags, ok
+	})
+	srv, other := httptest.NewServer(stub), httptest.NewServer(stub)
+	defer srv.Close()
+	defer other.Close()
+
+	host, otherHost := strings.TrimPrefix(srv.URL, "http://"), strings.TrimPrefix(other.URL, "http://")
+	image := host + "/org/app"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:  image,
+			Images: []string{otherHost + "/org/service-a", otherHost + "/org/missing"},
+		},
+	}
+
+	r := &ImageRepositoryReconciler{
+		Database: NewDatabase(),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+	}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.TotalTagCount).To(Equal(3))
+
+	results := repo.Status.Images
+	g.Expect(results).To(HaveLen(2))
+	g.Expect(results[0]).To(Equal(imagev1alpha1.ImageScanResult{
+		Image:              otherHost + "/org/service-a",
+		CanonicalImageName: otherHost + "/org/service-a",
+		TagCount:           1,
+	}))
+	g.Expect(results[1].Error).ToNot(BeEmpty())
+	g.Expect(r.Database.Tags(otherHost + "/org/service-a")).To(Equal([]string{"2.0.0"}))
+
+	// a listed image whose tags have gone from the database is scanned
+	// again straight away, as is `.spec.image`
+	g.Expect(r.Database.Delete(context.TODO(), otherHost+"/org/service-a")).To(Succeed())
+	ok, _ := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+
+	// a failure to scan `.spec.image` doesn't fail the image
+	// repository, while some of the listed images can be scanned
+	delete(available, "org/app")
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(readyCondition(repo).Reason).To(Equal(imagev1alpha1.PartiallyScannedReason))
+	g.Expect(readyCondition(repo).Message).To(HavePrefix("scanned 1 of 2 images"))
+	g.Expect(repo.Status.ScanFailures).To(BeZero())
+
+	// but it does once none can be
+	delete(available, "org/service-a")
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(isReady(repo)).To(BeFalse())
+	g.Expect(repo.Status.Images[0].Error).ToNot(BeEmpty())
+	g.Expect(repo.Status.Images[0].TagCount).To(Equal(1))
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const (
+	// defaultRevisionTagPattern matches tags that are the revision.
+	defaultRevisionTagPattern = `^(.+)$`
+	// minShortRevision is the shortest revision in a tag that will be
+	// taken as a prefix of the expected revision.
+	minShortRevision = 7
+)
+
+// checkRevision sets the RevisionAvailable condition of the image
+// repo according to whether one of the tags given is for the expected
+// revision, or removes the condition if no revision is expected.
+func checkRevision(imageRepo imagev1alpha1.ImageRepository, tags []string) imagev1alpha1.ImageRepository {
+	expected := imageRepo.Spec.ExpectedRevision
+	if expected == "" {
+		return imagev1alpha1.RemoveImageRepositoryCondition(imageRepo, imagev1alpha1.RevisionAvailableCondition)
+	}
+
+	pattern := imageRepo.Spec.RevisionTagPattern
+	if pattern == "" {
+		pattern = defaultRevisionTagPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err == nil && re.NumSubexp() == 0 {
+		err = fmt.Errorf("pattern has no capture group for the revision")
+	}
+	if err != nil {
+		return imagev1alpha1.SetImageRepositoryCondition(imageRepo,
+			imagev1alpha1.RevisionAvailableCondition, corev1.ConditionUnknown,
+			imagev1alpha1.RevisionMissingReason,
+			fmt.Sprintf("invalid revision tag pattern %q: %s", pattern, err.Error()))
+	}
+
+	for _, tag := range tags {
+		match := re.FindStringSubmatch(tag)
+		if match == nil {
+			continue
+		}
+		if revision := match[1]; revisionMatches(expected, revision) {
+			return imagev1alpha1.SetImageRepositoryCondition(imageRepo,
+				imagev1alpha1.RevisionAvailableCondition, corev1.ConditionTrue,
+				imagev1alpha1.RevisionAvailableReason,
+				fmt.Sprintf("found tag %q for revision %s", tag, expected))
+		}
+	}
+	return imagev1alpha1.SetImageRepositoryCondition(imageRepo,
+		imagev1alpha1.RevisionAvailableCondition, corev1.ConditionFalse,
+		imagev1alpha1.RevisionMissingReason,
+		fmt.Sprintf("no tag found for revision %s", expected))
+}
+
+// revisionMatches says whether the revision found in a tag is the
+// expected revision, or a short form of it.
+func revisionMatches(expected, found string) bool {
+	if found == expected {
+		return true
+	}
+	return len(found) >= minShortRevision && strings.HasPrefix(expected, found)
+}
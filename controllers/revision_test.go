@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestScanChecksExpectedRevision(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"latest", "main-3f2a1bc", "main-9e8d7c6", "1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:              imageName,
+			RevisionTagPattern: `^main-([0-9a-f]+)$`,
+		},
+	}
+	revisionCondition := func() *imagev1alpha1.Condition {
+		for i := range repo.Status.Conditions {
+			if repo.Status.Conditions[i].Type == imagev1alpha1.RevisionAvailableCondition {
+				return &repo.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+
+	// a full SHA is found by its short form in a tag
+	repo.Spec.ExpectedRevision = "3f2a1bc4d5e6f708192a3b4c5d6e7f8091a2b3c4"
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.Conditions[0].Type).To(Equal(imagev1alpha1.ReadyCondition))
+	g.Expect(revisionCondition()).ToNot(BeNil())
+	g.Expect(revisionCondition().Status).To(Equal(corev1.ConditionTrue))
+	g.Expect(revisionCondition().Reason).To(Equal(imagev1alpha1.RevisionAvailableReason))
+	g.Expect(revisionCondition().Message).To(ContainSubstring("main-3f2a1bc"))
+
+	repo.Spec.ExpectedRevision = "0000000aaaa"
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(revisionCondition().Status).To(Equal(corev1.ConditionFalse))
+	g.Expect(revisionCondition().Reason).To(Equal(imagev1alpha1.RevisionMissingReason))
+
+	// with the default pattern, the tag must be the revision
+	repo.Spec.RevisionTagPattern = ""
+	repo.Spec.ExpectedRevision = "1.0.0"
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(revisionCondition().Status).To(Equal(corev1.ConditionTrue))
+	repo.Spec.ExpectedRevision = "3f2a1bc"
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(revisionCondition().Status).To(Equal(corev1.ConditionFalse))
+
+	// no expected revision, no condition
+	repo.Spec.ExpectedRevision = ""
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(revisionCondition()).To(BeNil())
+	g.Expect(repo.Status.Conditions).To(HaveLen(1))
+}
+
+func TestRevisionMatches(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(revisionMatches("3f2a1bc4d5e6", "3f2a1bc4d5e6")).To(BeTrue())
+	g.Expect(revisionMatches("3f2a1bc4d5e6", "3f2a1bc")).To(BeTrue())
+	// too short to be taken as a short SHA
+	g.Expect(revisionMatches("3f2a1bc4d5e6", "3f2a")).To(BeFalse())
+	g.Expect(revisionMatches("3f2a1bc", "3f2a1bc4d5e6")).To(BeFalse())
+}
@@ -17,16 +17,39 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
 	"github.com/fluxcd/pkg/apis/meta"
@@ -42,6 +65,12 @@ var _ = Describe("ImageRepository controller", func() {
 
 	AfterEach(func() {
 		Expect(k8sClient.Delete(context.Background(), &repo)).To(Succeed())
+		// the controller removes its finalizer before the object
+		// goes; until then, the name can't be used again
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), types.NamespacedName{Namespace: repo.Namespace, Name: repo.Name}, &imagev1alpha1.ImageRepository{})
+			return apierrors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
 	})
 
 	It("expands the canonical image name", func() {
@@ -76,6 +105,7 @@ var _ = Describe("ImageRepository controller", func() {
 		Expect(repoAfter.Name).To(Equal(imageName))
 		Expect(repoAfter.Namespace).To(Equal("default"))
 		Expect(repoAfter.Status.CanonicalImageName).To(Equal("index.docker.io/library/alpine"))
+		Expect(repoAfter.Status.ShortImageName).To(Equal("alpine"))
 	})
 
 	It("fetches the tags for an image", func() {
@@ -110,6 +140,50 @@ var _ = Describe("ImageRepository controller", func() {
 		Expect(repoAfter.Status.LastScanResult.TagCount).To(Equal(len(versions)))
 	})
 
+	It("exports the tags to a ConfigMap owned by the ImageRepository", func() {
+		versions := []string{"1.0.0", "1.0.1", "1.1.0"}
+		imgRepo := loadImages("test-export", versions)
+
+		repo = imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image: imgRepo,
+				ExportTags: &imagev1alpha1.TagExport{
+					MaxTags: 2,
+				},
+			},
+		}
+		objectName := types.NamespacedName{
+			Name:      "export",
+			Namespace: "default",
+		}
+
+		repo.Name = objectName.Name
+		repo.Namespace = objectName.Namespace
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		r := imageRepoReconciler
+		Expect(r.Create(ctx, &repo)).To(Succeed())
+
+		var cm corev1.ConfigMap
+		Eventually(func() bool {
+			err := r.Get(context.Background(), objectName, &cm)
+			return err == nil
+		}, timeout, interval).Should(BeTrue())
+
+		var repoAfter imagev1alpha1.ImageRepository
+		Expect(r.Get(context.Background(), objectName, &repoAfter)).To(Succeed())
+
+		Expect(cm.Data["image"]).To(Equal(imgRepo))
+		Expect(cm.Data["tagCount"]).To(Equal("3"))
+		Expect(cm.Data["truncated"]).To(Equal("true"))
+		Expect(strings.Split(cm.Data["tags"], "\n")).To(HaveLen(2))
+		Expect(cm.OwnerReferences).To(HaveLen(1))
+		Expect(cm.OwnerReferences[0].UID).To(Equal(repoAfter.UID))
+		Expect(*cm.OwnerReferences[0].Controller).To(BeTrue())
+	})
+
 	Context("when the ImageRepository is suspended", func() {
 		It("does not process the image", func() {
 			repo = imagev1alpha1.ImageRepository{
@@ -211,3 +285,1440 @@ func loadImages(imageName string, versions []string) string {
 	}
 	return imgRepo
 }
+
+// loadMultiPlatformImages uploads, for each tag given, an image index
+// with an image for each of the platforms given, and returns the
+// image repo.
+func loadMultiPlatformImages(imageName string, platforms map[string][]v1.Platform) string {
+	registry := strings.TrimPrefix(registryServer.URL, "http://")
+	imgRepo := registry + "/" + imageName
+	for tag, tagPlatforms := range platforms {
+		imgRef, err := name.NewTag(imgRepo + ":" + tag)
+		Expect(err).ToNot(HaveOccurred())
+		var adds []mutate.IndexAddendum
+		for i := range tagPlatforms {
+			img, err := random.Image(512, 1)
+			Expect(err).ToNot(HaveOccurred())
+			adds = append(adds, mutate.IndexAddendum{
+				Add: img,
+				Descriptor: v1.Descriptor{
+					Platform: &tagPlatforms[i],
+				},
+			})
+		}
+		Expect(remote.WriteIndex(imgRef, mutate.AppendManifests(empty.Index, adds...))).To(Succeed())
+	}
+	return imgRepo
+}
+
+// loadCharts pushes Helm chart manifests for the versions given to
+// the local registry, as `helm chart push` would, and returns the
+// chart repo. As with Helm, any `+` in a version is replaced with `_`
+// to make the tag.
+func loadCharts(chartName string, versions []string) string {
+	registry := strings.TrimPrefix(registryServer.URL, "http://")
+	for _, version := range versions {
+		config := []byte(fmt.Sprintf(`{"name":%q,"version":%q,"apiVersion":"v2"}`, chartName, version))
+		configDigest, _, err := v1.SHA256(bytes.NewReader(config))
+		Expect(err).ToNot(HaveOccurred())
+		manifest := fmt.Sprintf(`{"schemaVersion":2,`+
+			`"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json","digest":%q,"size":%d},`+
+			`"layers":[{"mediaType":"application/vnd.cncf.helm.chart.content.v1.tar+gzip","digest":%q,"size":0}]}`,
+			configDigest.String(), len(config), configDigest.String())
+
+		tag := strings.Replace(version, "+", "_", -1)
+		req, err := http.NewRequest("PUT", registryServer.URL+"/v2/"+chartName+"/manifests/"+tag, strings.NewReader(manifest))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+	}
+	return registry + "/" + chartName
+}
+
+func TestScanDoubleFetch(t *testing.T) {
+	// a registry that gives a different answer each time it's asked,
+	// as an eventually consistent backend might.
+	var mu sync.Mutex
+	listings := [][]string{
+		{"v1", "v2"},
+		{"v2", "v3"},
+	}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		next := listings[0]
+		listings = listings[1:]
+		return next, true
+	}))
+	defer srv.Close()
+
+	g := NewWithT(t)
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/flappy"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:       imageName,
+			DoubleFetch: true,
+		},
+	}
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(3))
+	g.Expect(r.Database.Tags(ref.Context().String())).To(ConsistOf("v1", "v2", "v3"))
+	g.Expect(listings).To(BeEmpty())
+}
+
+func TestStartupDelaySpreadsScans(t *testing.T) {
+	g := NewWithT(t)
+
+	const ramp = 10 * time.Minute
+	start := time.Now()
+	r := &ImageRepositoryReconciler{
+		StartupScanRamp: ramp,
+		startedAt:       start,
+	}
+
+	// lots of objects all coming up for reconciliation at startup
+	// should be spread evenly over the ramp
+	perMinute := make([]int, ramp/time.Minute)
+	for i := 0; i < 1000; i++ {
+		objectName := types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("repo-%d", i)}
+		delay := r.startupDelay(objectName, start)
+		g.Expect(delay).To(BeNumerically(">=", 0))
+		g.Expect(delay).To(BeNumerically("<", ramp))
+		perMinute[delay/time.Minute]++
+	}
+	for _, n := range perMinute {
+		g.Expect(n).To(BeNumerically("~", 100, 50))
+	}
+
+	// an object keeps its slot when it's reconciled again, and
+	// goes ahead once the slot is reached
+	objectName := types.NamespacedName{Namespace: "default", Name: "repo-0"}
+	delay := r.startupDelay(objectName, start)
+	g.Expect(r.startupDelay(objectName, start.Add(delay/2))).To(Equal(delay - delay/2))
+	g.Expect(r.startupDelay(objectName, start.Add(delay))).To(BeNumerically("<=", 0))
+
+	// nothing is delayed once the ramp is over, or if there's no ramp
+	g.Expect(r.startupDelay(objectName, start.Add(ramp))).To(BeZero())
+	r.StartupScanRamp = 0
+	g.Expect(r.startupDelay(objectName, start)).To(BeZero())
+}
+
+func TestReconcileTruncatesLongMessages(t *testing.T) {
+	g := NewWithT(t)
+
+	detail := strings.Repeat("the registry had a lot to say about this; ", 50) + "THE END"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(detail))
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: strings.TrimPrefix(srv.URL, "http://") + "/verbose",
+		},
+	}
+	repo.Name = "verbose"
+	repo.Namespace = "default"
+
+	var logged bytes.Buffer
+	r := &ImageRepositoryReconciler{
+		Client:                    fake.NewFakeClientWithScheme(s, repo),
+		Log:                       zap.LoggerTo(&logged, true),
+		Database:                  NewDatabase(),
+		MaxConditionMessageLength: 200,
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).To(HaveOccurred())
+
+	var repoAfter imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+	g.Expect(repoAfter.Status.Conditions).To(HaveLen(1))
+	message := repoAfter.Status.Conditions[0].Message
+	g.Expect(len(message)).To(Equal(200))
+	g.Expect(message).To(HaveSuffix("..."))
+	g.Expect(logged.String()).To(ContainSubstring("THE END"))
+}
+
+func TestStableTransitionTime(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	tags := []string{"1.0.0", "1.1.0"}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		return tags, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:                imageName,
+			StableTransitionTime: true,
+		},
+	}
+
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanTime).ToNot(BeNil())
+
+	// backdate the transition and the scan, so any update shows
+	transitioned := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	repo.Status.Conditions[0].LastTransitionTime = transitioned
+	repo.Status.LastScanTime = &transitioned
+
+	// the same tags again: only the scan time moves
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(imagev1alpha1.GetLastTransitionTime(repo).Time).To(Equal(transitioned.Time))
+	g.Expect(repo.Status.LastScanTime.After(transitioned.Time)).To(BeTrue())
+
+	// the next scan is scheduled from the scan time, not the
+	// transition time
+	repo.Status.CanonicalImageName = ref.Context().String()
+	ok, _ := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	// a new tag is a change
+	mu.Lock()
+	tags = append(tags, "1.2.0")
+	mu.Unlock()
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(imagev1alpha1.GetLastTransitionTime(repo).After(transitioned.Time)).To(BeTrue())
+	g.Expect(repo.Status.Conditions[0].Message).To(ContainSubstring("found 3 tags"))
+
+	// without the toggle, every scan updates the condition
+	repo.Spec.StableTransitionTime = false
+	repo.Status.Conditions[0].LastTransitionTime = transitioned
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(imagev1alpha1.GetLastTransitionTime(repo).After(transitioned.Time)).To(BeTrue())
+}
+
+func TestSuspendAndResumeKeepsSchedule(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var scans int
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		scans++
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: strings.TrimPrefix(srv.URL, "http://") + "/app",
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	reconcile := func() (ctrl.Result, imagev1alpha1.ImageRepository) {
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var repoAfter imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+		return result, repoAfter
+	}
+
+	_, scanned := reconcile()
+	g.Expect(scans).To(Equal(1))
+	g.Expect(scanned.Status.SuspendedSince).To(BeNil())
+
+	// an image repository scanned before lastScanTime was recorded
+	// is scheduled from the Ready condition
+	lastScan := metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	scanned.Status.LastScanTime = nil
+	scanned.Status.Conditions[0].LastTransitionTime = lastScan
+	g.Expect(r.Status().Update(context.TODO(), &scanned)).To(Succeed())
+
+	scanned.Spec.Suspend = true
+	g.Expect(r.Update(context.TODO(), &scanned)).To(Succeed())
+	_, suspended := reconcile()
+	g.Expect(suspended.Status.SuspendedSince).ToNot(BeNil())
+	g.Expect(suspended.Status.Conditions[0].Reason).To(Equal(imagev1alpha1.SuspendedReason))
+	g.Expect(suspended.Status.LastScanTime).ToNot(BeNil())
+	g.Expect(suspended.Status.LastScanTime.Time).To(BeTemporally("==", lastScan.Time))
+
+	// reconciling while suspended doesn't move either time
+	suspendedSince := *suspended.Status.SuspendedSince
+	_, suspended = reconcile()
+	g.Expect(suspended.Status.SuspendedSince.Time).To(BeTemporally("==", suspendedSince.Time))
+	g.Expect(suspended.Status.LastScanTime.Time).To(BeTemporally("==", lastScan.Time))
+	g.Expect(scans).To(Equal(1))
+
+	// on resuming, the next scan is an interval after the last scan,
+	// not right away, nor an interval after suspending
+	suspended.Spec.Suspend = false
+	g.Expect(r.Update(context.TODO(), &suspended)).To(Succeed())
+	result, resumed := reconcile()
+	g.Expect(scans).To(Equal(1))
+	g.Expect(resumed.Status.SuspendedSince).To(BeNil())
+	g.Expect(resumed.Status.Conditions[0].Status).To(Equal(corev1.ConditionUnknown))
+	g.Expect(result.RequeueAfter).To(BeNumerically("<=", defaultScanInterval-time.Minute))
+	g.Expect(result.RequeueAfter).To(BeNumerically(">", defaultScanInterval-2*time.Minute))
+
+	// once due, it's scanned as usual
+	resumed.Status.LastScanTime = &metav1.Time{Time: time.Now().Add(-defaultScanInterval)}
+	g.Expect(r.Status().Update(context.TODO(), &resumed)).To(Succeed())
+	_, rescanned := reconcile()
+	g.Expect(scans).To(Equal(2))
+	g.Expect(rescanned.Status.Conditions[0].Status).To(Equal(corev1.ConditionTrue))
+}
+
+func TestShouldScanAfterSpecChange(t *testing.T) {
+	g := NewWithT(t)
+
+	db := NewDatabase()
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: "example.com/app"},
+	}
+	repo.Generation = 1
+	repo.Status.CanonicalImageName = "example.com/app"
+	repo.Status.LastScanResult.TagCount = 1
+	repo.Status.LastScanTime = &metav1.Time{Time: time.Now()}
+	repo.Status.ObservedGeneration = 1
+	g.Expect(db.SetTags(context.TODO(), scannedDatabaseKey("", repo), []string{"1.0.0"})).To(Succeed())
+
+	r := &ImageRepositoryReconciler{Database: db}
+	ok, _ := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	// a change to the spec is scanned for straight away
+	repo.Generation = 2
+	ok, _ = r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+
+	// unless it's to resume scanning
+	repo.Status.SuspendedSince = &metav1.Time{Time: time.Now()}
+	ok, _ = r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	// as is a scan asked for
+	repo.Status.SuspendedSince = nil
+	repo.Status.ObservedGeneration = 2
+	repo.Spec.ForceScan = true
+	ok, _ = r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+}
+
+func TestForceScanIsReset(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var scans int
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		scans++
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: strings.TrimPrefix(srv.URL, "http://") + "/app",
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	reconcile := func() imagev1alpha1.ImageRepository {
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var repoAfter imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+		return repoAfter
+	}
+
+	scanned := reconcile()
+	g.Expect(scans).To(Equal(1))
+	scanned = reconcile()
+	g.Expect(scans).To(Equal(1))
+
+	scanned.Spec.ForceScan = true
+	g.Expect(r.Update(context.TODO(), &scanned)).To(Succeed())
+	rescanned := reconcile()
+	g.Expect(scans).To(Equal(2))
+	g.Expect(rescanned.Spec.ForceScan).To(BeFalse())
+	g.Expect(isReady(rescanned)).To(BeTrue())
+	g.Expect(rescanned.Status.LastScanTime.Time).To(BeTemporally(">=", scanned.Status.LastScanTime.Time))
+
+	// and once done, it's not done again
+	reconcile()
+	g.Expect(scans).To(Equal(2))
+}
+
+func TestScanFailureGrace(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failing
+		mu.Unlock()
+		if fail && r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		registryStub(func(string) ([]string, bool) {
+			return []string{"1.0.0"}, true
+		}).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	setFailing := func(f bool) {
+		mu.Lock()
+		failing = f
+		mu.Unlock()
+	}
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	condition := func(repo imagev1alpha1.ImageRepository, conditionType string) *imagev1alpha1.Condition {
+		for i := range repo.Status.Conditions {
+			if repo.Status.Conditions[i].Type == conditionType {
+				return &repo.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+	scan := func(repo imagev1alpha1.ImageRepository) imagev1alpha1.ImageRepository {
+		repo, _ = r.scan(context.TODO(), repo, ref)
+		return repo
+	}
+
+	// by default, the first failure makes the repository not ready
+	repo := scan(imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	})
+	g.Expect(isReady(repo)).To(BeTrue())
+	setFailing(true)
+	repo = scan(repo)
+	g.Expect(isReady(repo)).To(BeFalse())
+	g.Expect(condition(repo, imagev1alpha1.ScanFailingCondition)).To(BeNil())
+
+	// with a threshold, it stays ready until that many failures
+	setFailing(false)
+	repo = scan(imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName, FailureThreshold: 3},
+	})
+	g.Expect(isReady(repo)).To(BeTrue())
+	setFailing(true)
+	repo = scan(scan(repo))
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(repo.Status.FailingSince).ToNot(BeNil())
+	failing2 := condition(repo, imagev1alpha1.ScanFailingCondition)
+	g.Expect(failing2).ToNot(BeNil())
+	g.Expect(failing2.Status).To(Equal(corev1.ConditionTrue))
+	g.Expect(failing2.Message).To(HavePrefix("2 consecutive scans failed"))
+	repo = scan(repo)
+	g.Expect(isReady(repo)).To(BeFalse())
+	g.Expect(condition(repo, imagev1alpha1.ScanFailingCondition)).To(BeNil())
+
+	// and recovers as usual
+	setFailing(false)
+	repo = scan(repo)
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(repo.Status.FailingSince).To(BeNil())
+	g.Expect(condition(repo, imagev1alpha1.ScanFailingCondition)).To(BeNil())
+
+	// with a grace period, it stays ready until that long has passed
+	repo.Spec.FailureThreshold = 0
+	repo.Spec.FailureGracePeriod = &metav1.Duration{Duration: time.Minute}
+	setFailing(true)
+	repo = scan(scan(repo))
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(condition(repo, imagev1alpha1.ScanFailingCondition)).ToNot(BeNil())
+	repo.Status.FailingSince = &metav1.Time{Time: time.Now().Add(-2 * time.Minute)}
+	repo = scan(repo)
+	g.Expect(isReady(repo)).To(BeFalse())
+}
+
+func TestScanRecordsVisibility(t *testing.T) {
+	public := newTestRegistry("", "")
+	defer public.Close()
+	private := newTestRegistry("scanner", "hunter2")
+	defer private.Close()
+
+	s := runtime.NewScheme()
+	NewWithT(t).Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+
+	scan := func(g *WithT, reg *testRegistry, withSecret, probe bool) imagev1alpha1.ImageRepository {
+		imgRepo, err := reg.pushImages("app", "1.0.0")
+		g.Expect(err).ToNot(HaveOccurred())
+		ref, err := name.ParseReference(imgRepo)
+		g.Expect(err).ToNot(HaveOccurred())
+
+		secret := dockerConfigSecret("creds", map[string]string{reg.host(): basicAuth("scanner", "hunter2")})
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: imgRepo},
+		}
+		repo.Name = "app"
+		repo.Namespace = "default"
+		if withSecret {
+			repo.Spec.SecretRef = &corev1.LocalObjectReference{Name: secret.Name}
+		}
+
+		r := &ImageRepositoryReconciler{
+			Client:          fake.NewFakeClientWithScheme(s, secret),
+			Log:             zap.LoggerTo(ioutil.Discard, true),
+			Database:        NewDatabase(),
+			ProbeVisibility: probe,
+		}
+		repo, err = r.scan(context.TODO(), repo, ref)
+		g.Expect(err).ToNot(HaveOccurred())
+		return repo
+	}
+
+	tests := []struct {
+		name       string
+		reg        *testRegistry
+		withSecret bool
+		probe      bool
+		want       string
+	}{
+		{name: "anonymous scan", reg: public, want: imagev1alpha1.PublicVisibility},
+		{name: "public, probed", reg: public, withSecret: true, probe: true, want: imagev1alpha1.PublicVisibility},
+		{name: "private, probed", reg: private, withSecret: true, probe: true, want: imagev1alpha1.PrivateVisibility},
+		{name: "private, not probed", reg: private, withSecret: true, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			repo := scan(g, tt.reg, tt.withSecret, tt.probe)
+			g.Expect(repo.Status.Visibility).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestChangedImageForgetsOldTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(repo string) ([]string, bool) {
+		switch repo {
+		case "old":
+			return []string{"1.0.0"}, true
+		case "new":
+			return []string{"2.0.0", "2.1.0"}, true
+		}
+		return nil, false
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	imageRepo := func(name string) *imagev1alpha1.ImageRepository {
+		repo := &imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{Image: host + "/old"},
+		}
+		repo.Name = name
+		repo.Namespace = "default"
+		return repo
+	}
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, imageRepo("app"), imageRepo("other")),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	reconcile := func(name string) imagev1alpha1.ImageRepository {
+		repoName := types.NamespacedName{Namespace: "default", Name: name}
+		_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+		g.Expect(err).ToNot(HaveOccurred())
+		var repoAfter imagev1alpha1.ImageRepository
+		g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+		return repoAfter
+	}
+	changeImage := func(repo imagev1alpha1.ImageRepository, image string) {
+		repo.Spec.Image = image
+		g.Expect(r.Update(context.TODO(), &repo)).To(Succeed())
+	}
+
+	app := reconcile("app")
+	other := reconcile("other")
+	g.Expect(r.Database.Tags(host + "/old")).To(Equal([]string{"1.0.0"}))
+
+	// while another image repository scans the old image, its tags
+	// are kept
+	changeImage(app, host+"/new")
+	app = reconcile("app")
+	g.Expect(app.Status.CanonicalImageName).To(Equal(host + "/new"))
+	g.Expect(r.Database.Tags(host + "/new")).To(Equal([]string{"2.0.0", "2.1.0"}))
+	g.Expect(r.Database.Tags(host + "/old")).To(Equal([]string{"1.0.0"}))
+
+	// once no image repository scans it, they're dropped
+	changeImage(other, host+"/new")
+	other = reconcile("other")
+	g.Expect(other.Status.CanonicalImageName).To(Equal(host + "/new"))
+	g.Expect(r.Database.Tags(host + "/old")).To(BeEmpty())
+	g.Expect(r.Database.Tags(host + "/new")).To(Equal([]string{"2.0.0", "2.1.0"}))
+}
+
+func TestScanHonoursCacheControl(t *testing.T) {
+	var cacheControl string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		registryStub(func(string) ([]string, bool) {
+			return []string{"1.0.0"}, true
+		}).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/cached"
+	ref, err := name.ParseReference(image)
+	NewWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		maxCacheHint time.Duration
+		want         time.Duration
+	}{
+		{name: "longer than the interval", cacheControl: "max-age=1800", maxCacheHint: time.Hour, want: 30 * time.Minute},
+		{name: "bounded", cacheControl: "public, max-age=86400", maxCacheHint: time.Hour, want: time.Hour},
+		{name: "shorter than the interval", cacheControl: "max-age=60", maxCacheHint: time.Hour},
+		{name: "not to be cached", cacheControl: "no-cache", maxCacheHint: time.Hour},
+		{name: "hints ignored", cacheControl: "max-age=1800"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			cacheControl = tt.cacheControl
+
+			r := &ImageRepositoryReconciler{
+				Database:     NewDatabase(),
+				MaxCacheHint: tt.maxCacheHint,
+			}
+			repo := imagev1alpha1.ImageRepository{
+				Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+			}
+			repo.Status.CanonicalImageName = image
+			repo, err := r.scan(context.TODO(), repo, ref)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			ok, when := r.shouldScan(repo, time.Now())
+			g.Expect(ok).To(BeFalse())
+			if tt.want == 0 {
+				g.Expect(repo.Status.LastScanResult.CacheHint).To(BeNil())
+				g.Expect(when).To(BeNumerically("~", defaultScanInterval, time.Second))
+				return
+			}
+			g.Expect(repo.Status.LastScanResult.CacheHint).To(Equal(&metav1.Duration{Duration: tt.want}))
+			g.Expect(when).To(BeNumerically("~", tt.want, time.Second))
+		})
+	}
+}
+
+// readyCondition returns the Ready condition of the image
+// repository, or nil if there isn't one.
+func readyCondition(repo imagev1alpha1.ImageRepository) *imagev1alpha1.Condition {
+	for i := range repo.Status.Conditions {
+		if repo.Status.Conditions[i].Type == imagev1alpha1.ReadyCondition {
+			return &repo.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestScanRestrictsRedirects(t *testing.T) {
+	elsewhere := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0"}, true
+	}))
+	defer elsewhere.Close()
+	elsewhereHost := strings.TrimPrefix(elsewhere.URL, "http://")
+
+	// the registry sends tag listings to another host
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			http.Redirect(w, r, elsewhere.URL+r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/redirected"
+	ref, err := name.ParseReference(image)
+	NewWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name     string
+		restrict bool
+		allowed  []string
+		wantErr  bool
+	}{
+		{name: "not restricted", restrict: false},
+		{name: "restricted to the same host", restrict: true, wantErr: true},
+		{name: "other host allowed", restrict: true, allowed: []string{"registry.example.com", elsewhereHost}},
+		{name: "other host allowed without port", restrict: true, allowed: []string{"127.0.0.1"}},
+		{name: "other domain allowed", restrict: true, allowed: []string{"*.example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := &ImageRepositoryReconciler{
+				Database:             NewDatabase(),
+				RestrictRedirects:    tt.restrict,
+				AllowedRedirectHosts: tt.allowed,
+			}
+			repo := imagev1alpha1.ImageRepository{
+				Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+			}
+			repo.Status.CanonicalImageName = image
+			repo, err := r.scan(context.TODO(), repo, ref)
+			if !tt.wantErr {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(r.Database.Tags(ref.Context().String())).To(ConsistOf("1.0.0", "1.1.0"))
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(err.Error()).To(ContainSubstring(elsewhereHost))
+			g.Expect(r.Database.Tags(ref.Context().String())).To(BeEmpty())
+			ready := readyCondition(repo)
+			g.Expect(ready).ToNot(BeNil())
+			g.Expect(ready.Status).To(Equal(corev1.ConditionFalse))
+			g.Expect(ready.Reason).To(Equal(imagev1alpha1.UnexpectedRedirectReason))
+		})
+	}
+}
+
+func TestRedirectAllowed(t *testing.T) {
+	g := NewWithT(t)
+	allowed := []string{"cdn.example.com", "mirror.example.org:5000", "*.blobs.example.net"}
+	for host, want := range map[string]bool{
+		"cdn.example.com":          true,
+		"cdn.example.com:443":      true,
+		"mirror.example.org:5000":  true,
+		"mirror.example.org":       false,
+		"eu.blobs.example.net":     true,
+		"blobs.example.net":        false,
+		"evil-blobs.example.net":   false,
+		"attacker.example":         false,
+		"cdn.example.com.attacker": false,
+	} {
+		g.Expect(redirectAllowed(&url.URL{Scheme: "https", Host: host}, allowed)).To(Equal(want), host)
+	}
+}
+
+func TestScanLimitsResponseSize(t *testing.T) {
+	// the listing has a lot of tags with long names
+	var tags []string
+	for i := 0; i < 2000; i++ {
+		tags = append(tags, fmt.Sprintf("1.0.%d-%s", i, strings.Repeat("x", 100)))
+	}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return tags, true
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/huge"
+	ref, err := name.ParseReference(image)
+	NewWithT(t).Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name    string
+		limit   int64
+		wantErr bool
+	}{
+		{name: "no limit"},
+		{name: "within the limit", limit: 1 << 20},
+		{name: "over the limit", limit: 64 << 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r := &ImageRepositoryReconciler{
+				Database:        NewDatabase(),
+				MaxResponseSize: tt.limit,
+			}
+			repo := imagev1alpha1.ImageRepository{
+				Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+			}
+			repo.Status.CanonicalImageName = image
+			repo, err := r.scan(context.TODO(), repo, ref)
+			if !tt.wantErr {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(r.Database.Tags(ref.Context().String())).To(HaveLen(len(tags)))
+				return
+			}
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(r.Database.Tags(ref.Context().String())).To(BeEmpty())
+			ready := readyCondition(repo)
+			g.Expect(ready).ToNot(BeNil())
+			g.Expect(ready.Status).To(Equal(corev1.ConditionFalse))
+			g.Expect(ready.Reason).To(Equal(imagev1alpha1.ResponseTooLargeReason))
+		})
+	}
+}
+
+func TestScanRecordsLatestTags(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return tags, true
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/listed"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+
+	// none are listed without a limit
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.LatestTags).To(BeNil())
+	g.Expect(repo.Status.LastScanResult.Truncated).To(BeFalse())
+
+	r.StatusTagLimit = 10
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.LatestTags).To(Equal(tags))
+	g.Expect(repo.Status.LastScanResult.Truncated).To(BeFalse())
+
+	// beyond the limit, the last listed are kept
+	r.StatusTagLimit = 2
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(4))
+	g.Expect(repo.Status.LastScanResult.LatestTags).To(Equal([]string{"1.2.0", "1.3.0"}))
+	g.Expect(repo.Status.LastScanResult.Truncated).To(BeTrue())
+}
+
+func TestScanTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(&slowPagedRegistry{pages: 1, delay: 500 * time.Millisecond})
+	defer srv.Close()
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:   strings.TrimPrefix(srv.URL, "http://") + "/slow",
+			Timeout: &metav1.Duration{Duration: 100 * time.Millisecond},
+		},
+	}
+	repo.Name = "slow"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	g.Expect(r.scanTimeout(*repo)).To(Equal(100 * time.Millisecond))
+
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).To(HaveOccurred())
+
+	// the timeout is recorded as such, even though the scan's
+	// context is done
+	var after imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &after)).To(Succeed())
+	ready := readyCondition(after)
+	g.Expect(ready).ToNot(BeNil())
+	g.Expect(ready.Reason).To(Equal(imagev1alpha1.ScanTimeoutReason))
+	g.Expect(ready.Message).To(HavePrefix("scan timed out after 100ms"))
+
+	// without a timeout in the spec, the reconciler's default is used
+	repo.Spec.Timeout = nil
+	g.Expect(r.scanTimeout(*repo)).To(Equal(defaultScanTimeout))
+	r.ScanTimeout = time.Minute
+	g.Expect(r.scanTimeout(*repo)).To(Equal(time.Minute))
+}
+
+// failingDatabase is a database that can't record tags.
+type failingDatabase struct {
+	*database
+}
+
+func (db failingDatabase) SetTags(ctx context.Context, repo string, tags []string) error {
+	return fmt.Errorf("database unavailable")
+}
+
+func (db failingDatabase) SetTagsWithDigests(ctx context.Context, repo string, tags []string, digests map[string]string) error {
+	return fmt.Errorf("database unavailable")
+}
+
+func TestScanFailsWhenTagsNotRecorded(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	r := &ImageRepositoryReconciler{Database: failingDatabase{NewDatabase()}}
+	scanned, err := r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(MatchError(ContainSubstring("database unavailable")))
+	g.Expect(isReady(scanned)).To(BeFalse())
+	g.Expect(readyCondition(scanned).Message).To(ContainSubstring("unable to record tags"))
+	g.Expect(scanned.Status.ScanFailures).To(Equal(1))
+}
+
+func TestEmptyRepositoryWaitsForNextScan(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return nil, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/empty"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+	repo.Status.CanonicalImageName = ref.Context().String()
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	ok, _ := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(0))
+
+	// having been scanned and found empty, it's not scanned again
+	// until it's due
+	ok, when := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeFalse())
+	g.Expect(when).To(BeNumerically("~", defaultScanInterval, time.Second))
+
+	// whereas one that had tags, which the database has lost (e.g.,
+	// on restarting), is scanned again straight away
+	repo.Status.LastScanResult.TagCount = 2
+	ok, _ = r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+}
+
+// countingDatabase counts the times tags, and the times they were
+// seen, are written to it.
+type countingDatabase struct {
+	*database
+	writes     int
+	timeWrites int
+}
+
+func (db *countingDatabase) SetTagsWithDigests(ctx context.Context, repo string, tags []string, digests map[string]string) error {
+	db.writes++
+	return db.database.SetTagsWithDigests(ctx, repo, tags, digests)
+}
+
+func (db *countingDatabase) SetTagTimes(ctx context.Context, repo string, times map[string]TagTimes) error {
+	db.timeWrites++
+	return db.database.SetTagTimes(ctx, repo, times)
+}
+
+// failingPlatformsDatabase can't record platforms.
+type failingPlatformsDatabase struct {
+	*database
+}
+
+func (db *failingPlatformsDatabase) SetTagPlatforms(ctx context.Context, repo string, platforms map[string][]string) error {
+	return errors.New("database unavailable")
+}
+
+func TestScanFailsIfPlatformsNotRecorded(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+	imageName, err := reg.pushImages("app", "v1")
+	g.Expect(err).ToNot(HaveOccurred())
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: &failingPlatformsDatabase{database: NewDatabase()}}
+	repo, err := r.scan(context.TODO(), imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName, InspectPlatforms: true},
+	}, ref)
+	g.Expect(err).To(MatchError(ContainSubstring("unable to record platforms")))
+	g.Expect(isReady(repo)).To(BeFalse())
+}
+
+// failingTagTimesDatabase can't record when tags were seen.
+type failingTagTimesDatabase struct {
+	*database
+}
+
+func (db *failingTagTimesDatabase) SetTagTimes(ctx context.Context, repo string, times map[string]TagTimes) error {
+	return errors.New("database unavailable")
+}
+
+func TestScanFailsIfTagTimesNotRecorded(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: &failingTagTimesDatabase{database: NewDatabase()}}
+	repo, err := r.scan(context.TODO(), imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}, ref)
+	g.Expect(err).To(MatchError(ContainSubstring("unable to record when tags were seen")))
+	g.Expect(isReady(repo)).To(BeFalse())
+}
+
+func TestPartialScanKeepsDigests(t *testing.T) {
+	g := NewWithT(t)
+
+	// the tags are listed by a registry that can be told to fail the
+	// second page, and everything else is served by a real one
+	flaky := &flakyRegistry{}
+	images := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			flaky.ServeHTTP(w, r)
+			return
+		}
+		images.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	pushed := map[string]string{}
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		img, err := random.Image(512, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		ref, err := name.NewTag(imageName + ":" + tag)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(remote.Write(ref, img)).To(Succeed())
+		digest, err := img.Digest()
+		g.Expect(err).ToNot(HaveOccurred())
+		pushed[tag] = digest.String()
+	}
+
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	db := NewDatabase()
+	r := &ImageRepositoryReconciler{Database: db, DigestTagLimit: 3}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+	dbKey := ref.Context().String()
+
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	for tag, digest := range pushed {
+		g.Expect(db.TagDigest(dbKey, tag)).To(Equal(digest))
+	}
+
+	flaky.fail(2)
+	_, err = r.scan(context.TODO(), repo, ref)
+	var partial *partialListError
+	g.Expect(errors.As(err, &partial)).To(BeTrue())
+	g.Expect(db.Tags(dbKey)).To(ConsistOf("v1", "v2", "v3"))
+	for tag, digest := range pushed {
+		g.Expect(db.TagDigest(dbKey, tag)).To(Equal(digest))
+	}
+}
+
+func TestScanOnlyWritesChangedTags(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"1.0.0", "1.1.0"}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return tags, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	db := &countingDatabase{database: NewDatabase()}
+	events := record.NewFakeRecorder(10)
+	r := &ImageRepositoryReconciler{Database: db, EventRecorder: events, Log: zap.LoggerTo(ioutil.Discard, true)}
+	scanned, err := r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(Equal(1))
+	g.Expect(db.timeWrites).To(Equal(1))
+	g.Expect(scanned.Status.LastScanResult.TagsChanged).To(BeTrue())
+	// there's nothing to compare the first scan with, so no change is
+	// reported
+	g.Expect(events.Events).ToNot(Receive())
+
+	// the same tags, in another order, aren't written again, nor are
+	// the times they were seen
+	tags = []string{"1.1.0", "1.0.0"}
+	scanned, err = r.scan(context.TODO(), scanned, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(Equal(1))
+	g.Expect(db.timeWrites).To(Equal(1))
+	g.Expect(scanned.Status.LastScanResult.TagsChanged).To(BeFalse())
+
+	tags = []string{"1.1.0", "1.2.0"}
+	scanned, err = r.scan(context.TODO(), scanned, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(Equal(2))
+	g.Expect(db.timeWrites).To(Equal(2))
+	g.Expect(scanned.Status.LastScanResult.TagsChanged).To(BeTrue())
+	g.Expect(events.Events).To(Receive(Equal("Normal TagsChanged tags changed: 1 added (1.2.0), 1 removed (1.0.0)")))
+	g.Expect(db.Tags(databaseKey(r.DatabaseKey, ref.Context()))).To(Equal([]string{"1.1.0", "1.2.0"}))
+	g.Expect(scanned.Status.LastScanResult.RemovedTagCount).To(Equal(1))
+}
+
+func TestScanRetainsMissingTags(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"1.0.0", "1.1.0"}
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return tags, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	db := NewDatabase()
+	dbKey := databaseKey("", ref.Context())
+	r := &ImageRepositoryReconciler{Database: db, TagRetention: time.Hour, Log: zap.LoggerTo(ioutil.Discard, true)}
+	scanned, err := r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	firstSeen := db.TagTimes(dbKey)["1.0.0"].FirstSeen
+	g.Expect(firstSeen).ToNot(BeZero())
+
+	// a tag missing from the listing is kept while it's within the
+	// retention, though it's not counted as found
+	tags = []string{"1.1.0"}
+	scanned, err = r.scan(context.TODO(), scanned, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.Tags(dbKey)).To(ConsistOf("1.0.0", "1.1.0"))
+	g.Expect(db.TagTimes(dbKey)["1.0.0"].FirstSeen).To(Equal(firstSeen))
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(1))
+	g.Expect(scanned.Status.LastScanResult.RemovedTagCount).To(Equal(0))
+
+	// once it's gone unseen for longer, it's dropped
+	g.Expect(db.SetTagTimes(context.TODO(), dbKey, map[string]TagTimes{"1.0.0": {LastSeen: time.Now().Add(-2 * time.Hour)}})).To(Succeed())
+	scanned, err = r.scan(context.TODO(), scanned, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.Tags(dbKey)).To(Equal([]string{"1.1.0"}))
+	g.Expect(scanned.Status.LastScanResult.RemovedTagCount).To(Equal(1))
+}
+
+func TestSummarizeTagChanges(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(summarizeTagChanges(diffTags([]string{"v1", "v2"}, []string{"v2", "v3", "v4"}))).
+		To(Equal("tags changed: 2 added (v3, v4), 1 removed (v1)"))
+	g.Expect(summarizeTagChanges(diffTags(nil, []string{"v1"}))).
+		To(Equal("tags changed: 1 added (v1)"))
+
+	var many []string
+	for i := 0; i < maxTagsInSummary+2; i++ {
+		many = append(many, fmt.Sprintf("v%d", i))
+	}
+	g.Expect(summarizeTagChanges(nil, many)).
+		To(Equal("tags changed: 12 removed (v0, v1, v2, v3, v4, v5, v6, v7, v8, v9 and 2 more)"))
+}
+
+func TestLogTagChanges(t *testing.T) {
+	g := NewWithT(t)
+
+	var many []string
+	for i := 0; i < 1000; i++ {
+		many = append(many, fmt.Sprintf("v%d", i))
+	}
+	logged := func(limit int) map[string]interface{} {
+		var buf bytes.Buffer
+		logTagChanges(zap.LoggerTo(&buf, false), many, []string{"old"}, limit)
+		var entry map[string]interface{}
+		g.Expect(json.Unmarshal(buf.Bytes(), &entry)).To(Succeed())
+		return entry
+	}
+
+	entry := logged(3)
+	g.Expect(entry["msg"]).To(Equal("tags changed"))
+	g.Expect(entry["addedCount"]).To(BeEquivalentTo(1000))
+	g.Expect(entry["removedCount"]).To(BeEquivalentTo(1))
+	g.Expect(entry["added"]).To(Equal([]interface{}{"v0", "v1", "v2"}))
+	g.Expect(entry["removed"]).To(Equal([]interface{}{"old"}))
+
+	// with no limit, only the counts are given
+	entry = logged(0)
+	g.Expect(entry["addedCount"]).To(BeEquivalentTo(1000))
+	g.Expect(entry).ToNot(HaveKey("added"))
+}
+
+// roundTripperFunc lets a func stand in for the transport to a
+// registry.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// listingFailsWith returns a transport to a registry that answers the
+// ping, but fails to list tags with the status given.
+func listingFailsWith(status int) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		code := status
+		if req.URL.Path == "/v2/" {
+			code = http.StatusOK
+		}
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+}
+
+func TestScanFailureReasons(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantReason string
+		permanent  bool
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, wantReason: imagev1alpha1.AuthenticationFailedReason, permanent: true},
+		{name: "forbidden", status: http.StatusForbidden, wantReason: imagev1alpha1.AuthenticationFailedReason, permanent: true},
+		{name: "not found", status: http.StatusNotFound, wantReason: imagev1alpha1.RepositoryNotFoundReason, permanent: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantReason: imagev1alpha1.ReconciliationFailedReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			s := runtime.NewScheme()
+			g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+			g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+			repo := &imagev1alpha1.ImageRepository{
+				Spec: imagev1alpha1.ImageRepositorySpec{
+					Image: "registry.example.com/app",
+				},
+			}
+			repo.Name = "app"
+			repo.Namespace = "default"
+
+			r := &ImageRepositoryReconciler{
+				Client:    fake.NewFakeClientWithScheme(s, repo),
+				Log:       zap.LoggerTo(ioutil.Discard, true),
+				Database:  NewDatabase(),
+				Transport: listingFailsWith(tt.status),
+			}
+			repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+			result, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+			if tt.permanent {
+				// retrying straight away won't help, so it's left
+				// until the next scan is due
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+			} else {
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(result.Requeue).To(BeTrue())
+			}
+
+			var repoAfter imagev1alpha1.ImageRepository
+			g.Expect(r.Get(context.TODO(), repoName, &repoAfter)).To(Succeed())
+			ready := readyCondition(repoAfter)
+			g.Expect(ready).ToNot(BeNil())
+			g.Expect(ready.Status).To(Equal(corev1.ConditionFalse))
+			g.Expect(ready.Reason).To(Equal(tt.wantReason))
+		})
+	}
+}
+
+func TestDryRunScan(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName, DryRun: true},
+	}
+
+	db := &countingDatabase{database: NewDatabase()}
+	r := &ImageRepositoryReconciler{Database: db}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(BeZero())
+	g.Expect(db.Tags(databaseKey("", ref.Context()))).To(BeEmpty())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.DryRun).To(BeTrue())
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(readyCondition(repo).Message).To(HavePrefix("dry run:"))
+
+	// it's scanned again when due, though nothing was recorded
+	ok, _ := r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeFalse())
+
+	// and straight away, for real, once it's no longer a dry run
+	repo.Spec.DryRun = false
+	ok, _ = r.shouldScan(repo, time.Now())
+	g.Expect(ok).To(BeTrue())
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.DryRun).To(BeFalse())
+	g.Expect(db.Tags(databaseKey("", ref.Context()))).To(HaveLen(2))
+}
+
+func TestScanSkipsUnchangedListing(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"1.0.0", "1.1.0"}
+	etag := `"v1"`
+	var conditional, notModified int
+	stub := registryStub(func(string) ([]string, bool) {
+		return tags, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") && etag != "" {
+			if match := r.Header.Get("If-None-Match"); match != "" {
+				conditional++
+				if match == etag {
+					notModified++
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.Header().Set("ETag", etag)
+		}
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	db := &countingDatabase{database: NewDatabase()}
+	r := &ImageRepositoryReconciler{Database: db, Log: zap.LoggerTo(ioutil.Discard, true)}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(Equal(1))
+	g.Expect(conditional).To(BeZero())
+	g.Expect(repo.Status.LastScanResult.ETag).To(Equal(etag))
+
+	// the listing hasn't changed, so nothing is written
+	firstScan := repo.Status.LastScanTime
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(notModified).To(Equal(1))
+	g.Expect(db.writes).To(Equal(1))
+	g.Expect(isReady(repo)).To(BeTrue())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.ETag).To(Equal(etag))
+	g.Expect(repo.Status.LastScanTime).ToNot(Equal(firstScan))
+
+	// a changed listing is scanned in full
+	tags, etag = []string{"1.0.0", "1.1.0", "1.2.0"}, `"v2"`
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(conditional).To(Equal(2))
+	g.Expect(notModified).To(Equal(1))
+	g.Expect(db.writes).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(3))
+	g.Expect(repo.Status.LastScanResult.ETag).To(Equal(etag))
+
+	// as is every listing, once the registry stops giving ETags
+	tags, etag = []string{"1.0.0"}, ""
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(db.writes).To(Equal(3))
+	g.Expect(repo.Status.LastScanResult.ETag).To(BeEmpty())
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(conditional).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(1))
+}
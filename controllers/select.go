@@ -0,0 +1,237 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	semver "github.com/Masterminds/semver/v3"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// maxNewerTags is the most tags reported as newer than a baseline.
+const maxNewerTags = 100
+
+// SelectLatestTag returns the tag that the policy selects from those
+// recorded in the database for an image repository, exactly as the
+// ImagePolicy reconciler selects it; or the empty string if there's
+// no such tag, or the policy has no rule the controller recognises.
+//
+// The image repository is given by the name its tags are keyed on in
+// the database (by default, its canonical name; e.g.,
+// `index.docker.io/library/alpine`), and by its artifact type, which
+// decides how tags are interpreted as versions.
+func SelectLatestTag(db DatabaseReader, repo, artifactType string, spec imagev1alpha1.ImagePolicySpec) (string, error) {
+	tags, err := candidateTags(db, repo, spec)
+	if err != nil {
+		return "", err
+	}
+	return selectLatest(tags, artifactType, spec.Policy)
+}
+
+// selectLatest returns the tag the policy selects from those given.
+func selectLatest(tags []string, artifactType string, policy imagev1alpha1.ImagePolicyChoice) (string, error) {
+	switch {
+	case policy.SemVer != nil:
+		chart := artifactType == imagev1alpha1.ChartArtifactType
+		return calculateLatestImageSemver(&policy, tags, chart)
+	case policy.Date != nil:
+		return calculateLatestImageDate(&policy, tags)
+	default:
+		return "", nil
+	}
+}
+
+// countMatching returns how many of the tags given the policy would
+// choose from: for a semver policy, the versions within its range;
+// for a date policy, the tags with a date matching it; and for an
+// extension, all of them, since there's no telling which it would
+// consider.
+func countMatching(tags []string, artifactType string, policy imagev1alpha1.ImagePolicyChoice) (int, error) {
+	var count int
+	switch {
+	case policy.Extension != nil:
+		count = len(tags)
+	case policy.SemVer != nil:
+		constraint, err := semver.NewConstraint(policy.SemVer.Range)
+		if err != nil {
+			return 0, err
+		}
+		chart := artifactType == imagev1alpha1.ChartArtifactType
+		for _, tag := range tags {
+			version := tag
+			if chart {
+				version = strings.ReplaceAll(tag, "_", "+")
+			}
+			if v, err := semver.NewVersion(version); err == nil && constraint.Check(v) {
+				count++
+			}
+		}
+	case policy.Date != nil:
+		dateOf, err := tagDates(policy.Date)
+		if err != nil {
+			return 0, err
+		}
+		for _, tag := range tags {
+			if _, ok := dateOf(tag); ok {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// NewerTags returns the tags that the policy would choose from which
+// come after the baseline tag in the policy's ordering, in that order
+// (so the nearest to the baseline is first), and up to maxNewerTags
+// of them. The ordering is that of the policy: by version, for a
+// semver policy, and only versions within its range count; or by
+// date, for a date policy. So the baseline must itself be a version,
+// or have a date in it, accordingly; it need not be one of the tags.
+// The arguments are as for SelectLatestTag.
+func NewerTags(db DatabaseReader, repo, artifactType string, spec imagev1alpha1.ImagePolicySpec, baseline string) ([]string, error) {
+	tags, err := candidateTags(db, repo, spec)
+	if err != nil {
+		return nil, err
+	}
+	return newerTags(tags, artifactType, spec.Policy, baseline)
+}
+
+// newerTags returns those of the tags given that come after the
+// baseline, as described for NewerTags.
+func newerTags(tags []string, artifactType string, policy imagev1alpha1.ImagePolicyChoice, baseline string) ([]string, error) {
+	var newer []string
+	switch {
+	case policy.Extension != nil:
+		return nil, fmt.Errorf("a baseline can't be used with the tag selection extension %q, which doesn't say how tags are ordered", policy.Extension.Name)
+	case policy.SemVer != nil:
+		constraint, err := semver.NewConstraint(policy.SemVer.Range)
+		if err != nil {
+			return nil, err
+		}
+		chart := artifactType == imagev1alpha1.ChartArtifactType
+		versionOf := func(tag string) (*semver.Version, error) {
+			if chart {
+				tag = strings.ReplaceAll(tag, "_", "+")
+			}
+			return semver.NewVersion(tag)
+		}
+		base, err := versionOf(baseline)
+		if err != nil {
+			return nil, fmt.Errorf("baseline %q is not a version: %w", baseline, err)
+		}
+		versions := map[string]*semver.Version{}
+		for _, tag := range tags {
+			if v, err := versionOf(tag); err == nil && constraint.Check(v) && v.GreaterThan(base) {
+				versions[tag] = v
+				newer = append(newer, tag)
+			}
+		}
+		sort.Slice(newer, func(i, j int) bool {
+			vi, vj := versions[newer[i]], versions[newer[j]]
+			if vi.Equal(vj) {
+				return newer[i] < newer[j]
+			}
+			return vi.LessThan(vj)
+		})
+	case policy.Date != nil:
+		dateOf, err := tagDates(policy.Date)
+		if err != nil {
+			return nil, err
+		}
+		base, ok := dateOf(baseline)
+		if !ok {
+			return nil, fmt.Errorf("baseline %q does not have a date matching the policy", baseline)
+		}
+		for _, tag := range tags {
+			if date, ok := dateOf(tag); ok && date.After(base) {
+				newer = append(newer, tag)
+			}
+		}
+		sort.Slice(newer, func(i, j int) bool {
+			di, _ := dateOf(newer[i])
+			dj, _ := dateOf(newer[j])
+			if di.Equal(dj) {
+				return newer[i] < newer[j]
+			}
+			return di.Before(dj)
+		})
+	}
+
+	if len(newer) > maxNewerTags {
+		newer = newer[:maxNewerTags]
+	}
+	return newer, nil
+}
+
+// candidateTags returns the tags a policy chooses from: those of the
+// image repository, less any floating tags (unless the policy
+// includes them) and any not available for the policy's platform.
+func candidateTags(db DatabaseReader, repo string, spec imagev1alpha1.ImagePolicySpec) ([]string, error) {
+	tags, err := db.Tags(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !spec.IncludeFloatingTags {
+		floating := spec.FloatingTags
+		if len(floating) == 0 {
+			floating = imagev1alpha1.DefaultFloatingTags
+		}
+		tags = withoutFloatingTags(tags, floating)
+	}
+	if spec.Platform != "" {
+		tags = filterByPlatform(db, repo, tags, spec.Platform)
+	}
+	return tags, nil
+}
+
+// withoutFloatingTags returns the tags that aren't any of those
+// floating tags given, compared without regard to case.
+func withoutFloatingTags(tags, floating []string) []string {
+	filtered := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		isFloating := false
+		for _, f := range floating {
+			if strings.EqualFold(tag, f) {
+				isFloating = true
+				break
+			}
+		}
+		if !isFloating {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered
+}
+
+// filterByPlatform returns those tags recorded as being available
+// for the platform given.
+func filterByPlatform(db DatabaseReader, repo string, tags []string, platform string) []string {
+	var filtered []string
+	for _, tag := range tags {
+		for _, p := range db.TagPlatforms(repo, tag) {
+			if platformMatches(platform, p) {
+				filtered = append(filtered, tag)
+				break
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestSelectLatestTag(t *testing.T) {
+	const repo = "registry.example.com/app"
+
+	db := NewDatabase()
+	db.SetTags(context.TODO(), repo, []string{
+		"1.0.0", "1.1.0", "2.0.0-rc.1", "1.2.0_build.1",
+		"nightly-20240101", "nightly-20240215", "latest",
+	})
+	db.SetTagPlatforms(context.TODO(), repo, map[string][]string{
+		"1.0.0": {"linux/amd64", "linux/arm64"},
+		"1.1.0": {"linux/amd64"},
+	})
+
+	semver := func(r string) imagev1alpha1.ImagePolicySpec {
+		return imagev1alpha1.ImagePolicySpec{
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: r},
+			},
+		}
+	}
+	onPlatform := func(spec imagev1alpha1.ImagePolicySpec, platform string) imagev1alpha1.ImagePolicySpec {
+		spec.Platform = platform
+		return spec
+	}
+
+	tests := []struct {
+		name         string
+		artifactType string
+		spec         imagev1alpha1.ImagePolicySpec
+		want         string
+		wantErr      bool
+	}{
+		{
+			name: "semver",
+			spec: semver("1.x"),
+			want: "1.1.0",
+		},
+		{
+			name:         "semver with chart versions",
+			artifactType: imagev1alpha1.ChartArtifactType,
+			spec:         semver("1.x"),
+			want:         "1.2.0_build.1",
+		},
+		{
+			name:    "invalid semver range",
+			spec:    semver("not a range"),
+			wantErr: true,
+		},
+		{
+			name: "date",
+			spec: imagev1alpha1.ImagePolicySpec{
+				Policy: imagev1alpha1.ImagePolicyChoice{
+					Date: &imagev1alpha1.DatePolicy{Pattern: `^nightly-(\d{8})$`, Layout: "20060102"},
+				},
+			},
+			want: "nightly-20240215",
+		},
+		{
+			name: "platform",
+			spec: onPlatform(semver("1.x"), "linux/arm64"),
+			want: "1.0.0",
+		},
+		{
+			name: "platform with no tags",
+			spec: onPlatform(semver("1.x"), "windows/amd64"),
+			want: "",
+		},
+		{
+			name: "no policy",
+			spec: imagev1alpha1.ImagePolicySpec{},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got, err := SelectLatestTag(db, repo, tt.artifactType, tt.spec)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestNewerTags(t *testing.T) {
+	const repo = "registry.example.com/app"
+
+	db := NewDatabase()
+	db.SetTags(context.TODO(), repo, []string{
+		"1.0.0", "1.2.0", "1.1.0", "1.1.1", "2.0.0", "0.9.0",
+		"nightly-20240301", "nightly-20240101", "nightly-20240215", "latest",
+	})
+
+	semver := func(r string) imagev1alpha1.ImagePolicySpec {
+		return imagev1alpha1.ImagePolicySpec{
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: r},
+			},
+		}
+	}
+	date := imagev1alpha1.ImagePolicySpec{
+		Policy: imagev1alpha1.ImagePolicyChoice{
+			Date: &imagev1alpha1.DatePolicy{Pattern: `^nightly-(\d{8})$`, Layout: "20060102"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		spec     imagev1alpha1.ImagePolicySpec
+		baseline string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "semver, in version order",
+			spec:     semver(">=0.1.0"),
+			baseline: "1.1.0",
+			want:     []string{"1.1.1", "1.2.0", "2.0.0"},
+		},
+		{
+			name:     "semver, only within range",
+			spec:     semver("1.x"),
+			baseline: "1.0.0",
+			want:     []string{"1.1.0", "1.1.1", "1.2.0"},
+		},
+		{
+			name:     "semver, baseline not among the tags",
+			spec:     semver(">=0.1.0"),
+			baseline: "1.1.5",
+			want:     []string{"1.2.0", "2.0.0"},
+		},
+		{
+			name:     "semver, nothing newer",
+			spec:     semver(">=0.1.0"),
+			baseline: "2.0.0",
+			want:     nil,
+		},
+		{
+			name:     "semver, baseline not a version",
+			spec:     semver(">=0.1.0"),
+			baseline: "latest",
+			wantErr:  true,
+		},
+		{
+			name:     "date, in date order",
+			spec:     date,
+			baseline: "nightly-20240101",
+			want:     []string{"nightly-20240215", "nightly-20240301"},
+		},
+		{
+			name:     "date, baseline without a date",
+			spec:     date,
+			baseline: "1.0.0",
+			wantErr:  true,
+		},
+		{
+			name:     "no policy",
+			spec:     imagev1alpha1.ImagePolicySpec{},
+			baseline: "1.0.0",
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got, err := NewerTags(db, repo, "", tt.spec, tt.baseline)
+			if tt.wantErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestFloatingTagsExcluded(t *testing.T) {
+	const repo = "registry.example.com/app"
+
+	db := NewDatabase()
+	db.SetTags(context.TODO(), repo, []string{"1.0.0", "1.1.0", "v2", "latest", "Stable", "edge"})
+
+	spec := func(floating []string, include bool) imagev1alpha1.ImagePolicySpec {
+		return imagev1alpha1.ImagePolicySpec{
+			Policy: imagev1alpha1.ImagePolicyChoice{
+				SemVer: &imagev1alpha1.SemVerPolicy{Range: ">=1.0.0"},
+			},
+			FloatingTags:        floating,
+			IncludeFloatingTags: include,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		spec       imagev1alpha1.ImagePolicySpec
+		candidates []string
+		want       string
+	}{
+		{
+			name:       "well-known floating tags by default",
+			spec:       spec(nil, false),
+			candidates: []string{"1.0.0", "1.1.0", "v2"},
+			want:       "v2",
+		},
+		{
+			name:       "floating tags given",
+			spec:       spec([]string{"v2", "latest"}, false),
+			candidates: []string{"1.0.0", "1.1.0", "Stable", "edge"},
+			want:       "1.1.0",
+		},
+		{
+			name:       "floating tags included",
+			spec:       spec([]string{"v2"}, true),
+			candidates: []string{"1.0.0", "1.1.0", "v2", "latest", "Stable", "edge"},
+			want:       "v2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(candidateTags(db, repo, tt.spec)).To(Equal(tt.candidates))
+			got, err := SelectLatestTag(db, repo, "", tt.spec)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestCountMatching(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"1.0.0", "1.1.0", "2.0.0", "1.2.0_build.1", "latest", "main-20240101", "main-20240215", "main-bad"}
+	count := func(artifactType string, policy imagev1alpha1.ImagePolicyChoice) int {
+		n, err := countMatching(tags, artifactType, policy)
+		g.Expect(err).ToNot(HaveOccurred())
+		return n
+	}
+
+	semverRange := func(r string) imagev1alpha1.ImagePolicyChoice {
+		return imagev1alpha1.ImagePolicyChoice{SemVer: &imagev1alpha1.SemVerPolicy{Range: r}}
+	}
+	g.Expect(count("", semverRange("1.x"))).To(Equal(2))
+	g.Expect(count("", semverRange(">=0.0.0"))).To(Equal(3))
+	// chart versions may have had `+` replaced with `_`
+	g.Expect(count(imagev1alpha1.ChartArtifactType, semverRange("1.x"))).To(Equal(3))
+	g.Expect(count("", semverRange("3.x"))).To(BeZero())
+
+	date := imagev1alpha1.ImagePolicyChoice{Date: &imagev1alpha1.DatePolicy{Pattern: `^main-(.+)$`, Layout: "20060102"}}
+	g.Expect(count("", date)).To(Equal(2))
+
+	// no rule matches nothing
+	g.Expect(count("", imagev1alpha1.ImagePolicyChoice{})).To(BeZero())
+
+	_, err := countMatching(tags, "", semverRange("not a range"))
+	g.Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"regexp"
+)
+
+// signatureTagRegexp matches the tags cosign stores signatures,
+// attestations and SBOMs under: the digest of the image they're for,
+// with the colon swapped for a dash, and a suffix saying which.
+var signatureTagRegexp = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.(sig|att|sbom)$`)
+
+// isSignatureTag says whether the tag is one of cosign's.
+func isSignatureTag(tag string) bool {
+	return signatureTagRegexp.MatchString(tag)
+}
+
+// withoutSignatureTags returns the tags given, less those cosign
+// uses (see isSignatureTag). The order of the tags is kept.
+func withoutSignatureTags(tags []string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !isSignatureTag(tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
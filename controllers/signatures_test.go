@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+const testDigest = "sha256-9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// mixedTags has image tags along with cosign's signature,
+// attestation and SBOM tags, and some that look a bit like them but
+// aren't.
+var mixedTags = []string{
+	"1.0.0",
+	testDigest + ".sig",
+	"1.1.0",
+	testDigest + ".att",
+	testDigest + ".sbom",
+	"1.2.0.sig",
+	"sha256-abc.sig",
+	testDigest + ".sig.bak",
+	testDigest,
+}
+
+func TestWithoutSignatureTags(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(withoutSignatureTags(mixedTags)).To(Equal([]string{
+		"1.0.0", "1.1.0", "1.2.0.sig", "sha256-abc.sig", testDigest + ".sig.bak", testDigest,
+	}))
+	g.Expect(withoutSignatureTags(nil)).To(BeEmpty())
+}
+
+func TestScanExcludesSignatureTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", testDigest + ".sig", "1.1.0", testDigest + ".att", testDigest + ".sbom"}, true
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/signed"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: image},
+	}
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(r.Database.Tags(image)).To(Equal([]string{"1.0.0", "1.1.0"}))
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+
+	// so a policy selects from the image tags only
+	latest, err := SelectLatestTag(r.Database, image, "", imagev1alpha1.ImagePolicySpec{
+		Policy: imagev1alpha1.ImagePolicyChoice{
+			SemVer: &imagev1alpha1.SemVerPolicy{Range: "1.x"},
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(latest).To(Equal("1.1.0"))
+
+	// unless asked to keep them
+	repo.Spec.IncludeSignatureTags = true
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(5))
+	g.Expect(r.Database.Tags(image)).To(ContainElement(testDigest + ".sig"))
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+var varReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveImage returns the image name given in the ImageRepository,
+// with any `${VAR}` references replaced by values from the objects
+// listed in `.spec.substituteFrom`.
+func (r *ImageRepositoryReconciler) resolveImage(ctx context.Context, repo imagev1alpha1.ImageRepository) (string, error) {
+	if len(repo.Spec.SubstituteFrom) == 0 {
+		return repo.Spec.Image, nil
+	}
+
+	vars := map[string]string{}
+	for _, from := range repo.Spec.SubstituteFrom {
+		objectName := types.NamespacedName{Namespace: repo.GetNamespace(), Name: from.Name}
+		switch from.Kind {
+		case "ConfigMap":
+			var cm corev1.ConfigMap
+			if err := r.Get(ctx, objectName, &cm); err != nil {
+				return "", fmt.Errorf("unable to get ConfigMap %q for substitution: %w", from.Name, err)
+			}
+			for k, v := range cm.Data {
+				vars[k] = v
+			}
+		case "Secret":
+			var secret corev1.Secret
+			if err := r.Get(ctx, objectName, &secret); err != nil {
+				return "", fmt.Errorf("unable to get Secret %q for substitution: %w", from.Name, err)
+			}
+			for k, v := range secret.Data {
+				vars[k] = string(v)
+			}
+		default:
+			return "", fmt.Errorf("unsupported kind %q in substituteFrom", from.Kind)
+		}
+	}
+	return substituteVars(repo.Spec.Image, vars)
+}
+
+// substituteVars replaces each `${VAR}` in s with the value of VAR
+// in vars. It is an error for any variable referenced to be missing.
+func substituteVars(s string, vars map[string]string) (string, error) {
+	var missing []string
+	result := varReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := varReference.FindStringSubmatch(ref)[1]
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("variables not set: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestSubstituteVars(t *testing.T) {
+	g := NewWithT(t)
+
+	vars := map[string]string{"REGISTRY": "ghcr.io", "ENV": "staging"}
+
+	image, err := substituteVars("${REGISTRY}/acme/app-${ENV}", vars)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(image).To(Equal("ghcr.io/acme/app-staging"))
+
+	image, err = substituteVars("ghcr.io/acme/app", vars)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(image).To(Equal("ghcr.io/acme/app"))
+
+	_, err = substituteVars("${REGISTRY}/${ORG}/app-${TIER}", vars)
+	g.Expect(err).To(MatchError("variables not set: ORG, TIER"))
+}
+
+func TestResolveImage(t *testing.T) {
+	g := NewWithT(t)
+
+	cm := &corev1.ConfigMap{Data: map[string]string{"REGISTRY": "ghcr.io", "ENV": "dev"}}
+	cm.Name, cm.Namespace = "cluster-vars", "default"
+	secret := &corev1.Secret{Data: map[string][]byte{"ENV": []byte("prod")}}
+	secret.Name, secret.Namespace = "cluster-secrets", "default"
+
+	r := &ImageRepositoryReconciler{Client: fake.NewFakeClient(cm, secret)}
+	repoWith := func(image string, from ...imagev1alpha1.SubstituteReference) imagev1alpha1.ImageRepository {
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:          image,
+				SubstituteFrom: from,
+			},
+		}
+		repo.Namespace = "default"
+		return repo
+	}
+	vars := imagev1alpha1.SubstituteReference{Kind: "ConfigMap", Name: "cluster-vars"}
+	secrets := imagev1alpha1.SubstituteReference{Kind: "Secret", Name: "cluster-secrets"}
+
+	image, err := r.resolveImage(context.TODO(), repoWith("${REGISTRY}/acme/app-${ENV}", vars))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(image).To(Equal("ghcr.io/acme/app-dev"))
+
+	// later objects take precedence
+	image, err = r.resolveImage(context.TODO(), repoWith("${REGISTRY}/acme/app-${ENV}", vars, secrets))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(image).To(Equal("ghcr.io/acme/app-prod"))
+
+	// without substituteFrom, the image is taken literally
+	image, err = r.resolveImage(context.TODO(), repoWith("${REGISTRY}/acme/app"))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(image).To(Equal("${REGISTRY}/acme/app"))
+
+	_, err = r.resolveImage(context.TODO(), repoWith("${REGISTRY}/acme/app-${TIER}", vars))
+	g.Expect(err).To(MatchError("variables not set: TIER"))
+
+	_, err = r.resolveImage(context.TODO(), repoWith("${REGISTRY}/acme/app",
+		imagev1alpha1.SubstituteReference{Kind: "ConfigMap", Name: "missing"}))
+	g.Expect(err).To(HaveOccurred())
+}
@@ -25,7 +25,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/registry"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -58,6 +57,7 @@ var imageRepoReconciler *ImageRepositoryReconciler
 var imagePolicyReconciler *ImagePolicyReconciler
 var testEnv *envtest.Environment
 var registryServer *httptest.Server
+var privateRegistry *testRegistry
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -118,12 +118,10 @@ var _ = BeforeSuite(func(done Done) {
 	k8sClient = k8sMgr.GetClient()
 	Expect(k8sClient).ToNot(BeNil())
 
-	// set up a local registry for testing scanning
-	regHandler := registry.New()
-	registryServer = httptest.NewServer(&tagListHandler{
-		registryHandler: regHandler,
-		imagetags:       map[string][]string{},
-	})
+	// set up local registries for testing scanning: one that is open,
+	// and one that requires credentials
+	registryServer = newTestRegistry("", "").server
+	privateRegistry = newTestRegistry("scanner", "hunter2")
 
 	close(done)
 }, 60)
@@ -133,6 +131,7 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).ToNot(HaveOccurred())
 	registryServer.Close()
+	privateRegistry.Close()
 })
 
 // ---
@@ -164,7 +163,11 @@ func (h *tagListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				Name: repo,
 				Tags: tags,
 			}
-			Expect(json.NewEncoder(w).Encode(result)).To(Succeed())
+			// this is served to plain tests as well as specs, so it
+			// can't use Expect
+			if err := json.NewEncoder(w).Encode(result); err != nil {
+				panic(err)
+			}
 			println("Requested tags", repo, strings.Join(tags, ", "))
 			return
 		}
@@ -176,10 +179,32 @@ func (h *tagListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.registryHandler.ServeHTTP(w, r)
 	if r.Method == "PUT" {
 		pathElements := strings.Split(r.URL.Path, "/")
-		if len(pathElements) == 5 && pathElements[1] == "v2" && pathElements[3] == "manifests" {
+		// manifests pushed by digest (e.g., those in an index) are not tags
+		if len(pathElements) == 5 && pathElements[1] == "v2" && pathElements[3] == "manifests" && !strings.Contains(pathElements[4], ":") {
 			repo, tag := pathElements[2], pathElements[4]
 			println("Recording tag", repo, tag)
 			h.imagetags[repo] = append(h.imagetags[repo], tag)
 		}
 	}
 }
+
+// registryStub serves just enough of the registry API for scanning:
+// the API version check, and tag lists as given by the func
+// supplied, which returns false if there is no such repository.
+func registryStub(tags func(repo string) ([]string, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if withoutTagsList := strings.TrimSuffix(r.URL.Path, "/tags/list"); r.Method == "GET" && withoutTagsList != r.URL.Path {
+			repo := strings.TrimPrefix(withoutTagsList, "/v2/")
+			if t, ok := tags(repo); ok {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tagListResult{Name: repo, Tags: t})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+}
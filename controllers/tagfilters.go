@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+// tagFilter keeps the tags matching include, if it's set, and not
+// matching exclude, if it's set.
+type tagFilter struct {
+	include, exclude *regexp.Regexp
+}
+
+// newTagFilter compiles the filters given in an image repository's
+// spec, which may be nil.
+func newTagFilter(filters *imagev1alpha1.TagFilters) (tagFilter, error) {
+	var f tagFilter
+	if filters == nil {
+		return f, nil
+	}
+	var err error
+	if filters.Include != "" {
+		if f.include, err = regexp.Compile(filters.Include); err != nil {
+			return f, fmt.Errorf("invalid .spec.tagFilters.include: %w", err)
+		}
+	}
+	if filters.Exclude != "" {
+		if f.exclude, err = regexp.Compile(filters.Exclude); err != nil {
+			return f, fmt.Errorf("invalid .spec.tagFilters.exclude: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// apply returns the tags given that the filter keeps, in the same
+// order.
+func (f tagFilter) apply(tags []string) []string {
+	if f.include == nil && f.exclude == nil {
+		return tags
+	}
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if f.include != nil && !f.include.MatchString(tag) {
+			continue
+		}
+		if f.exclude != nil && f.exclude.MatchString(tag) {
+			continue
+		}
+		kept = append(kept, tag)
+	}
+	return kept
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestTagFilter(t *testing.T) {
+	g := NewWithT(t)
+
+	tags := []string{"20.04", "20.04-rc1", "22.04", "latest", "bionic"}
+
+	f, err := newTagFilter(nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.apply(tags)).To(Equal(tags))
+
+	f, err = newTagFilter(&imagev1alpha1.TagFilters{Include: `^\d+\.\d+`})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.apply(tags)).To(Equal([]string{"20.04", "20.04-rc1", "22.04"}))
+
+	f, err = newTagFilter(&imagev1alpha1.TagFilters{Exclude: `-rc\d+$|^latest$`})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.apply(tags)).To(Equal([]string{"20.04", "22.04", "bionic"}))
+
+	f, err = newTagFilter(&imagev1alpha1.TagFilters{Include: `^\d+\.\d+`, Exclude: `-rc\d+$`})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.apply(tags)).To(Equal([]string{"20.04", "22.04"}))
+
+	_, err = newTagFilter(&imagev1alpha1.TagFilters{Include: `[`})
+	g.Expect(err).To(MatchError(ContainSubstring("tagFilters.include")))
+	_, err = newTagFilter(&imagev1alpha1.TagFilters{Exclude: `(`})
+	g.Expect(err).To(MatchError(ContainSubstring("tagFilters.exclude")))
+}
+
+func TestScanFiltersTags(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0", "1.1.0-rc1", "1.1.0", "nightly-20201101", "nightly-20201102"}, true
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "http://") + "/filtered"
+	ref, err := name.ParseReference(image)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: image,
+			TagFilters: &imagev1alpha1.TagFilters{
+				Include: `^\d`,
+				Exclude: `-rc\d+$`,
+			},
+		},
+	}
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(r.Database.Tags(image)).To(Equal([]string{"1.0.0", "1.1.0"}))
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.LastScanResult.UnfilteredTagCount).To(Equal(5))
+}
+
+func TestReconcileInvalidTagFilter(t *testing.T) {
+	g := NewWithT(t)
+
+	s := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+	g.Expect(imagev1alpha1.AddToScheme(s)).To(Succeed())
+
+	repo := &imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:      "registry.example.com/app",
+			TagFilters: &imagev1alpha1.TagFilters{Include: `v[`},
+		},
+	}
+	repo.Name = "app"
+	repo.Namespace = "default"
+
+	r := &ImageRepositoryReconciler{
+		Client:   fake.NewFakeClientWithScheme(s, repo),
+		Log:      zap.LoggerTo(ioutil.Discard, true),
+		Database: NewDatabase(),
+	}
+	repoName := types.NamespacedName{Name: repo.Name, Namespace: repo.Namespace}
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: repoName})
+	g.Expect(err).To(HaveOccurred())
+
+	var after imagev1alpha1.ImageRepository
+	g.Expect(r.Get(context.TODO(), repoName, &after)).To(Succeed())
+	ready := readyCondition(after)
+	g.Expect(ready).ToNot(BeNil())
+	g.Expect(ready.Reason).To(Equal(imagev1alpha1.TagFilterInvalidReason))
+	g.Expect(ready.Message).To(ContainSubstring("tagFilters.include"))
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	tagsclient "github.com/fluxcd/image-reflector-controller/pkg/client"
+)
+
+// TagServer serves a read-only API to the tags recorded in the
+// database, for other controllers and tools; see pkg/client for a
+// client. Each request must carry the token as a bearer token.
+type TagServer struct {
+	// Addr is the address to listen on.
+	Addr string
+	// Token is the secret that requests must carry.
+	Token    string
+	Database DatabaseReader
+	// DatabaseKey says which name tags are keyed on in the database;
+	// it must agree with the ImageRepositoryReconciler.
+	DatabaseKey string
+	Log         logr.Logger
+}
+
+// NewTagServer returns a server for the tags in the database; it
+// must be added to the manager to be started.
+func NewTagServer(addr, token string, db DatabaseReader, log logr.Logger) *TagServer {
+	return &TagServer{
+		Addr:     addr,
+		Token:    token,
+		Database: db,
+		Log:      log,
+	}
+}
+
+// Start serves the API until stop is closed.
+func (s *TagServer) Start(stop <-chan struct{}) error {
+	srv := newServer(s.Addr, s)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
+}
+
+func (s *TagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != tagsclient.TagsPath && r.URL.Path != tagsclient.TagExistsPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	image := r.URL.Query().Get("image")
+	repo, err := name.NewRepository(image)
+	if err != nil {
+		http.Error(w, "invalid image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := databaseKey(s.DatabaseKey, repo)
+
+	switch r.URL.Path {
+	case tagsclient.TagsPath:
+		tags, err := s.Database.Tags(key)
+		if err != nil {
+			s.Log.Error(err, "unable to read tags", "image", image)
+			http.Error(w, "unable to read tags", http.StatusInternalServerError)
+			return
+		}
+		if tags == nil {
+			tags = []string{}
+		}
+		s.respond(w, tagsclient.TagsResponse{Image: image, Tags: tags})
+	case tagsclient.TagExistsPath:
+		tag := r.URL.Query().Get("tag")
+		if tag == "" {
+			http.Error(w, "no tag given", http.StatusBadRequest)
+			return
+		}
+		exists, err := s.Database.HasTag(key, tag)
+		if err != nil {
+			s.Log.Error(err, "unable to read tags", "image", image)
+			http.Error(w, "unable to read tags", http.StatusInternalServerError)
+			return
+		}
+		s.respond(w, tagsclient.TagExistsResponse{Image: image, Tag: tag, Exists: exists})
+	}
+}
+
+// authorized says whether the request carries the token, as a bearer
+// token.
+func (s *TagServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return s.Token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(s.Token)) == 1
+}
+
+func (s *TagServer) respond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Log.Error(err, "unable to write response")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+)
+
+// TagTimes records when a tag was first and last found by a scan.
+type TagTimes struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// updateTagTimes returns the times to record for the tags of a repo
+// after a scan at `now` found the tags given, from those recorded
+// before (known) for the tags recorded before (previous).
+//
+// A tag previously recorded but not found is kept, with its times as
+// they were, until it's gone unseen for longer than the retention
+// given, in case it's only missing from one listing; these are
+// returned as retained. Those gone unseen for longer, or all of them
+// if there's no retention, are dropped and counted as removed. A tag
+// recorded before its times were is taken to have been last seen
+// now.
+//
+// So that a scan finding the same tags as before needn't change what's
+// recorded, the time a tag was last seen is only moved on once it's
+// more than a tenth of the retention old; that's all the precision
+// the retention needs. Without a retention, it's left as it was.
+func updateTagTimes(known map[string]TagTimes, previous, found []string, now time.Time, retention time.Duration) (times map[string]TagTimes, retained []string, removed int) {
+	times = make(map[string]TagTimes, len(found))
+	for _, tag := range found {
+		t, ok := known[tag]
+		if !ok || t.FirstSeen.IsZero() {
+			times[tag] = TagTimes{FirstSeen: now, LastSeen: now}
+			continue
+		}
+		if retention > 0 && now.Sub(t.LastSeen) > retention/10 {
+			t.LastSeen = now
+		}
+		times[tag] = t
+	}
+	for _, tag := range previous {
+		if _, ok := times[tag]; ok {
+			continue
+		}
+		t, ok := known[tag]
+		if !ok {
+			t = TagTimes{FirstSeen: now, LastSeen: now}
+		}
+		if retention <= 0 || now.Sub(t.LastSeen) > retention {
+			removed++
+			continue
+		}
+		times[tag] = t
+		retained = append(retained, tag)
+	}
+	return times, retained, removed
+}
+
+// sameTagTimes says whether the tag times are the same, so there's
+// no need to record them again.
+func sameTagTimes(a, b map[string]TagTimes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for tag, t := range a {
+		u, ok := b[tag]
+		if !ok || !t.FirstSeen.Equal(u.FirstSeen) || !t.LastSeen.Equal(u.LastSeen) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestUpdateTagTimes(t *testing.T) {
+	g := NewWithT(t)
+
+	first := time.Unix(1600000000, 0)
+	now := first.Add(2 * time.Hour)
+	known := map[string]TagTimes{
+		"kept":    {FirstSeen: first, LastSeen: first.Add(time.Hour)},
+		"missing": {FirstSeen: first, LastSeen: first.Add(time.Hour)},
+		"stale":   {FirstSeen: first, LastSeen: first},
+	}
+	previous := []string{"kept", "missing", "stale", "untimed"}
+
+	// with a retention, tags gone missing since they were last seen
+	// are kept until it's passed
+	times, retained, removed := updateTagTimes(known, previous, []string{"kept", "new"}, now, 90*time.Minute)
+	g.Expect(times).To(Equal(map[string]TagTimes{
+		"kept":    {FirstSeen: first, LastSeen: now},
+		"new":     {FirstSeen: now, LastSeen: now},
+		"missing": {FirstSeen: first, LastSeen: first.Add(time.Hour)},
+		"untimed": {FirstSeen: now, LastSeen: now},
+	}))
+	g.Expect(retained).To(Equal([]string{"missing", "untimed"}))
+	g.Expect(removed).To(Equal(1))
+
+	// without one, they're dropped straight away, and there's no
+	// need to move on when a tag was last seen
+	times, retained, removed = updateTagTimes(known, previous, []string{"kept"}, now, 0)
+	g.Expect(times).To(Equal(map[string]TagTimes{
+		"kept": {FirstSeen: first, LastSeen: first.Add(time.Hour)},
+	}))
+	g.Expect(retained).To(BeEmpty())
+	g.Expect(removed).To(Equal(3))
+
+	// when a tag was last seen isn't moved on until it's more than a
+	// tenth of the retention old, so finding the same tags again
+	// changes nothing
+	times, _, _ = updateTagTimes(known, []string{"kept"}, []string{"kept"}, now, 20*time.Hour)
+	g.Expect(sameTagTimes(times, map[string]TagTimes{"kept": known["kept"]})).To(BeTrue())
+	times, _, _ = updateTagTimes(known, []string{"kept"}, []string{"kept"}, now, 5*time.Hour)
+	g.Expect(times).To(Equal(map[string]TagTimes{
+		"kept": {FirstSeen: first, LastSeen: now},
+	}))
+}
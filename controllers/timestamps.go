@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// fetchTimestamps fetches the config of the image at each of the tags
+// given, and returns a map of tag to when the image was created, for
+// those tags for which it's known. A tag with no creation time in its
+// config (or a zero one, as reproducible builds often give), or whose
+// image can't be fetched, is left out rather than failing the lot.
+// The fetches run with the fetcher given, as in fetchPlatforms.
+func fetchTimestamps(ctx context.Context, repo name.Repository, tags []string, transport http.RoundTripper, auth authn.Authenticator, f *fetcher) (map[string]time.Time, error) {
+	options := []remote.Option{
+		remote.WithTransport(&contextTransport{inner: transport, ctx: ctx}),
+	}
+	if auth != nil {
+		options = append(options, remote.WithAuth(auth))
+	}
+
+	found := make([]time.Time, len(tags))
+	err := f.forEachTag(ctx, tags, func(i int, tag string) {
+		found[i], _ = createdForTag(repo.Tag(tag), options...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make(map[string]time.Time, len(tags))
+	for i, tag := range tags {
+		if created := found[i]; created.Unix() > 0 {
+			timestamps[tag] = created
+		}
+	}
+	return timestamps, nil
+}
+
+// createdForTag returns when the image at the tag was created, as
+// given in its config. An index has no creation time of its own, so
+// for a multi-arch image, that of the first image in the index is
+// used.
+func createdForTag(ref name.Reference, options ...remote.Option) (time.Time, error) {
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var img v1.Image
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return time.Time{}, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(manifest.Manifests) == 0 {
+			return time.Time{}, errors.New("index has no manifests")
+		}
+		if img, err = index.Image(manifest.Manifests[0].Digest); err != nil {
+			return time.Time{}, err
+		}
+	default:
+		if img, err = desc.Image(); err != nil {
+			return time.Time{}, err
+		}
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return config.Created.Time, nil
+}
+
+// tagTimeSpan returns the earliest and latest of the times given; or
+// nil for both, if there are none.
+func tagTimeSpan(timestamps map[string]time.Time) (oldest, newest *time.Time) {
+	for _, t := range timestamps {
+		t := t
+		if oldest == nil || t.Before(*oldest) {
+			oldest = &t
+		}
+		if newest == nil || t.After(*newest) {
+			newest = &t
+		}
+	}
+	return oldest, newest
+}
+
+// sortByCreated returns the tags in the order their images were
+// created, oldest first, with those whose creation time isn't known
+// put before the rest, in the order given; and whether any creation
+// time was known, since otherwise there's no order to give.
+func sortByCreated(tags []string, timestamps map[string]time.Time) ([]string, bool) {
+	var known bool
+	for _, tag := range tags {
+		if _, ok := timestamps[tag]; ok {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return tags, false
+	}
+	sorted := append([]string(nil), tags...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, iok := timestamps[sorted[i]]
+		tj, jok := timestamps[sorted[j]]
+		if !iok || !jok {
+			return !iok && jok
+		}
+		return ti.Before(tj)
+	})
+	return sorted, true
+}
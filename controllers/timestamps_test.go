@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	. "github.com/onsi/gomega"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestTagTimeSpan(t *testing.T) {
+	g := NewWithT(t)
+
+	oldest, newest := tagTimeSpan(nil)
+	g.Expect(oldest).To(BeNil())
+	g.Expect(newest).To(BeNil())
+
+	jan := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	jun := time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)
+	dec := time.Date(2020, time.December, 1, 0, 0, 0, 0, time.UTC)
+	oldest, newest = tagTimeSpan(map[string]time.Time{"b": dec, "a": jan, "c": jun})
+	g.Expect(*oldest).To(Equal(jan))
+	g.Expect(*newest).To(Equal(dec))
+
+	oldest, newest = tagTimeSpan(map[string]time.Time{"only": jun})
+	g.Expect(*oldest).To(Equal(jun))
+	g.Expect(*newest).To(Equal(jun))
+}
+
+func TestSortByCreated(t *testing.T) {
+	g := NewWithT(t)
+
+	jan := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dec := time.Date(2020, time.December, 1, 0, 0, 0, 0, time.UTC)
+	sorted, ok := sortByCreated([]string{"b", "x", "a", "y"}, map[string]time.Time{"a": dec, "b": jan})
+	g.Expect(ok).To(BeTrue())
+	g.Expect(sorted).To(Equal([]string{"x", "y", "b", "a"}))
+
+	// with nothing to go by, the order's left alone
+	sorted, ok = sortByCreated([]string{"b", "a"}, nil)
+	g.Expect(ok).To(BeFalse())
+	g.Expect(sorted).To(Equal([]string{"b", "a"}))
+}
+
+func TestScanOrdersLatestTagsByCreated(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	imageName := reg.host() + "/ordered"
+	push := func(tag string, created time.Time) {
+		img, err := random.Image(512, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+		g.Expect(err).ToNot(HaveOccurred())
+		ref, err := name.NewTag(imageName + ":" + tag)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(remote.Write(ref, img)).To(Succeed())
+	}
+	// listed lexically, these are a, b, c, d
+	push("a", time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC))
+	push("b", time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC))
+	push("c", time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC))
+	push("d", time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC))
+
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	r := &ImageRepositoryReconciler{Database: NewDatabase(), StatusTagLimit: 2}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.LatestTags).To(Equal([]string{"c", "d"}))
+	g.Expect(repo.Status.LastScanResult.LatestTagsOrder).To(BeEmpty())
+
+	// only the last three listed are candidates, so a isn't considered
+	r.TimestampTagLimit = 3
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.LatestTags).To(Equal([]string{"c", "b"}))
+	g.Expect(repo.Status.LastScanResult.LatestTagsOrder).To(Equal(imagev1alpha1.CreatedTagOrder))
+	g.Expect(repo.Status.LastScanResult.Truncated).To(BeTrue())
+}
+
+func TestScanRecordsTagTimeSpan(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+
+	imageName := reg.host() + "/timestamped"
+	push := func(tag string, created time.Time) v1.Image {
+		img, err := random.Image(512, 1)
+		g.Expect(err).ToNot(HaveOccurred())
+		if !created.IsZero() {
+			img, err = mutate.CreatedAt(img, v1.Time{Time: created})
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		ref, err := name.NewTag(imageName + ":" + tag)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(remote.Write(ref, img)).To(Succeed())
+		return img
+	}
+
+	oldest := time.Date(2019, time.March, 1, 12, 0, 0, 0, time.UTC)
+	newest := time.Date(2021, time.July, 4, 9, 30, 0, 0, time.UTC)
+	push("v1", oldest)
+	push("v2", time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC))
+	// the zero time (as random images have), or the start of the
+	// epoch (as reproducible builds give), says nothing of when the
+	// image was made, so don't count
+	push("reproducible", time.Unix(0, 0))
+	push("unknown", time.Time{})
+	// a multi-arch image takes the time of its first image
+	indexed := push("indexed-image", newest)
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: indexed})
+	indexRef, err := name.NewTag(imageName + ":multi")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(remote.WriteIndex(indexRef, index)).To(Succeed())
+
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	// only in the timestamp-inspecting mode
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.OldestTagTime).To(BeNil())
+	g.Expect(repo.Status.NewestTagTime).To(BeNil())
+
+	repo.Spec.InspectTimestamps = true
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.OldestTagTime).ToNot(BeNil())
+	g.Expect(repo.Status.OldestTagTime.Time.Equal(oldest)).To(BeTrue())
+	g.Expect(repo.Status.NewestTagTime).ToNot(BeNil())
+	g.Expect(repo.Status.NewestTagTime.Time.Equal(newest)).To(BeTrue())
+}
+
+func TestScanRecordsNoTagTimeSpanWithoutTimestamps(t *testing.T) {
+	g := NewWithT(t)
+
+	reg := newTestRegistry("", "")
+	defer reg.Close()
+	imageName, err := reg.pushImages("untimed", "v1", "v2")
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName, InspectTimestamps: true},
+	}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+	g.Expect(repo.Status.OldestTagTime).To(BeNil())
+	g.Expect(repo.Status.NewestTagTime).To(BeNil())
+}
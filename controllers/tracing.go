@@ -0,0 +1,148 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+// tracerName names the tracer the controller's spans come from.
+const tracerName = "github.com/fluxcd/image-reflector-controller"
+
+// startSpan starts a span as a child of any in the context. Until
+// tracing is set up with SetupTracing, spans are not recorded.
+func startSpan(ctx context.Context, spanName string, attrs ...label.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, spanName, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording the error it ended with, if any.
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Error))
+	}
+	span.End()
+}
+
+// repositoryLabels gives the registry host and repository of a scan,
+// as span attributes.
+func repositoryLabels(repo name.Repository) []label.KeyValue {
+	return []label.KeyValue{
+		label.String("registry", repo.RegistryStr()),
+		label.String("repository", repo.RepositoryStr()),
+	}
+}
+
+// otlpConfig is how to reach the OTLP collector spans are exported
+// to, as given in the standard environment variables.
+type otlpConfig struct {
+	address  string
+	insecure bool
+	headers  map[string]string
+}
+
+// otlpConfigFromEnv reads the collector's address, and any headers
+// to send, from `OTEL_EXPORTER_OTLP_ENDPOINT` (or
+// `OTEL_EXPORTER_OTLP_TRACES_ENDPOINT`) and `OTEL_EXPORTER_OTLP_HEADERS`
+// (or `OTEL_EXPORTER_OTLP_TRACES_HEADERS`). The connection is insecure
+// if the endpoint is given as an `http://` URL, or
+// `OTEL_EXPORTER_OTLP_INSECURE` is true.
+func otlpConfigFromEnv(getenv func(string) string) (otlpConfig, error) {
+	lookup := func(key string) string {
+		if v := getenv(strings.Replace(key, "OTLP_", "OTLP_TRACES_", 1)); v != "" {
+			return v
+		}
+		return getenv(key)
+	}
+
+	var cfg otlpConfig
+	endpoint := lookup("OTEL_EXPORTER_OTLP_ENDPOINT")
+	switch {
+	case strings.HasPrefix(endpoint, "http://"):
+		cfg.insecure = true
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+	case strings.HasPrefix(endpoint, "https://"):
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+	}
+	cfg.address = strings.TrimSuffix(endpoint, "/")
+	if insecure := lookup("OTEL_EXPORTER_OTLP_INSECURE"); insecure != "" {
+		v, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_INSECURE: %w", err)
+		}
+		cfg.insecure = cfg.insecure || v
+	}
+	if headers := lookup("OTEL_EXPORTER_OTLP_HEADERS"); headers != "" {
+		cfg.headers = map[string]string{}
+		for _, pair := range strings.Split(headers, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return cfg, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: expected key=value, got %q", pair)
+			}
+			cfg.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return cfg, nil
+}
+
+// SetupTracing has spans exported to the OTLP collector given in the
+// environment (see otlpConfigFromEnv), as from the service named. It
+// returns a func that flushes any spans yet to be exported, and stops
+// exporting them.
+func SetupTracing(serviceName string) (func(context.Context) error, error) {
+	cfg, err := otlpConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	var options []otlp.ExporterOption
+	if cfg.address != "" {
+		options = append(options, otlp.WithAddress(cfg.address))
+	}
+	if cfg.insecure {
+		options = append(options, otlp.WithInsecure())
+	}
+	if len(cfg.headers) > 0 {
+		options = append(options, otlp.WithHeaders(cfg.headers))
+	}
+	exporter, err := otlp.NewExporter(options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+	batcher := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(batcher),
+		sdktrace.WithResource(resource.New(semconv.ServiceNameKey.String(serviceName))),
+	)
+	global.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		batcher.Shutdown()
+		return exporter.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/api/global"
+	exporttrace "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestOTLPConfigFromEnv(t *testing.T) {
+	g := NewWithT(t)
+
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	cfg, err := otlpConfigFromEnv(env(nil))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cfg).To(Equal(otlpConfig{}))
+
+	cfg, err = otlpConfigFromEnv(env(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "api-key=secret, tenant=a",
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cfg).To(Equal(otlpConfig{
+		address:  "collector:4317",
+		insecure: true,
+		headers:  map[string]string{"api-key": "secret", "tenant": "a"},
+	}))
+
+	// those for traces take precedence
+	cfg, err = otlpConfigFromEnv(env(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4317",
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "https://traces:4317",
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cfg.address).To(Equal("traces:4317"))
+	g.Expect(cfg.insecure).To(BeFalse())
+
+	_, err = otlpConfigFromEnv(env(map[string]string{"OTEL_EXPORTER_OTLP_INSECURE": "maybe"}))
+	g.Expect(err).To(HaveOccurred())
+	_, err = otlpConfigFromEnv(env(map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "novalue"}))
+	g.Expect(err).To(HaveOccurred())
+}
+
+// spanRecorder is a span exporter that keeps the names of the spans
+// it's given.
+type spanRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *spanRecorder) ExportSpans(_ context.Context, spans []*exporttrace.SpanData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, span := range spans {
+		s.names = append(s.names, span.Name)
+	}
+	return nil
+}
+
+func (s *spanRecorder) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestScanRecordsSpans(t *testing.T) {
+	g := NewWithT(t)
+
+	spans := &spanRecorder{}
+	previous := global.TracerProvider()
+	global.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	defer global.SetTracerProvider(previous)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	_, err = r.scan(context.TODO(), imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(spans.names).To(Equal([]string{"credentials", "list tags", "record tags", "ImageRepository.scan"}))
+}
@@ -0,0 +1,504 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tlsVersions maps the TLS versions accepted by ParseTLSVersion to
+// their crypto/tls values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version given as e.g., "1.2", into
+// the value used by crypto/tls.
+func ParseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q; expected one of 1.0, 1.1, 1.2, 1.3", version)
+}
+
+// maxIdleConnsPerHost is the most idle connections kept to each
+// registry host. Many image repositories are often on the same
+// registry, and scanned concurrently, so this is well above
+// http.DefaultTransport's two.
+const maxIdleConnsPerHost = 32
+
+// NewTransport returns a transport for making requests to
+// registries, which is otherwise like http.DefaultTransport, but
+// will refuse to negotiate a TLS version lower than that given, and
+// keeps more connections to each registry for reuse. It's meant to
+// be made once and shared by all scans, so that connections (and
+// their TLS sessions) are reused from one scan to the next.
+func NewTransport(tlsMinVersion uint16) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tlsMinVersion,
+	}
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	return transport
+}
+
+// insecureTransport returns a transport like the one given, but
+// which doesn't verify the certificates of the servers it connects
+// to; nil is taken to mean http.DefaultTransport. Only an
+// *http.Transport can be made so; any other transport is returned as
+// it is. Each call makes a new transport, with its own pool of
+// connections, so it's kept in a transportCache to be reused.
+func insecureTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	base, ok := rt.(*http.Transport)
+	if !ok {
+		return rt
+	}
+	insecure := base.Clone()
+	if insecure.TLSClientConfig == nil {
+		insecure.TLSClientConfig = &tls.Config{}
+	}
+	insecure.TLSClientConfig.InsecureSkipVerify = true
+	return insecure
+}
+
+// transportKey says how a transport kept in a transportCache was
+// made: from which base transport, and whether it skips verifying
+// certificates or else trusts the CA certificates with the hash
+// given.
+type transportKey struct {
+	base     http.RoundTripper
+	insecure bool
+	caHash   [sha256.Size]byte
+}
+
+// cachedTransport is a transport kept in a transportCache, with what
+// it was made from.
+type cachedTransport struct {
+	key       transportKey
+	transport http.RoundTripper
+}
+
+// transportCache keeps the transport made for each image repository
+// that needs one of its own (to skip verifying certificates, or to
+// trust particular ones), so that its pool of connections is kept
+// from one scan to the next. When what the transport is made from
+// changes, e.g., because the CA certificates were rotated, it's
+// replaced, and the old one's idle connections are closed. The zero
+// value is ready to use.
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[types.NamespacedName]cachedTransport
+}
+
+// get returns the transport kept for the image repository, if it was
+// made as the key says; otherwise it makes one with the func given,
+// and keeps that instead.
+func (c *transportCache) get(repo types.NamespacedName, key transportKey, make func() (http.RoundTripper, error)) (http.RoundTripper, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.transports[repo]
+	if ok && cached.key == key {
+		return cached.transport, nil
+	}
+	transport, err := make()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		closeIdleConnections(cached.transport)
+	}
+	if c.transports == nil {
+		c.transports = map[types.NamespacedName]cachedTransport{}
+	}
+	c.transports[repo] = cachedTransport{key: key, transport: transport}
+	return transport, nil
+}
+
+// forget drops the transport kept for the image repository, if
+// there is one, closing its idle connections.
+func (c *transportCache) forget(repo types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.transports[repo]; ok {
+		closeIdleConnections(cached.transport)
+		delete(c.transports, repo)
+	}
+}
+
+// closeIdleConnections closes the transport's idle connections, if
+// it's a kind of transport that has any.
+func closeIdleConnections(rt http.RoundTripper) {
+	if t, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// headerTransport is an http.RoundTripper that sets a fixed set of
+// headers on each request before handing it to the inner transport.
+// Since the headers may carry secrets, the values are never logged;
+// and if a host is given, they're only sent to that host, so they
+// don't follow a redirect elsewhere, e.g., to the storage a registry
+// serves blobs from.
+type headerTransport struct {
+	inner   http.RoundTripper
+	headers map[string]string
+	host    string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host != "" && req.URL.Host != t.host {
+		return t.inner.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the request it's given
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.inner.RoundTrip(req)
+}
+
+// withUserAgent returns a transport that gives the user agent on each
+// request, or the transport as it is if there's no user agent. It
+// must be wrapped around any headerTransport setting an image
+// repository's custom headers, so that a User-Agent given among those
+// wins.
+func withUserAgent(rt http.RoundTripper, userAgent string) http.RoundTripper {
+	if userAgent == "" {
+		return rt
+	}
+	return &headerTransport{
+		inner:   rt,
+		headers: map[string]string{"User-Agent": userAgent},
+	}
+}
+
+// unexpectedRedirectError is returned when a registry redirects a
+// request to a host that isn't allowed.
+type unexpectedRedirectError struct {
+	from, to string
+}
+
+func (e *unexpectedRedirectError) Error() string {
+	return fmt.Sprintf("registry %s redirected a request to %s, which is not an allowed host", e.from, e.to)
+}
+
+// redirectTransport refuses to follow a redirect from a registry to
+// any host but the registry's own and those allowed. An http.Client
+// following a redirect hands the request for the new location to the
+// transport with the response that redirected it, so this is where
+// it can be refused, before anything is sent to the new host.
+type redirectTransport struct {
+	inner   http.RoundTripper
+	allowed []string
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Response != nil && req.Response.Request != nil {
+		// a redirect may follow a redirect; the registry's host is
+		// that of the first request
+		origin := req.Response.Request
+		for origin.Response != nil && origin.Response.Request != nil {
+			origin = origin.Response.Request
+		}
+		if req.URL.Host != origin.URL.Host && !redirectAllowed(req.URL, t.allowed) {
+			return nil, &unexpectedRedirectError{from: origin.URL.Host, to: req.URL.Host}
+		}
+	}
+	return t.inner.RoundTrip(req)
+}
+
+// redirectAllowed says whether the URL is at one of the hosts
+// allowed. A host may be given with or without a port, or as
+// `*.<domain>` to allow any host within the domain.
+func redirectAllowed(u *url.URL, allowed []string) bool {
+	for _, host := range allowed {
+		switch {
+		case host == u.Host || host == u.Hostname():
+			return true
+		case strings.HasPrefix(host, "*.") && strings.HasSuffix(u.Hostname(), host[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// responseTooLargeError is returned when reading a response to a
+// request for a listing of tags, if it goes over the limit.
+type responseTooLargeError struct {
+	limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("registry's listing of tags is larger than the limit of %d bytes", e.limit)
+}
+
+// responseSizeTransport limits the size of the responses to requests
+// for a listing of tags, so that a broken or malicious registry can't
+// make the controller run out of memory. A response that says it's
+// too large is refused straight away; otherwise, reading the body
+// fails once it's gone over the limit.
+type responseSizeTransport struct {
+	inner http.RoundTripper
+	limit int64
+}
+
+func (t *responseSizeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.inner.RoundTrip(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/tags/list") {
+		return res, err
+	}
+	if res.ContentLength > t.limit {
+		res.Body.Close()
+		return nil, &responseTooLargeError{limit: t.limit}
+	}
+	res.Body = &limitedBody{
+		ReadCloser: res.Body,
+		reader:     io.LimitedReader{R: res.Body, N: t.limit + 1},
+		limit:      t.limit,
+	}
+	return res, nil
+}
+
+// limitedBody reads up to limit bytes of a response body, and fails
+// with a *responseTooLargeError if there's more.
+type limitedBody struct {
+	io.ReadCloser
+	reader io.LimitedReader
+	limit  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	// the reader is allowed one byte over the limit, to tell a body
+	// of exactly the limit from one over it
+	if b.reader.N <= 0 {
+		return 0, &responseTooLargeError{limit: b.limit}
+	}
+	return n, err
+}
+
+// contextTransport binds each request to a context, for use with the
+// parts of the registry client that don't accept a context.
+type contextTransport struct {
+	inner http.RoundTripper
+	ctx   context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.inner.RoundTrip(req.WithContext(t.ctx))
+}
+
+// deprecationTransport is an http.RoundTripper that records any
+// `Deprecation` or `Sunset` headers (RFC 8594) in the responses from
+// the registry, so they can be reported.
+type deprecationTransport struct {
+	inner http.RoundTripper
+
+	mu      sync.Mutex
+	notices []string
+}
+
+func (t *deprecationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	var found []string
+	for _, header := range []string{"Deprecation", "Sunset"} {
+		if v := res.Header.Get(header); v != "" {
+			found = append(found, header+": "+v)
+		}
+	}
+	if len(found) > 0 {
+		t.mu.Lock()
+		t.notices = unionTags(t.notices, found)
+		t.mu.Unlock()
+	}
+	return res, nil
+}
+
+// notice returns the deprecation headers seen so far, as a single
+// message; or the empty string if none have been seen.
+func (t *deprecationTransport) notice() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.notices, "; ")
+}
+
+// firstResponseTransport is an http.RoundTripper that keeps the
+// headers of the first response from the registry -- usually to the
+// API version check -- so the registry can be identified from them.
+type firstResponseTransport struct {
+	inner http.RoundTripper
+
+	mu     sync.Mutex
+	header http.Header
+}
+
+func (t *firstResponseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	t.mu.Lock()
+	if t.header == nil {
+		t.header = res.Header.Clone()
+	}
+	t.mu.Unlock()
+	return res, nil
+}
+
+// firstHeader returns the headers of the first response, or nil if
+// there's been no response.
+func (t *firstResponseTransport) firstHeader() http.Header {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.header
+}
+
+// cacheControlTransport is an http.RoundTripper that keeps the
+// freshness window given by the `Cache-Control` header of the first
+// response listing tags, if there is one.
+type cacheControlTransport struct {
+	inner http.RoundTripper
+
+	mu     sync.Mutex
+	seen   bool
+	maxAge time.Duration
+}
+
+func (t *cacheControlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.inner.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, "/tags/list") {
+		return res, err
+	}
+	t.mu.Lock()
+	if !t.seen {
+		t.seen = true
+		t.maxAge, _ = parseMaxAge(res.Header.Get("Cache-Control"))
+	}
+	t.mu.Unlock()
+	return res, nil
+}
+
+// freshFor returns how long the listing of tags is fresh for, as
+// given by the registry; or zero if it gave no such hint.
+func (t *cacheControlTransport) freshFor() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxAge
+}
+
+// parseMaxAge returns the `max-age` given in a `Cache-Control` header
+// value, and whether there is one. A response that mustn't be cached
+// (`no-cache` or `no-store`) has no max-age.
+func parseMaxAge(cacheControl string) (time.Duration, bool) {
+	var maxAge time.Duration
+	found := false
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`))
+			if err != nil || seconds < 0 {
+				return 0, false
+			}
+			maxAge, found = time.Duration(seconds)*time.Second, true
+		}
+	}
+	return maxAge, found
+}
+
+// retryTransport is an http.RoundTripper that retries requests which
+// fail for want of a DNS answer, or with some other temporary network
+// error, up to the number of retries given, doubling the delay
+// between attempts each time. This is so a scan survives a momentary
+// blip in DNS, rather than failing and waiting for the controller to
+// back off and try again. Requests with a body that can't be
+// replayed are not retried.
+type retryTransport struct {
+	inner   http.RoundTripper
+	retries int
+	delay   time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.delay
+	for attempt := 0; ; attempt++ {
+		res, err := t.inner.RoundTrip(req)
+		if err == nil || attempt >= t.retries || !retryableNetworkError(err) {
+			return res, err
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return res, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return res, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// retryableNetworkError says whether the error, from making a
+// request, is worth retrying straight away: a failure to resolve the
+// host (which includes an answer of "no such host", since that's
+// what a misbehaving DNS server often gives), or a network error
+// that says it is temporary. Timeouts don't count, since they will
+// already have used up time; nor do errors from the registry.
+func retryableNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Temporary() && !opErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,664 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	imagev1alpha1 "github.com/fluxcd/image-reflector-controller/api/v1alpha1"
+)
+
+func TestScanSendsCustomHeaders(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var requests []*http.Request
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1", "v2"}, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/gated"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+			CustomHeaders: map[string]string{
+				"X-Tenant-Id":   "tenant-a",
+				"X-Gateway-Key": "s3cr3t",
+			},
+		},
+	}
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(2))
+
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(requests).ToNot(BeEmpty())
+	for _, req := range requests {
+		g.Expect(req.Header.Get("X-Tenant-Id")).To(Equal("tenant-a"))
+		g.Expect(req.Header.Get("X-Gateway-Key")).To(Equal("s3cr3t"))
+	}
+}
+
+func TestCustomHeadersNotSentAcrossRedirects(t *testing.T) {
+	g := NewWithT(t)
+
+	// the listing is served from another host, as a registry might
+	// serve blobs from a CDN
+	var mu sync.Mutex
+	var cdnRequests []*http.Request
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cdnRequests = append(cdnRequests, r)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tagListResult{Name: "gated", Tags: []string{"v1"}})
+	}))
+	defer cdn.Close()
+	var registryKeys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		registryKeys = append(registryKeys, r.Header.Get("X-Gateway-Key"))
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/gated"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:         imageName,
+			CustomHeaders: map[string]string{"X-Gateway-Key": "s3cr3t"},
+		},
+	}
+	r := &ImageRepositoryReconciler{Database: NewDatabase()}
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.LastScanResult.TagCount).To(Equal(1))
+
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(registryKeys).ToNot(BeEmpty())
+	for _, key := range registryKeys {
+		g.Expect(key).To(Equal("s3cr3t"))
+	}
+	g.Expect(cdnRequests).ToNot(BeEmpty())
+	for _, req := range cdnRequests {
+		g.Expect(req.Header.Get("X-Gateway-Key")).To(BeEmpty())
+	}
+}
+
+func TestScanSendsUserAgent(t *testing.T) {
+	g := NewWithT(t)
+
+	var mu sync.Mutex
+	var userAgents []string
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+	r := &ImageRepositoryReconciler{Database: NewDatabase(), UserAgent: "image-reflector-controller/1.2.3"}
+	_, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// one given in the custom headers wins
+	repo.Spec.CustomHeaders = map[string]string{"User-Agent": "custom/1.0"}
+	_, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(userAgents).ToNot(BeEmpty())
+	g.Expect(userAgents[0]).To(Equal("image-reflector-controller/1.2.3"))
+	g.Expect(userAgents[len(userAgents)-1]).To(Equal("custom/1.0"))
+	g.Expect(userAgents).ToNot(ContainElement("go-containerregistry"))
+}
+
+func TestScanRespectsTLSMinVersion(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewUnstartedServer(registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	imageName := strings.TrimPrefix(srv.URL, "https://") + "/old-tls"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+		},
+	}
+
+	scanWithMinVersion := func(version string) (imagev1alpha1.ImageRepository, error) {
+		minVersion, err := ParseTLSVersion(version)
+		g.Expect(err).ToNot(HaveOccurred())
+		transport := NewTransport(minVersion)
+		transport.TLSClientConfig.RootCAs = roots
+		r := &ImageRepositoryReconciler{
+			Database:  NewDatabase(),
+			Transport: transport,
+		}
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// sanity check: the server is reachable if TLS 1.1 is allowed
+	scanned, err := scanWithMinVersion("1.0")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(1))
+
+	_, err = scanWithMinVersion("1.2")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestNewTransportKeepsConnectionsPerHost(t *testing.T) {
+	g := NewWithT(t)
+	transport := NewTransport(tls.VersionTLS12)
+	g.Expect(transport.MaxIdleConnsPerHost).To(Equal(maxIdleConnsPerHost))
+	g.Expect(transport).ToNot(BeIdenticalTo(http.DefaultTransport))
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	g := NewWithT(t)
+
+	v, err := ParseTLSVersion("1.2")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v).To(Equal(uint16(tls.VersionTLS12)))
+
+	_, err = ParseTLSVersion("1.4")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestScanReportsDeprecationOnce(t *testing.T) {
+	g := NewWithT(t)
+
+	sunset := "Sat, 01 Feb 2025 00:00:00 GMT"
+	stub := registryStub(func(string) ([]string, bool) {
+		return []string{"v1"}, true
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", sunset)
+		stub.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/legacy"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	events := record.NewFakeRecorder(10)
+	r := &ImageRepositoryReconciler{
+		Database:      NewDatabase(),
+		EventRecorder: events,
+	}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image: imageName,
+		},
+	}
+
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.RegistryDeprecation).To(Equal("Deprecation: true; Sunset: " + sunset))
+	g.Expect(events.Events).To(Receive(ContainSubstring("Sunset: " + sunset)))
+
+	// the same notice is not reported again
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(events.Events).ToNot(Receive())
+
+	// but a different one is
+	sunset = "Sun, 01 Jun 2025 00:00:00 GMT"
+	repo, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(repo.Status.RegistryDeprecation).To(ContainSubstring(sunset))
+	g.Expect(events.Events).To(Receive(HavePrefix("Warning RegistryDeprecation")))
+}
+
+// flakyResolverTransport returns a transport that fails to resolve
+// the host as many times as given, before connecting as usual.
+func flakyResolverTransport(failures int) http.RoundTripper {
+	var mu sync.Mutex
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		fail := failures > 0
+		failures--
+		mu.Unlock()
+		if fail {
+			return nil, &net.DNSError{Err: "server misbehaving", Name: addr, IsTemporary: true}
+		}
+		return dial(ctx, network, addr)
+	}
+	// so each request needs a new connection
+	transport.DisableKeepAlives = true
+	return transport
+}
+
+func TestScanRetriesDNSFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewServer(registryStub(func(string) ([]string, bool) {
+		return []string{"1.0.0"}, true
+	}))
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "http://") + "/app"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{Image: imageName},
+	}
+
+	// without retries, the blip fails the scan. NB the registry is
+	// pinged with HTTPS then HTTP, so it takes two failures.
+	r := &ImageRepositoryReconciler{
+		Database:  NewDatabase(),
+		Transport: flakyResolverTransport(2),
+	}
+	_, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+	var dnsErr *net.DNSError
+	g.Expect(errors.As(err, &dnsErr)).To(BeTrue())
+
+	// with retries, it's survived
+	r = &ImageRepositoryReconciler{
+		Database:          NewDatabase(),
+		Transport:         flakyResolverTransport(2),
+		NetworkRetries:    2,
+		NetworkRetryDelay: time.Millisecond,
+	}
+	scanned, err := r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(1))
+
+	// but the retries are bounded
+	r.Transport = flakyResolverTransport(10)
+	_, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestRetryableNetworkError(t *testing.T) {
+	g := NewWithT(t)
+
+	dnsErr := &net.DNSError{Err: "no such host", Name: "registry.example.com", IsNotFound: true}
+	g.Expect(retryableNetworkError(dnsErr)).To(BeTrue())
+	g.Expect(retryableNetworkError(fmt.Errorf("Get https://registry.example.com/v2/: %w", dnsErr))).To(BeTrue())
+	g.Expect(retryableNetworkError(&net.OpError{Op: "dial", Err: dnsErr})).To(BeTrue())
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	g.Expect(retryableNetworkError(refused)).To(BeFalse())
+	g.Expect(retryableNetworkError(errors.New("unexpected status code 500"))).To(BeFalse())
+}
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		found  bool
+	}{
+		{header: "max-age=300", want: 5 * time.Minute, found: true},
+		{header: "public, Max-Age=60", want: time.Minute, found: true},
+		{header: `max-age="120", must-revalidate`, want: 2 * time.Minute, found: true},
+		{header: "max-age=300, no-cache"},
+		{header: "no-store"},
+		{header: "max-age=soon"},
+		{header: "max-age=-1"},
+		{header: "public"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			g := NewWithT(t)
+			got, found := parseMaxAge(tt.header)
+			g.Expect(found).To(Equal(tt.found))
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+}
+
+func TestResponseSizeTransport(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("length") == "" {
+			// without a Content-Length, the body has to be read to
+			// find out it's too large
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	get := func(path string, limit int64) ([]byte, error) {
+		client := &http.Client{Transport: &responseSizeTransport{inner: http.DefaultTransport, limit: limit}}
+		res, err := client.Get(srv.URL + path)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		return ioutil.ReadAll(res.Body)
+	}
+
+	for _, path := range []string{"/v2/app/tags/list", "/v2/app/tags/list?length=1"} {
+		g := NewWithT(t)
+		read, err := get(path, 100)
+		g.Expect(err).ToNot(HaveOccurred(), path)
+		g.Expect(string(read)).To(Equal(body))
+
+		_, err = get(path, 99)
+		var tooLarge *responseTooLargeError
+		g.Expect(errors.As(err, &tooLarge)).To(BeTrue(), path)
+	}
+
+	// only listings of tags are limited
+	g := NewWithT(t)
+	read, err := get("/v2/app/manifests/latest", 10)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(read).To(HaveLen(100))
+}
+
+func TestScanInsecureRegistry(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewTLSServer(registryStub(func(string) ([]string, bool) {
+		return []string{"v1", "v2"}, true
+	}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "https://") + "/self-signed"
+	scan := func(insecure bool) (imagev1alpha1.ImageRepository, error) {
+		repo := imagev1alpha1.ImageRepository{
+			Spec: imagev1alpha1.ImageRepositorySpec{
+				Image:    imageName,
+				Insecure: insecure,
+			},
+		}
+		ref, err := name.ParseReference(imageName, nameOptions(repo.Spec)...)
+		g.Expect(err).ToNot(HaveOccurred())
+		r := &ImageRepositoryReconciler{
+			Database:  NewDatabase(),
+			Transport: NewTransport(tls.VersionTLS12),
+		}
+		return r.scan(context.TODO(), repo, ref)
+	}
+
+	// the certificate isn't trusted
+	_, err := scan(false)
+	g.Expect(err).To(HaveOccurred())
+
+	scanned, err := scan(true)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(2))
+}
+
+func TestInsecureTransport(t *testing.T) {
+	g := NewWithT(t)
+
+	base := NewTransport(tls.VersionTLS12)
+	insecure := insecureTransport(base)
+	g.Expect(insecure).ToNot(BeIdenticalTo(base))
+	g.Expect(insecure.(*http.Transport).TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+	g.Expect(insecure.(*http.Transport).TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+	g.Expect(base.TLSClientConfig.InsecureSkipVerify).To(BeFalse())
+
+	g.Expect(insecureTransport(nil).(*http.Transport).TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+
+	// other transports can't be made insecure
+	other := &headerTransport{inner: base}
+	g.Expect(insecureTransport(other)).To(BeIdenticalTo(other))
+}
+
+// idleClosingTransport counts the times its idle connections are
+// closed.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleClosingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestTransportCache(t *testing.T) {
+	g := NewWithT(t)
+
+	var c transportCache
+	repo := types.NamespacedName{Namespace: "default", Name: "app"}
+	var made []*idleClosingTransport
+	get := func(key transportKey) http.RoundTripper {
+		transport, err := c.get(repo, key, func() (http.RoundTripper, error) {
+			t := &idleClosingTransport{}
+			made = append(made, t)
+			return t, nil
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		return transport
+	}
+	base := http.DefaultTransport
+	ca := transportKey{base: base, caHash: sha256.Sum256([]byte("ca"))}
+
+	// the same transport is given for as long as it's made the same
+	// way, so connections are reused across scans
+	first := get(ca)
+	g.Expect(get(ca)).To(BeIdenticalTo(first))
+	g.Expect(made).To(HaveLen(1))
+
+	// once the certificates change, it's replaced, and the old one's
+	// connections closed
+	rotated := get(transportKey{base: base, caHash: sha256.Sum256([]byte("rotated"))})
+	g.Expect(rotated).ToNot(BeIdenticalTo(first))
+	g.Expect(made).To(HaveLen(2))
+	g.Expect(made[0].closed).To(Equal(1))
+
+	// another image repository gets its own
+	_, err := c.get(types.NamespacedName{Namespace: "default", Name: "other"}, ca, func() (http.RoundTripper, error) {
+		return &idleClosingTransport{}, nil
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(c.transports).To(HaveLen(2))
+
+	// a transport that can't be made isn't kept, and the one before
+	// it stays
+	_, err = c.get(repo, transportKey{base: base, insecure: true}, func() (http.RoundTripper, error) {
+		return nil, errors.New("bad certificate")
+	})
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(get(transportKey{base: base, caHash: sha256.Sum256([]byte("rotated"))})).To(BeIdenticalTo(rotated))
+
+	c.forget(repo)
+	g.Expect(made[1].closed).To(Equal(1))
+	g.Expect(c.transports).To(HaveLen(1))
+}
+
+func TestInsecureNames(t *testing.T) {
+	g := NewWithT(t)
+
+	spec := imagev1alpha1.ImageRepositorySpec{Insecure: true}
+	ref, err := name.ParseReference("registry.internal:5000/team/app", nameOptions(spec)...)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ref.Context().Registry.Scheme()).To(Equal("http"))
+	// the name is the same as it would be otherwise
+	g.Expect(ref.Context().String()).To(Equal("registry.internal:5000/team/app"))
+
+	ref, err = name.ParseReference("registry.internal:5000/team/app", nameOptions(imagev1alpha1.ImageRepositorySpec{})...)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ref.Context().Registry.Scheme()).To(Equal("https"))
+}
+
+// caSecret returns a secret with the certificate of the TLS server
+// given, as the CA certificate.
+func caSecret(name string, srv *httptest.Server) *corev1.Secret {
+	secret := &corev1.Secret{
+		Data: map[string][]byte{
+			caCertKey: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		},
+	}
+	secret.Name = name
+	secret.Namespace = "default"
+	return secret
+}
+
+func TestTransportFromCertSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer srv.Close()
+
+	base := NewTransport(tls.VersionTLS12)
+	transport, err := transportFromCertSecret(*caSecret("ca", srv), base)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(transport).ToNot(BeIdenticalTo(base))
+	g.Expect(transport.TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+	g.Expect(base.TLSClientConfig.RootCAs).To(BeNil())
+
+	res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+	res.Body.Close()
+	g.Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+	// anything but an *http.Transport is replaced
+	transport, err = transportFromCertSecret(*caSecret("ca", srv), &headerTransport{inner: base})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(transport.TLSClientConfig.RootCAs).ToNot(BeNil())
+
+	missing := caSecret("missing", srv)
+	missing.Data = map[string][]byte{"tls.crt": missing.Data[caCertKey]}
+	_, err = transportFromCertSecret(*missing, base)
+	g.Expect(err).To(MatchError(ContainSubstring(`no "ca.crt" key`)))
+
+	garbage := caSecret("garbage", srv)
+	garbage.Data[caCertKey] = []byte("not a certificate")
+	_, err = transportFromCertSecret(*garbage, base)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestScanWithCertSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewTLSServer(registryStub(func(string) ([]string, bool) {
+		return []string{"v1", "v2", "v3"}, true
+	}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer srv.Close()
+
+	imageName := strings.TrimPrefix(srv.URL, "https://") + "/internal-ca"
+	ref, err := name.ParseReference(imageName)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	events := record.NewFakeRecorder(10)
+	r := &ImageRepositoryReconciler{
+		Client:        fake.NewFakeClient(caSecret("registry-ca", srv)),
+		Database:      NewDatabase(),
+		Transport:     NewTransport(tls.VersionTLS12),
+		EventRecorder: events,
+	}
+	repo := imagev1alpha1.ImageRepository{
+		Spec: imagev1alpha1.ImageRepositorySpec{
+			Image:         imageName,
+			CertSecretRef: &corev1.LocalObjectReference{Name: "registry-ca"},
+		},
+	}
+	repo.Name = "internal-ca"
+	repo.Namespace = "default"
+
+	scanned, err := r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(3))
+
+	// without the CA, the registry isn't trusted
+	repo.Spec.CertSecretRef = nil
+	_, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+
+	repo.Spec.CertSecretRef = &corev1.LocalObjectReference{Name: "absent"}
+	scanned, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(readyCondition(scanned).Reason).To(Equal(imagev1alpha1.SecretNotFoundReason))
+
+	// insecure wins, with a warning
+	repo.Spec.Insecure = true
+	scanned, err = r.scan(context.TODO(), repo, ref)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(scanned.Status.LastScanResult.TagCount).To(Equal(3))
+	g.Expect(events.Events).To(Receive(HavePrefix("Warning InsecureOverridesCertSecret")))
+}
@@ -6,6 +6,7 @@ replace github.com/fluxcd/image-reflector-controller/api => ./api
 
 require (
 	github.com/Masterminds/semver/v3 v3.1.0
+	github.com/aws/aws-sdk-go v1.35.24
 	github.com/fluxcd/image-reflector-controller/api v0.0.0-00010101000000-000000000000
 	github.com/fluxcd/pkg/apis/meta v0.1.0
 	github.com/fluxcd/pkg/recorder v0.0.5
@@ -14,7 +15,14 @@ require (
 	github.com/google/go-containerregistry v0.1.1
 	github.com/onsi/ginkgo v1.12.1
 	github.com/onsi/gomega v1.10.1
+	github.com/prometheus/client_golang v1.0.0
+	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v0.13.0
+	go.opentelemetry.io/otel/exporters/otlp v0.13.0
+	go.opentelemetry.io/otel/sdk v0.13.0
 	go.uber.org/zap v1.10.0
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/text v0.3.3
 	k8s.io/api v0.18.9
 	k8s.io/apimachinery v0.18.9
 	k8s.io/client-go v0.18.6
@@ -17,16 +17,21 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
 	uzap "go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/fluxcd/pkg/recorder"
@@ -36,6 +41,11 @@ import (
 	// +kubebuilder:scaffold:imports
 )
 
+// VERSION is the version of the controller, given in the User-Agent of
+// requests to registries; it's set when building, with
+// `-ldflags "-X main.VERSION=<version>"`.
+var VERSION = "0.0.0-dev.0"
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -49,80 +59,493 @@ func init() {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the controller until it's told to stop, and returns the
+// code to exit with. It returns rather than exiting, so that what's
+// deferred (e.g., closing the database) is done whatever happens.
+func run() int {
 	var (
 		metricsAddr          string
+		healthAddr           string
+		tracing              bool
+		userAgent            string
+		scanHealthGrace      time.Duration
 		eventsAddr           string
 		enableLeaderElection bool
 		logLevel             string
 		logJSON              bool
+		watchAllNamespaces   bool
+		watchNamespace       string
+		tlsMinVersion        string
+		startupScanRamp      time.Duration
+		enableWebhooks       bool
+		minScanInterval      time.Duration
+		defaultScanInterval  time.Duration
+		tagRetention         time.Duration
+		maxMessageLength     int
+		scanFailureBackoff   time.Duration
+		maxFailureBackoff    time.Duration
+		partialScanCredit    int
+		maxStoredTags        int
+		storageBackend       string
+		storagePath          string
+		databaseKey          string
+		metadataConcurrency  int
+		concurrentScans      int
+		maxRegistryRequests  int
+		maxMetadataFetches   int
+		networkRetries       int
+		networkRetryDelay    time.Duration
+		registryScanLimits   string
+		probeVisibility      bool
+		scanProgressInterval time.Duration
+		scanReportInterval   time.Duration
+		maxCacheHint         time.Duration
+		perObjectMetrics     bool
+		prioritizeActive     bool
+		restrictRedirects    bool
+		allowedRedirectHosts string
+		maxResponseSize      int64
+		statusTagLimit       int
+		digestTagLimit       int
+		timestampTagLimit    int
+		tagChangeLogLimit    int
+		extensionTimeout     time.Duration
+		scanTimeout          time.Duration
+		pushWebhookAddr      string
+		pushWebhookToken     string
+		tagsAPIAddr          string
+		tagsAPIToken         string
+		allowInlineAuth      bool
+		defaultKeychain      bool
 		controllerName       = "image-reflector-controller"
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&healthAddr, "health-addr", ":9440", "The address the health endpoints (/healthz and /readyz) bind to.")
+	flag.DurationVar(&scanHealthGrace, "scan-health-grace", 30*time.Minute,
+		"Report not ready when scans have been failing to reach registries and none has succeeded for this long. "+
+			"Zero means scans don't count towards readiness.")
 	flag.StringVar(&eventsAddr, "events-addr", "", "The address of the events receiver.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&logLevel, "log-level", "info", "Set logging level. Can be debug, info or error.")
 	flag.BoolVar(&logJSON, "log-json", false, "Set logging to JSON format.")
+	flag.BoolVar(&watchAllNamespaces, "watch-all-namespaces", true,
+		"Watch for resources in all namespaces; if set to false, only the namespaces given "+
+			"by --watch-namespace (or else the runtime namespace) are watched.")
+	flag.StringVar(&watchNamespace, "watch-namespace", "",
+		"Comma-separated list of namespaces to watch, when not watching all namespaces.")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2",
+		"The minimum TLS version to accept when connecting to registries; one of 1.0, 1.1, 1.2, 1.3.")
+	flag.DurationVar(&startupScanRamp, "startup-scan-ramp", 0,
+		"Spread the scans that are due at startup over this length of time, rather than running them all at once.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the validating admission webhooks; this needs a serving certificate in the manager's certificate directory.")
+	flag.DurationVar(&minScanInterval, "min-scan-interval", imagev1alpha1.DefaultMinScanInterval,
+		"The shortest scan interval used: image repositories with a shorter .spec.scanInterval are scanned at this "+
+			"interval instead, and rejected by the webhook. Zero means no minimum.")
+	flag.DurationVar(&defaultScanInterval, "default-scan-interval", 10*time.Minute,
+		"The scan interval for image repositories that don't give a .spec.scanInterval.")
+	flag.DurationVar(&tagRetention, "tag-retention", 0,
+		"Keep tags no longer found by scans recorded for this long after they were last seen. Zero means they're dropped by the first scan not to find them.")
+	flag.IntVar(&maxMessageLength, "max-condition-message-length", imagev1alpha1.DefaultMaxConditionMessageLength,
+		"Truncate status condition messages longer than this many bytes; the full message is logged. Zero means no limit.")
+	flag.DurationVar(&scanFailureBackoff, "min-backoff", 0,
+		"Back off for this long after a failed scan, doubling with each consecutive failure up to --max-backoff, "+
+			"plus up to a tenth again at random. If zero, failed scans are retried with the default rate limiting.")
+	flag.DurationVar(&maxFailureBackoff, "max-backoff", 0,
+		"The longest to back off after failed scans. If zero, the scan interval of the image repository.")
+	flag.IntVar(&partialScanCredit, "partial-scan-credit", 1,
+		"The number of consecutive failures forgiven by a scan that fetches only some pages of tags.")
+	flag.IntVar(&maxStoredTags, "max-stored-tags", 0,
+		"The most tags to keep in memory across all image repositories; when exceeded, the tags of the "+
+			"least recently scanned repositories are dropped until they are next scanned. Zero means no limit. "+
+			"Only applies to the memory storage backend.")
+	flag.StringVar(&storageBackend, "storage-backend", "memory",
+		"Where to keep the tags found by scans; either memory, or disk, which keeps them in --storage-path so they "+
+			"survive restarts.")
+	flag.StringVar(&storagePath, "storage-path", "/data",
+		"The directory the tags are kept in, with --storage-backend=disk; e.g., where a persistent volume is mounted.")
+	flag.StringVar(&databaseKey, "database-key", controllers.CanonicalNameKey,
+		"The name to key image repositories on in the database; either canonical (e.g., index.docker.io/library/alpine) or short (e.g., alpine).")
+	flag.IntVar(&concurrentScans, "concurrent-scans", 1,
+		"The number of image repositories scanned at once. Raising this scans many image repositories sooner, "+
+			"at the cost of more requests to registries at the same time (see --max-registry-requests).")
+	flag.IntVar(&maxRegistryRequests, "max-registry-requests", 0,
+		"The most requests in flight to each registry host across all scans; others wait their turn. Zero means no limit.")
+	flag.IntVar(&metadataConcurrency, "metadata-fetch-concurrency", 1,
+		"The most requests for per-tag metadata (platforms, or references when auditing) to make at once, per scan.")
+	flag.IntVar(&maxMetadataFetches, "max-metadata-fetches", 0,
+		"The most requests for per-tag metadata to make at once across all scans, taking turns fairly "+
+			"so that large repositories don't hold up small ones. Zero means no limit.")
+	flag.IntVar(&networkRetries, "network-retries", 2,
+		"The number of times to retry a request to a registry during a scan, if it fails to resolve the "+
+			"registry's host or with a temporary network error.")
+	flag.DurationVar(&networkRetryDelay, "network-retry-delay", 250*time.Millisecond,
+		"How long to wait before retrying a request that failed with a DNS or temporary network error; "+
+			"this doubles with each retry.")
+	flag.StringVar(&registryScanLimits, "registry-scan-limits", "",
+		"Comma-separated list of limits on scans of a registry, of the form <registry>=<scans>/<period> "+
+			"(e.g., index.docker.io=200/6h); scans of image repositories sharing an account on the registry "+
+			"are paced to keep within the limit between them.")
+	flag.BoolVar(&prioritizeActive, "prioritize-active-repositories", false,
+		"When scans are waiting for their turn under --registry-scan-limits, give the earlier turns to the image "+
+			"repositories whose recent scans have most often found new tags.")
+	flag.BoolVar(&restrictRedirects, "restrict-registry-redirects", false,
+		"Fail a scan when the registry redirects a request to a host other than its own, or one of those given "+
+			"with --allowed-redirect-hosts.")
+	flag.StringVar(&allowedRedirectHosts, "allowed-redirect-hosts", "",
+		"Comma-separated list of hosts registries may redirect to, when --restrict-registry-redirects is set; "+
+			"*.<domain> allows any host within the domain.")
+	flag.IntVar(&statusTagLimit, "status-tag-limit", 10,
+		"The most tags listed in the status of an image repository after a scan. Zero means none are listed.")
+	flag.IntVar(&digestTagLimit, "digest-tag-limit", 0,
+		"Resolve and record the digests of this many of the latest tags found by each scan, with a request for each. Zero means none are.")
+	flag.IntVar(&timestampTagLimit, "timestamp-tag-limit", 0,
+		"Fetch when the images at this many of the latest tags found by each scan were created, with requests for each, "+
+			"and list the latest tags in the status in that order. Zero means they're listed in the registry's order.")
+	flag.IntVar(&tagChangeLogLimit, "tag-change-log-limit", 10,
+		"The most tags named in each of the samples of tags added and removed logged when a scan finds the tags have changed. "+
+			"Zero means only how many were added and removed is logged.")
+	flag.Int64Var(&maxResponseSize, "max-tag-list-response-size", 64<<20,
+		"The largest response to a request for a listing of tags accepted from a registry, in bytes; a scan getting "+
+			"a larger response fails. Zero means no limit.")
+	flag.DurationVar(&scanTimeout, "scan-timeout", 10*time.Second,
+		"How long a scan of an image repository is given, unless the ImageRepository gives its own .spec.timeout.")
+	flag.StringVar(&pushWebhookAddr, "push-webhook-addr", "",
+		"The address to receive registries' push notifications on, under /hook/harbor and /hook/dockerhub, to scan "+
+			"the image pushed to straight away. If empty, no notifications are received.")
+	flag.StringVar(&pushWebhookToken, "push-webhook-token", os.Getenv("PUSH_WEBHOOK_TOKEN"),
+		"The secret token push notifications must carry. Defaults to $PUSH_WEBHOOK_TOKEN, so it can be given from a Secret.")
+	flag.StringVar(&tagsAPIAddr, "tags-api-addr", "",
+		"The address to serve the read-only API to the recorded tags on, for other controllers and tools. If empty, it's not served.")
+	flag.StringVar(&tagsAPIToken, "tags-api-token", os.Getenv("TAGS_API_TOKEN"),
+		"The bearer token requests to the tags API must carry. Defaults to $TAGS_API_TOKEN, so it can be given from a Secret.")
+	flag.DurationVar(&extensionTimeout, "extension-timeout", 5*time.Second,
+		"How long a tag selection extension, named by an ImagePolicy, is given to select a tag.")
+	flag.BoolVar(&allowInlineAuth, "allow-inline-auth", false,
+		"Let ImageRepository objects give credentials inline, in .spec.inlineAuth. This is insecure, and meant only "+
+			"for tests and CI.")
+	flag.BoolVar(&defaultKeychain, "default-keychain", false,
+		"Look up credentials in the controller's own docker config (as given by $DOCKER_CONFIG) for image "+
+			"repositories that give none.")
+	flag.StringVar(&userAgent, "user-agent", controllerName+"/"+VERSION,
+		"The User-Agent given on requests to registries, unless an image repository gives one in .spec.customHeaders.")
+	flag.BoolVar(&tracing, "tracing", false,
+		"Export OpenTelemetry traces of reconciliations and scans to the OTLP collector given by the standard "+
+			"OTEL_EXPORTER_OTLP_* environment variables.")
+	flag.BoolVar(&probeVisibility, "probe-visibility", false,
+		"Also try listing the tags of image repositories scanned with credentials anonymously, to record "+
+			"whether they are public. This makes another request to the registry for each scan.")
+	flag.DurationVar(&scanProgressInterval, "scan-progress-interval", 5*time.Second,
+		"How often to report the progress of a long scan in the status of the image repository, "+
+			"once the scan has been going that long. Zero means progress isn't reported.")
+	flag.DurationVar(&scanReportInterval, "scan-report-interval", 5*time.Minute,
+		"How often to assemble each ImageScanReport again, if it doesn't give an interval itself.")
+	flag.DurationVar(&maxCacheHint, "max-cache-hint", time.Hour,
+		"The longest to put off the next scan of an image repository, when the registry's Cache-Control header "+
+			"says its listing of tags stays fresh for longer than the scan interval. Zero means such hints are ignored.")
+	flag.BoolVar(&perObjectMetrics, "per-object-metrics", true,
+		"Export metrics with a series per object (e.g., the image selected by each ImagePolicy). If false, objects "+
+			"are only counted in aggregate metrics; individual objects can also opt out with the "+
+			imagev1alpha1.PerObjectMetricsAnnotation+"=false annotation.")
 	flag.Parse()
 
 	ctrl.SetLogger(newLogger(logLevel, logJSON))
 
+	if defaultScanInterval <= 0 || defaultScanInterval < minScanInterval {
+		setupLog.Error(nil, "invalid value for --default-scan-interval; it must be positive, and no shorter than --min-scan-interval",
+			"value", defaultScanInterval.String(), "minimum", minScanInterval.String())
+		return 1
+	}
+	setupLog.Info("scan intervals", "default", defaultScanInterval.String(), "minimum", minScanInterval.String())
+
+	if tracing {
+		shutdown, err := controllers.SetupTracing(controllerName)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			return 1
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				setupLog.Error(err, "unable to flush traces")
+			}
+		}()
+	}
+
+	minTLS, err := controllers.ParseTLSVersion(tlsMinVersion)
+	if err != nil {
+		setupLog.Error(err, "invalid value for --tls-min-version")
+		return 1
+	}
+	// one transport for all requests to registries, so connections
+	// are kept and reused across scans and controllers
+	registryTransport := controllers.NewTransport(minTLS)
+
+	if databaseKey != controllers.CanonicalNameKey && databaseKey != controllers.ShortNameKey {
+		setupLog.Error(nil, "invalid value for --database-key; expected canonical or short", "value", databaseKey)
+		return 1
+	}
+
+	var metadataFetchPool *controllers.FetchPool
+	if maxMetadataFetches > 0 {
+		metadataFetchPool = controllers.NewFetchPool(maxMetadataFetches)
+	}
+
+	var hostLimiter *controllers.HostLimiter
+	if maxRegistryRequests > 0 {
+		hostLimiter = controllers.NewHostLimiter(maxRegistryRequests)
+	}
+
+	var scanBudget *controllers.ScanBudget
+	if registryScanLimits != "" {
+		limits, err := controllers.ParseScanLimits(registryScanLimits)
+		if err != nil {
+			setupLog.Error(err, "invalid value for --registry-scan-limits")
+			return 1
+		}
+		scanBudget = controllers.NewScanBudget(limits)
+		scanBudget.PrioritizeActive = prioritizeActive
+	}
+
 	var eventRecorder *recorder.EventRecorder
 	if eventsAddr != "" {
 		if er, err := recorder.NewEventRecorder(eventsAddr, controllerName); err != nil {
 			setupLog.Error(err, "unable to create event recorder")
-			os.Exit(1)
+			return 1
 		} else {
 			eventRecorder = er
 		}
 	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "e189b2df.fluxcd.io",
-		Namespace:          os.Getenv("RUNTIME_NAMESPACE"),
-	})
+	var watchNamespaces []string
+	if !watchAllNamespaces {
+		for _, ns := range strings.Split(watchNamespace, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				watchNamespaces = append(watchNamespaces, ns)
+			}
+		}
+		if len(watchNamespaces) == 0 {
+			if ns := os.Getenv("RUNTIME_NAMESPACE"); ns != "" {
+				watchNamespaces = []string{ns}
+			}
+		}
+		if len(watchNamespaces) == 0 {
+			setupLog.Error(nil, "no namespace to watch; use --watch-namespace or set RUNTIME_NAMESPACE")
+			return 1
+		}
+		setupLog.Info("watching namespaces", "namespaces", watchNamespaces)
+	}
+
+	mgrOptions := ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     metricsAddr,
+		HealthProbeBindAddress: healthAddr,
+		Port:                   9443,
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       "e189b2df.fluxcd.io",
+	}
+	switch len(watchNamespaces) {
+	case 0:
+	case 1:
+		mgrOptions.Namespace = watchNamespaces[0]
+	default:
+		mgrOptions.NewCache = cache.MultiNamespacedCacheBuilder(watchNamespaces)
+	}
+
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		setupLog.Error(err, "unable to get kubeconfig")
+		return 1
+	}
+	mgr, err := ctrl.NewManager(restConfig, mgrOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+		return 1
+	}
+
+	var redirectHosts []string
+	for _, host := range strings.Split(allowedRedirectHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			redirectHosts = append(redirectHosts, host)
+		}
+	}
+
+	var keychain authn.Keychain
+	if defaultKeychain {
+		keychain = authn.DefaultKeychain
+	}
+
+	var db interface {
+		controllers.DatabaseWriter
+		controllers.DatabaseReader
+	}
+	switch storageBackend {
+	case "memory":
+		db = controllers.NewBoundedDatabase(maxStoredTags)
+	case "disk":
+		boltDB, err := controllers.NewBoltDatabase(storagePath)
+		if err != nil {
+			setupLog.Error(err, "unable to open database", "path", storagePath)
+			return 1
+		}
+		defer boltDB.Close()
+		db = boltDB
+	default:
+		setupLog.Error(nil, "invalid value for --storage-backend; expected memory or disk", "value", storageBackend)
+		return 1
+	}
+
+	// the database is checked for both liveness and readiness, since
+	// the controller can't do anything without it
+	if err := mgr.AddHealthzCheck("database", controllers.DatabaseChecker(db)); err != nil {
+		setupLog.Error(err, "unable to add health check")
+		return 1
+	}
+	if err := mgr.AddReadyzCheck("database", controllers.DatabaseChecker(db)); err != nil {
+		setupLog.Error(err, "unable to add readiness check")
+		return 1
+	}
+	var scanHealth *controllers.ScanHealth
+	if scanHealthGrace > 0 {
+		scanHealth = controllers.NewScanHealth(scanHealthGrace)
+		if err := mgr.AddReadyzCheck("scans", scanHealth.Check); err != nil {
+			setupLog.Error(err, "unable to add readiness check")
+			return 1
+		}
 	}
 
-	db := controllers.NewDatabase()
+	var pushReceiver *controllers.PushReceiver
+	if pushWebhookAddr != "" {
+		if pushWebhookToken == "" {
+			setupLog.Error(nil, "--push-webhook-token (or $PUSH_WEBHOOK_TOKEN) must be given with --push-webhook-addr")
+			return 1
+		}
+		pushReceiver = controllers.NewPushReceiver(pushWebhookAddr, pushWebhookToken, mgr.GetClient(),
+			ctrl.Log.WithName("push-receiver"))
+		pushReceiver.WatchNamespaces = watchNamespaces
+		if err := mgr.Add(pushReceiver); err != nil {
+			setupLog.Error(err, "unable to add push receiver")
+			return 1
+		}
+	}
+
+	if tagsAPIAddr != "" {
+		if tagsAPIToken == "" {
+			setupLog.Error(nil, "--tags-api-token (or $TAGS_API_TOKEN) must be given with --tags-api-addr")
+			return 1
+		}
+		tagServer := controllers.NewTagServer(tagsAPIAddr, tagsAPIToken, db, ctrl.Log.WithName("tags-api"))
+		tagServer.DatabaseKey = databaseKey
+		if err := mgr.Add(tagServer); err != nil {
+			setupLog.Error(err, "unable to add tags API server")
+			return 1
+		}
+	}
 
 	if err = (&controllers.ImageRepositoryReconciler{
-		Client:                mgr.GetClient(),
-		Log:                   ctrl.Log.WithName("controllers").WithName(imagev1alpha1.ImageRepositoryKind),
-		Scheme:                mgr.GetScheme(),
-		Database:              db,
-		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
-		ExternalEventRecorder: eventRecorder,
+		Client:                    mgr.GetClient(),
+		Log:                       ctrl.Log.WithName("controllers").WithName(imagev1alpha1.ImageRepositoryKind),
+		Scheme:                    mgr.GetScheme(),
+		Database:                  db,
+		EventRecorder:             mgr.GetEventRecorderFor(controllerName),
+		ExternalEventRecorder:     eventRecorder,
+		WatchNamespaces:           watchNamespaces,
+		Transport:                 registryTransport,
+		StartupScanRamp:           startupScanRamp,
+		FailureBackoff:            scanFailureBackoff,
+		MaxFailureBackoff:         maxFailureBackoff,
+		PartialScanCredit:         partialScanCredit,
+		DatabaseKey:               databaseKey,
+		MetadataFetchConcurrency:  metadataConcurrency,
+		MetadataFetchPool:         metadataFetchPool,
+		MaxConcurrentScans:        concurrentScans,
+		HostLimiter:               hostLimiter,
+		NetworkRetries:            networkRetries,
+		NetworkRetryDelay:         networkRetryDelay,
+		ScanBudget:                scanBudget,
+		ProbeVisibility:           probeVisibility,
+		ProgressInterval:          scanProgressInterval,
+		MaxCacheHint:              maxCacheHint,
+		RestrictRedirects:         restrictRedirects,
+		AllowedRedirectHosts:      redirectHosts,
+		MaxResponseSize:           maxResponseSize,
+		ScanTimeout:               scanTimeout,
+		DefaultScanInterval:       defaultScanInterval,
+		MinScanInterval:           minScanInterval,
+		MaxConditionMessageLength: maxMessageLength,
+		TagRetention:              tagRetention,
+		UserAgent:                 userAgent,
+		DisablePerObjectMetrics:   !perObjectMetrics,
+		PushReceiver:              pushReceiver,
+		ScanHealth:                scanHealth,
+		StatusTagLimit:            statusTagLimit,
+		DigestTagLimit:            digestTagLimit,
+		TimestampTagLimit:         timestampTagLimit,
+		TagChangeLogLimit:         tagChangeLogLimit,
+		AllowInlineAuth:           allowInlineAuth,
+		Keychain:                  keychain,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", imagev1alpha1.ImageRepositoryKind)
-		os.Exit(1)
+		return 1
 	}
 	if err = (&controllers.ImagePolicyReconciler{
-		Client:                mgr.GetClient(),
-		Log:                   ctrl.Log.WithName("controllers").WithName(imagev1alpha1.ImagePolicyKind),
-		Scheme:                mgr.GetScheme(),
-		Database:              db,
-		EventRecorder:         mgr.GetEventRecorderFor(controllerName),
-		ExternalEventRecorder: eventRecorder,
+		Client:                    mgr.GetClient(),
+		Log:                       ctrl.Log.WithName("controllers").WithName(imagev1alpha1.ImagePolicyKind),
+		Scheme:                    mgr.GetScheme(),
+		Database:                  db,
+		EventRecorder:             mgr.GetEventRecorderFor(controllerName),
+		ExternalEventRecorder:     eventRecorder,
+		WatchNamespaces:           watchNamespaces,
+		DatabaseKey:               databaseKey,
+		Transport:                 registryTransport,
+		UserAgent:                 userAgent,
+		DisablePerObjectMetrics:   !perObjectMetrics,
+		AllowInlineAuth:           allowInlineAuth,
+		Keychain:                  keychain,
+		TagSelectors:              controllers.BuiltinTagSelectors(),
+		ExtensionTimeout:          extensionTimeout,
+		MaxConditionMessageLength: maxMessageLength,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", imagev1alpha1.ImagePolicyKind)
-		os.Exit(1)
+		return 1
+	}
+	if err = (&controllers.ImageScanReportReconciler{
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName(imagev1alpha1.ImageScanReportKind),
+		Scheme:          mgr.GetScheme(),
+		WatchNamespaces: watchNamespaces,
+		DefaultInterval: scanReportInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", imagev1alpha1.ImageScanReportKind)
+		return 1
+	}
+	if enableWebhooks {
+		if err = (&imagev1alpha1.ImagePolicy{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", imagev1alpha1.ImagePolicyKind)
+			return 1
+		}
+		if err = (&imagev1alpha1.ImageRepositoryValidator{
+			MinScanInterval: minScanInterval,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", imagev1alpha1.ImageRepositoryKind)
+			return 1
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
 
 // newLogger returns a logger configured for dev or production use.
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is a client for the image reflector controller's API
+// for reading the tags it has recorded for images, as served when the
+// controller is run with `--tags-api-addr`.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// TagsPath is the path the tags of an image are listed at, with
+	// the image given as the `image` query parameter.
+	TagsPath = "/v1/tags"
+	// TagExistsPath is the path at which whether an image has a tag
+	// is told, with the image and tag given as the `image` and `tag`
+	// query parameters.
+	TagExistsPath = "/v1/tags/exists"
+)
+
+// TagsResponse is the response listing the tags of an image.
+type TagsResponse struct {
+	// Image is the image, as asked for.
+	Image string `json:"image"`
+	// Tags lists the tags recorded for the image.
+	Tags []string `json:"tags"`
+}
+
+// TagExistsResponse is the response telling whether an image has a
+// tag.
+type TagExistsResponse struct {
+	// Image is the image, as asked for.
+	Image string `json:"image"`
+	// Tag is the tag, as asked for.
+	Tag string `json:"tag"`
+	// Exists says whether the tag is recorded for the image.
+	Exists bool `json:"exists"`
+}
+
+// Client reads the tags recorded by an image reflector controller.
+type Client struct {
+	// BaseURL is the address of the API, e.g.,
+	// `http://image-reflector-controller.flux-system:9292`.
+	BaseURL string
+	// Token is the bearer token given with each request.
+	Token string
+	// HTTPClient makes the requests; if nil, http.DefaultClient
+	// does.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the API at the address given, which gives
+// the token with each request.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Tags returns the tags recorded for the image, which is named as in
+// an image repository's `.status.canonicalImageName`.
+func (c *Client) Tags(ctx context.Context, image string) ([]string, error) {
+	var res TagsResponse
+	if err := c.get(ctx, TagsPath, url.Values{"image": {image}}, &res); err != nil {
+		return nil, err
+	}
+	return res.Tags, nil
+}
+
+// HasTag says whether the tag is recorded for the image.
+func (c *Client) HasTag(ctx context.Context, image, tag string) (bool, error) {
+	var res TagExistsResponse
+	if err := c.get(ctx, TagExistsPath, url.Values{"image": {image}, "tag": {tag}}, &res); err != nil {
+		return false, err
+	}
+	return res.Exists, nil
+}
+
+// get makes a request to the path, with the query given, and decodes
+// the response into v.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(c.BaseURL, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
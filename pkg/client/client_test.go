@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/fluxcd/image-reflector-controller/controllers"
+	"github.com/fluxcd/image-reflector-controller/pkg/client"
+)
+
+const token = "s3cr3t"
+
+func newServer(g *WithT) *httptest.Server {
+	db := controllers.NewDatabase()
+	g.Expect(db.SetTags(context.TODO(), "ghcr.io/org/app", []string{"1.0.0", "1.1.0"})).To(Succeed())
+	return httptest.NewServer(controllers.NewTagServer("", token, db, zap.LoggerTo(ioutil.Discard, true)))
+}
+
+func TestClientTags(t *testing.T) {
+	g := NewWithT(t)
+	srv := newServer(g)
+	defer srv.Close()
+
+	c := client.New(srv.URL, token)
+	tags, err := c.Tags(context.TODO(), "ghcr.io/org/app")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(Equal([]string{"1.0.0", "1.1.0"}))
+
+	// an image with nothing recorded has no tags
+	tags, err = c.Tags(context.TODO(), "ghcr.io/org/other")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tags).To(BeEmpty())
+
+	_, err = c.Tags(context.TODO(), "Not An Image")
+	g.Expect(err).To(MatchError(ContainSubstring("400")))
+}
+
+func TestClientHasTag(t *testing.T) {
+	g := NewWithT(t)
+	srv := newServer(g)
+	defer srv.Close()
+
+	c := client.New(srv.URL, token)
+	exists, err := c.HasTag(context.TODO(), "ghcr.io/org/app", "1.1.0")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	exists, err = c.HasTag(context.TODO(), "ghcr.io/org/app", "2.0.0")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+
+	_, err = c.HasTag(context.TODO(), "ghcr.io/org/app", "")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestServerRequiresToken(t *testing.T) {
+	g := NewWithT(t)
+	srv := newServer(g)
+	defer srv.Close()
+
+	_, err := client.New(srv.URL, "wrong").Tags(context.TODO(), "ghcr.io/org/app")
+	g.Expect(err).To(MatchError(ContainSubstring("401")))
+
+	res, err := http.Get(srv.URL + client.TagsPath + "?image=ghcr.io/org/app")
+	g.Expect(err).ToNot(HaveOccurred())
+	res.Body.Close()
+	g.Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+	// the token must be given as a bearer token
+	req, err := http.NewRequest(http.MethodGet, srv.URL+client.TagsPath+"?image=ghcr.io/org/app", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Authorization", token)
+	res, err = http.DefaultClient.Do(req)
+	g.Expect(err).ToNot(HaveOccurred())
+	res.Body.Close()
+	g.Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+}